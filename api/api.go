@@ -27,16 +27,9 @@ type APIClient struct {
 	Key     string
 	Port    int
 	Cipher  string
-	Rtask   *RepoTask
-	Wtask   *RepoWwwTask
-}
-type RepoTask struct {
-	StartTime *time.Time
-	RepoList  *[]UserTraffic
-}
-type RepoWwwTask struct {
-	StartTime *time.Time
-	RepoList  *[]WwwTraffic
+	// traffic and www accumulate usage until it is reported.
+	traffic TrafficCounter
+	www     wwwLog
 }
 type Configs struct {
 	Database DatabaseConfig `toml:"database"`
@@ -51,6 +44,15 @@ type DatabaseConfig struct {
 	DBName   string `toml:"dbname"`
 }
 
+// DSN 返回 go-sql-driver/mysql 格式的连接字符串
+func (c DatabaseConfig) DSN() string {
+	port := c.Port
+	if port == 0 {
+		port = 3306
+	}
+	return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", c.Username, c.Password, c.Host, port, c.DBName)
+}
+
 func New(apiConfig *Config) *APIClient {
 
 	client := resty.New()
@@ -81,24 +83,12 @@ func New(apiConfig *Config) *APIClient {
 
 		return nil
 	})
-	// Registering Response Middleware
-	t := time.Now().UTC()
-	task := RepoTask{
-		StartTime: &t,
-		RepoList:  &[]UserTraffic{},
-	}
-	Wtask := RepoWwwTask{
-		StartTime: &t,
-		RepoList:  &[]WwwTraffic{},
-	}
 	apiClient := &APIClient{
 		client:  client,
 		NodeID:  &apiConfig.NodeID,
 		Key:     apiConfig.Key,
 		APIHost: apiConfig.APIHost,
 		LogHost: apiConfig.LogHost,
-		Rtask:   &task,
-		Wtask:   &Wtask,
 	}
 	return apiClient
 }
@@ -140,16 +130,7 @@ type Database struct {
 }
 
 // 数据库初始化函数
-func NewDatabase(username, password, dbname string) (*Database, error) {
-	// 读取配置文件
-	// var config Configs
-	// if _, err := toml.DecodeFile("config.toml", &config); err != nil {
-	// 	log.Fatal(err)
-	// }
-	// 构建数据库连接字符串
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", username, password,
-		"slave.czw4eey0m0hj.ca-central-1.rds.amazonaws.com", 3306, dbname)
-
+func NewDatabase(dsn string) (*Database, error) {
 	// 打开数据库连接
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
@@ -159,6 +140,7 @@ func NewDatabase(username, password, dbname string) (*Database, error) {
 	// 检查数据库连接是否正常
 	err = db.Ping()
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
@@ -221,80 +203,56 @@ func (c *APIClient) Init() error {
 	//print(fmt.Sprintf("%v", res_j))
 	return nil
 }
-func (c *APIClient) GetUsers() (retc *UserRets, err error) {
-
-	// // path := "/api/SsGetUsers"
-	// path := "http://vice.mobileairport.net/api/tool/GetUsers"
-	retc = &UserRets{}
-	// // c.client.SetQueryParam("n", strconv.Itoa(*c.NodeID))
-	// client := resty.New()
-	// ret, err := client.R().SetQueryParam("n", strconv.Itoa(*c.NodeID)).
-	// 	Get(path)
-	// if ret.StatusCode() != 200 {
-	// 	return
-	// }
-	// retstr := utils.GenDecode(ret.Body())
-	// err = json.Unmarshal(retstr, retc)
-	// 初始化数据库连接
-	db, err := NewDatabase("admin", "jzhMzB69OZaAHzNGyNYU", "vpnplan")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer db.Close()
 
-	// 执行第一个查询
-	query1 := "SELECT group_id,port as conn_port,cipher FROM server_shadowsocks where id =" + strconv.Itoa(*c.NodeID)
-	rows1, err := db.Query(query1)
+// GetNodeID returns the node ID assigned by the control plane in Init.
+func (c *APIClient) GetNodeID() int {
+	return *c.NodeID
+}
+
+// GetUsers fetches the node's keys from the control plane, so that
+// APIClient can be used directly as a UserSource.
+func (c *APIClient) GetUsers() (*UserRets, error) {
+	path := "/api/SsGetUsers"
+	res, err := c.client.R().SetQueryParam("n", strconv.Itoa(*c.NodeID)).Get(path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("request %s failed: %s", c.assembleURL(path), err)
 	}
-	defer rows1.Close()
-
-	// 处理第一个查询结果
-	for rows1.Next() {
-		var groupid int
-		var key Keys
-		// 根据你的表结构定义相应的变量
-
-		err := rows1.Scan(&groupid, &key.Port, &key.Cipher)
-		if err != nil {
-			log.Fatal(err)
-		}
-		// 执行第二个查询
-		//todo port 映射为实际字段
-		query2 := "SELECT nid,wg_key,conn_port as port FROM m_user_ext where sup_id != 0 and sup_id >=" + strconv.Itoa(groupid)
-		rows2, err := db.Query(query2)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer rows2.Close()
-
-		// 处理第二个查询结果
-		for rows2.Next() {
-			// 处理第二个查询结果的逻辑，类似上面的处理方式
-			var key2 Key2
-			err := rows2.Scan(&key2.Nid, &key2.WgKey, &key2.Port)
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			// 将第一个查询的数据和第二个查询的数据合并到 Data 切片中
-			retc.Data = append(retc.Data, mergeToUserEntry(key, key2))
-		}
+	if res.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("request %s failed: %s", c.assembleURL(path), res.Status())
 	}
-	// 检查是否有错误导致迭代结束
-	if err := rows1.Err(); err != nil {
-		log.Fatal(err)
+	retc := &UserRets{}
+	if err := json.Unmarshal(utils.GenDecode(res.Body()), retc); err != nil {
+		return nil, fmt.Errorf("ret %s invalid: %v", c.assembleURL(path), err)
 	}
-
-	return
+	return retc, nil
 }
-func (c *APIClient) AddWwwRepo(traffic WwwTraffic) {
-	if traffic.UNID != "" && (traffic.Host != "") {
-		newlist := append(*c.Wtask.RepoList, traffic)
-		c.Wtask.RepoList = &newlist
+
+// AddDestination records that user `uid` at `clientAddr` connected to `host`
+// through `outbound`, from the local `sourceIP`.
+func (c *APIClient) AddDestination(uid, host, clientAddr, outbound, sourceIP string, isUDP bool) {
+	if uid == "" || host == "" {
+		return
 	}
+	traffic := WwwTraffic{
+		UNID:     uid,
+		Host:     host,
+		Uip:      clientAddr,
+		Date:     time.Now().Unix(),
+		Status:   1,
+		Outbound: outbound,
+		SourceIP: sourceIP,
+	}
+	if isUDP {
+		traffic.IsUdp = 1
+	}
+	c.www.add(traffic)
+}
+
+// DrainDestinations returns the destinations recorded since the last call.
+func (c *APIClient) DrainDestinations() []WwwTraffic {
+	return c.www.drain()
 }
+
 func (c *APIClient) ReportSys() error {
 	path := "/api/SsRepoSys"
 
@@ -339,7 +297,7 @@ func (c *APIClient) ReportWwwTraffic(traffic *[]WwwTraffic) error {
 	// 	mylog.Logf("ReportWwwTraffic:err:%v", err)
 	// 	return err
 	// }
-	url := "http://vice.mobileairport.net/api/tool/SsRepoWww"
+	url := strings.TrimSuffix(c.LogHost, "/") + "/api/tool/SsRepoWww"
 	res, err := http.Post(url, "application/json;charset=utf-8", strings.NewReader(string(dat)))
 	if err != nil {
 		return err
@@ -351,14 +309,16 @@ func (c *APIClient) ReportWwwTraffic(traffic *[]WwwTraffic) error {
 	// }
 	return nil
 }
-func (c *APIClient) AddRepo(utice *UserTraffic) {
 
-	fmt.Printf("repo add %v", utice)
+// AddTraffic adds `up` bytes from and `down` bytes to the client to user `uid`.
+// It's called for every connection and packet, from many goroutines.
+func (c *APIClient) AddTraffic(uid string, up, down int64) {
+	c.traffic.Add(uid, up, down)
+}
 
-	if utice.UID != "" && (utice.D != 0 || utice.U != 0) {
-		newlist := append(*c.Rtask.RepoList, *utice)
-		c.Rtask.RepoList = &newlist
-	}
+// DrainTraffic returns the traffic per user since the last call.
+func (c *APIClient) DrainTraffic() []UserTraffic {
+	return c.traffic.Drain()
 }
 
 // ReportUserTraffic reports the user traffic
@@ -410,6 +370,10 @@ func (c *APIClient) ReportUserTraffic(userTraffic *[]UserTraffic) error {
 	if err != nil {
 		return err
 	}
+	// The spool deletes the batch once this returns nil, so only a 2xx is an ack.
+	if !res.IsSuccess() {
+		return fmt.Errorf("request %s failed: %s", c.assembleURL(path), res.Status())
+	}
 	return nil
 }
 func (c *APIClient) Debug() {
@@ -1 +1,84 @@
 package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeyFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestFileUserSource_JSON(t *testing.T) {
+	path := writeKeyFile(t, "keys.json", `{"keys": [
+		{"id": "user-0", "port": 9000, "cipher": "chacha20-ietf-poly1305", "secret": "Secret0"},
+		{"id": "user-1", "port": 9001, "cipher": "aes-128-gcm", "secret": "Secret1"}
+	]}`)
+	users, err := NewFileUserSource(path).GetUsers()
+	require.NoError(t, err)
+	require.Equal(t, []Key{
+		{ID: "user-0", Port: 9000, Cipher: "chacha20-ietf-poly1305", Secret: "Secret0"},
+		{ID: "user-1", Port: 9001, Cipher: "aes-128-gcm", Secret: "Secret1"},
+	}, users.Data)
+}
+
+func TestFileUserSource_YAML(t *testing.T) {
+	path := writeKeyFile(t, "keys.yml", `
+keys:
+  - id: user-0
+    port: 9000
+    cipher: chacha20-ietf-poly1305
+    secret: Secret0
+`)
+	users, err := NewFileUserSource(path).GetUsers()
+	require.NoError(t, err)
+	require.Equal(t, []Key{{ID: "user-0", Port: 9000, Cipher: "chacha20-ietf-poly1305", Secret: "Secret0"}}, users.Data)
+}
+
+func TestFileUserSource_Invalid(t *testing.T) {
+	_, err := NewFileUserSource(filepath.Join(t.TempDir(), "missing.json")).GetUsers()
+	require.Error(t, err)
+
+	path := writeKeyFile(t, "keys.json", `{"keys": [{"id": "user-0", "port": 9000}]}`)
+	_, err = NewFileUserSource(path).GetUsers()
+	require.Error(t, err)
+
+	path = writeKeyFile(t, "keys.json", `{"keys": [`)
+	_, err = NewFileUserSource(path).GetUsers()
+	require.Error(t, err)
+}
+
+func TestNewUserSource(t *testing.T) {
+	client := New(&Config{APIHost: "http://localhost"})
+
+	source, err := NewUserSource("file", "keys.json", client)
+	require.NoError(t, err)
+	require.IsType(t, &FileUserSource{}, source)
+
+	source, err = NewUserSource("mysql", "user:pass@tcp(localhost:3306)/db", client)
+	require.NoError(t, err)
+	require.IsType(t, &MySQLUserSource{}, source)
+
+	source, err = NewUserSource("http", "", client)
+	require.NoError(t, err)
+	require.Equal(t, client, source)
+
+	_, err = NewUserSource("mysql", "", client)
+	require.Error(t, err)
+	_, err = NewUserSource("file", "", client)
+	require.Error(t, err)
+	_, err = NewUserSource("ldap", "", client)
+	require.Error(t, err)
+}
+
+func TestDatabaseConfigDSN(t *testing.T) {
+	config := DatabaseConfig{Username: "admin", Password: "pw", Host: "db.example", DBName: "vpnplan"}
+	require.Equal(t, "admin:pw@tcp(db.example:3306)/vpnplan", config.DSN())
+	config.Port = 3307
+	require.Equal(t, "admin:pw@tcp(db.example:3307)/vpnplan", config.DSN())
+}
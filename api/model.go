@@ -5,10 +5,39 @@ import (
 )
 
 type Key struct {
-	ID     string
-	Port   int
-	Cipher string
-	Secret string
+	ID     string `json:"id" yaml:"id"`
+	Port   int    `json:"port" yaml:"port"`
+	Cipher string `json:"cipher" yaml:"cipher"`
+	Secret string `json:"secret" yaml:"secret"`
+	// Quota is the number of bytes the key may transfer per QuotaPeriod
+	// ("daily", "weekly", "monthly" or empty for never reset). 0 means no limit.
+	Quota       int64  `json:"quota,omitempty" yaml:"quota,omitempty"`
+	QuotaPeriod string `json:"quota_period,omitempty" yaml:"quota_period,omitempty"`
+	// QuotaUsed is the usage in the current period, as known to the source.
+	QuotaUsed int64 `json:"quota_used,omitempty" yaml:"quota_used,omitempty"`
+	// UploadRate and DownloadRate limit the key in bytes per second, across
+	// all its connections. 0 means no limit.
+	UploadRate   int64 `json:"upload_rate,omitempty" yaml:"upload_rate,omitempty"`
+	DownloadRate int64 `json:"download_rate,omitempty" yaml:"download_rate,omitempty"`
+	// MaxConnections, MaxUDPSessions and MaxDevices cap the simultaneous TCP
+	// connections, UDP NAT sessions and recent client IPs. 0 means no limit.
+	MaxConnections int `json:"max_connections,omitempty" yaml:"max_connections,omitempty"`
+	MaxUDPSessions int `json:"max_udp_sessions,omitempty" yaml:"max_udp_sessions,omitempty"`
+	MaxDevices     int `json:"max_devices,omitempty" yaml:"max_devices,omitempty"`
+	// Plan names the plan of the key, which destination rules can target.
+	Plan string `json:"plan,omitempty" yaml:"plan,omitempty"`
+	// Outbound names the outbound the targets of the key go through, unless
+	// a routing rule picks another one. Empty means the default of the node.
+	Outbound string `json:"outbound,omitempty" yaml:"outbound,omitempty"`
+	// SourceIP is the local IP the key connects to targets of its family
+	// from, instead of one of the pool of the node. Empty means the pool.
+	SourceIP string `json:"source_ip,omitempty" yaml:"source_ip,omitempty"`
+}
+
+// Access returns the key without its quota and limits, that is, only the
+// fields that define the cipher.
+func (p Key) Access() Key {
+	return Key{ID: p.ID, Port: p.Port, Cipher: p.Cipher, Secret: p.Secret}
 }
 
 func (p Key) Hash() uint32 {
@@ -37,4 +66,8 @@ type WwwTraffic struct {
 	Date   int64
 	IsUdp  int8
 	Status int8
+	// Outbound names the outbound the connection went through.
+	Outbound string
+	// SourceIP is the local IP the connection came from, if known.
+	SourceIP string
 }
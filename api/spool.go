@@ -0,0 +1,372 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"myoss/mylog"
+)
+
+const (
+	spoolSuffix = ".seg"
+	// Limits for the retry backoff of Spool.Run.
+	spoolMinBackoff = 5 * time.Second
+	spoolMaxBackoff = 10 * time.Minute
+)
+
+// SpoolMetrics receives the state of a Spool.
+type SpoolMetrics interface {
+	// SetReportSpool sets the number of segments and bytes waiting to be sent.
+	SetReportSpool(segments int, bytes int64)
+	// AddReportBatch records a batch send attempt of `entries` entries.
+	AddReportBatch(status string, entries int)
+	// AddReportSpoolDropped records entries dropped because the spool was full.
+	AddReportSpoolDropped(entries int)
+}
+
+// Spool is a durable queue of traffic reports. Reports are appended to
+// segment files in a directory and every segment is sent as one batch. A
+// segment is only deleted after the control plane acknowledged its batch, so
+// reports survive restarts and failed requests, and may be sent more than once.
+type Spool struct {
+	dir        string
+	maxBytes   int64
+	maxEntries int
+	metrics    SpoolMetrics
+
+	mu sync.Mutex
+	// segments is ordered oldest first. If current is open, it is the last one.
+	segments []*spoolSegment
+	current  *os.File
+	nextSeq  uint64
+	// sending is the segment that is being sent, which must not be dropped.
+	sending *spoolSegment
+}
+
+type spoolSegment struct {
+	seq     uint64
+	size    int64
+	entries int
+}
+
+// OpenSpool opens the spool in `dir`, creating it if needed, and picks up any
+// segments left by a previous run. When the spool grows beyond `maxBytes`, the
+// oldest segments are dropped. Segments hold at most `maxEntries` entries.
+// `metrics` may be nil.
+func OpenSpool(dir string, maxBytes int64, maxEntries int, metrics SpoolMetrics) (*Spool, error) {
+	if maxBytes <= 0 || maxEntries <= 0 {
+		return nil, fmt.Errorf("invalid spool limits: %d bytes, %d entries", maxBytes, maxEntries)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{dir: dir, maxBytes: maxBytes, maxEntries: maxEntries, metrics: metrics, nextSeq: 1}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, spoolSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, &spoolSegment{seq: seq, size: int64(len(data)), entries: bytes.Count(data, []byte{'\n'})})
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+	s.mu.Lock()
+	s.enforceCapLocked()
+	s.updateMetricsLocked()
+	s.mu.Unlock()
+	return s, nil
+}
+
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSuffix))
+}
+
+// Append durably adds `traffic` to the spool. It returns once the entries
+// have been synced to disk. If it fails, none of the entries are added, so
+// the caller can keep all of them for later.
+func (s *Spool) Append(traffic []UserTraffic) error {
+	lines := make([][]byte, 0, len(traffic))
+	for _, t := range traffic {
+		line, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, append(line, '\n'))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	mark := s.markLocked()
+	if err := s.appendLocked(lines); err != nil {
+		if rollbackErr := s.rollbackLocked(mark); rollbackErr != nil {
+			mylog.Logf("Failed to roll back the report spool: %v", rollbackErr)
+		}
+		s.updateMetricsLocked()
+		return err
+	}
+	s.enforceCapLocked()
+	s.updateMetricsLocked()
+	return nil
+}
+
+func (s *Spool) appendLocked(lines [][]byte) error {
+	for _, line := range lines {
+		last := len(s.segments) - 1
+		if s.current == nil || s.segments[last].entries >= s.maxEntries {
+			if err := s.rotateLocked(); err != nil {
+				return err
+			}
+			last = len(s.segments) - 1
+		}
+		if _, err := s.current.Write(line); err != nil {
+			return err
+		}
+		s.segments[last].size += int64(len(line))
+		s.segments[last].entries++
+	}
+	if s.current != nil {
+		return s.current.Sync()
+	}
+	return nil
+}
+
+// spoolMark is the state of the spool before an Append, to roll it back to.
+type spoolMark struct {
+	segments int
+	// open is whether the last segment was the current one, which Append
+	// may have written to. size and entries are its size and entries then.
+	open    bool
+	size    int64
+	entries int
+}
+
+func (s *Spool) markLocked() spoolMark {
+	m := spoolMark{segments: len(s.segments), open: s.current != nil}
+	if m.open {
+		last := s.segments[m.segments-1]
+		m.size, m.entries = last.size, last.entries
+	}
+	return m
+}
+
+// rollbackLocked removes what was appended since `m`: the segments that were
+// opened, and the entries written to the segment that was current.
+func (s *Spool) rollbackLocked(m spoolMark) error {
+	if len(s.segments) > m.segments {
+		s.sealLocked()
+		for _, seg := range s.segments[m.segments:] {
+			if err := os.Remove(s.path(seg.seq)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		s.segments = s.segments[:m.segments]
+	}
+	if m.open {
+		last := s.segments[m.segments-1]
+		if err := os.Truncate(s.path(last.seq), m.size); err != nil {
+			return err
+		}
+		last.size, last.entries = m.size, m.entries
+	}
+	return nil
+}
+
+// rotateLocked seals the current segment and opens a new one.
+func (s *Spool) rotateLocked() error {
+	s.sealLocked()
+	file, err := os.OpenFile(s.path(s.nextSeq), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.current = file
+	s.segments = append(s.segments, &spoolSegment{seq: s.nextSeq})
+	s.nextSeq++
+	return nil
+}
+
+func (s *Spool) sealLocked() {
+	if s.current != nil {
+		s.current.Close()
+		s.current = nil
+	}
+}
+
+// enforceCapLocked drops the oldest segments until the spool fits in maxBytes.
+func (s *Spool) enforceCapLocked() {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	for i := 0; total > s.maxBytes && i < len(s.segments); {
+		seg := s.segments[i]
+		if seg == s.sending || (s.current != nil && i == len(s.segments)-1) {
+			i++
+			continue
+		}
+		if err := os.Remove(s.path(seg.seq)); err != nil && !os.IsNotExist(err) {
+			mylog.Logf("Failed to drop spool segment %d: %v", seg.seq, err)
+			return
+		}
+		mylog.Logf("Report spool is full, dropped %d entries", seg.entries)
+		if s.metrics != nil {
+			s.metrics.AddReportSpoolDropped(seg.entries)
+		}
+		total -= seg.size
+		s.segments = append(s.segments[:i], s.segments[i+1:]...)
+	}
+}
+
+func (s *Spool) updateMetricsLocked() {
+	if s.metrics == nil {
+		return
+	}
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	s.metrics.SetReportSpool(len(s.segments), total)
+}
+
+// next returns the oldest segment and its entries, sealing the current
+// segment if it's the only one left. It returns nil if the spool is empty.
+func (s *Spool) next() (*spoolSegment, []UserTraffic, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segments) == 0 {
+		return nil, nil, nil
+	}
+	if len(s.segments) == 1 {
+		s.sealLocked()
+	}
+	seg := s.segments[0]
+	data, err := os.ReadFile(s.path(seg.seq))
+	if err != nil {
+		return nil, nil, err
+	}
+	var entries []UserTraffic
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var t UserTraffic
+		if err := json.Unmarshal(scanner.Bytes(), &t); err != nil {
+			// A torn write from a crash. The rest of the segment is still valid.
+			mylog.Logf("Skipping invalid entry in spool segment %d: %v", seg.seq, err)
+			continue
+		}
+		entries = append(entries, t)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	s.sending = seg
+	return seg, entries, nil
+}
+
+// done ends sending `seg`, deleting it if it was acknowledged.
+func (s *Spool) done(seg *spoolSegment, acked bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sending = nil
+	if !acked {
+		return nil
+	}
+	if err := os.Remove(s.path(seg.seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i, other := range s.segments {
+		if other == seg {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			break
+		}
+	}
+	s.updateMetricsLocked()
+	return nil
+}
+
+// Flush sends every segment in order with `send`, which must only return nil
+// once the batch has been acknowledged. It stops at the first error.
+func (s *Spool) Flush(send func([]UserTraffic) error) error {
+	for {
+		seg, entries, err := s.next()
+		if err != nil || seg == nil {
+			return err
+		}
+		if len(entries) == 0 {
+			if err := s.done(seg, true); err != nil {
+				return err
+			}
+			continue
+		}
+		err = send(entries)
+		if s.metrics != nil {
+			status := "OK"
+			if err != nil {
+				status = "ERR"
+			}
+			s.metrics.AddReportBatch(status, len(entries))
+		}
+		if doneErr := s.done(seg, err == nil); doneErr != nil && err == nil {
+			err = doneErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Run flushes the spool right away, so that entries left by a previous run
+// don't wait for the first interval, and then every `interval` until `stop`
+// is closed. After a failure it retries with exponential backoff instead.
+func (s *Spool) Run(send func([]UserTraffic) error, interval time.Duration, stop <-chan struct{}) {
+	backoff := spoolMinBackoff
+	var wait time.Duration
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := s.Flush(send); err != nil {
+			wait = backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+			mylog.Logf("Failed to send traffic report, retrying in %v: %v", wait, err)
+			if backoff *= 2; backoff > spoolMaxBackoff {
+				backoff = spoolMaxBackoff
+			}
+			continue
+		}
+		backoff = spoolMinBackoff
+		wait = interval
+	}
+}
+
+// Close closes the current segment. Entries already appended stay on disk.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sealLocked()
+	return nil
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSpoolMetrics struct {
+	segments int
+	bytes    int64
+	batches  map[string]int
+	dropped  int
+}
+
+func (m *fakeSpoolMetrics) SetReportSpool(segments int, bytes int64) {
+	m.segments, m.bytes = segments, bytes
+}
+
+func (m *fakeSpoolMetrics) AddReportBatch(status string, entries int) {
+	if m.batches == nil {
+		m.batches = make(map[string]int)
+	}
+	m.batches[status] += entries
+}
+
+func (m *fakeSpoolMetrics) AddReportSpoolDropped(entries int) {
+	m.dropped += entries
+}
+
+func traffic(uids ...string) []UserTraffic {
+	var list []UserTraffic
+	for _, uid := range uids {
+		list = append(list, UserTraffic{UID: uid, U: 1, D: 2})
+	}
+	return list
+}
+
+func TestSpool_BatchesAndAck(t *testing.T) {
+	m := &fakeSpoolMetrics{}
+	spool, err := OpenSpool(t.TempDir(), 1<<20, 2, m)
+	require.NoError(t, err)
+	require.NoError(t, spool.Append(traffic("a", "b", "c")))
+	require.Equal(t, 2, m.segments)
+
+	var sent [][]UserTraffic
+	fail := true
+	send := func(batch []UserTraffic) error {
+		if fail {
+			return errors.New("unavailable")
+		}
+		sent = append(sent, batch)
+		return nil
+	}
+	require.Error(t, spool.Flush(send))
+	require.Equal(t, 2, m.segments)
+	require.Equal(t, 2, m.batches["ERR"])
+
+	fail = false
+	require.NoError(t, spool.Flush(send))
+	require.Equal(t, [][]UserTraffic{traffic("a", "b"), traffic("c")}, sent)
+	require.Equal(t, 0, m.segments)
+	require.EqualValues(t, 0, m.bytes)
+	require.Equal(t, 3, m.batches["OK"])
+}
+
+func TestSpool_SurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := OpenSpool(dir, 1<<20, 10, nil)
+	require.NoError(t, err)
+	require.NoError(t, spool.Append(traffic("a")))
+	require.NoError(t, spool.Close())
+
+	// Simulate a write torn by a crash.
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	f, err := os.OpenFile(dir+"/"+files[0].Name(), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"UID":"b","U`)
+	require.NoError(t, err)
+	f.Close()
+
+	spool, err = OpenSpool(dir, 1<<20, 10, nil)
+	require.NoError(t, err)
+	require.NoError(t, spool.Append(traffic("c")))
+	var sent []UserTraffic
+	require.NoError(t, spool.Flush(func(batch []UserTraffic) error {
+		sent = append(sent, batch...)
+		return nil
+	}))
+	require.Equal(t, traffic("a", "c"), sent)
+	files, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestSpool_RunFlushesAtStart(t *testing.T) {
+	spool, err := OpenSpool(t.TempDir(), 1<<20, 10, nil)
+	require.NoError(t, err)
+	require.NoError(t, spool.Append(traffic("a")))
+
+	sent := make(chan []UserTraffic, 1)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		spool.Run(func(batch []UserTraffic) error {
+			sent <- batch
+			return nil
+		}, time.Hour, stop)
+		close(done)
+	}()
+	select {
+	case batch := <-sent:
+		require.Equal(t, traffic("a"), batch)
+	case <-time.After(5 * time.Second):
+		t.Fatal("spool wasn't flushed at start")
+	}
+	close(stop)
+	<-done
+}
+
+func TestSpool_SizeCap(t *testing.T) {
+	m := &fakeSpoolMetrics{}
+	// Each entry is about 25 bytes, so only the newest segments fit.
+	spool, err := OpenSpool(t.TempDir(), 60, 1, m)
+	require.NoError(t, err)
+	require.NoError(t, spool.Append(traffic("a", "b", "c", "d")))
+	require.Equal(t, 2, m.dropped)
+	require.LessOrEqual(t, m.bytes, int64(60))
+
+	var sent []UserTraffic
+	require.NoError(t, spool.Flush(func(batch []UserTraffic) error {
+		sent = append(sent, batch...)
+		return nil
+	}))
+	require.Equal(t, traffic("c", "d"), sent)
+}
+
+func TestSpool_AppendIsAllOrNothing(t *testing.T) {
+	dir := t.TempDir()
+	m := &fakeSpoolMetrics{}
+	spool, err := OpenSpool(dir, 1<<20, 2, m)
+	require.NoError(t, err)
+	require.NoError(t, spool.Append(traffic("a")))
+	size := m.bytes
+
+	// "c" needs a new segment, whose file can't be made.
+	obstacle := spool.path(spool.nextSeq)
+	require.NoError(t, os.Mkdir(obstacle, 0700))
+	require.Error(t, spool.Append(traffic("b", "c")))
+	require.Equal(t, 1, m.segments)
+	require.Equal(t, size, m.bytes)
+
+	require.NoError(t, os.Remove(obstacle))
+	require.NoError(t, spool.Append(traffic("d")))
+	var sent []UserTraffic
+	require.NoError(t, spool.Flush(func(batch []UserTraffic) error {
+		sent = append(sent, batch...)
+		return nil
+	}))
+	require.Equal(t, traffic("a", "d"), sent)
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const trafficShards = 32
+
+// TrafficCounter accumulates the traffic of each user. It's safe for
+// concurrent use, and adding to a user that is already known doesn't allocate.
+type TrafficCounter struct {
+	shards [trafficShards]trafficShard
+}
+
+type trafficShard struct {
+	// Add holds the read lock while it updates a counter, so Drain, which
+	// holds the write lock, sees every update exactly once.
+	mu    sync.RWMutex
+	users map[string]*userCounter
+}
+
+type userCounter struct {
+	up   int64
+	down int64
+}
+
+func (c *TrafficCounter) shard(uid string) *trafficShard {
+	// Inline FNV-1a, to avoid allocating a hasher.
+	h := uint32(2166136261)
+	for i := 0; i < len(uid); i++ {
+		h ^= uint32(uid[i])
+		h *= 16777619
+	}
+	return &c.shards[h%trafficShards]
+}
+
+// Add adds `up` bytes from and `down` bytes to the client to the user `uid`.
+func (c *TrafficCounter) Add(uid string, up, down int64) {
+	if uid == "" || (up == 0 && down == 0) {
+		return
+	}
+	shard := c.shard(uid)
+	shard.mu.RLock()
+	counter, ok := shard.users[uid]
+	if ok {
+		atomic.AddInt64(&counter.up, up)
+		atomic.AddInt64(&counter.down, down)
+		shard.mu.RUnlock()
+		return
+	}
+	shard.mu.RUnlock()
+
+	shard.mu.Lock()
+	if shard.users == nil {
+		shard.users = make(map[string]*userCounter)
+	}
+	counter, ok = shard.users[uid]
+	if !ok {
+		counter = &userCounter{}
+		shard.users[uid] = counter
+	}
+	counter.up += up
+	counter.down += down
+	shard.mu.Unlock()
+}
+
+// Drain returns the traffic of every user since the last Drain and resets
+// the counters. Users without traffic since then are forgotten.
+func (c *TrafficCounter) Drain() []UserTraffic {
+	var traffic []UserTraffic
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.mu.Lock()
+		for uid, counter := range shard.users {
+			if counter.up == 0 && counter.down == 0 {
+				delete(shard.users, uid)
+				continue
+			}
+			traffic = append(traffic, UserTraffic{UID: uid, U: counter.up, D: counter.down})
+			counter.up, counter.down = 0, 0
+		}
+		shard.mu.Unlock()
+	}
+	return traffic
+}
+
+// wwwLog is the list of destinations visited since the last report.
+type wwwLog struct {
+	mu   sync.Mutex
+	list []WwwTraffic
+}
+
+func (l *wwwLog) add(traffic WwwTraffic) {
+	l.mu.Lock()
+	l.list = append(l.list, traffic)
+	l.mu.Unlock()
+}
+
+func (l *wwwLog) drain() []WwwTraffic {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := l.list
+	l.list = nil
+	return list
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func sortedTraffic(traffic []UserTraffic) []UserTraffic {
+	sort.Slice(traffic, func(i, j int) bool { return traffic[i].UID < traffic[j].UID })
+	return traffic
+}
+
+func TestTrafficCounter(t *testing.T) {
+	var c TrafficCounter
+	c.Add("a", 1, 2)
+	c.Add("b", 0, 5)
+	c.Add("a", 10, 20)
+	c.Add("", 100, 100)
+	c.Add("c", 0, 0)
+	require.Equal(t, []UserTraffic{{UID: "a", U: 11, D: 22}, {UID: "b", D: 5}}, sortedTraffic(c.Drain()))
+	require.Empty(t, c.Drain())
+
+	c.Add("b", 1, 0)
+	require.Equal(t, []UserTraffic{{UID: "b", U: 1}}, c.Drain())
+}
+
+// Many connections add traffic while the report loop drains it. Every byte
+// must be reported exactly once.
+func TestTrafficCounter_Concurrent(t *testing.T) {
+	const (
+		conns   = 2000
+		users   = 50
+		packets = 100
+	)
+	var c TrafficCounter
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func(uid string) {
+			defer wg.Done()
+			for j := 0; j < packets; j++ {
+				c.Add(uid, 1, 2)
+			}
+		}(fmt.Sprintf("user-%d", i%users))
+	}
+
+	totals := make(map[string]UserTraffic)
+	drain := func() {
+		for _, traffic := range c.Drain() {
+			total := totals[traffic.UID]
+			total.U += traffic.U
+			total.D += traffic.D
+			totals[traffic.UID] = total
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			drain()
+		}
+	}
+	drain()
+
+	require.Len(t, totals, users)
+	const perUser = conns / users * packets
+	for uid, total := range totals {
+		require.Equal(t, int64(perUser), total.U, uid)
+		require.Equal(t, int64(2*perUser), total.D, uid)
+	}
+}
+
+func TestAPIClientDestinations(t *testing.T) {
+	client := New(&Config{APIHost: "http://localhost"})
+	client.AddDestination("a", "example.com:443", "1.2.3.4:5678", "direct", "203.0.113.7", false)
+	client.AddDestination("", "example.com:443", "1.2.3.4:5678", "direct", "", false)
+	client.AddDestination("b", "8.8.8.8:53", "1.2.3.4:5678", "relay", "", true)
+	destinations := client.DrainDestinations()
+	require.Len(t, destinations, 2)
+	require.Equal(t, "a", destinations[0].UNID)
+	require.EqualValues(t, 0, destinations[0].IsUdp)
+	require.Equal(t, "203.0.113.7", destinations[0].SourceIP)
+	require.Equal(t, "relay", destinations[1].Outbound)
+	require.EqualValues(t, 1, destinations[1].IsUdp)
+	require.Empty(t, client.DrainDestinations())
+}
+
+func BenchmarkTrafficCounter_Add(b *testing.B) {
+	var c TrafficCounter
+	uids := make([]string, 1000)
+	for i := range uids {
+		uids[i] = fmt.Sprintf("user-%d", i)
+	}
+	b.ReportAllocs()
+	b.SetParallelism(100)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			c.Add(uids[i%len(uids)], 1500, 1500)
+			i++
+		}
+	})
+}
+
+func BenchmarkTrafficCounter_AddWithDrain(b *testing.B) {
+	var c TrafficCounter
+	uids := make([]string, 1000)
+	for i := range uids {
+		uids[i] = fmt.Sprintf("user-%d", i)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.Drain()
+			}
+		}
+	}()
+	b.ReportAllocs()
+	b.SetParallelism(100)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			c.Add(uids[i%len(uids)], 1500, 1500)
+			i++
+		}
+	})
+}
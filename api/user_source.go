@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// UserSource supplies the set of access keys a node should serve.
+type UserSource interface {
+	// GetUsers returns the full, current list of keys.
+	GetUsers() (*UserRets, error)
+}
+
+// NewUserSource creates the UserSource named by `kind`:
+//   - "mysql": `location` is the DSN of the control-plane database.
+//   - "file": `location` is the path of a JSON or YAML key file.
+//   - "http": keys are fetched from /api/SsGetUsers through `client`.
+func NewUserSource(kind, location string, client *APIClient) (UserSource, error) {
+	switch kind {
+	case "mysql":
+		if location == "" {
+			return nil, fmt.Errorf("mysql user source requires a DSN")
+		}
+		return NewMySQLUserSource(location, client.GetNodeID), nil
+	case "file":
+		if location == "" {
+			return nil, fmt.Errorf("file user source requires a path")
+		}
+		return NewFileUserSource(location), nil
+	case "http":
+		if client == nil {
+			return nil, fmt.Errorf("http user source requires an API client")
+		}
+		return client, nil
+	default:
+		return nil, fmt.Errorf("unknown user source %q", kind)
+	}
+}
+
+// FileUserSource reads the keys from a local file. The format is chosen by the
+// file extension: .yml and .yaml are parsed as YAML, anything else as JSON.
+// The file is re-read on every call, so edits are picked up on the next poll.
+type FileUserSource struct {
+	Path string
+}
+
+// userFile is the on-disk layout of a FileUserSource.
+type userFile struct {
+	Keys []Key `json:"keys" yaml:"keys"`
+}
+
+// NewFileUserSource creates a UserSource backed by the file at `path`.
+func NewFileUserSource(path string) *FileUserSource {
+	return &FileUserSource{Path: path}
+}
+
+func (f *FileUserSource) GetUsers() (*UserRets, error) {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file %v: %v", f.Path, err)
+	}
+	var keys userFile
+	switch strings.ToLower(filepath.Ext(f.Path)) {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(data, &keys)
+	default:
+		err = json.Unmarshal(data, &keys)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key file %v: %v", f.Path, err)
+	}
+	for i, key := range keys.Keys {
+		if key.ID == "" || key.Port == 0 || key.Cipher == "" || key.Secret == "" {
+			return nil, fmt.Errorf("key file %v: entry %d is missing id, port, cipher or secret", f.Path, i)
+		}
+		if key.Quota < 0 || key.QuotaUsed < 0 {
+			return nil, fmt.Errorf("key file %v: entry %d has a negative quota", f.Path, i)
+		}
+		if key.UploadRate < 0 || key.DownloadRate < 0 {
+			return nil, fmt.Errorf("key file %v: entry %d has a negative rate", f.Path, i)
+		}
+		if key.MaxConnections < 0 || key.MaxUDPSessions < 0 || key.MaxDevices < 0 {
+			return nil, fmt.Errorf("key file %v: entry %d has a negative connection limit", f.Path, i)
+		}
+	}
+	return &UserRets{Data: keys.Keys}, nil
+}
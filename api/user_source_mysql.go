@@ -0,0 +1,114 @@
+package api
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	// 节点所属的分组、端口和加密方式
+	nodeQuery = "SELECT group_id,port as conn_port,cipher FROM server_shadowsocks where id = ?"
+	// 分组下的所有用户
+	//todo port 映射为实际字段
+	userQuery = "SELECT nid,wg_key,conn_port as port FROM m_user_ext where sup_id != 0 and sup_id >= ?"
+)
+
+// MySQLUserSource reads the keys straight from the control-plane database.
+// The connection pool is opened on first use and kept for later polls.
+type MySQLUserSource struct {
+	dsn    string
+	nodeID func() int
+
+	mu sync.Mutex
+	db *Database
+}
+
+// NewMySQLUserSource creates a UserSource for the database at `dsn`.
+// `nodeID` is called on every poll, because the ID is only known after APIClient.Init.
+func NewMySQLUserSource(dsn string, nodeID func() int) *MySQLUserSource {
+	return &MySQLUserSource{dsn: dsn, nodeID: nodeID}
+}
+
+func (s *MySQLUserSource) conn() (*Database, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		db, err := NewDatabase(s.dsn)
+		if err != nil {
+			return nil, err
+		}
+		s.db = db
+	}
+	return s.db, nil
+}
+
+func (s *MySQLUserSource) GetUsers() (*UserRets, error) {
+	db, err := s.conn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to user database: %v", err)
+	}
+
+	// 执行第一个查询
+	rows1, err := db.db.Query(nodeQuery, s.nodeID())
+	if err != nil {
+		return nil, fmt.Errorf("node query failed: %v", err)
+	}
+	type nodeRow struct {
+		groupID int
+		key     Keys
+	}
+	var nodes []nodeRow
+	for rows1.Next() {
+		var row nodeRow
+		if err := rows1.Scan(&row.groupID, &row.key.Port, &row.key.Cipher); err != nil {
+			rows1.Close()
+			return nil, fmt.Errorf("failed to scan node row: %v", err)
+		}
+		nodes = append(nodes, row)
+	}
+	// 检查是否有错误导致迭代结束
+	err = rows1.Err()
+	rows1.Close()
+	if err != nil {
+		return nil, fmt.Errorf("node query failed: %v", err)
+	}
+
+	retc := &UserRets{}
+	for _, node := range nodes {
+		// 执行第二个查询
+		if err := s.appendUsers(db, node.groupID, node.key, retc); err != nil {
+			return nil, err
+		}
+	}
+	return retc, nil
+}
+
+func (s *MySQLUserSource) appendUsers(db *Database, groupID int, key Keys, retc *UserRets) error {
+	rows2, err := db.db.Query(userQuery, groupID)
+	if err != nil {
+		return fmt.Errorf("user query failed: %v", err)
+	}
+	defer rows2.Close()
+	for rows2.Next() {
+		var key2 Key2
+		if err := rows2.Scan(&key2.Nid, &key2.WgKey, &key2.Port); err != nil {
+			return fmt.Errorf("failed to scan user row: %v", err)
+		}
+		// 将第一个查询的数据和第二个查询的数据合并到 Data 切片中
+		retc.Data = append(retc.Data, mergeToUserEntry(key, key2))
+	}
+	if err := rows2.Err(); err != nil {
+		return fmt.Errorf("user query failed: %v", err)
+	}
+	return nil
+}
+
+// Close releases the connection pool, if one was opened.
+func (s *MySQLUserSource) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db != nil {
+		s.db.Close()
+		s.db = nil
+	}
+}
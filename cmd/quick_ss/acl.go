@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	"myoss/service"
+
+	"github.com/BurntSushi/toml"
+)
+
+// aclFile is the format of the acl.file.
+type aclFile struct {
+	Rules []service.ACLRule `toml:"rule"`
+}
+
+// loadACLRules reads the destination rules in the TOML file at `path`.
+func loadACLRules(path string) ([]service.ACLRule, error) {
+	var file aclFile
+	meta, err := toml.DecodeFile(path, &file)
+	if err != nil {
+		return nil, err
+	}
+	// A misspelt key would silently widen a rule.
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown keys %v", undecoded)
+	}
+	return file.Rules, nil
+}
+
+// reloadACL replaces the destination rules with those in s.aclFile. If the
+// file is invalid, the current rules stay.
+func (s *SSServer) reloadACL(trigger string) error {
+	rules, err := loadACLRules(s.aclFile)
+	if err == nil {
+		err = s.acl.Update(rules)
+	}
+	if err != nil {
+		logger.Errorf("Reload (%v) of the destination rules failed: %v", trigger, err)
+		return err
+	}
+	logger.Infof("Reload (%v): %d destination rules", trigger, len(rules))
+	return nil
+}
+
+// watchACL reloads the destination rules whenever `fileChanged` fires.
+func (s *SSServer) watchACL(fileChanged <-chan struct{}) {
+	for range fileChanged {
+		s.reloadACL("file")
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"myoss/api"
+	"myoss/service"
+)
+
+// adminAPI is a local REST API to inspect and change the keys of a running
+// server. Changes are stored as overrides on top of the user source and are
+// applied through doRun, like any other reload.
+type adminAPI struct {
+	server *SSServer
+	token  string
+}
+
+type adminKey struct {
+	ID             string `json:"id"`
+	Cipher         string `json:"cipher"`
+	TCPConnections int64  `json:"tcp_connections"`
+	UDPSessions    int64  `json:"udp_sessions"`
+	Quota          int64  `json:"quota,omitempty"`
+	QuotaPeriod    string `json:"quota_period,omitempty"`
+	QuotaUsed      int64  `json:"quota_used"`
+	UploadRate     int64  `json:"upload_rate,omitempty"`
+	DownloadRate   int64  `json:"download_rate,omitempty"`
+	Devices        int    `json:"devices"`
+	MaxConnections int    `json:"max_connections,omitempty"`
+	MaxUDPSessions int    `json:"max_udp_sessions,omitempty"`
+	MaxDevices     int    `json:"max_devices,omitempty"`
+}
+
+type adminPort struct {
+	Port   int        `json:"port"`
+	Listen []string   `json:"listen"`
+	Keys   []adminKey `json:"keys"`
+}
+
+type adminDiff struct {
+	AddedKeys    int `json:"added_keys"`
+	RemovedKeys  int `json:"removed_keys"`
+	AddedPorts   int `json:"added_ports"`
+	RemovedPorts int `json:"removed_ports"`
+	// Secret is only set when a rotation generated a new secret.
+	Secret string `json:"secret,omitempty"`
+}
+
+// listenAdmin opens the admin listener. `addr` is either host:port or
+// unix:/path/to/socket.
+func listenAdmin(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		// Remove a stale socket from a previous run.
+		os.Remove(path)
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// StartAdmin serves the admin API on `addr` until the process exits.
+func (s *SSServer) StartAdmin(addr, token string) error {
+	listener, err := listenAdmin(addr)
+	if err != nil {
+		return fmt.Errorf("Failed to start admin API on %v: %v", addr, err)
+	}
+	logger.Infof("Admin API on %v", addr)
+	go func() {
+		logger.Errorf("Admin API stopped: %v", http.Serve(listener, &adminAPI{server: s, token: token}))
+	}()
+	return nil
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const bearer = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, bearer) ||
+		subtle.ConstantTimeCompare([]byte(auth[len(bearer):]), []byte(a.token)) != 1 {
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	isKey := len(parts) >= 3 && parts[0] == "v1" && parts[1] == "keys"
+	switch {
+	case path == "v1/keys" && r.Method == http.MethodGet:
+		a.listKeys(w)
+	case path == "v1/keys" && r.Method == http.MethodPost:
+		a.addKey(w, r)
+	case isKey && len(parts) == 3 && r.Method == http.MethodDelete:
+		a.removeKey(w, parts[2])
+	case isKey && len(parts) == 4 && parts[3] == "rotate" && r.Method == http.MethodPost:
+		a.rotateKey(w, r, parts[2])
+	case path == "v1/overrides" && r.Method == http.MethodGet:
+		a.listOverrides(w)
+	case path == "v1/overrides" && r.Method == http.MethodDelete:
+		a.clearOverrides(w)
+	case path == "v1/bans" && r.Method == http.MethodGet:
+		a.listBans(w)
+	case len(parts) == 3 && parts[0] == "v1" && parts[1] == "bans" && r.Method == http.MethodDelete:
+		a.unban(w, parts[2])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func (a *adminAPI) listKeys(w http.ResponseWriter) {
+	s := a.server
+	s.mu.Lock()
+	ports := make([]adminPort, 0, len(s.ports))
+	for portNum, port := range s.ports {
+		p := adminPort{Port: portNum, Keys: make([]adminKey, 0, len(port.keys))}
+		for addr := range port.listeners {
+			p.Listen = append(p.Listen, addr.String())
+		}
+		sort.Strings(p.Listen)
+		for key, entry := range port.keys {
+			quota, used := entry.QuotaUsage()
+			upload, download := entry.RateLimit()
+			maxTCP, maxUDP, maxDevices := entry.ConnectionLimits()
+			p.Keys = append(p.Keys, adminKey{
+				ID:             key.ID,
+				Cipher:         key.Cipher,
+				TCPConnections: entry.ActiveTCPConnections(),
+				UDPSessions:    entry.ActiveUDPSessions(),
+				Quota:          quota,
+				QuotaPeriod:    key.QuotaPeriod,
+				QuotaUsed:      used,
+				UploadRate:     upload,
+				DownloadRate:   download,
+				Devices:        entry.Devices(),
+				MaxConnections: maxTCP,
+				MaxUDPSessions: maxUDP,
+				MaxDevices:     maxDevices,
+			})
+		}
+		sort.Slice(p.Keys, func(i, j int) bool { return p.Keys[i].ID < p.Keys[j].ID })
+		ports = append(ports, p)
+	}
+	s.mu.Unlock()
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Port < ports[j].Port })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ports": ports})
+}
+
+// findKeyLocked returns the running key with this ID, which doRun keeps
+// unique. s.mu must be held.
+func (s *SSServer) findKeyLocked(id string) (api.Key, bool) {
+	for _, port := range s.ports {
+		for key := range port.keys {
+			if key.ID == id {
+				return key, true
+			}
+		}
+	}
+	return api.Key{}, false
+}
+
+// change applies `update` to a copy of the overrides and reloads. The
+// overrides are only kept if the reload succeeds.
+func (a *adminAPI) change(update func(o *keyOverrides)) (adminDiff, error) {
+	s := a.server
+	s.mu.Lock()
+	previous := s.overrides
+	next := keyOverrides{Set: make(map[string]api.Key), Removed: make(map[string]bool)}
+	for id, key := range previous.Set {
+		next.Set[id] = key
+	}
+	for id := range previous.Removed {
+		next.Removed[id] = true
+	}
+	update(&next)
+	s.overrides = next
+	diff, err := s.applyLocked()
+	if err != nil {
+		s.overrides = previous
+	}
+	s.mu.Unlock()
+	s.reportReload("admin", diff, err)
+	return adminDiff{AddedKeys: diff.addedKeys, RemovedKeys: diff.removedKeys, AddedPorts: diff.addedPorts, RemovedPorts: diff.removedPorts}, err
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<16))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+	return nil
+}
+
+func validateKey(key api.Key, allowStreamCiphers bool) error {
+	if key.ID == "" || key.Secret == "" {
+		return fmt.Errorf("id and secret are required")
+	}
+	if key.Port <= 0 || key.Port > 65535 {
+		return fmt.Errorf("invalid port %d", key.Port)
+	}
+	if key.Quota < 0 || key.QuotaUsed < 0 {
+		return fmt.Errorf("quota must not be negative")
+	}
+	if key.UploadRate < 0 || key.DownloadRate < 0 {
+		return fmt.Errorf("rates must not be negative")
+	}
+	if key.MaxConnections < 0 || key.MaxUDPSessions < 0 || key.MaxDevices < 0 {
+		return fmt.Errorf("connection limits must not be negative")
+	}
+	if _, err := service.ParseQuotaPeriod(key.QuotaPeriod); err != nil {
+		return err
+	}
+	if _, err := newKeyCipher(key.Cipher, key.Secret, allowStreamCiphers); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *adminAPI) addKey(w http.ResponseWriter, r *http.Request) {
+	var key api.Key
+	if err := decodeBody(r, &key); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := validateKey(key, a.server.allowStreamCiphers); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	a.writeChange(w, http.StatusCreated, func(o *keyOverrides) { o.setKey(key) }, "")
+}
+
+func (a *adminAPI) writeChange(w http.ResponseWriter, status int, update func(o *keyOverrides), secret string) {
+	diff, err := a.change(update)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	diff.Secret = secret
+	writeJSON(w, status, diff)
+}
+
+func (a *adminAPI) removeKey(w http.ResponseWriter, id string) {
+	a.server.mu.Lock()
+	_, found := a.server.findKeyLocked(id)
+	a.server.mu.Unlock()
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("key %q not found", id))
+		return
+	}
+	a.writeChange(w, http.StatusOK, func(o *keyOverrides) { o.removeKey(id) }, "")
+}
+
+func newSecret() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func (a *adminAPI) rotateKey(w http.ResponseWriter, r *http.Request, id string) {
+	var body struct {
+		Secret string `json:"secret"`
+	}
+	if r.ContentLength != 0 {
+		if err := decodeBody(r, &body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	generated := ""
+	if body.Secret == "" {
+		secret, err := newSecret()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		body.Secret, generated = secret, secret
+	}
+
+	a.server.mu.Lock()
+	key, found := a.server.findKeyLocked(id)
+	a.server.mu.Unlock()
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("key %q not found", id))
+		return
+	}
+	key.Secret = body.Secret
+	a.writeChange(w, http.StatusOK, func(o *keyOverrides) { o.setKey(key) }, generated)
+}
+
+func (a *adminAPI) listOverrides(w http.ResponseWriter) {
+	s := a.server
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.overrides.Set))
+	for id := range s.overrides.Set {
+		ids = append(ids, id)
+	}
+	removed := make([]string, 0, len(s.overrides.Removed))
+	for id := range s.overrides.Removed {
+		removed = append(removed, id)
+	}
+	s.mu.Unlock()
+	sort.Strings(ids)
+	sort.Strings(removed)
+	writeJSON(w, http.StatusOK, map[string][]string{"set": ids, "removed": removed})
+}
+
+func (a *adminAPI) clearOverrides(w http.ResponseWriter) {
+	a.writeChange(w, http.StatusOK, func(o *keyOverrides) { *o = keyOverrides{} }, "")
+}
+
+func (a *adminAPI) listBans(w http.ResponseWriter) {
+	now := time.Now()
+	bans, udpBans := a.server.bans.List(now), a.server.udpBans.List(now)
+	if bans == nil {
+		bans = []service.Ban{}
+	}
+	if udpBans == nil {
+		udpBans = []service.Ban{}
+	}
+	writeJSON(w, http.StatusOK, map[string][]service.Ban{"bans": bans, "udp_bans": udpBans})
+}
+
+func (a *adminAPI) unban(w http.ResponseWriter, address string) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("%q is not an IP address", address))
+		return
+	}
+	// The IP is unbanned from both TCP and UDP.
+	now := time.Now()
+	unbanned := a.server.bans.Unban(ip, now)
+	if a.server.udpBans.Unban(ip, now) {
+		unbanned = true
+	}
+	if !unbanned {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%v is not banned", ip))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"unbanned": ip.String()})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"myoss/api"
+	"myoss/service"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testToken = "0123456789abcdef"
+
+func adminRequest(t *testing.T, handler http.Handler, method, path, body string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	return rec.Code, result
+}
+
+func TestAdminAPI(t *testing.T) {
+	s := makeTestServer()
+	defer s.Stop()
+	port := freePort(t)
+	s.users = &fakeUserSource{users: &api.UserRets{Data: []api.Key{makeKey("a0", port, "secret")}}}
+	require.NoError(t, s.reload("startup"))
+	handler := &adminAPI{server: s, token: testToken}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/keys", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	code, body := adminRequest(t, handler, http.MethodGet, "/v1/keys", "")
+	require.Equal(t, http.StatusOK, code)
+	ports := body["ports"].([]interface{})
+	require.Len(t, ports, 1)
+	require.Equal(t, []interface{}{"127.0.0.1:" + jsonInt(port)}, ports[0].(map[string]interface{})["listen"])
+	keys := ports[0].(map[string]interface{})["keys"].([]interface{})
+	require.Equal(t, "a0", keys[0].(map[string]interface{})["id"])
+	require.EqualValues(t, 0, keys[0].(map[string]interface{})["tcp_connections"])
+
+	code, body = adminRequest(t, handler, http.MethodPost, "/v1/keys",
+		`{"id": "a1", "port": `+jsonInt(port)+`, "cipher": "aes-128-gcm", "secret": "s1"}`)
+	require.Equal(t, http.StatusCreated, code)
+	require.EqualValues(t, 1, body["added_keys"])
+
+	code, _ = adminRequest(t, handler, http.MethodPost, "/v1/keys", `{"id": "bad", "port": 1, "cipher": "rc4", "secret": "s"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, body = adminRequest(t, handler, http.MethodPost, "/v1/keys/a0/rotate", "")
+	require.Equal(t, http.StatusOK, code)
+	require.NotEmpty(t, body["secret"])
+	s.mu.Lock()
+	rotated, _ := s.findKeyLocked("a0")
+	s.mu.Unlock()
+	require.Equal(t, body["secret"], rotated.Secret)
+
+	// Overrides survive a reload from the source.
+	require.NoError(t, s.reload("poll"))
+	s.mu.Lock()
+	_, found := s.findKeyLocked("a1")
+	s.mu.Unlock()
+	require.True(t, found)
+
+	code, _ = adminRequest(t, handler, http.MethodDelete, "/v1/keys/a0", "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = adminRequest(t, handler, http.MethodDelete, "/v1/keys/a0", "")
+	require.Equal(t, http.StatusNotFound, code)
+
+	code, body = adminRequest(t, handler, http.MethodGet, "/v1/overrides", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []interface{}{"a1"}, body["set"])
+	require.Equal(t, []interface{}{"a0"}, body["removed"])
+
+	code, _ = adminRequest(t, handler, http.MethodDelete, "/v1/overrides", "")
+	require.Equal(t, http.StatusOK, code)
+	s.mu.Lock()
+	key, found := s.findKeyLocked("a0")
+	_, foundA1 := s.findKeyLocked("a1")
+	s.mu.Unlock()
+	require.True(t, found)
+	require.Equal(t, "secret", key.Secret)
+	require.False(t, foundA1)
+}
+
+func jsonInt(i int) string {
+	b, _ := json.Marshal(i)
+	return string(b)
+}
+
+func TestAdminBans(t *testing.T) {
+	s := makeTestServer()
+	s.bans = service.NewBanList(1, time.Minute, time.Hour, 10)
+	s.udpBans = service.NewBanList(1, time.Minute, time.Hour, 10)
+	handler := &adminAPI{server: s, token: testToken}
+	s.bans.AddFailure(net.ParseIP("192.0.2.1"), time.Now())
+	s.udpBans.AddFailure(net.ParseIP("192.0.2.2"), time.Now())
+
+	code, body := adminRequest(t, handler, http.MethodGet, "/v1/bans", "")
+	require.Equal(t, http.StatusOK, code)
+	bans := body["bans"].([]interface{})
+	require.Len(t, bans, 1)
+	require.Equal(t, "192.0.2.1", bans[0].(map[string]interface{})["ip"])
+	udpBans := body["udp_bans"].([]interface{})
+	require.Len(t, udpBans, 1)
+	require.Equal(t, "192.0.2.2", udpBans[0].(map[string]interface{})["ip"])
+	code, _ = adminRequest(t, handler, http.MethodDelete, "/v1/bans/192.0.2.2", "")
+	require.Equal(t, http.StatusOK, code)
+
+	code, _ = adminRequest(t, handler, http.MethodDelete, "/v1/bans/not-an-ip", "")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = adminRequest(t, handler, http.MethodDelete, "/v1/bans/192.0.2.1", "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = adminRequest(t, handler, http.MethodDelete, "/v1/bans/192.0.2.1", "")
+	require.Equal(t, http.StatusNotFound, code)
+	code, body = adminRequest(t, handler, http.MethodGet, "/v1/bans", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Empty(t, body["bans"])
+	require.Empty(t, body["udp_bans"])
+}
+
+func TestValidateAdminListen(t *testing.T) {
+	require.Empty(t, validateAdminListen("127.0.0.1:9092"))
+	require.Empty(t, validateAdminListen("[::1]:9092"))
+	require.Empty(t, validateAdminListen("localhost:9092"))
+	require.Empty(t, validateAdminListen("unix:/run/admin.sock"))
+	require.NotEmpty(t, validateAdminListen("0.0.0.0:9092"))
+	require.NotEmpty(t, validateAdminListen("unix:"))
+	require.NotEmpty(t, validateAdminListen("9092"))
+}
@@ -0,0 +1,897 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"myoss/api"
+	"myoss/dns"
+	"myoss/outbound"
+	"myoss/service"
+	ss "myoss/shadowsocks"
+	"myoss/transport"
+
+	"github.com/BurntSushi/toml"
+	"github.com/op/go-logging"
+)
+
+// Config is the quick_ss configuration. It is read from the TOML file given
+// with -config, and any flag set on the command line overrides the file.
+type Config struct {
+	API       APIConfig        `toml:"api"`
+	Users     UsersConfig      `toml:"users"`
+	Server    ServerConfig     `toml:"server"`
+	Listen    ListenConfig     `toml:"listen"`
+	Proxy     ProxyConfig      `toml:"proxy_protocol"`
+	Metrics   MetricsConfig    `toml:"metrics"`
+	Admin     AdminConfig      `toml:"admin"`
+	Report    ReportConfig     `toml:"report"`
+	Ban       BanConfig        `toml:"ban"`
+	WebSocket WebSocketConfig  `toml:"websocket"`
+	TLS       TLSConfig        `toml:"tls"`
+	Fallback  FallbackConfig   `toml:"fallback"`
+	ACL       ACLConfig        `toml:"acl"`
+	DNS       DNSConfig        `toml:"dns"`
+	Outbounds []OutboundConfig `toml:"outbounds"`
+	Routing   RoutingConfig    `toml:"routing"`
+	Egress    EgressConfig     `toml:"egress"`
+	Log       LogConfig        `toml:"log"`
+}
+
+// APIConfig describes the control plane the node registers with and reports to.
+type APIConfig struct {
+	Host    string `toml:"host"`
+	LogHost string `toml:"log_host"`
+	Key     string `toml:"key"`
+	NodeID  int    `toml:"node_id"`
+}
+
+// UsersConfig selects the api.UserSource. For the mysql source, Location is
+// the DSN; if it is empty the DSN is built from Database instead.
+// The mysql and http sources are polled every PollInterval; the file source is
+// watched for changes instead.
+type UsersConfig struct {
+	Source       string             `toml:"source"`
+	Location     string             `toml:"location"`
+	PollInterval time.Duration      `toml:"poll_interval"`
+	Database     api.DatabaseConfig `toml:"database"`
+}
+
+// ServerConfig holds the settings of the Shadowsocks listeners.
+type ServerConfig struct {
+	ListenIP       string        `toml:"listen_ip"`
+	NATTimeout     time.Duration `toml:"nat_timeout"`
+	TCPReadTimeout time.Duration `toml:"tcp_read_timeout"`
+	ReplayHistory  int           `toml:"replay_history"`
+	// UploadRate and DownloadRate limit the whole node, in bytes per second.
+	// 0 means no limit.
+	UploadRate   int64 `toml:"upload_rate"`
+	DownloadRate int64 `toml:"download_rate"`
+	// DeviceWindow is how long a client IP counts towards the max_devices
+	// of a key after its last connection.
+	DeviceWindow time.Duration `toml:"device_window"`
+	// IdentityPSK is the base64 identity key of Shadowsocks 2022 multi-user
+	// ports. Clients that send identity headers with it are found with one
+	// lookup instead of trial decryption. Empty disables identity headers.
+	IdentityPSK string `toml:"identity_psk"`
+	// AllowStreamCiphers lets keys use the legacy stream ciphers, which have
+	// no integrity or replay protection. A port with a stream key can't have
+	// any other key.
+	AllowStreamCiphers bool `toml:"allow_stream_ciphers"`
+	// Plugin is the SIP003 plugin that every port runs behind: an executable,
+	// or "obfs-server" for the built-in simple-obfs. Empty means none.
+	Plugin     string `toml:"plugin"`
+	PluginOpts string `toml:"plugin_opts"`
+	// UDPOverTCP lets clients relay UDP packets in their TCP streams, for
+	// networks that drop UDP. Those streams end after NATTimeout without packets.
+	// It's off by default.
+	UDPOverTCP bool `toml:"udp_over_tcp"`
+}
+
+type MetricsConfig struct {
+	Addr        string `toml:"addr"`
+	IPCountryDB string `toml:"ip_country_db"`
+}
+
+// AdminConfig enables the admin API. Listen is a loopback host:port or
+// unix:/path/to/socket, and every request must carry the Token.
+type AdminConfig struct {
+	Listen string `toml:"listen"`
+	Token  string `toml:"token"`
+}
+
+// ReportConfig controls how traffic reports reach the control plane. Reports
+// are spooled in SpoolDir and sent every Interval, at most BatchSize entries
+// per request. The oldest reports are dropped when the spool outgrows MaxBytes.
+type ReportConfig struct {
+	SpoolDir  string        `toml:"spool_dir"`
+	MaxBytes  int64         `toml:"max_bytes"`
+	BatchSize int           `toml:"batch_size"`
+	Interval  time.Duration `toml:"interval"`
+}
+
+// BanConfig controls the banning of client IPs that fail authentication, as
+// probes and trial-decryption floods do. An IP that fails MaxFailures times
+// within Window is banned for Duration. At most MaxIPs IPs are tracked.
+// MaxFailures 0 disables banning.
+type BanConfig struct {
+	MaxFailures int           `toml:"max_failures"`
+	Window      time.Duration `toml:"window"`
+	Duration    time.Duration `toml:"duration"`
+	MaxIPs      int           `toml:"max_ips"`
+}
+
+// WebSocketConfig makes every port serve Shadowsocks over WebSocket instead
+// of raw TCP, so nodes can sit behind CDNs and HTTP reverse proxies. Streams
+// are served on StreamPath and packets on PacketPath, if it's set. Raw UDP
+// is still served. RealIPHeader is the header where a trusted proxy puts the
+// client IP.
+type WebSocketConfig struct {
+	Enabled      bool   `toml:"enabled"`
+	StreamPath   string `toml:"stream_path"`
+	PacketPath   string `toml:"packet_path"`
+	RealIPHeader string `toml:"real_ip_header"`
+}
+
+// TLSConfig makes every port serve Shadowsocks over TLS, or WebSocket over
+// TLS if WebSocket is enabled too. The certificates come from CertFile and
+// KeyFile, or from the <name>.crt and <name>.key pairs in CertDir, and are
+// chosen by SNI. They are reloaded when the files change. Clients that ask
+// for another server name, or don't speak TLS, are relayed to Decoy.
+type TLSConfig struct {
+	Enabled        bool          `toml:"enabled"`
+	CertFile       string        `toml:"cert_file"`
+	KeyFile        string        `toml:"key_file"`
+	CertDir        string        `toml:"cert_dir"`
+	ALPN           []string      `toml:"alpn"`
+	Decoy          string        `toml:"decoy"`
+	ReloadInterval time.Duration `toml:"reload_interval"`
+}
+
+// FallbackConfig relays the TCP clients that fail authentication to a decoy
+// server, such as a local nginx, instead of draining them until the read
+// timeout, so that probes see a plausible service. Ports gives ports their
+// own decoy, keyed by port number; the other ports use Addr. Empty means
+// draining.
+type FallbackConfig struct {
+	Addr  string            `toml:"addr"`
+	Ports map[string]string `toml:"ports"`
+}
+
+// portAddrs returns the decoys of Ports by port number.
+func (c FallbackConfig) portAddrs() (map[int]string, error) {
+	addrs := make(map[int]string, len(c.Ports))
+	for portText, addr := range c.Ports {
+		port, err := strconv.Atoi(portText)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("bad port %q", portText)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("port %v: %v", port, err)
+		}
+		addrs[port] = addr
+	}
+	return addrs, nil
+}
+
+// ListenConfig sets where the ports listen: on each of Addresses, or on all
+// the addresses of the Family if it's empty. Family is dual (the default),
+// for dual-stack sockets, ipv4 or ipv6. Interface binds the sockets to a
+// network interface on Linux. Ports gives ports their own settings, keyed by
+// port number, with the same defaults.
+type ListenConfig struct {
+	Addresses []string                    `toml:"addresses"`
+	Family    string                      `toml:"family"`
+	Interface string                      `toml:"interface"`
+	Ports     map[string]PortListenConfig `toml:"ports"`
+}
+
+// PortListenConfig overrides the listen settings of a port. Hops are more
+// ports, or ranges of ports like "20000-20100", that serve the keys of the
+// port, for clients that hop between ports.
+type PortListenConfig struct {
+	Addresses []string `toml:"addresses"`
+	Family    string   `toml:"family"`
+	Interface string   `toml:"interface"`
+	Hops      []string `toml:"hops"`
+}
+
+// settings returns the listen settings of the ports, and those of the ports
+// that have their own, by port number. listenIP is the legacy
+// server.listen_ip, the only address if it's set.
+func (c ListenConfig) settings(listenIP string) (listenSettings, map[int]listenSettings, error) {
+	addresses := c.Addresses
+	if listenIP != "" {
+		if len(addresses) > 0 {
+			return listenSettings{}, nil, fmt.Errorf("set either server.listen_ip or listen.addresses")
+		}
+		addresses = []string{listenIP}
+	}
+	defaults, err := newListenSettings(addresses, c.Family, c.Interface, listenSettings{family: "dual"})
+	if err != nil {
+		return listenSettings{}, nil, err
+	}
+	ports := make(map[int]listenSettings, len(c.Ports))
+	served := make(map[int]int)
+	for portText, portConfig := range c.Ports {
+		port, err := strconv.Atoi(portText)
+		if err != nil || port <= 0 || port > 65535 {
+			return listenSettings{}, nil, fmt.Errorf("bad port %q", portText)
+		}
+		settings, err := newListenSettings(portConfig.Addresses, portConfig.Family, portConfig.Interface, defaults)
+		if err != nil {
+			return listenSettings{}, nil, fmt.Errorf("port %v: %v", port, err)
+		}
+		if settings.hops, err = parsePortRanges(portConfig.Hops); err != nil {
+			return listenSettings{}, nil, fmt.Errorf("port %v: %v", port, err)
+		}
+		for _, hop := range append([]int{port}, settings.hops...) {
+			if other, ok := served[hop]; ok && other != port {
+				return listenSettings{}, nil, fmt.Errorf("port %v: port %v is already a hop of port %v", port, hop, other)
+			} else if ok {
+				return listenSettings{}, nil, fmt.Errorf("port %v: duplicate hop %v", port, hop)
+			}
+			served[hop] = port
+		}
+		ports[port] = settings
+	}
+	return defaults, ports, nil
+}
+
+// newListenSettings parses listen settings, taking those that are empty
+// from `defaults`.
+func newListenSettings(addresses []string, family, iface string, defaults listenSettings) (listenSettings, error) {
+	settings := defaults
+	settings.hops = nil
+	if family != "" {
+		if _, ok := listenFamilies[family]; !ok {
+			return listenSettings{}, fmt.Errorf("unknown family %q, want dual, ipv4 or ipv6", family)
+		}
+		settings.family = family
+	}
+	if iface != "" {
+		if _, err := service.BindInterface(iface); err != nil {
+			return listenSettings{}, err
+		}
+		settings.iface = iface
+	}
+	if len(addresses) > 0 {
+		settings.ips = nil
+		for _, address := range addresses {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				return listenSettings{}, fmt.Errorf("%q is not an IP address", address)
+			}
+			settings.ips = append(settings.ips, ip)
+		}
+	}
+	for _, ip := range settings.ips {
+		isIPv4 := ip.To4() != nil
+		if (settings.family == "ipv4" && !isIPv4) || (settings.family == "ipv6" && isIPv4) {
+			return listenSettings{}, fmt.Errorf("address %v is not of family %v", ip, settings.family)
+		}
+	}
+	return settings, nil
+}
+
+// ProxyConfig makes the ports accept the PROXY protocol of the L4 load
+// balancers in Trusted, CIDRs or IPs, so that their clients keep their own
+// address for bans, device limits, metrics and logs. The connections of the
+// balancers must start with a v1 or v2 header, sent within HeaderTimeout.
+// Their UDP packets may start with a v2 header. Other clients are served as
+// they are.
+type ProxyConfig struct {
+	Enabled       bool          `toml:"enabled"`
+	Trusted       []string      `toml:"trusted"`
+	HeaderTimeout time.Duration `toml:"header_timeout"`
+}
+
+// options returns the PROXY protocol options of the ports, with
+// `sessionTimeout` as the UDP session timeout.
+func (c ProxyConfig) options(sessionTimeout time.Duration) (*transport.ProxyProtocolOptions, error) {
+	if len(c.Trusted) == 0 {
+		return nil, fmt.Errorf("no trusted balancers")
+	}
+	opts := &transport.ProxyProtocolOptions{HeaderTimeout: c.HeaderTimeout, SessionTimeout: sessionTimeout}
+	for _, text := range c.Trusted {
+		_, network, err := net.ParseCIDR(text)
+		if err != nil {
+			ip := net.ParseIP(text)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not a CIDR or IP", text)
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		}
+		opts.Trusted = append(opts.Trusted, network)
+	}
+	return opts, nil
+}
+
+// ACLConfig points to the TOML file with the destination rules of the node,
+// a list of [[rule]] tables. See acl_example.toml. The file is reloaded when
+// it changes and on SIGHUP.
+type ACLConfig struct {
+	File string `toml:"file"`
+}
+
+// DNSConfig makes the node resolve target names with its own Upstreams
+// instead of the system resolver, and cache the answers for their TTL.
+// Upstreams are tried in order: "udp://host:port" or just "host" for plain
+// DNS, "tls://host:port" for DNS over TLS and "https://host/path" for DNS
+// over HTTPS. Prefer is ipv4, ipv6, ipv4_only or ipv6_only. Empty Upstreams
+// means the system resolver.
+type DNSConfig struct {
+	Upstreams []string      `toml:"upstreams"`
+	Prefer    string        `toml:"prefer"`
+	Timeout   time.Duration `toml:"timeout"`
+	CacheSize int           `toml:"cache_size"`
+}
+
+func (c DNSConfig) resolverConfig() dns.Config {
+	return dns.Config{Upstreams: c.Upstreams, Prefer: c.Prefer, Timeout: c.Timeout, CacheSize: c.CacheSize}
+}
+
+// OutboundConfig is an outbound that targets can be routed through, named
+// for [routing] and the outbound of keys. Type direct connects from the local
+// SourceIP. The other types are upstream proxies: socks5, http (HTTP
+// CONNECT, which can't relay UDP) or shadowsocks, which uses Cipher with
+// Password as the secret. Servers are host:port, in order of preference: a
+// server that fails to connect is skipped until it works again. If
+// HealthCheck is set, a host:port is dialed through each server every
+// HealthInterval to find out sooner.
+type OutboundConfig struct {
+	Name           string        `toml:"name"`
+	Type           string        `toml:"type"`
+	SourceIP       string        `toml:"source_ip"`
+	Servers        []string      `toml:"servers"`
+	Username       string        `toml:"username"`
+	Password       string        `toml:"password"`
+	Cipher         string        `toml:"cipher"`
+	HealthCheck    string        `toml:"health_check"`
+	HealthInterval time.Duration `toml:"health_interval"`
+}
+
+const defaultHealthInterval = 30 * time.Second
+
+func (c OutboundConfig) healthInterval() time.Duration {
+	if c.HealthInterval <= 0 {
+		return defaultHealthInterval
+	}
+	return c.HealthInterval
+}
+
+// newOutbound creates the outbound, which fails over between its servers.
+func (c OutboundConfig) newOutbound() (*outbound.Failover, error) {
+	if len(c.Servers) == 0 {
+		return nil, fmt.Errorf("no servers")
+	}
+	var servers []outbound.Outbound
+	for _, server := range c.Servers {
+		var upstream outbound.Outbound
+		var err error
+		switch c.Type {
+		case "socks5":
+			upstream, err = outbound.NewSOCKS5(server, c.Username, c.Password)
+		case "http":
+			upstream, err = outbound.NewHTTPConnect(server, c.Username, c.Password)
+		case "shadowsocks":
+			var cipher *ss.Cipher
+			if cipher, err = ss.NewCipher(c.Cipher, c.Password); err == nil {
+				upstream, err = outbound.NewShadowsocks(server, cipher)
+			}
+		default:
+			return nil, fmt.Errorf("unknown type %q", c.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, upstream)
+	}
+	return outbound.NewFailover(c.Name, servers)
+}
+
+// RoutingConfig picks the outbound of each target: that of the first of
+// Rules that matches it, or else the outbound of its key, or else Default.
+// Outbounds are named by [[outbounds]], or "direct" to connect directly,
+// which is what an empty Default means, or "blocked" to refuse the target.
+// Rules with countries need metrics.ip_country_db.
+type RoutingConfig struct {
+	Default string              `toml:"default"`
+	Rules   []service.RouteRule `toml:"rules"`
+}
+
+// newRouter creates the outbounds and the router that picks among them, with
+// `resolver` and `locate` for the rules with CIDRs and countries.
+func (c *Config) newRouter(resolver *dns.Resolver, locate func(net.Addr) (string, error)) (*service.Router, map[string]*outbound.Failover, error) {
+	failovers := make(map[string]*outbound.Failover, len(c.Outbounds))
+	routerConfig := service.RouterConfig{
+		Outbounds: make(map[string]outbound.Outbound, len(c.Outbounds)),
+		SourceIPs: make(map[string]net.IP),
+		Default:   c.Routing.Default,
+		Rules:     c.Routing.Rules,
+		Resolver:  resolver,
+		Locate:    locate,
+	}
+	names := make(map[string]bool, len(c.Outbounds))
+	for i, outboundConfig := range c.Outbounds {
+		if outboundConfig.Name == "" {
+			return nil, nil, fmt.Errorf("outbound %d: no name", i+1)
+		}
+		if names[outboundConfig.Name] {
+			return nil, nil, fmt.Errorf("outbound %v: duplicate name", outboundConfig.Name)
+		}
+		names[outboundConfig.Name] = true
+		if outboundConfig.Type == "direct" {
+			ip := net.ParseIP(outboundConfig.SourceIP)
+			if ip == nil {
+				return nil, nil, fmt.Errorf("outbound %v: bad source_ip %q", outboundConfig.Name, outboundConfig.SourceIP)
+			}
+			routerConfig.SourceIPs[outboundConfig.Name] = ip
+			continue
+		}
+		if outboundConfig.HealthCheck != "" {
+			if _, _, err := net.SplitHostPort(outboundConfig.HealthCheck); err != nil {
+				return nil, nil, fmt.Errorf("outbound %v: health_check: %v", outboundConfig.Name, err)
+			}
+		}
+		failover, err := outboundConfig.newOutbound()
+		if err != nil {
+			return nil, nil, fmt.Errorf("outbound %v: %v", outboundConfig.Name, err)
+		}
+		failovers[outboundConfig.Name] = failover
+		routerConfig.Outbounds[outboundConfig.Name] = failover
+	}
+	router, err := service.NewRouter(routerConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("routing: %v", err)
+	}
+	return router, failovers, nil
+}
+
+// EgressConfig picks the local addresses that the node connects to targets
+// from. Each key connects from one of SourceIPs of the family of the target,
+// picked by hashing its ID so that it sticks to it, unless the key has its
+// own source_ip. Mark sets SO_MARK and Interface binds the sockets to a
+// network interface, for policy routing on Linux.
+type EgressConfig struct {
+	SourceIPs []string `toml:"source_ips"`
+	Mark      int      `toml:"mark"`
+	Interface string   `toml:"interface"`
+}
+
+func (c EgressConfig) newEgress() (*service.Egress, error) {
+	config := service.EgressConfig{Mark: c.Mark, Interface: c.Interface}
+	for _, ipText := range c.SourceIPs {
+		ip := net.ParseIP(ipText)
+		if ip == nil {
+			return nil, fmt.Errorf("bad source IP %q", ipText)
+		}
+		config.SourceIPs = append(config.SourceIPs, ip)
+	}
+	return service.NewEgress(config)
+}
+
+// listValue is a flag.Value for a comma-separated list.
+type listValue struct {
+	list *[]string
+}
+
+func (v listValue) String() string {
+	if v.list == nil {
+		return ""
+	}
+	return strings.Join(*v.list, ",")
+}
+
+func (v listValue) Set(value string) error {
+	*v.list = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v.list = append(*v.list, item)
+		}
+	}
+	return nil
+}
+
+type LogConfig struct {
+	Level string `toml:"level"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		API: APIConfig{
+			Host:    "https://aerodrome.onemelody.cn/",
+			LogHost: "http://vice.mobileairport.net/",
+		},
+		Users: UsersConfig{Source: "mysql", PollInterval: 5 * time.Second},
+		Server: ServerConfig{
+			NATTimeout:     defaultNatTimeout,
+			TCPReadTimeout: tcpReadTimeout,
+			DeviceWindow:   10 * time.Minute,
+		},
+		Report: ReportConfig{
+			SpoolDir:  "/var/lib/quick_ss/spool",
+			MaxBytes:  64 << 20,
+			BatchSize: 1000,
+			Interval:  5 * time.Minute,
+		},
+		Ban: BanConfig{
+			MaxFailures: 20,
+			Window:      time.Minute,
+			Duration:    time.Hour,
+			MaxIPs:      100000,
+		},
+		WebSocket: WebSocketConfig{StreamPath: "/ws", PacketPath: "/ws-udp"},
+		TLS:       TLSConfig{ReloadInterval: 10 * time.Second},
+		Proxy:     ProxyConfig{HeaderTimeout: 10 * time.Second},
+		DNS:       DNSConfig{Prefer: dns.PreferIPv4, Timeout: 5 * time.Second, CacheSize: 10000},
+		Log:       LogConfig{Level: "INFO"},
+	}
+}
+
+// registerFlags binds one flag per config field, using the current values as defaults.
+func registerFlags(fs *flag.FlagSet, c *Config) {
+	fs.StringVar(&c.API.Host, "api_host", c.API.Host, "Base URL of the control-plane API")
+	fs.StringVar(&c.API.LogHost, "log_host", c.API.LogHost, "Base URL that access logs are reported to")
+	fs.StringVar(&c.API.Key, "api_key", c.API.Key, "Key used to authenticate with the control plane")
+	fs.IntVar(&c.API.NodeID, "node_id", c.API.NodeID, "Node ID, if not assigned by the control plane")
+	fs.StringVar(&c.Users.Source, "users", c.Users.Source, "Where to load access keys from: mysql, file or http")
+	fs.StringVar(&c.Users.Location, "users_location", c.Users.Location, "MySQL DSN for -users=mysql, key file path for -users=file")
+	fs.DurationVar(&c.Users.PollInterval, "users_poll", c.Users.PollInterval, "How often to poll the mysql and http user sources")
+	fs.StringVar(&c.Server.ListenIP, "listen_ip", c.Server.ListenIP, "IP address to bind the Shadowsocks ports to (default all interfaces)")
+	fs.StringVar(&c.Listen.Family, "listen_family", c.Listen.Family, "Address family of the Shadowsocks ports: dual, ipv4 or ipv6 (default dual)")
+	fs.StringVar(&c.Listen.Interface, "listen_interface", c.Listen.Interface, "Network interface that the Shadowsocks ports are bound to")
+	fs.DurationVar(&c.Server.NATTimeout, "udp_timeout", c.Server.NATTimeout, "UDP NAT timeout")
+	fs.DurationVar(&c.Server.TCPReadTimeout, "tcp_timeout", c.Server.TCPReadTimeout, "Time allowed for a client to send its TCP header")
+	fs.IntVar(&c.Server.ReplayHistory, "replay_history", c.Server.ReplayHistory, "Replay buffer size (# of handshakes)")
+	fs.Int64Var(&c.Server.UploadRate, "upload_rate", c.Server.UploadRate, "Upload limit for the whole node, in bytes per second (0 for none)")
+	fs.DurationVar(&c.Server.DeviceWindow, "device_window", c.Server.DeviceWindow, "How long a client IP counts towards the device limit of a key after it disconnects")
+	fs.Int64Var(&c.Server.DownloadRate, "download_rate", c.Server.DownloadRate, "Download limit for the whole node, in bytes per second (0 for none)")
+	fs.StringVar(&c.Server.IdentityPSK, "identity_psk", c.Server.IdentityPSK, "Base64 identity key for Shadowsocks 2022 identity headers (empty to disable)")
+	fs.StringVar(&c.Server.Plugin, "plugin", c.Server.Plugin, "SIP003 plugin executable, or obfs-server for the built-in simple-obfs")
+	fs.StringVar(&c.Server.PluginOpts, "plugin_opts", c.Server.PluginOpts, "Options passed to the SIP003 plugin")
+	fs.BoolVar(&c.Server.UDPOverTCP, "udp_over_tcp", c.Server.UDPOverTCP, "Let clients relay UDP packets over TCP")
+	fs.BoolVar(&c.Server.AllowStreamCiphers, "allow_stream_ciphers", c.Server.AllowStreamCiphers, "Allow keys with insecure legacy stream ciphers")
+	fs.StringVar(&c.Metrics.Addr, "metrics", c.Metrics.Addr, "Address for the Prometheus metrics")
+	fs.StringVar(&c.Metrics.IPCountryDB, "ip_country_db", c.Metrics.IPCountryDB, "Path to the ip-to-country mmdb file")
+	fs.StringVar(&c.Admin.Listen, "admin", c.Admin.Listen, "Address for the admin API: a loopback host:port or unix:/path")
+	fs.StringVar(&c.Admin.Token, "admin_token", c.Admin.Token, "Bearer token required by the admin API")
+	fs.StringVar(&c.Report.SpoolDir, "spool_dir", c.Report.SpoolDir, "Directory where traffic reports are kept until acknowledged")
+	fs.Int64Var(&c.Report.MaxBytes, "spool_max_bytes", c.Report.MaxBytes, "Size of the report spool above which the oldest reports are dropped")
+	fs.IntVar(&c.Report.BatchSize, "report_batch", c.Report.BatchSize, "Maximum number of traffic entries per report")
+	fs.DurationVar(&c.Report.Interval, "report_interval", c.Report.Interval, "How often traffic reports are sent")
+	fs.IntVar(&c.Ban.MaxFailures, "ban_failures", c.Ban.MaxFailures, "Authentication failures within -ban_window that get a client IP banned (0 to disable)")
+	fs.DurationVar(&c.Ban.Window, "ban_window", c.Ban.Window, "Window in which authentication failures are counted")
+	fs.DurationVar(&c.Ban.Duration, "ban_duration", c.Ban.Duration, "How long a client IP stays banned")
+	fs.IntVar(&c.Ban.MaxIPs, "ban_max_ips", c.Ban.MaxIPs, "Maximum number of client IPs tracked for banning")
+	fs.BoolVar(&c.WebSocket.Enabled, "websocket", c.WebSocket.Enabled, "Serve Shadowsocks over WebSocket instead of raw TCP")
+	fs.StringVar(&c.WebSocket.StreamPath, "ws_path", c.WebSocket.StreamPath, "URL path of WebSocket streams")
+	fs.StringVar(&c.WebSocket.PacketPath, "ws_udp_path", c.WebSocket.PacketPath, "URL path of WebSocket packets (empty to disable)")
+	fs.BoolVar(&c.Proxy.Enabled, "proxy_protocol", c.Proxy.Enabled, "Accept the PROXY protocol of the trusted load balancers")
+	fs.Var(listValue{&c.Proxy.Trusted}, "proxy_protocol_trusted", "Comma-separated CIDRs or IPs of the load balancers that send PROXY headers")
+	fs.StringVar(&c.ACL.File, "acl", c.ACL.File, "TOML file with the destination rules")
+	fs.Var(listValue{&c.DNS.Upstreams}, "dns", "Comma-separated DNS upstreams for target names: udp://host:port, tls://host:port or https://host/path (default the system resolver)")
+	fs.StringVar(&c.DNS.Prefer, "dns_prefer", c.DNS.Prefer, "Address family preference of target names: ipv4, ipv6, ipv4_only or ipv6_only")
+	fs.StringVar(&c.Routing.Default, "outbound", c.Routing.Default, "Outbound of the targets that no routing rule or key picks one for (default direct)")
+	fs.Var(listValue{&c.Egress.SourceIPs}, "source_ips", "Comma-separated local IPs that targets are connected from, spread across keys (default any)")
+	fs.IntVar(&c.Egress.Mark, "egress_mark", c.Egress.Mark, "SO_MARK of the connections to targets, for policy routing (0 for none)")
+	fs.StringVar(&c.Egress.Interface, "egress_interface", c.Egress.Interface, "Network interface that the connections to targets are bound to")
+	fs.StringVar(&c.Fallback.Addr, "fallback", c.Fallback.Addr, "host:port that TCP clients failing authentication are relayed to")
+	fs.BoolVar(&c.TLS.Enabled, "tls", c.TLS.Enabled, "Serve Shadowsocks over TLS")
+	fs.StringVar(&c.TLS.CertFile, "tls_cert", c.TLS.CertFile, "TLS certificate file")
+	fs.StringVar(&c.TLS.KeyFile, "tls_key", c.TLS.KeyFile, "TLS key file")
+	fs.StringVar(&c.TLS.CertDir, "tls_cert_dir", c.TLS.CertDir, "Directory of <name>.crt and <name>.key pairs, chosen by SNI")
+	fs.StringVar(&c.TLS.Decoy, "tls_decoy", c.TLS.Decoy, "host:port of the web server that gets non-Shadowsocks TLS clients")
+	fs.StringVar(&c.WebSocket.RealIPHeader, "ws_real_ip_header", c.WebSocket.RealIPHeader, "Header with the client IP set by a trusted proxy, e.g. X-Forwarded-For")
+	fs.StringVar(&c.Log.Level, "log_level", c.Log.Level, "Log level: DEBUG, INFO, NOTICE, WARNING, ERROR or CRITICAL")
+}
+
+// parseConfig parses the command line in `args`, loading the file named by
+// -config first so that flags take precedence over it.
+func parseConfig(name string, args []string, output io.Writer) (*Config, *cliOptions, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	var opts cliOptions
+	fs.StringVar(&opts.ConfigFile, "config", "", "Path to the TOML configuration file")
+	fs.BoolVar(&opts.Version, "version", false, "Print the version and exit")
+	fs.StringVar(&opts.Youhua, "y", "n", "init")
+	config := defaultConfig()
+	registerFlags(fs, config)
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if opts.ConfigFile == "" {
+		return config, &opts, nil
+	}
+
+	fileConfig := defaultConfig()
+	if _, err := toml.DecodeFile(opts.ConfigFile, fileConfig); err != nil {
+		return nil, nil, fmt.Errorf("failed to read config file %v: %v", opts.ConfigFile, err)
+	}
+	overrides := flag.NewFlagSet(name, flag.ContinueOnError)
+	registerFlags(overrides, fileConfig)
+	var setErr error
+	fs.Visit(func(f *flag.Flag) {
+		if override := overrides.Lookup(f.Name); override != nil && setErr == nil {
+			setErr = override.Value.Set(f.Value.String())
+		}
+	})
+	if setErr != nil {
+		return nil, nil, setErr
+	}
+	return fileConfig, &opts, nil
+}
+
+// cliOptions are the flags that only make sense on the command line.
+type cliOptions struct {
+	ConfigFile string
+	Version    bool
+	Youhua     string
+}
+
+// usersDSN returns the DSN for the mysql user source.
+func (c *Config) usersDSN() string {
+	if c.Users.Location != "" || c.Users.Database.Host == "" {
+		return c.Users.Location
+	}
+	return c.Users.Database.DSN()
+}
+
+func validateURL(name, value string) string {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Sprintf("%s: %q is not an http(s) URL", name, value)
+	}
+	return ""
+}
+
+func validateAdminListen(listen string) string {
+	if strings.HasPrefix(listen, "unix:") {
+		if len(listen) == len("unix:") {
+			return "admin.listen: missing socket path"
+		}
+		return ""
+	}
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Sprintf("admin.listen: %v", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Sprintf("admin.listen: %q is not a loopback address", host)
+	}
+	return ""
+}
+
+// Validate checks the configuration and reports every problem it finds.
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(problem string) {
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	add(validateURL("api.host", c.API.Host))
+	if c.API.LogHost != "" {
+		add(validateURL("api.log_host", c.API.LogHost))
+	}
+	if c.API.Key == "" {
+		add("api.key: must be set")
+	}
+	if c.API.NodeID < 0 {
+		add("api.node_id: must not be negative")
+	}
+
+	switch c.Users.Source {
+	case "mysql":
+		if c.usersDSN() == "" {
+			add("users: the mysql source needs users.location or users.database")
+		}
+	case "file":
+		if c.Users.Location == "" {
+			add("users.location: the file source needs a path")
+		} else if _, err := os.Stat(c.Users.Location); err != nil {
+			add(fmt.Sprintf("users.location: %v", err))
+		}
+	case "http":
+	default:
+		add(fmt.Sprintf("users.source: unknown source %q, want mysql, file or http", c.Users.Source))
+	}
+
+	if c.Users.PollInterval <= 0 {
+		add("users.poll_interval: must be positive")
+	}
+
+	if c.Server.ListenIP != "" && net.ParseIP(c.Server.ListenIP) == nil {
+		add(fmt.Sprintf("server.listen_ip: %q is not an IP address", c.Server.ListenIP))
+	} else if _, ports, err := c.Listen.settings(c.Server.ListenIP); err != nil {
+		add(fmt.Sprintf("listen: %v", err))
+	} else if c.Server.Plugin != "" && c.Server.Plugin != transport.ObfsPluginName {
+		// External plugins listen on the public ports themselves.
+		for port, settings := range ports {
+			if settings.iface != "" {
+				add(fmt.Sprintf("listen.ports.%v.interface: can't be used with an external server.plugin", port))
+			}
+		}
+		if c.Listen.Interface != "" {
+			add("listen.interface: can't be used with an external server.plugin")
+		}
+	}
+	if c.Server.NATTimeout <= 0 {
+		add("server.nat_timeout: must be positive")
+	}
+	if c.Server.TCPReadTimeout <= 0 {
+		add("server.tcp_read_timeout: must be positive")
+	}
+	if c.Server.ReplayHistory < 0 || c.Server.ReplayHistory > service.MaxCapacity {
+		add(fmt.Sprintf("server.replay_history: must be between 0 and %d", service.MaxCapacity))
+	}
+	if c.Server.UploadRate < 0 {
+		add("server.upload_rate: must not be negative")
+	}
+	if c.Server.DownloadRate < 0 {
+		add("server.download_rate: must not be negative")
+	}
+	if c.Server.DeviceWindow <= 0 {
+		add("server.device_window: must be positive")
+	}
+	if c.Server.IdentityPSK != "" {
+		if _, err := ss.NewIdentityKey(c.Server.IdentityPSK); err != nil {
+			add(fmt.Sprintf("server.identity_psk: %v", err))
+		}
+	}
+	if c.Server.Plugin == transport.ObfsPluginName {
+		if _, err := transport.NewObfsServer(c.Server.PluginOpts); err != nil {
+			add(fmt.Sprintf("server.plugin_opts: %v", err))
+		}
+	} else if c.Server.Plugin != "" {
+		if _, err := exec.LookPath(c.Server.Plugin); err != nil {
+			add(fmt.Sprintf("server.plugin: %v", err))
+		}
+	}
+
+	if c.Metrics.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.Addr); err != nil {
+			add(fmt.Sprintf("metrics.addr: %v", err))
+		}
+	}
+	if c.Metrics.IPCountryDB != "" {
+		if _, err := os.Stat(c.Metrics.IPCountryDB); err != nil {
+			add(fmt.Sprintf("metrics.ip_country_db: %v", err))
+		}
+	}
+
+	if c.Admin.Listen != "" {
+		add(validateAdminListen(c.Admin.Listen))
+		if len(c.Admin.Token) < 16 {
+			add("admin.token: must be at least 16 characters")
+		}
+	}
+
+	if c.Report.SpoolDir == "" {
+		add("report.spool_dir: must be set")
+	}
+	if c.Report.MaxBytes <= 0 {
+		add("report.max_bytes: must be positive")
+	}
+	if c.Report.BatchSize <= 0 {
+		add("report.batch_size: must be positive")
+	}
+	if c.Report.Interval <= 0 {
+		add("report.interval: must be positive")
+	}
+
+	if c.Ban.MaxFailures < 0 {
+		add("ban.max_failures: must not be negative")
+	}
+	if c.Ban.MaxFailures > 0 {
+		if c.Ban.Window <= 0 {
+			add("ban.window: must be positive")
+		}
+		if c.Ban.Duration <= 0 {
+			add("ban.duration: must be positive")
+		}
+		if c.Ban.MaxIPs <= 0 {
+			add("ban.max_ips: must be positive")
+		}
+	}
+
+	if c.WebSocket.Enabled {
+		if !strings.HasPrefix(c.WebSocket.StreamPath, "/") {
+			add("websocket.stream_path: must start with /")
+		}
+		if c.WebSocket.PacketPath != "" && !strings.HasPrefix(c.WebSocket.PacketPath, "/") {
+			add("websocket.packet_path: must start with /")
+		}
+		if c.WebSocket.PacketPath == c.WebSocket.StreamPath {
+			add("websocket.packet_path: must differ from stream_path")
+		}
+		if c.Server.Plugin != "" {
+			add("websocket.enabled: can't be used with server.plugin")
+		}
+	}
+
+	if c.TLS.Enabled {
+		if (c.TLS.CertDir == "") == (c.TLS.CertFile == "" && c.TLS.KeyFile == "") {
+			add("tls: set either cert_file and key_file, or cert_dir")
+		} else if _, err := transport.NewCertStore(c.TLS.CertFile, c.TLS.KeyFile, c.TLS.CertDir); err != nil {
+			add(fmt.Sprintf("tls: %v", err))
+		}
+		if c.TLS.Decoy != "" {
+			if _, _, err := net.SplitHostPort(c.TLS.Decoy); err != nil {
+				add(fmt.Sprintf("tls.decoy: %v", err))
+			}
+		}
+		if c.TLS.ReloadInterval <= 0 {
+			add("tls.reload_interval: must be positive")
+		}
+		if c.Server.Plugin != "" {
+			add("tls.enabled: can't be used with server.plugin")
+		}
+	}
+
+	if c.Proxy.Enabled {
+		if _, err := c.Proxy.options(c.Server.NATTimeout); err != nil {
+			add(fmt.Sprintf("proxy_protocol.trusted: %v", err))
+		}
+		if c.Proxy.HeaderTimeout <= 0 {
+			add("proxy_protocol.header_timeout: must be positive")
+		}
+	}
+
+	if c.Fallback.Addr != "" {
+		if _, _, err := net.SplitHostPort(c.Fallback.Addr); err != nil {
+			add(fmt.Sprintf("fallback.addr: %v", err))
+		}
+	}
+	if _, err := c.Fallback.portAddrs(); err != nil {
+		add(fmt.Sprintf("fallback.ports: %v", err))
+	}
+	if c.WebSocket.Enabled && (c.Fallback.Addr != "" || len(c.Fallback.Ports) > 0) {
+		add("fallback: can't be used with websocket, whose HTTP server answers probes")
+	}
+
+	if c.ACL.File != "" {
+		if rules, err := loadACLRules(c.ACL.File); err != nil {
+			add(fmt.Sprintf("acl.file: %v", err))
+		} else if _, err := service.NewACL(rules); err != nil {
+			add(fmt.Sprintf("acl.file: %v", err))
+		}
+	}
+
+	if len(c.DNS.Upstreams) > 0 {
+		if _, err := dns.NewResolver(c.DNS.resolverConfig(), nil); err != nil {
+			add(fmt.Sprintf("dns: %v", err))
+		}
+	}
+
+	if _, err := c.Egress.newEgress(); err != nil {
+		add(fmt.Sprintf("egress: %v", err))
+	}
+
+	// The IP-to-country database is only opened at startup.
+	var locate func(net.Addr) (string, error)
+	if c.Metrics.IPCountryDB != "" {
+		locate = func(net.Addr) (string, error) { return "", nil }
+	}
+	if _, _, err := c.newRouter(nil, locate); err != nil {
+		add(err.Error())
+	}
+
+	if _, err := logging.LogLevel(c.Log.Level); err != nil {
+		add(fmt.Sprintf("log.level: unknown level %q", c.Log.Level))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"myoss/service"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestParseConfig_Defaults(t *testing.T) {
+	config, opts, err := parseConfig("test", []string{"-api_key", "k", "-users", "http"}, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, "", opts.ConfigFile)
+	require.Equal(t, defaultNatTimeout, config.Server.NATTimeout)
+	require.Equal(t, tcpReadTimeout, config.Server.TCPReadTimeout)
+	require.Equal(t, "k", config.API.Key)
+	require.NoError(t, config.Validate())
+}
+
+func TestParseConfig_FlagsOverrideFile(t *testing.T) {
+	path := writeConfig(t, `
+[api]
+host = "https://api.example/"
+key = "file-key"
+
+[users]
+source = "mysql"
+
+[users.database]
+username = "admin"
+password = "pw"
+host = "db.example"
+dbname = "vpnplan"
+
+[server]
+nat_timeout = "2m"
+replay_history = 5000
+
+[log]
+level = "WARNING"
+`)
+	config, opts, err := parseConfig("test", []string{"-config", path, "-replay_history", "100", "-log_level", "DEBUG"}, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, path, opts.ConfigFile)
+	require.Equal(t, "https://api.example/", config.API.Host)
+	require.Equal(t, "file-key", config.API.Key)
+	require.Equal(t, 2*time.Minute, config.Server.NATTimeout)
+	require.Equal(t, tcpReadTimeout, config.Server.TCPReadTimeout)
+	require.Equal(t, 100, config.Server.ReplayHistory)
+	require.Equal(t, "DEBUG", config.Log.Level)
+	require.Equal(t, "admin:pw@tcp(db.example:3306)/vpnplan", config.usersDSN())
+	require.NoError(t, config.Validate())
+}
+
+func TestParseConfig_BadFile(t *testing.T) {
+	_, _, err := parseConfig("test", []string{"-config", filepath.Join(t.TempDir(), "missing.toml")}, io.Discard)
+	require.Error(t, err)
+
+	path := writeConfig(t, `[server]
+nat_timeout = true
+`)
+	_, _, err = parseConfig("test", []string{"-config", path}, io.Discard)
+	require.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	config := defaultConfig()
+	config.API.Host = "not a url"
+	config.Users.Source = "ldap"
+	config.Server.ListenIP = "localhost"
+	config.Server.NATTimeout = 0
+	config.Server.ReplayHistory = -1
+	config.Server.IdentityPSK = "c2hvcnQ="
+	config.Server.Plugin = "obfs-server"
+	config.Server.PluginOpts = "obfs=ws"
+	config.Metrics.Addr = "9091"
+	config.Log.Level = "LOUD"
+	err := config.Validate()
+	require.Error(t, err)
+	for _, field := range []string{"api.host", "api.key", "users.source", "server.listen_ip",
+		"server.nat_timeout", "server.replay_history", "server.identity_psk", "server.plugin_opts", "metrics.addr", "log.level"} {
+		require.Contains(t, err.Error(), field)
+	}
+}
+
+func TestValidatePlugin(t *testing.T) {
+	config := defaultConfig()
+	config.API.Key = "key"
+	config.Users.Source = "http"
+	config.Server.Plugin = "obfs-server"
+	config.Server.PluginOpts = "obfs=tls;obfs-host=www.example.com"
+	require.NoError(t, config.Validate())
+
+	config.Server.Plugin = "/nonexistent/v2ray-plugin"
+	config.Server.PluginOpts = "server"
+	err := config.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "server.plugin")
+}
+
+func TestValidateWebSocket(t *testing.T) {
+	config := defaultConfig()
+	config.API.Key = "key"
+	config.Users.Source = "http"
+	config.WebSocket.Enabled = true
+	require.NoError(t, config.Validate())
+
+	config.WebSocket.StreamPath = "ws"
+	config.WebSocket.PacketPath = "ws"
+	config.Server.Plugin = "obfs-server"
+	config.Server.PluginOpts = "obfs=http"
+	err := config.Validate()
+	require.Error(t, err)
+	for _, field := range []string{"websocket.stream_path", "websocket.packet_path", "websocket.enabled"} {
+		require.Contains(t, err.Error(), field)
+	}
+}
+
+func TestValidateTLS(t *testing.T) {
+	config := defaultConfig()
+	config.API.Key = "key"
+	config.Users.Source = "http"
+	config.TLS.Enabled = true
+	err := config.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "either cert_file and key_file, or cert_dir")
+
+	config.TLS.CertDir = t.TempDir()
+	config.TLS.Decoy = "no-port"
+	config.TLS.ReloadInterval = 0
+	config.Server.Plugin = "obfs-server"
+	config.Server.PluginOpts = "obfs=http"
+	err = config.Validate()
+	require.Error(t, err)
+	for _, field := range []string{"no certificates", "tls.decoy", "tls.reload_interval", "tls.enabled"} {
+		require.Contains(t, err.Error(), field)
+	}
+}
+
+func TestValidateFallback(t *testing.T) {
+	config := defaultConfig()
+	config.API.Key = "key"
+	config.Users.Source = "http"
+	config.Fallback.Addr = "127.0.0.1:80"
+	config.Fallback.Ports = map[string]string{"8443": "127.0.0.1:443"}
+	require.NoError(t, config.Validate())
+	addrs, err := config.Fallback.portAddrs()
+	require.NoError(t, err)
+	require.Equal(t, map[int]string{8443: "127.0.0.1:443"}, addrs)
+
+	config.Fallback.Addr = "no-port"
+	config.Fallback.Ports = map[string]string{"https": "127.0.0.1:443"}
+	config.WebSocket.Enabled = true
+	err = config.Validate()
+	require.Error(t, err)
+	for _, field := range []string{"fallback.addr", "fallback.ports", "fallback: can't be used with websocket"} {
+		require.Contains(t, err.Error(), field)
+	}
+}
+
+func TestValidateACL(t *testing.T) {
+	config := defaultConfig()
+	config.API.Key = "key"
+	config.Users.Source = "http"
+	config.ACL.File = "acl_example.toml"
+	require.NoError(t, config.Validate())
+	rules, err := loadACLRules(config.ACL.File)
+	require.NoError(t, err)
+	require.Len(t, rules, 5)
+
+	path := filepath.Join(t.TempDir(), "acl.toml")
+	require.NoError(t, os.WriteFile(path, []byte("[[rule]]\nid = \"smtp\"\naction = \"deny\"\nport = [\"25\"]\n"), 0600))
+	config.ACL.File = path
+	err = config.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown keys")
+}
+
+func TestValidateDNS(t *testing.T) {
+	config, _, err := parseConfig("test", []string{"-api_key", "k", "-users", "http", "-dns", "1.1.1.1, tls://1.1.1.1"}, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.1.1.1", "tls://1.1.1.1"}, config.DNS.Upstreams)
+	require.NoError(t, config.Validate())
+
+	config.DNS.Upstreams = []string{"quic://1.1.1.1"}
+	config.DNS.Prefer = "ipv5"
+	err = config.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "dns: upstream")
+
+	// Without upstreams the system resolver is used, and the rest is ignored.
+	config.DNS.Upstreams = nil
+	require.NoError(t, config.Validate())
+}
+
+func TestValidateOutbounds(t *testing.T) {
+	path := writeConfig(t, `
+[api]
+key = "k"
+[users]
+source = "http"
+
+[[outbounds]]
+name = "residential"
+type = "socks5"
+servers = ["10.0.0.2:1080", "10.0.0.3:1080"]
+health_check = "1.1.1.1:443"
+
+[[outbounds]]
+name = "relay"
+type = "shadowsocks"
+servers = ["relay.example:8388"]
+cipher = "chacha20-ietf-poly1305"
+password = "secret"
+
+[routing]
+default = "relay"
+
+[[routing.rules]]
+domains = ["netflix.com"]
+outbound = "residential"
+`)
+	config, _, err := parseConfig("test", []string{"-config", path}, io.Discard)
+	require.NoError(t, err)
+	require.NoError(t, config.Validate())
+	require.Equal(t, defaultHealthInterval, config.Outbounds[0].healthInterval())
+	router, outbounds, err := config.newRouter(nil, nil)
+	require.NoError(t, err)
+	require.Len(t, outbounds, 2)
+	require.Equal(t, "residential", router.Route(nil, "www.netflix.com", 443).Outbound)
+	require.Equal(t, "relay", router.Route(nil, "example.com", 443).Outbound)
+
+	config.Outbounds[1].Type = "vmess"
+	config.Routing.Rules[0].Outbound = "missing"
+	err = config.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `outbound relay: unknown type "vmess"`)
+
+	config.Outbounds[1].Type = "http"
+	err = config.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `routing: rule 1: unknown outbound "missing"`)
+}
+
+func TestValidateRouting(t *testing.T) {
+	config := defaultConfig()
+	config.API.Key = "key"
+	config.Users.Source = "http"
+	config.Outbounds = []OutboundConfig{{Name: "us", Type: "direct", SourceIP: "203.0.113.7"}}
+	config.Routing.Rules = []service.RouteRule{
+		{DomainKeywords: []string{"google"}, Outbound: "us"},
+		{Ports: []string{"25"}, Outbound: service.BlockedOutbound},
+	}
+	require.NoError(t, config.Validate())
+	router, _, err := config.newRouter(nil, nil)
+	require.NoError(t, err)
+	route := router.Route(nil, "www.google.com", 443)
+	require.Equal(t, "us", route.Outbound)
+	require.Equal(t, "203.0.113.7", route.SourceIP.String())
+	require.True(t, router.Route(nil, "mail.example", 25).Blocked())
+
+	config.Routing.Rules = append(config.Routing.Rules, service.RouteRule{Countries: []string{"CN"}, Outbound: "direct"})
+	err = config.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "countries need an IP-to-country database")
+
+	config.Routing.Rules = nil
+	config.Outbounds[0].SourceIP = "us-east"
+	err = config.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `outbound us: bad source_ip "us-east"`)
+}
+
+func TestValidateEgress(t *testing.T) {
+	config, _, err := parseConfig("test", []string{"-api_key", "k", "-users", "http", "-source_ips", "203.0.113.5, 2001:db8::5"}, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, []string{"203.0.113.5", "2001:db8::5"}, config.Egress.SourceIPs)
+	require.NoError(t, config.Validate())
+
+	config.Egress.SourceIPs = append(config.Egress.SourceIPs, "eth0")
+	err = config.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `egress: bad source IP "eth0"`)
+}
+
+func TestValidateListen(t *testing.T) {
+	config := defaultConfig()
+	config.API.Key = "key"
+	config.Users.Source = "http"
+	config.Listen.Addresses = []string{"192.0.2.1", "2001:db8::1"}
+	config.Listen.Ports = map[string]PortListenConfig{
+		"8388": {Family: "ipv4", Addresses: []string{"192.0.2.2"}, Hops: []string{"20000-20002", "20010"}},
+		"8389": {Hops: []string{"20003"}},
+	}
+	require.NoError(t, config.Validate())
+	defaults, ports, err := config.Listen.settings("")
+	require.NoError(t, err)
+	require.Equal(t, "dual", defaults.family)
+	require.Len(t, defaults.ips, 2)
+	require.Equal(t, []int{20000, 20001, 20002, 20010}, ports[8388].hops)
+	require.Equal(t, "ipv4", ports[8388].family)
+	// Ports inherit the settings they don't set.
+	require.Equal(t, defaults.ips, ports[8389].ips)
+	require.Equal(t, []listenAddr{{ip: "192.0.2.1", port: 8389}, {ip: "2001:db8::1", port: 8389}, {ip: "192.0.2.1", port: 20003}, {ip: "2001:db8::1", port: 20003}}, ports[8389].addrs(8389))
+
+	for _, test := range []struct {
+		listen   ListenConfig
+		listenIP string
+		problem  string
+	}{
+		{ListenConfig{Family: "ipv5"}, "", `unknown family "ipv5"`},
+		{ListenConfig{Addresses: []string{"eth0"}}, "", `"eth0" is not an IP address`},
+		{ListenConfig{Addresses: []string{"2001:db8::1"}, Family: "ipv4"}, "", "address 2001:db8::1 is not of family ipv4"},
+		{ListenConfig{Addresses: []string{"192.0.2.1"}}, "192.0.2.1", "set either server.listen_ip or listen.addresses"},
+		{ListenConfig{Ports: map[string]PortListenConfig{"8388": {Hops: []string{"9000-8999"}}}}, "", `bad port range "9000-8999"`},
+		{ListenConfig{Ports: map[string]PortListenConfig{"8388": {Hops: []string{"70000"}}}}, "", `bad port range "70000"`},
+		{ListenConfig{Ports: map[string]PortListenConfig{"8388": {Hops: []string{"9000-9010"}}, "9005": {}}}, "", "is already a hop of port"},
+		{ListenConfig{Ports: map[string]PortListenConfig{"8388": {Hops: []string{"9000", "9000"}}}}, "", "duplicate hop 9000"},
+	} {
+		config.Listen = test.listen
+		config.Server.ListenIP = test.listenIP
+		err := config.Validate()
+		require.Error(t, err, test.problem)
+		require.Contains(t, err.Error(), test.problem)
+	}
+}
+
+func TestValidateProxyProtocol(t *testing.T) {
+	config, _, err := parseConfig("test", []string{"-api_key", "k", "-users", "http", "-proxy_protocol", "-proxy_protocol_trusted", "10.0.0.0/8, 2001:db8::1"}, io.Discard)
+	require.NoError(t, err)
+	require.NoError(t, config.Validate())
+	opts, err := config.Proxy.options(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.0/8", opts.Trusted[0].String())
+	require.Equal(t, "2001:db8::1/128", opts.Trusted[1].String())
+	require.Equal(t, 10*time.Second, opts.HeaderTimeout)
+	// UDP doesn't go through an external plugin, so it still gets headers.
+	config.Server.Plugin = os.Args[0]
+	require.NoError(t, config.Validate())
+	config.Server.Plugin = ""
+
+	config.Proxy.Trusted = []string{"balancer"}
+	config.Proxy.HeaderTimeout = 0
+	err = config.Validate()
+	require.Error(t, err)
+	for _, problem := range []string{`proxy_protocol.trusted: "balancer" is not a CIDR or IP`, "proxy_protocol.header_timeout"} {
+		require.Contains(t, err.Error(), problem)
+	}
+
+	config.Proxy.Trusted = nil
+	err = config.Validate()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "proxy_protocol.trusted: no trusted balancers")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"myoss/service"
+)
+
+// listenFamilies maps the families of [listen] to the suffix of their
+// networks. Dual-stack sockets use the bare "tcp" and "udp" networks.
+var listenFamilies = map[string]string{"dual": "", "ipv4": "4", "ipv6": "6"}
+
+// listenSettings are where the keys of a port are served.
+type listenSettings struct {
+	// ips are the IPs to listen on. Empty means all the IPs of the family.
+	ips []net.IP
+	// family is dual, ipv4 or ipv6.
+	family string
+	// iface is the network interface the sockets are bound to, or "" for any.
+	iface string
+	// hops are more ports that serve the keys of the port, for port hopping.
+	hops []int
+}
+
+// addrs returns the addresses that port `portNum` listens on: each of the
+// IPs, on the port and on its hops.
+func (l listenSettings) addrs(portNum int) []listenAddr {
+	family := listenFamilies[l.family]
+	ips := []string{""}
+	if len(l.ips) > 0 {
+		ips = make([]string, 0, len(l.ips))
+		for _, ip := range l.ips {
+			ips = append(ips, ip.String())
+		}
+	}
+	addrs := make([]listenAddr, 0, len(ips)*(1+len(l.hops)))
+	for _, port := range append([]int{portNum}, l.hops...) {
+		for _, ip := range ips {
+			addrs = append(addrs, listenAddr{family: family, ip: ip, port: port, iface: l.iface})
+		}
+	}
+	return addrs
+}
+
+// listenAddr is an address that a port listens on with TCP and UDP. It's
+// comparable, so the listeners of a port are keyed on it.
+type listenAddr struct {
+	// family is the suffix of the networks: "" for dual-stack sockets, "4"
+	// or "6".
+	family string
+	// ip is the IP to listen on, or "" for all the IPs of the family.
+	ip    string
+	port  int
+	iface string
+}
+
+// host returns the IP of `a`, or the unspecified IP of its family.
+func (a listenAddr) host() string {
+	switch {
+	case a.ip != "":
+		return a.ip
+	case a.family == "4":
+		return "0.0.0.0"
+	case a.family == "6":
+		return "::"
+	default:
+		return ""
+	}
+}
+
+func (a listenAddr) String() string {
+	s := net.JoinHostPort(a.host(), strconv.Itoa(a.port))
+	if a.iface != "" {
+		s += "@" + a.iface
+	}
+	return s
+}
+
+// tcpAddr is the address that a SIP003 plugin listens on for the port.
+func (a listenAddr) tcpAddr() *net.TCPAddr {
+	return &net.TCPAddr{IP: net.ParseIP(a.host()), Port: a.port}
+}
+
+func (a listenAddr) listenConfig() (net.ListenConfig, error) {
+	var lc net.ListenConfig
+	if a.iface != "" {
+		control, err := service.BindInterface(a.iface)
+		if err != nil {
+			return lc, err
+		}
+		lc.Control = control
+	}
+	return lc, nil
+}
+
+// listenTCP listens for TCP connections on `a`.
+func (a listenAddr) listenTCP() (net.Listener, error) {
+	lc, err := a.listenConfig()
+	if err != nil {
+		return nil, err
+	}
+	return lc.Listen(context.Background(), "tcp"+a.family, net.JoinHostPort(a.ip, strconv.Itoa(a.port)))
+}
+
+// listenUDP listens for UDP packets on `a`.
+func (a listenAddr) listenUDP() (net.PacketConn, error) {
+	lc, err := a.listenConfig()
+	if err != nil {
+		return nil, err
+	}
+	return lc.ListenPacket(context.Background(), "udp"+a.family, net.JoinHostPort(a.ip, strconv.Itoa(a.port)))
+}
+
+// parsePortRanges parses ports and ranges of ports like "20000-20100".
+func parsePortRanges(ranges []string) ([]int, error) {
+	var ports []int
+	for _, text := range ranges {
+		first, last, isRange := strings.Cut(text, "-")
+		low, err := strconv.Atoi(strings.TrimSpace(first))
+		high := low
+		if err == nil && isRange {
+			high, err = strconv.Atoi(strings.TrimSpace(last))
+		}
+		if err != nil || low <= 0 || high > 65535 || low > high {
+			return nil, fmt.Errorf("bad port range %q", text)
+		}
+		for port := low; port <= high; port++ {
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
@@ -2,25 +2,31 @@ package main
 
 import (
 	"container/list"
+	"context"
 	"flag"
 	"fmt"
-	"math/rand"
 	"myoss/api"
+	"myoss/dns"
 	"myoss/mylog"
 	ss "myoss/shadowsocks"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	onet "myoss/net"
 	"myoss/service"
 	"myoss/service/metrics"
+	"myoss/transport"
 
 	"github.com/op/go-logging"
 	"github.com/oschwald/geoip2-golang"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
@@ -30,9 +36,11 @@ var logger *logging.Logger
 var version = "dev"
 
 // 59 seconds is most common timeout for servers that do not respond to invalid requests
+// Default for server.tcp_read_timeout.
 const tcpReadTimeout time.Duration = 59 * time.Second
 
 // A UDP NAT timeout of at least 5 minutes is recommended in RFC 4787 Section 4.3.
+// Default for server.nat_timeout.
 const defaultNatTimeout time.Duration = 5 * time.Minute
 
 func init() {
@@ -46,162 +54,518 @@ func init() {
 	logger = logging.MustGetLogger("")
 }
 
+// ssPort serves the keys of a port on each of its listen addresses.
 type ssPort struct {
+	cipherList service.CipherList
+	// keys maps each key served on this port to its entry in cipherList.
+	keys map[api.Key]*service.CipherEntry
+	// listeners maps each address the port listens on to its services,
+	// which share cipherList.
+	listeners map[listenAddr]*portListener
+}
+
+// portListener serves a port on one of its listen addresses.
+type portListener struct {
 	tcpService service.TCPService
 	udpService service.UDPService
-	cipherList service.CipherList
+	// plugin is the SIP003 plugin in front of the TCP service, or nil.
+	plugin *transport.Plugin
+	// packetService serves the packets carried over WebSocket, if the port
+	// serves WebSocket packets.
+	packetService service.UDPService
 }
 
 type SSServer struct {
+	mu          sync.Mutex // Protects .ports, .sourceUsers and .overrides
 	natTimeout  time.Duration
+	readTimeout time.Duration
+	// listen is where the ports listen, unless they have their own
+	// settings in portListen.
+	listen      listenSettings
+	portListen  map[int]listenSettings
 	m           metrics.ShadowsocksMetrics
 	replayCache service.ReplayCache
 	ports       map[int]*ssPort
 	api         *api.APIClient
+	users       api.UserSource
+	// sourceUsers is the last key list read from users.
+	sourceUsers *api.UserRets
+	overrides   keyOverrides
+	spool       *api.Spool
+	nodeLimits  *service.NodeLimits
+	// deviceWindow is how long an IP counts as a device of a key.
+	deviceWindow time.Duration
+	// bans is shared by all ports. It's nil if banning is disabled.
+	bans *service.BanList
+	// udpBans are the bans of UDP clients, which are kept apart because
+	// UDP source addresses can be spoofed. It's nil if banning is disabled.
+	udpBans *service.BanList
+	// identity is the Shadowsocks 2022 identity key of all ports, or nil.
+	identity *ss.IdentityKey
+	// allowStreamCiphers enables keys with legacy stream ciphers.
+	allowStreamCiphers bool
+	// udpOverTCP lets clients relay UDP packets in their TCP streams.
+	udpOverTCP bool
+	// acl holds the destination rules of all ports, loaded from aclFile.
+	// It's nil, and allows everything, if there's no aclFile.
+	acl     *service.ACL
+	aclFile string
+	// resolver resolves the target names of all ports, or is nil to use the
+	// system resolver.
+	resolver *dns.Resolver
+	// router picks the outbound of the targets of all ports.
+	router *service.Router
+	// egress picks the source IPs of the connections of all ports.
+	egress *service.Egress
+	// plugin and pluginOpts are the SIP003 plugin of every port. If the
+	// plugin is built in, obfs removes it from each connection instead.
+	plugin     string
+	pluginOpts string
+	obfs       onet.StreamTransport
+	// webSocket makes the ports serve Shadowsocks over WebSocket, if set.
+	webSocket *transport.WebSocketOptions
+	// tls makes the ports terminate TLS, under WebSocket if both are set.
+	tls *transport.TLSOptions
+	// proxyProtocol recovers the addresses of the clients of load
+	// balancers, if set.
+	proxyProtocol *transport.ProxyProtocolOptions
+	// fallback is where TCP clients failing authentication are relayed,
+	// unless their port has its own in portFallbacks. Empty means none.
+	fallback      string
+	portFallbacks map[int]string
+}
+
+// listenFor returns the listen settings of port `portNum`.
+func (s *SSServer) listenFor(portNum int) listenSettings {
+	if settings, ok := s.portListen[portNum]; ok {
+		return settings
+	}
+	return s.listen
 }
 
+// startPort starts serving port `portNum` on all its listen addresses. If
+// one fails, none are left running.
 func (s *SSServer) startPort(portNum int) error {
-	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: portNum})
+	port := &ssPort{cipherList: service.NewCipherList(), listeners: make(map[listenAddr]*portListener)}
+	s.ports[portNum] = port
+	for _, addr := range s.listenFor(portNum).addrs(portNum) {
+		if err := s.startListener(portNum, port, addr); err != nil {
+			s.removePort(portNum)
+			return err
+		}
+	}
+	return nil
+}
+
+// startListener starts serving port `portNum` on `addr`.
+func (s *SSServer) startListener(portNum int, port *ssPort, addr listenAddr) error {
+	external := s.plugin != "" && s.obfs == nil
+	var listener net.Listener
+	var err error
+	if external {
+		// The plugin listens on the public port, and forwards to the
+		// service on a loopback port.
+		listener, err = net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	} else {
+		listener, err = addr.listenTCP()
+	}
 	if err != nil {
-		return fmt.Errorf("Failed to start TCP on port %v: %v", portNum, err)
+		return fmt.Errorf("Failed to start TCP on %v: %v", addr, err)
 	}
-	packetConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: portNum})
+	packetConn, err := addr.listenUDP()
 	if err != nil {
-		return fmt.Errorf("Failed to start UDP on port %v: %v", portNum, err)
+		listener.Close()
+		return fmt.Errorf("Failed to start UDP on %v: %v", addr, err)
+	}
+	if s.proxyProtocol != nil {
+		// UDP never goes through an external plugin, so only TCP loses
+		// the headers of the load balancer to it.
+		if !external {
+			listener = transport.NewProxyProtocolListener(listener, *s.proxyProtocol)
+		}
+		packetConn = transport.NewProxyProtocolPacketConn(packetConn, *s.proxyProtocol)
+	}
+	l := &portListener{}
+	if external {
+		l.plugin, err = transport.StartPlugin(s.plugin, s.pluginOpts, addr.tcpAddr(), listener.Addr().(*net.TCPAddr))
+		if err != nil {
+			listener.Close()
+			packetConn.Close()
+			return fmt.Errorf("Failed to start plugin on %v: %v", addr, err)
+		}
+		logger.Infof("Listening TCP with plugin %v and UDP on %v", s.plugin, addr)
+	} else {
+		logger.Infof("Listening %v and UDP on %v", s.streamTransportName(), addr)
 	}
-	logger.Infof("Listening TCP and UDP on port %v", portNum)
-	port := &ssPort{cipherList: service.NewCipherList()}
 	// TODO: Register initial data metrics at zero.
-	port.tcpService = service.NewTCPService(port.cipherList, &s.replayCache, s.m, tcpReadTimeout, s.api)
-	port.udpService = service.NewUDPService(s.natTimeout, port.cipherList, s.m, s.api)
-	s.ports[portNum] = port
-	go port.tcpService.Serve(listener)
-	go port.udpService.Serve(packetConn)
+	l.tcpService = service.NewTCPService(port.cipherList, &s.replayCache, s.m, s.readTimeout)
+	l.udpService = service.NewUDPService(s.natTimeout, port.cipherList, s.m)
+	l.tcpService.SetNodeLimits(s.nodeLimits)
+	l.udpService.SetNodeLimits(s.nodeLimits)
+	if !external {
+		// Behind an external plugin, every TCP client has a loopback address.
+		l.tcpService.SetBanList(s.bans)
+	}
+	l.udpService.SetBanList(s.udpBans)
+	l.tcpService.SetIdentityKey(s.identity)
+	l.udpService.SetIdentityKey(s.identity)
+	l.tcpService.SetTransport(s.obfs)
+	l.tcpService.SetFallback(s.fallbackFor(portNum))
+	l.tcpService.SetACL(s.acl)
+	l.udpService.SetACL(s.acl)
+	l.tcpService.SetResolver(s.resolver)
+	l.udpService.SetResolver(s.resolver)
+	l.tcpService.SetRouter(s.router)
+	l.udpService.SetRouter(s.router)
+	l.tcpService.SetEgress(s.egress)
+	l.udpService.SetEgress(s.egress)
+	l.udpService.SetReplayCache(&s.replayCache)
+	if s.udpOverTCP {
+		l.tcpService.SetUDPOverTCP(s.natTimeout)
+	}
+	if s.api != nil {
+		l.tcpService.SetTrafficRecorder(s.api)
+		l.udpService.SetTrafficRecorder(s.api)
+	}
+	port.listeners[addr] = l
+	streamListener := listener
+	if s.tls != nil {
+		streamListener = transport.NewTLSListener(listener, *s.tls)
+	}
+	if s.webSocket != nil {
+		ws := transport.NewWebSocketServer(streamListener, *s.webSocket)
+		go ws.Serve()
+		go l.tcpService.Serve(ws.StreamListener())
+		if s.webSocket.PacketPath != "" {
+			l.packetService = service.NewUDPService(s.natTimeout, port.cipherList, s.m)
+			l.packetService.SetNodeLimits(s.nodeLimits)
+			l.packetService.SetBanList(s.bans)
+			l.packetService.SetIdentityKey(s.identity)
+			l.packetService.SetACL(s.acl)
+			l.packetService.SetResolver(s.resolver)
+			l.packetService.SetRouter(s.router)
+			l.packetService.SetEgress(s.egress)
+			l.packetService.SetReplayCache(&s.replayCache)
+			if s.api != nil {
+				l.packetService.SetTrafficRecorder(s.api)
+			}
+			go l.packetService.Serve(ws.PacketConn())
+		}
+	} else {
+		go l.tcpService.Serve(streamListener)
+	}
+	go l.udpService.Serve(packetConn)
 	return nil
 }
 
+// fallbackFor returns the fallback of port `portNum`.
+func (s *SSServer) fallbackFor(portNum int) string {
+	if fallback, ok := s.portFallbacks[portNum]; ok {
+		return fallback
+	}
+	return s.fallback
+}
+
+// streamTransportName describes how the ports carry Shadowsocks streams.
+func (s *SSServer) streamTransportName() string {
+	switch {
+	case s.webSocket != nil && s.tls != nil:
+		return "WebSocket over TLS"
+	case s.webSocket != nil:
+		return "WebSocket"
+	case s.tls != nil:
+		return "TLS"
+	default:
+		return "TCP"
+	}
+}
+
+// removePort stops serving port `portNum` on all its listen addresses.
 func (s *SSServer) removePort(portNum int) error {
 	port, ok := s.ports[portNum]
 	if !ok {
 		return fmt.Errorf("Port %v doesn't exist", portNum)
 	}
-	tcpErr := port.tcpService.Stop()
-	udpErr := port.udpService.Stop()
+	var firstErr error
+	for addr := range port.listeners {
+		if err := port.stopListener(addr); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
 	delete(s.ports, portNum)
+	return firstErr
+}
+
+// stopListener stops serving the port on `addr`.
+func (port *ssPort) stopListener(addr listenAddr) error {
+	l, ok := port.listeners[addr]
+	if !ok {
+		return fmt.Errorf("Not listening on %v", addr)
+	}
+	var pluginErr error
+	if l.plugin != nil {
+		pluginErr = l.plugin.Stop()
+	}
+	tcpErr := l.tcpService.Stop()
+	udpErr := l.udpService.Stop()
+	if l.packetService != nil {
+		l.packetService.Stop()
+	}
+	delete(port.listeners, addr)
+	if pluginErr != nil {
+		return fmt.Errorf("Failed to stop plugin on %v: %v", addr, pluginErr)
+	}
 	if tcpErr != nil {
-		return fmt.Errorf("Failed to close listener on %v: %v", portNum, tcpErr)
+		return fmt.Errorf("Failed to close listener on %v: %v", addr, tcpErr)
 	}
 	if udpErr != nil {
-		return fmt.Errorf("Failed to close packetConn on %v: %v", portNum, udpErr)
+		return fmt.Errorf("Failed to close packetConn on %v: %v", addr, udpErr)
 	}
-	logger.Infof("Stopped TCP and UDP on port %v", portNum)
+	logger.Infof("Stopped TCP and UDP on %v", addr)
 	return nil
 }
 
-func (s *SSServer) doRun(users *api.UserRets) error {
-	logger.Infof("doRun")
-
-	//config, err := readConfig(filename)
-	//if err != nil {
-	//	return fmt.Errorf("Failed to read config file %v: %v", filename, err)
-	//}
-
-	// users, err := s.api.GetUsers()
-	// if err != nil {
-	// 	return err
-	// }
-	//keys := []Key{}
-	//keys = append(keys, Key{
-	//	ID:     "user-0",
-	//	Port:   9000,
-	//	Cipher: "chacha20-ietf-poly1305",
-	//	Secret: "121212",
-	//})
-	//keys = append(keys, Key{
-	//	ID:     "user-1",
-	//	Port:   9000,
-	//	Cipher: "aes-128-gcm",
-	//	Secret: "232323",
-	//})
-	//config := &Config{
-	//	Keys: keys,
-	//}
-	portChanges := make(map[int]int)
-	portCiphers := make(map[int]*list.List) // Values are *List of *CipherEntry.
+// keyDiff summarizes what a call to doRun changed.
+type keyDiff struct {
+	addedKeys, removedKeys, addedPorts, removedPorts int
+}
+
+func (d keyDiff) empty() bool {
+	return d == keyDiff{}
+}
+
+// doRun makes the running ports and cipher lists match `users`. Ports whose
+// key set is unchanged are left alone, and entries for keys that are still
+// present are reused so their per-key state survives the update. A key whose
+// quota or limits changed keeps its entry.
+func (s *SSServer) doRun(users *api.UserRets) (keyDiff, error) {
+	var diff keyDiff
+	desired := make(map[int]map[api.Key]*service.CipherEntry)
+	periods := make(map[api.Key]service.QuotaPeriod)
+	// Keys are identified by ID in the traffic reports and the admin API.
+	ids := make(map[string]bool, len(users.Data))
 	for _, keyConfig := range users.Data {
-		portChanges[keyConfig.Port] = 1
-		cipherList, ok := portCiphers[keyConfig.Port]
-		if !ok {
-			cipherList = list.New()
-			portCiphers[keyConfig.Port] = cipherList
+		if ids[keyConfig.ID] {
+			return keyDiff{}, fmt.Errorf("Duplicate key ID %v", keyConfig.ID)
 		}
-		cipher, err := ss.NewCipher(keyConfig.Cipher, keyConfig.Secret)
+		ids[keyConfig.ID] = true
+		period, err := service.ParseQuotaPeriod(keyConfig.QuotaPeriod)
 		if err != nil {
-			return fmt.Errorf("Failed to create cipher for key %v: %v", keyConfig.ID, err)
+			return keyDiff{}, fmt.Errorf("Invalid quota for key %v: %v", keyConfig.ID, err)
+		}
+		periods[keyConfig] = period
+		keys, ok := desired[keyConfig.Port]
+		if !ok {
+			keys = make(map[api.Key]*service.CipherEntry)
+			desired[keyConfig.Port] = keys
+		}
+		keys[keyConfig] = nil
+	}
+	// The hops of a port can't have keys of their own.
+	hopOf := make(map[int]int)
+	for portNum := range desired {
+		for _, hop := range s.listenFor(portNum).hops {
+			hopOf[hop] = portNum
 		}
-		entry := service.MakeCipherEntry(keyConfig.ID, cipher, keyConfig.Secret)
-		cipherList.PushBack(&entry)
 	}
-	for port := range s.ports {
-		portChanges[port] = portChanges[port] - 1
+	for portNum := range desired {
+		if other, ok := hopOf[portNum]; ok {
+			return keyDiff{}, fmt.Errorf("Port %v has keys, but it's a hop of port %v", portNum, other)
+		}
 	}
-	for portNum, count := range portChanges {
-		if count == -1 {
-			if err := s.removePort(portNum); err != nil {
-				return fmt.Errorf("Failed to remove port %v: %v", portNum, err)
+
+	// Build every new cipher before touching the running ports, so that a bad
+	// key leaves the server as it was.
+	portCiphers := make(map[int]*list.List) // Values are *List of *CipherEntry.
+	for portNum, keys := range desired {
+		var current map[api.Key]*service.CipherEntry
+		if port, ok := s.ports[portNum]; ok {
+			current = port.keys
+			if sameKeys(current, keys) {
+				desired[portNum] = current
+				continue
 			}
-		} else if count == +1 {
-			if err := s.startPort(portNum); err != nil {
-				return fmt.Errorf("Failed to start port %v: %v", portNum, err)
+		}
+		currentByAccess := make(map[api.Key]*service.CipherEntry, len(current))
+		for keyConfig, entry := range current {
+			currentByAccess[keyConfig.Access()] = entry
+		}
+		desiredAccess := make(map[api.Key]bool, len(keys))
+		cipherList := list.New()
+		for keyConfig := range keys {
+			desiredAccess[keyConfig.Access()] = true
+			entry, ok := currentByAccess[keyConfig.Access()]
+			if !ok {
+				cipher, err := newKeyCipher(keyConfig.Cipher, keyConfig.Secret, s.allowStreamCiphers)
+				if err != nil {
+					return keyDiff{}, fmt.Errorf("Failed to create cipher for key %v: %v", keyConfig.ID, err)
+				}
+				if cipher.IsStream() {
+					logger.Warningf("Key %v uses the stream cipher %v, which has no integrity or replay protection", keyConfig.ID, keyConfig.Cipher)
+				}
+				newEntry := service.MakeCipherEntry(keyConfig.ID, cipher, keyConfig.Secret)
+				entry = &newEntry
+				diff.addedKeys++
 			}
+			keys[keyConfig] = entry
+			cipherList.PushBack(entry)
+		}
+		// Stream ciphers can't authenticate clients, so the server can't tell
+		// which key a connection uses if there's more than one.
+		if len(keys) > 1 {
+			for keyConfig, entry := range keys {
+				if entry.Cipher.IsStream() {
+					return keyDiff{}, fmt.Errorf("Key %v uses a stream cipher, so it must be the only key on port %v", keyConfig.ID, portNum)
+				}
+			}
+		}
+		for keyConfig := range current {
+			if !desiredAccess[keyConfig.Access()] {
+				diff.removedKeys++
+			}
+		}
+		portCiphers[portNum] = cipherList
+	}
+
+	for portNum, port := range s.ports {
+		if _, ok := desired[portNum]; ok {
+			continue
+		}
+		diff.removedKeys += len(port.keys)
+		diff.removedPorts++
+		if err := s.removePort(portNum); err != nil {
+			return diff, fmt.Errorf("Failed to remove port %v: %v", portNum, err)
 		}
 	}
 	for portNum, cipherList := range portCiphers {
-		s.ports[portNum].cipherList.Update(cipherList)
+		if _, ok := s.ports[portNum]; !ok {
+			if err := s.startPort(portNum); err != nil {
+				return diff, fmt.Errorf("Failed to start port %v: %v", portNum, err)
+			}
+			diff.addedPorts++
+		}
+		port := s.ports[portNum]
+		port.cipherList.Update(cipherList)
+		port.keys = desired[portNum]
 	}
-	logger.Infof("Loaded %v access keys", len(users.Data))
-	s.m.SetNumAccessKeys(len(users.Data), len(portCiphers))
-	return nil
+	for _, keys := range desired {
+		for keyConfig, entry := range keys {
+			entry.SetQuota(keyConfig.Quota, periods[keyConfig], keyConfig.QuotaUsed)
+			entry.SetRateLimit(keyConfig.UploadRate, keyConfig.DownloadRate)
+			entry.SetConnectionLimits(keyConfig.MaxConnections, keyConfig.MaxUDPSessions, keyConfig.MaxDevices, s.deviceWindow)
+			entry.SetPlan(keyConfig.Plan)
+			entry.SetOutbound(keyConfig.Outbound)
+			entry.SetSourceIP(net.ParseIP(keyConfig.SourceIP))
+		}
+	}
+	streamKeys := 0
+	for _, keys := range desired {
+		for _, entry := range keys {
+			if entry.Cipher.IsStream() {
+				streamKeys++
+			}
+		}
+	}
+	if diff.empty() {
+		logger.Debugf("Loaded %v access keys", len(users.Data))
+	} else {
+		logger.Infof("Loaded %v access keys", len(users.Data))
+	}
+	s.m.SetNumAccessKeys(len(users.Data), len(desired))
+	s.m.SetStreamCipherKeys(streamKeys)
+	return diff, nil
+}
+
+// newKeyCipher creates the cipher of a key. Legacy stream ciphers are only
+// accepted if allowStream is set.
+func newKeyCipher(cipherName, secret string, allowStream bool) (*ss.Cipher, error) {
+	if !ss.IsStreamCipher(cipherName) {
+		return ss.NewCipher(cipherName, secret)
+	}
+	if !allowStream {
+		return nil, fmt.Errorf("stream cipher %v is insecure and disabled (see allow_stream_ciphers)", cipherName)
+	}
+	return ss.NewStreamCipher(cipherName, secret)
+}
+
+func sameKeys(a, b map[api.Key]*service.CipherEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			return false
+		}
+	}
+	return true
 }
 
 func (s *SSServer) CheckWwwRepo() {
 	ticker := time.NewTicker(30 * time.Second)
 	for {
 		<-ticker.C
-		if len(*s.api.Wtask.RepoList) == 0 {
+		destinations := s.api.DrainDestinations()
+		if len(destinations) == 0 {
 			logger.Infof("empty www repo")
 			continue
 		}
-		now := time.Now().UTC()
-		if (now.Unix() - s.api.Wtask.StartTime.Unix()) > 30 {
-			s.api.ReportWwwTraffic(s.api.Wtask.RepoList)
-			s.api.Wtask.RepoList = &[]api.WwwTraffic{}
-			s.api.Wtask.StartTime = &now
-		} else {
-			logger.Infof("www repo no time %v ---%v", s.api.Wtask.StartTime.String(), now.String())
+		if err := s.api.ReportWwwTraffic(&destinations); err != nil {
+			logger.Warningf("Failed to report destinations: %v", err)
+		}
+	}
+}
+
+// spoolTraffic moves the traffic accumulated in memory to the spool. On
+// failure the traffic stays in memory for the next attempt.
+func (s *SSServer) spoolTraffic() {
+	traffic := s.api.DrainTraffic()
+	if len(traffic) == 0 {
+		return
+	}
+	if err := s.spool.Append(traffic); err != nil {
+		logger.Errorf("Failed to spool traffic: %v", err)
+		// Append spools none of it when it fails, so all of it waits for
+		// the next try.
+		for _, t := range traffic {
+			s.api.AddTraffic(t.UID, t.U, t.D)
 		}
 	}
 }
+
+// CheckRepo spools the accumulated traffic every 10 seconds. The spool sends
+// it to the control plane on its own schedule.
 func (s *SSServer) CheckRepo() {
-	randomNumber := rand.Intn(300) + 300
-	interval := time.Duration(randomNumber) * time.Second
-	ticker := time.NewTicker(interval)
+	ticker := time.NewTicker(10 * time.Second)
 	for {
 		<-ticker.C
-		if len(*s.api.Rtask.RepoList) == 0 {
-			logger.Infof("empty repo")
-			continue
-		}
-		now := time.Now().UTC()
-		if (now.Unix() - s.api.Rtask.StartTime.Unix()) > 9 {
-			s.api.ReportUserTraffic(s.api.Rtask.RepoList)
-			s.api.Rtask.RepoList = &[]api.UserTraffic{}
-			s.api.Rtask.StartTime = &now
-		} else {
-			logger.Infof("repo no time %v ---%v", s.api.Rtask.StartTime.String(), now.String())
+		s.spoolTraffic()
+	}
+}
+
+// reportTraffic sends one batch from the spool.
+func (s *SSServer) reportTraffic(batch []api.UserTraffic) error {
+	return s.api.ReportUserTraffic(&batch)
+}
+
+// reportGauges periodically exports the number of devices of each key and
+// the number of banned IPs.
+func (s *SSServer) reportGauges() {
+	ticker := time.NewTicker(30 * time.Second)
+	for range ticker.C {
+		devices := make(map[string]int)
+		s.mu.Lock()
+		for _, port := range s.ports {
+			for key, entry := range port.keys {
+				devices[key.ID] = entry.Devices()
+			}
 		}
+		s.mu.Unlock()
+		s.m.SetKeyDevices(devices)
+		now := time.Now()
+		s.m.SetBannedIPs(len(s.bans.List(now)) + len(s.udpBans.List(now)))
 	}
 }
+
 func (s *SSServer) RepoSys() {
 	ticker := time.NewTicker(300 * time.Second)
 	for {
@@ -212,59 +576,11 @@ func (s *SSServer) RepoSys() {
 		}
 	}
 }
-func (s *SSServer) CheckUser(sigHup chan os.Signal) {
-	rand.Seed(time.Now().UnixNano())
-	// 生成30到60之间的随机整数rand.Intn(10) + 30
-	randomNumber := 5
-	interval := time.Duration(randomNumber) * time.Second
-	fmt.Println("随机生成的数字为:", interval)
-	ticker := time.NewTicker(interval)
-	hash := map[api.Key]uint32{}
-	// 在无限循环中接收信号并打印当前时间
-	for {
-		<-ticker.C
-		doNew := false
-
-		users, err := s.api.GetUsers()
-		if err != nil {
-			println(err)
-			continue
-		}
-
-		if len(users.Data) != len(hash) {
-			signal.Notify(sigHup, syscall.SIGHUP)
-			doNew = true
-			hash = make(map[api.Key]uint32)
-			logger.Infof("len(users.Data) != len(hash)")
-		}
-		for _, ok := range users.Data {
-			hashkey := ok.Hash()
-			vk, vok := hash[ok]
-			if !vok {
-				signal.Notify(sigHup, syscall.SIGHUP)
-				logger.Infof("!vok")
-				doNew = true
-				//break
-			}
-			if vk != hashkey {
-				signal.Notify(sigHup, syscall.SIGHUP)
-				logger.Infof("vk != hashkey")
-				doNew = true
-
-				//break
-			}
-			hash[ok] = hashkey
-		}
-		if doNew {
-			s.doRun(users)
-		}
-
-	}
-
-}
 
 // Stop serving on all ports.
 func (s *SSServer) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for portNum := range s.ports {
 		if err := s.removePort(portNum); err != nil {
 			return err
@@ -274,92 +590,218 @@ func (s *SSServer) Stop() error {
 }
 
 // RunSSServer starts a shadowsocks server running, and returns the server or an error.
-func RunSSServer(natTimeout time.Duration, sm metrics.ShadowsocksMetrics, replayHistory int, api2 *api.APIClient) (*SSServer, error) {
+func RunSSServer(config *Config, sm metrics.ShadowsocksMetrics, api2 *api.APIClient, users api.UserSource) (*SSServer, error) {
 	server := &SSServer{
-		natTimeout:  natTimeout,
-		m:           sm,
-		replayCache: service.NewReplayCache(replayHistory),
-		ports:       make(map[int]*ssPort),
-		api:         api2,
-	}
-	//err := server.loadConfig(filename)
-	server.api.Init()
-	users, err := server.api.GetUsers()
-	// if err != nil {
-	// 	return err
-	// }
-	err = server.doRun(users)
+		natTimeout:   config.Server.NATTimeout,
+		readTimeout:  config.Server.TCPReadTimeout,
+		m:            sm,
+		replayCache:  service.NewReplayCache(config.Server.ReplayHistory),
+		ports:        make(map[int]*ssPort),
+		api:          api2,
+		users:        users,
+		deviceWindow: config.Server.DeviceWindow,
+		plugin:       config.Server.Plugin,
+		udpOverTCP:   config.Server.UDPOverTCP,
+		pluginOpts:   config.Server.PluginOpts,
+		bans:         service.NewBanList(config.Ban.MaxFailures, config.Ban.Window, config.Ban.Duration, config.Ban.MaxIPs),
+		udpBans:      service.NewBanList(config.Ban.MaxFailures, config.Ban.Window, config.Ban.Duration, config.Ban.MaxIPs),
+		nodeLimits: &service.NodeLimits{
+			Upload:   service.NewRateLimiter(config.Server.UploadRate),
+			Download: service.NewRateLimiter(config.Server.DownloadRate),
+		},
+	}
+	if config.Server.IdentityPSK != "" {
+		identity, err := ss.NewIdentityKey(config.Server.IdentityPSK)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid identity key: %v", err)
+		}
+		server.identity = identity
+	}
+	if config.Server.Plugin == transport.ObfsPluginName {
+		obfs, err := transport.NewObfsServer(config.Server.PluginOpts)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid plugin options: %v", err)
+		}
+		server.obfs = obfs
+	}
+	if config.TLS.Enabled {
+		certs, err := transport.NewCertStore(config.TLS.CertFile, config.TLS.KeyFile, config.TLS.CertDir)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load TLS certificates: %v", err)
+		}
+		go certs.Watch(config.TLS.ReloadInterval, nil)
+		server.tls = &transport.TLSOptions{
+			Certs: certs,
+			ALPN:  config.TLS.ALPN,
+			Decoy: config.TLS.Decoy,
+		}
+	}
+	if config.Proxy.Enabled {
+		proxyProtocol, err := config.Proxy.options(config.Server.NATTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid PROXY protocol settings: %v", err)
+		}
+		server.proxyProtocol = proxyProtocol
+	}
+	if config.WebSocket.Enabled {
+		server.webSocket = &transport.WebSocketOptions{
+			StreamPath:   config.WebSocket.StreamPath,
+			PacketPath:   config.WebSocket.PacketPath,
+			RealIPHeader: config.WebSocket.RealIPHeader,
+		}
+	}
+	if config.ACL.File != "" {
+		rules, err := loadACLRules(config.ACL.File)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load the destination rules: %v", err)
+		}
+		if server.acl, err = service.NewACL(rules); err != nil {
+			return nil, fmt.Errorf("Invalid destination rules: %v", err)
+		}
+		server.aclFile = config.ACL.File
+		go server.watchACL(watchFile(config.ACL.File, time.Second))
+	}
+	if len(config.DNS.Upstreams) > 0 {
+		resolver, err := dns.NewResolver(config.DNS.resolverConfig(), sm)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid DNS configuration: %v", err)
+		}
+		server.resolver = resolver
+	}
+	egress, err := config.Egress.newEgress()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to dorun: %v", err)
+		return nil, fmt.Errorf("Invalid egress: %v", err)
+	}
+	server.egress = egress
+	// The metrics look up countries in the IP-to-country database.
+	var locate func(net.Addr) (string, error)
+	if config.Metrics.IPCountryDB != "" {
+		locate = sm.GetLocation
+	}
+	router, outbounds, err := config.newRouter(server.resolver, locate)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid outbounds: %v", err)
+	}
+	server.router = router
+	for _, outboundConfig := range config.Outbounds {
+		if outboundConfig.HealthCheck != "" {
+			go outbounds[outboundConfig.Name].CheckHealth(context.Background(), outboundConfig.HealthCheck, outboundConfig.healthInterval())
+		}
+	}
+	server.listen, server.portListen, err = config.Listen.settings(config.Server.ListenIP)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid listen settings: %v", err)
+	}
+	portFallbacks, err := config.Fallback.portAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid fallback ports: %v", err)
+	}
+	server.fallback = config.Fallback.Addr
+	server.portFallbacks = portFallbacks
+	if config.Server.AllowStreamCiphers {
+		server.allowStreamCiphers = true
+		logger.Warningf("Legacy stream ciphers are enabled. Keys that use them have no integrity or replay protection")
+	}
+	spool, err := api.OpenSpool(config.Report.SpoolDir, config.Report.MaxBytes, config.Report.BatchSize, sm)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open report spool: %v", err)
+	}
+	server.spool = spool
+	if err := server.api.Init(); err != nil {
+		logger.Warningf("Failed to init node: %v", err)
+	}
+	if err := server.reload("startup"); err != nil {
+		return nil, err
 	}
 	sigHup := make(chan os.Signal, 1)
-	go server.CheckUser(sigHup)
+	signal.Notify(sigHup, syscall.SIGHUP)
+	var fileChanged <-chan struct{}
+	var pollInterval time.Duration
+	if config.Users.Source == "file" {
+		fileChanged = watchFile(config.Users.Location, time.Second)
+	} else {
+		pollInterval = config.Users.PollInterval
+	}
+	go server.watchUsers(sigHup, fileChanged, pollInterval)
 	go server.RepoSys()
+	go server.reportGauges()
 	go server.CheckRepo()
+	go server.spool.Run(server.reportTraffic, config.Report.Interval, nil)
 	go server.CheckWwwRepo()
-	//signal.Notify(sigHup, syscall.SIGHUP)
-	//go func() {
-	//	for range sigHup {
-	//		logger.Info("Updating config")
-	//		if err := server.doRun(); err != nil {
-	//			logger.Errorf("Could not reload config: %v", err)
-	//		}
-	//	}
-	//}()
 	return server, nil
 }
 
 func main() {
-	var youhua string
-
-	flag.StringVar(&youhua, "y", "n", "init")
-	flag.Parse()
-	if youhua != "n" {
+	config, opts, err := parseConfig(os.Args[0], os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		logger.Fatal(err)
+	}
+	if opts.Youhua != "n" {
 		YouhuaRun()
 		return
 	}
-	//flag.Parse()
-
-	//if flags.Verbose {
-	//	logging.SetLevel(logging.DEBUG, "")
-	//} else {
-	//
-	//}
-	logging.SetLevel(logging.INFO, "")
-	//if flags.Version {
-	//	fmt.Println(version)
-	//	return
-	//}
-
-	//if flags.MetricsAddr != "" {
-	//	http.Handle("/metrics", promhttp.Handler())
-	//	go func() {
-	//		logger.Fatal(http.ListenAndServe(flags.MetricsAddr, nil))
-	//	}()
-	//	logger.Infof("Metrics on http://%v/metrics", flags.MetricsAddr)https://aerodrome.onemelody.cn/
-	//}
+	if opts.Version {
+		fmt.Println(version)
+		return
+	}
+	if err := config.Validate(); err != nil {
+		logger.Fatal(err)
+	}
+
+	level, _ := logging.LogLevel(config.Log.Level)
+	logging.SetLevel(level, "")
+
+	if config.Metrics.Addr != "" {
+		http.Handle("/metrics", promhttp.Handler())
+		go func() {
+			logger.Fatal(http.ListenAndServe(config.Metrics.Addr, nil))
+		}()
+		logger.Infof("Metrics on http://%v/metrics", config.Metrics.Addr)
+	}
 
 	var ipCountryDB *geoip2.Reader
-	var err error
+	if config.Metrics.IPCountryDB != "" {
+		logger.Infof("Using IP-Country database at %v", config.Metrics.IPCountryDB)
+		ipCountryDB, err = geoip2.Open(config.Metrics.IPCountryDB)
+		if err != nil {
+			logger.Fatalf("Could not open geoip database at %v: %v", config.Metrics.IPCountryDB, err)
+		}
+		defer ipCountryDB.Close()
+	}
 
-	api2 := api.New(&api.Config{APIHost: "https://aerodrome.onemelody.cn/", LogHost: "http://vice.mobileairport.net/", Key: "fe6fcd397f783b5548c918e6a026bb2d"})
+	api2 := api.New(&api.Config{
+		APIHost: config.API.Host,
+		LogHost: config.API.LogHost,
+		NodeID:  config.API.NodeID,
+		Key:     config.API.Key,
+	})
+	usersLocation := config.Users.Location
+	if config.Users.Source == "mysql" {
+		usersLocation = config.usersDSN()
+	}
+	users, err := api.NewUserSource(config.Users.Source, usersLocation, api2)
+	if err != nil {
+		logger.Fatalf("Invalid user source: %v", err)
+	}
 
-	//if flags.IPCountryDB != "" {
-	//	logger.Infof("Using IP-Country database at %v", flags.IPCountryDB)
-	//	ipCountryDB, err = geoip2.Open(flags.IPCountryDB)
-	//	if err != nil {
-	//		log.Fatalf("Could not open geoip database at %v: %v", flags.IPCountryDB, err)
-	//	}
-	//	defer ipCountryDB.Close()
-	//}
 	m := metrics.NewPrometheusShadowsocksMetrics(ipCountryDB, prometheus.DefaultRegisterer)
 	m.SetBuildInfo(version)
-	_, err = RunSSServer(defaultNatTimeout, m, 0, api2)
+	server, err := RunSSServer(config, m, api2, users)
 	if err != nil {
 		logger.Fatal(err)
 	}
+	if config.Admin.Listen != "" {
+		if err := server.StartAdmin(config.Admin.Listen, config.Admin.Token); err != nil {
+			logger.Fatal(err)
+		}
+	}
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	<-sigCh
+	// Keep the traffic that hasn't been spooled yet for the next run.
+	server.spoolTraffic()
+	server.spool.Close()
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"myoss/api"
+)
+
+// reload fetches the desired keys from the user source and applies them.
+// `trigger` names what caused the reload, for the logs and metrics.
+func (s *SSServer) reload(trigger string) error {
+	users, err := s.users.GetUsers()
+	if err != nil {
+		logger.Errorf("Reload (%v) failed to get users: %v", trigger, err)
+		s.m.AddReload(trigger, "ERR_SOURCE", 0, 0, 0, 0)
+		return err
+	}
+	s.mu.Lock()
+	s.sourceUsers = users
+	diff, err := s.applyLocked()
+	s.mu.Unlock()
+	s.reportReload(trigger, diff, err)
+	return err
+}
+
+// applyLocked applies the last keys from the user source, with the admin
+// overrides on top. s.mu must be held.
+func (s *SSServer) applyLocked() (keyDiff, error) {
+	users := s.sourceUsers
+	if users == nil {
+		users = &api.UserRets{}
+	}
+	return s.doRun(s.overrides.apply(users))
+}
+
+func (s *SSServer) reportReload(trigger string, diff keyDiff, err error) {
+	status := "OK"
+	if err != nil {
+		status = "ERR_APPLY"
+		logger.Errorf("Reload (%v) failed: %v", trigger, err)
+	}
+	if !diff.empty() || err != nil {
+		logger.Infof("Reload (%v): %d keys added, %d keys removed, %d ports added, %d ports removed",
+			trigger, diff.addedKeys, diff.removedKeys, diff.addedPorts, diff.removedPorts)
+	}
+	s.m.AddReload(trigger, status, diff.addedKeys, diff.removedKeys, diff.addedPorts, diff.removedPorts)
+}
+
+// keyOverrides are local changes layered over the keys from the user source,
+// so that they survive the next poll. Keys are identified by ID.
+type keyOverrides struct {
+	// Set holds keys that were added or whose secret was rotated.
+	Set map[string]api.Key `json:"set"`
+	// Removed holds the IDs of keys to drop from the source.
+	Removed map[string]bool `json:"removed"`
+}
+
+func (o *keyOverrides) empty() bool {
+	return len(o.Set) == 0 && len(o.Removed) == 0
+}
+
+func (o *keyOverrides) setKey(key api.Key) {
+	if o.Set == nil {
+		o.Set = make(map[string]api.Key)
+	}
+	o.Set[key.ID] = key
+	delete(o.Removed, key.ID)
+}
+
+func (o *keyOverrides) removeKey(id string) {
+	if o.Removed == nil {
+		o.Removed = make(map[string]bool)
+	}
+	o.Removed[id] = true
+	delete(o.Set, id)
+}
+
+// apply returns `users` with the overrides applied.
+func (o *keyOverrides) apply(users *api.UserRets) *api.UserRets {
+	if o.empty() {
+		return users
+	}
+	result := &api.UserRets{Data: make([]api.Key, 0, len(users.Data)+len(o.Set))}
+	for _, key := range users.Data {
+		if _, replaced := o.Set[key.ID]; replaced || o.Removed[key.ID] {
+			continue
+		}
+		result.Data = append(result.Data, key)
+	}
+	for _, key := range o.Set {
+		result.Data = append(result.Data, key)
+	}
+	return result
+}
+
+// watchUsers reloads the keys on SIGHUP, when `fileChanged` fires and, if
+// `pollInterval` is positive, periodically.
+func (s *SSServer) watchUsers(sigHup <-chan os.Signal, fileChanged <-chan struct{}, pollInterval time.Duration) {
+	var poll <-chan time.Time
+	if pollInterval > 0 {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	for {
+		select {
+		case <-sigHup:
+			logger.Info("Updating keys on SIGHUP")
+			s.reload("sighup")
+			if s.aclFile != "" {
+				s.reloadACL("sighup")
+			}
+		case <-fileChanged:
+			s.reload("file")
+		case <-poll:
+			s.reload("poll")
+		}
+	}
+}
+
+// watchFile polls the file at `path` every `interval`, and signals the returned
+// channel whenever its size or modification time changes.
+func watchFile(path string, interval time.Duration) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	stat := func() (time.Time, int64) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return info.ModTime(), info.Size()
+	}
+	lastMod, lastSize := stat()
+	go func() {
+		for range time.Tick(interval) {
+			mod, size := stat()
+			if mod.Equal(lastMod) && size == lastSize {
+				continue
+			}
+			lastMod, lastSize = mod, size
+			select {
+			case changed <- struct{}{}:
+			default:
+				// A reload is already pending.
+			}
+		}
+	}()
+	return changed
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"myoss/api"
+	"myoss/service"
+	"myoss/service/metrics"
+	"myoss/transport"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func freePort(t *testing.T) int {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func makeTestServer() *SSServer {
+	return &SSServer{
+		natTimeout:  time.Minute,
+		readTimeout: time.Second,
+		listen:      listenSettings{ips: []net.IP{net.ParseIP("127.0.0.1")}, family: "dual"},
+		m:           &metrics.NoOpMetrics{},
+		replayCache: service.NewReplayCache(0),
+		ports:       make(map[int]*ssPort),
+	}
+}
+
+func makeKey(id string, port int, secret string) api.Key {
+	return api.Key{ID: id, Port: port, Cipher: "chacha20-ietf-poly1305", Secret: secret}
+}
+
+func TestDoRunDiff(t *testing.T) {
+	s := makeTestServer()
+	defer s.Stop()
+	portA, portB := freePort(t), freePort(t)
+	keyA0 := makeKey("a0", portA, "secret-a0")
+	keyA1 := makeKey("a1", portA, "secret-a1")
+	keyB0 := makeKey("b0", portB, "secret-b0")
+
+	diff, err := s.doRun(&api.UserRets{Data: []api.Key{keyA0, keyA1}})
+	require.NoError(t, err)
+	require.Equal(t, keyDiff{addedKeys: 2, addedPorts: 1}, diff)
+	entryA0 := s.ports[portA].keys[keyA0]
+	require.NotNil(t, entryA0)
+
+	// Reapplying the same keys is a no-op.
+	diff, err = s.doRun(&api.UserRets{Data: []api.Key{keyA1, keyA0}})
+	require.NoError(t, err)
+	require.True(t, diff.empty())
+
+	// Rotating a secret replaces one key, and the untouched key keeps its entry.
+	keyA1.Secret = "rotated"
+	diff, err = s.doRun(&api.UserRets{Data: []api.Key{keyA0, keyA1, keyB0}})
+	require.NoError(t, err)
+	require.Equal(t, keyDiff{addedKeys: 2, removedKeys: 1, addedPorts: 1}, diff)
+	require.Same(t, entryA0, s.ports[portA].keys[keyA0])
+	require.Len(t, s.ports[portA].cipherList.SnapshotForClientIP(nil), 2)
+
+	diff, err = s.doRun(&api.UserRets{Data: []api.Key{keyB0}})
+	require.NoError(t, err)
+	require.Equal(t, keyDiff{removedKeys: 2, removedPorts: 1}, diff)
+	require.NotContains(t, s.ports, portA)
+}
+
+func TestDoRunBadKeyLeavesServerUnchanged(t *testing.T) {
+	s := makeTestServer()
+	defer s.Stop()
+	port := freePort(t)
+	key := makeKey("a0", port, "secret")
+	_, err := s.doRun(&api.UserRets{Data: []api.Key{key}})
+	require.NoError(t, err)
+
+	bad := api.Key{ID: "bad", Port: freePort(t), Cipher: "rc4", Secret: "secret"}
+	_, err = s.doRun(&api.UserRets{Data: []api.Key{bad}})
+	require.Error(t, err)
+	require.Len(t, s.ports, 1)
+	require.Contains(t, s.ports[port].keys, key)
+}
+
+func TestDoRunDuplicateIDs(t *testing.T) {
+	s := makeTestServer()
+	defer s.Stop()
+	port, otherPort := freePort(t), freePort(t)
+	key := makeKey("a0", port, "secret")
+	_, err := s.doRun(&api.UserRets{Data: []api.Key{key}})
+	require.NoError(t, err)
+
+	_, err = s.doRun(&api.UserRets{Data: []api.Key{key, makeKey("a0", otherPort, "other")}})
+	require.Error(t, err)
+	require.Len(t, s.ports, 1)
+	require.Contains(t, s.ports[port].keys, key)
+}
+
+func TestDoRunStreamCiphers(t *testing.T) {
+	s := makeTestServer()
+	defer s.Stop()
+	port := freePort(t)
+	stream := api.Key{ID: "stream", Port: port, Cipher: "aes-256-cfb", Secret: "secret"}
+
+	// Stream ciphers are rejected unless they are enabled.
+	_, err := s.doRun(&api.UserRets{Data: []api.Key{stream}})
+	require.Error(t, err)
+	require.Empty(t, s.ports)
+
+	s.allowStreamCiphers = true
+	_, err = s.doRun(&api.UserRets{Data: []api.Key{stream}})
+	require.NoError(t, err)
+	require.True(t, s.ports[port].keys[stream].Cipher.IsStream())
+
+	// A stream key must be the only key of its port.
+	_, err = s.doRun(&api.UserRets{Data: []api.Key{stream, makeKey("aead", port, "secret")}})
+	require.Error(t, err)
+	require.Len(t, s.ports[port].keys, 1)
+}
+
+func TestDoRunFallback(t *testing.T) {
+	decoy, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer decoy.Close()
+	go func() {
+		for {
+			conn, err := decoy.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("decoy"))
+			conn.Close()
+		}
+	}()
+
+	s := makeTestServer()
+	s.fallback = "127.0.0.1:1"
+	port, otherPort := freePort(t), freePort(t)
+	s.portFallbacks = map[int]string{port: decoy.Addr().String()}
+	_, err = s.doRun(&api.UserRets{Data: []api.Key{makeKey("a0", port, "secret"), makeKey("a1", otherPort, "secret")}})
+	require.NoError(t, err)
+	defer s.Stop()
+	require.Equal(t, "127.0.0.1:1", s.fallbackFor(otherPort))
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(make([]byte, 60))
+	require.NoError(t, err)
+	reply, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "decoy", string(reply))
+}
+
+func TestDoRunListen(t *testing.T) {
+	s := makeTestServer()
+	defer s.Stop()
+	port, hop, otherPort := freePort(t), freePort(t), freePort(t)
+	s.portListen = map[int]listenSettings{
+		port: {ips: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}, family: "dual", hops: []int{hop}},
+	}
+	_, err := s.doRun(&api.UserRets{Data: []api.Key{makeKey("a0", port, "secret"), makeKey("b0", otherPort, "secret")}})
+	require.NoError(t, err)
+	require.Len(t, s.ports[port].listeners, 4)
+	require.Len(t, s.ports[otherPort].listeners, 1)
+	for _, addr := range []string{"127.0.0.1", "::1"} {
+		for _, p := range []int{port, hop} {
+			conn, err := net.Dial("tcp", net.JoinHostPort(addr, fmt.Sprint(p)))
+			require.NoError(t, err)
+			conn.Close()
+		}
+	}
+
+	// The hops of a port can't have keys of their own.
+	_, err = s.doRun(&api.UserRets{Data: []api.Key{makeKey("a0", port, "secret"), makeKey("c0", hop, "secret")}})
+	require.Error(t, err)
+	require.Len(t, s.ports, 2)
+
+	// Removing the keys of a port closes all its listeners.
+	_, err = s.doRun(&api.UserRets{Data: []api.Key{makeKey("b0", otherPort, "secret")}})
+	require.NoError(t, err)
+	require.NotContains(t, s.ports, port)
+	_, err = net.Dial("tcp", net.JoinHostPort("::1", fmt.Sprint(hop)))
+	require.Error(t, err)
+}
+
+func TestListenFamily(t *testing.T) {
+	addr := listenAddr{family: "4", port: freePort(t)}
+	require.Equal(t, fmt.Sprintf("0.0.0.0:%d", addr.port), addr.String())
+	listener, err := addr.listenTCP()
+	require.NoError(t, err)
+	defer listener.Close()
+	require.NotNil(t, listener.Addr().(*net.TCPAddr).IP.To4())
+	packetConn, err := addr.listenUDP()
+	require.NoError(t, err)
+	defer packetConn.Close()
+	require.NotNil(t, packetConn.LocalAddr().(*net.UDPAddr).IP.To4())
+
+	addr = listenAddr{family: "6", ip: "::1", port: freePort(t), iface: "lo"}
+	require.Equal(t, fmt.Sprintf("[::1]:%d@lo", addr.port), addr.String())
+	listener, err = addr.listenTCP()
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("Binding to an interface needs CAP_NET_RAW")
+	}
+	require.NoError(t, err)
+	defer listener.Close()
+	conn, err := net.Dial("tcp", fmt.Sprintf("[::1]:%d", addr.port))
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestDoRunProxyProtocol(t *testing.T) {
+	s := makeTestServer()
+	defer s.Stop()
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s.proxyProtocol = &transport.ProxyProtocolOptions{Trusted: []*net.IPNet{loopback}}
+	s.bans = service.NewBanList(1, time.Minute, time.Hour, 100)
+	s.udpBans = service.NewBanList(1, time.Minute, time.Hour, 100)
+	port := freePort(t)
+	_, err := s.doRun(&api.UserRets{Data: []api.Key{makeKey("a0", port, "secret")}})
+	require.NoError(t, err)
+
+	// Clients that fail authentication through the balancer are banned, not
+	// the balancer.
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(append([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 5000 443\r\n"), make([]byte, 60)...))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return s.bans.Banned(net.ParseIP("192.0.2.1"), time.Now())
+	}, 2*time.Second, 10*time.Millisecond)
+	require.False(t, s.bans.Banned(net.ParseIP("127.0.0.1"), time.Now()))
+
+	packetConn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	defer packetConn.Close()
+	header := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x12\x00\x0c")
+	header = append(header, 192, 0, 2, 2, 127, 0, 0, 1, 0x13, 0x88, 0x01, 0xbb)
+	_, err = packetConn.Write(append(header, make([]byte, 60)...))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return s.udpBans.Banned(net.ParseIP("192.0.2.2"), time.Now())
+	}, 2*time.Second, 10*time.Millisecond)
+	require.False(t, s.udpBans.Banned(net.ParseIP("127.0.0.1"), time.Now()))
+	// UDP failures, which can be spoofed, don't ban the IP from TCP.
+	require.False(t, s.bans.Banned(net.ParseIP("192.0.2.2"), time.Now()))
+}
+
+func TestDoRunWebSocket(t *testing.T) {
+	s := makeTestServer()
+	s.webSocket = &transport.WebSocketOptions{StreamPath: "/ws", PacketPath: "/ws-udp"}
+	port := freePort(t)
+	_, err := s.doRun(&api.UserRets{Data: []api.Key{makeKey("a0", port, "secret")}})
+	require.NoError(t, err)
+	require.NotNil(t, s.ports[port].listeners[listenAddr{ip: "127.0.0.1", port: port}].packetService)
+
+	url := fmt.Sprintf("ws://127.0.0.1:%d", port)
+	for _, path := range []string{"/ws", "/ws-udp"} {
+		ws, _, err := websocket.DefaultDialer.Dial(url+path, nil)
+		require.NoError(t, err, path)
+		ws.Close()
+	}
+	_, resp, err := websocket.DefaultDialer.Dial(url+"/other", nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	require.NoError(t, s.Stop())
+	_, _, err = websocket.DefaultDialer.Dial(url+"/ws", nil)
+	require.Error(t, err)
+}
+
+func TestDoRunQuotaAndRates(t *testing.T) {
+	s := makeTestServer()
+	defer s.Stop()
+	key := makeKey("a0", freePort(t), "secret")
+	key.Quota = 1000
+	key.QuotaPeriod = "monthly"
+	key.QuotaUsed = 100
+	_, err := s.doRun(&api.UserRets{Data: []api.Key{key}})
+	require.NoError(t, err)
+	entry := s.ports[key.Port].keys[key]
+	limit, used := entry.QuotaUsage()
+	require.Equal(t, int64(1000), limit)
+	require.Equal(t, int64(100), used)
+
+	// A quota or rate change keeps the entry and its usage.
+	key.Quota = 2000
+	key.QuotaUsed = 50
+	key.DownloadRate = 4096
+	diff, err := s.doRun(&api.UserRets{Data: []api.Key{key}})
+	require.NoError(t, err)
+	require.True(t, diff.empty())
+	require.Same(t, entry, s.ports[key.Port].keys[key])
+	limit, used = entry.QuotaUsage()
+	require.Equal(t, int64(2000), limit)
+	require.Equal(t, int64(100), used)
+	upload, download := entry.RateLimit()
+	require.Equal(t, int64(0), upload)
+	require.Equal(t, int64(4096), download)
+
+	key.MaxConnections = 8
+	key.MaxDevices = 2
+	_, err = s.doRun(&api.UserRets{Data: []api.Key{key}})
+	require.NoError(t, err)
+	require.Same(t, entry, s.ports[key.Port].keys[key])
+	maxTCP, maxUDP, maxDevices := entry.ConnectionLimits()
+	require.Equal(t, 8, maxTCP)
+	require.Equal(t, 0, maxUDP)
+	require.Equal(t, 2, maxDevices)
+
+	key.QuotaPeriod = "yearly"
+	_, err = s.doRun(&api.UserRets{Data: []api.Key{key}})
+	require.Error(t, err)
+}
+
+type fakeUserSource struct {
+	users *api.UserRets
+}
+
+func (f *fakeUserSource) GetUsers() (*api.UserRets, error) {
+	return f.users, nil
+}
+
+func TestWatchFile(t *testing.T) {
+	path := writeConfig(t, "a")
+	changed := watchFile(path, 10*time.Millisecond)
+	select {
+	case <-changed:
+		t.Fatal("Unexpected change")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, os.WriteFile(path, []byte("ab"), 0600))
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("Change was not detected")
+	}
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	s := makeTestServer()
+	defer s.Stop()
+	port := freePort(t)
+	source := &fakeUserSource{users: &api.UserRets{}}
+	s.users = source
+	require.NoError(t, s.reload("startup"))
+	require.Empty(t, s.ports)
+
+	sigHup := make(chan os.Signal, 1)
+	go s.watchUsers(sigHup, nil, 0)
+	source.users = &api.UserRets{Data: []api.Key{makeKey("a0", port, "secret")}}
+	sigHup <- syscall.SIGHUP
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.ports) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestReloadACL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.toml")
+	require.NoError(t, os.WriteFile(path, []byte("[[rule]]\nid = \"smtp\"\naction = \"deny\"\nports = [\"25\"]\n"), 0600))
+	s := makeTestServer()
+	s.aclFile = path
+	s.acl, _ = service.NewACL(nil)
+	require.NoError(t, s.reloadACL("test"))
+	require.NotNil(t, s.acl.Check(nil, "192.0.2.1", nil, 25))
+
+	// Bad rules leave the current ones in place.
+	require.NoError(t, os.WriteFile(path, []byte("[[rule]]\nid = \"smtp\"\naction = \"block\"\nports = [\"25\"]\n"), 0600))
+	require.Error(t, s.reloadACL("test"))
+	require.NotNil(t, s.acl.Check(nil, "192.0.2.1", nil, 25))
+
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+	require.NoError(t, s.reloadACL("test"))
+	require.Nil(t, s.acl.Check(nil, "192.0.2.1", nil, 25))
+}
@@ -0,0 +1,399 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Address preferences of a Resolver.
+const (
+	PreferIPv4 = "ipv4"
+	PreferIPv6 = "ipv6"
+	OnlyIPv4   = "ipv4_only"
+	OnlyIPv6   = "ipv6_only"
+)
+
+// maxCacheTTL bounds how long an answer is cached, whatever its TTL.
+const maxCacheTTL = time.Hour
+
+// Metrics records the queries of a Resolver.
+type Metrics interface {
+	// AddDNSQuery records a query answered with `result` after `duration`, by
+	// `upstream` or by the cache if it's "cache".
+	AddDNSQuery(upstream, result string, duration time.Duration)
+}
+
+// Config describes a Resolver.
+type Config struct {
+	// Upstreams are tried in order until one answers. See NewUpstream.
+	Upstreams []string
+	// Prefer orders the addresses of a name: PreferIPv4 or PreferIPv6 put
+	// that family first, OnlyIPv4 and OnlyIPv6 drop the other one. Empty
+	// means PreferIPv4.
+	Prefer string
+	// Timeout bounds a lookup, across all upstreams.
+	Timeout time.Duration
+	// CacheSize is the number of answers kept until their TTL expires. 0
+	// disables the cache.
+	CacheSize int
+}
+
+// Resolver resolves the names of proxy targets with its own upstreams and
+// cache, instead of the system resolver.
+type Resolver struct {
+	upstreams []Upstream
+	types     []dnsmessage.Type
+	timeout   time.Duration
+	cache     *cache
+	metrics   Metrics
+}
+
+// NewResolver creates the resolver described by `config`, that reports its
+// queries to `metrics`.
+func NewResolver(config Config, metrics Metrics) (*Resolver, error) {
+	if len(config.Upstreams) == 0 {
+		return nil, errors.New("no upstreams")
+	}
+	if config.Timeout <= 0 {
+		return nil, errors.New("timeout must be positive")
+	}
+	if config.CacheSize < 0 {
+		return nil, errors.New("cache size must not be negative")
+	}
+	r := &Resolver{timeout: config.Timeout, metrics: metrics}
+	for _, spec := range config.Upstreams {
+		upstream, err := NewUpstream(spec)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, upstream)
+	}
+	switch config.Prefer {
+	case "", PreferIPv4:
+		r.types = []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	case PreferIPv6:
+		r.types = []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA}
+	case OnlyIPv4:
+		r.types = []dnsmessage.Type{dnsmessage.TypeA}
+	case OnlyIPv6:
+		r.types = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	default:
+		return nil, fmt.Errorf("unknown preference %q", config.Prefer)
+	}
+	if config.CacheSize > 0 {
+		r.cache = newCache(config.CacheSize)
+	}
+	return r, nil
+}
+
+// LookupIP returns the addresses of `host`, in order of preference. IP
+// literals are returned as they are. Errors are *net.DNSError.
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	fqdn := strings.ToLower(host)
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	name, err := dnsmessage.NewName(fqdn)
+	if err != nil || len(host) == 0 {
+		return nil, &net.DNSError{Err: "invalid name", Name: host}
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	ips := make([][]net.IP, len(r.types))
+	errs := make([]error, len(r.types))
+	var wg sync.WaitGroup
+	for i, qtype := range r.types {
+		wg.Add(1)
+		go func(i int, qtype dnsmessage.Type) {
+			defer wg.Done()
+			ips[i], errs[i] = r.lookup(ctx, name, qtype)
+		}(i, qtype)
+	}
+	wg.Wait()
+	var all []net.IP
+	for _, familyIPs := range ips {
+		all = append(all, familyIPs...)
+	}
+	if len(all) > 0 {
+		return all, nil
+	}
+	for _, err := range errs {
+		if err != nil {
+			err.(*net.DNSError).Name = host
+			return nil, err
+		}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// lookup returns the addresses of type `qtype` of `name`, from the cache or
+// the first upstream that answers. A name without such addresses has none
+// and no error.
+func (r *Resolver) lookup(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) ([]net.IP, error) {
+	key := cacheKey{name.String(), qtype}
+	if ips, ok := r.cache.get(key); ok {
+		r.addQuery("cache", resultOf(ips), 0)
+		return ips, nil
+	}
+	query, err := newQuery(name, qtype)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error()}
+	}
+	var lastErr *net.DNSError
+	for _, upstream := range r.upstreams {
+		start := time.Now()
+		resp, err := upstream.Exchange(ctx, query)
+		if err != nil {
+			timeout := ctx.Err() != nil || isTimeout(err)
+			lastErr = &net.DNSError{Err: err.Error(), Server: upstream.String(), IsTimeout: timeout}
+			if timeout {
+				r.addQuery(upstream.String(), "ERR_TIMEOUT", time.Since(start))
+			} else {
+				r.addQuery(upstream.String(), "ERR_UPSTREAM", time.Since(start))
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		ips, ttl, err := parseResponse(resp, name, qtype)
+		if err != nil {
+			lastErr = &net.DNSError{Err: err.Error(), Server: upstream.String()}
+			r.addQuery(upstream.String(), "ERR_RESPONSE", time.Since(start))
+			continue
+		}
+		r.addQuery(upstream.String(), resultOf(ips), time.Since(start))
+		r.cache.put(key, ips, ttl)
+		return ips, nil
+	}
+	return nil, lastErr
+}
+
+func (r *Resolver) addQuery(upstream, result string, duration time.Duration) {
+	if r.metrics != nil {
+		r.metrics.AddDNSQuery(upstream, result, duration)
+	}
+}
+
+func resultOf(ips []net.IP) string {
+	if len(ips) == 0 {
+		return "NOT_FOUND"
+	}
+	return "OK"
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func newQuery(name dnsmessage.Name, qtype dnsmessage.Type) ([]byte, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{
+		ID:               uint16(id[0])<<8 | uint16(id[1]),
+		RecursionDesired: true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	// Advertise a payload size that avoids IP fragmentation.
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// parseResponse returns the addresses in `resp`, the response to the query
+// for `qtype` of `name`, and how long they may be cached. Names that don't
+// exist, or have no such address, have none.
+func parseResponse(resp []byte, name dnsmessage.Name, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	if header.RCode != dnsmessage.RCodeSuccess && header.RCode != dnsmessage.RCodeNameError {
+		return nil, 0, fmt.Errorf("server returned %v", header.RCode)
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(questions) != 1 || questions[0].Type != qtype || !strings.EqualFold(questions[0].Name.String(), name.String()) {
+		return nil, 0, errors.New("response to another question")
+	}
+	var ips []net.IP
+	var ttl uint32
+	minTTL := func(t uint32) {
+		if len(ips) == 0 || t < ttl {
+			ttl = t
+		}
+	}
+	if header.RCode == dnsmessage.RCodeSuccess {
+		for {
+			h, err := p.AnswerHeader()
+			if err == dnsmessage.ErrSectionDone {
+				break
+			} else if err != nil {
+				return nil, 0, err
+			}
+			switch {
+			case h.Type == dnsmessage.TypeA && qtype == dnsmessage.TypeA:
+				a, err := p.AResource()
+				if err != nil {
+					return nil, 0, err
+				}
+				minTTL(h.TTL)
+				ips = append(ips, net.IP(a.A[:]))
+			case h.Type == dnsmessage.TypeAAAA && qtype == dnsmessage.TypeAAAA:
+				aaaa, err := p.AAAAResource()
+				if err != nil {
+					return nil, 0, err
+				}
+				minTTL(h.TTL)
+				ips = append(ips, net.IP(aaaa.AAAA[:]))
+			default:
+				if err := p.SkipAnswer(); err != nil {
+					return nil, 0, err
+				}
+			}
+		}
+		if len(ips) > 0 {
+			return ips, time.Duration(ttl) * time.Second, nil
+		}
+	} else if err := p.SkipAllAnswers(); err != nil {
+		return nil, 0, err
+	}
+	// Negative answers are cached for the TTL of the SOA record of the zone,
+	// as in RFC 2308, or not at all without it.
+	for {
+		h, err := p.AuthorityHeader()
+		if err == dnsmessage.ErrSectionDone {
+			return nil, 0, nil
+		} else if err != nil {
+			return nil, 0, err
+		}
+		if h.Type != dnsmessage.TypeSOA {
+			if err := p.SkipAuthority(); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		soa, err := p.SOAResource()
+		if err != nil {
+			return nil, 0, err
+		}
+		ttl = h.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		return nil, time.Duration(ttl) * time.Second, nil
+	}
+}
+
+type cacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+}
+
+type cacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// cache keeps the answers of a Resolver until their TTL expires. When it's
+// full, expired answers are dropped, or a random one if there are none.
+// A nil cache keeps nothing.
+type cache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[cacheKey]cacheEntry
+	now     func() time.Time
+}
+
+func newCache(size int) *cache {
+	return &cache{size: size, entries: make(map[cacheKey]cacheEntry), now: time.Now}
+}
+
+func (c *cache) get(key cacheKey) ([]net.IP, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.ips, true
+}
+
+func (c *cache) put(key cacheKey, ips []net.IP, ttl time.Duration) {
+	if c == nil || ttl <= 0 {
+		return
+	}
+	if ttl > maxCacheTTL {
+		ttl = maxCacheTTL
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{ips: ips, expires: now.Add(ttl)}
+}
@@ -0,0 +1,399 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubServer answers DNS queries from its records.
+type stubServer struct {
+	mu sync.Mutex
+	// records holds the addresses of each name, like "example.com.".
+	records map[string][]net.IP
+	ttl     uint32
+	// truncate makes the answers over UDP truncated.
+	truncate bool
+	queries  int
+}
+
+func newStubServer() *stubServer {
+	return &stubServer{
+		records: map[string][]net.IP{
+			"example.com.": {net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+			"v4.test.":     {net.ParseIP("192.0.2.2")},
+		},
+		ttl: 60,
+	}
+}
+
+func (s *stubServer) answer(t *testing.T, query []byte, udp bool) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	require.NoError(t, err)
+	q, err := p.Question()
+	require.NoError(t, err)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries++
+	header.Response = true
+	ips, ok := s.records[q.Name.String()]
+	if !ok {
+		header.RCode = dnsmessage.RCodeNameError
+	}
+	if udp && s.truncate {
+		header.Truncated = true
+		ips = nil
+	}
+	b := dnsmessage.NewBuilder(nil, header)
+	require.NoError(t, b.StartQuestions())
+	require.NoError(t, b.Question(q))
+	require.NoError(t, b.StartAnswers())
+	for _, ip := range ips {
+		h := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: s.ttl}
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			var a dnsmessage.AResource
+			copy(a.A[:], ip4)
+			require.NoError(t, b.AResource(h, a))
+		} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip)
+			require.NoError(t, b.AAAAResource(h, aaaa))
+		}
+	}
+	if !ok {
+		require.NoError(t, b.StartAuthorities())
+		soa := dnsmessage.SOAResource{NS: q.Name, MBox: q.Name, MinTTL: 5}
+		require.NoError(t, b.SOAResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 10}, soa))
+	}
+	resp, err := b.Finish()
+	require.NoError(t, err)
+	return resp
+}
+
+func (s *stubServer) queryCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries
+}
+
+// serveUDP serves plain DNS over UDP and TCP on the same port.
+func (s *stubServer) serveUDP(t *testing.T) string {
+	// The port the OS picks for TCP may be taken for UDP, so try a few.
+	var ln net.Listener
+	var pc net.PacketConn
+	for attempt := 0; pc == nil; attempt++ {
+		var err error
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		pc, err = net.ListenPacket("udp", ln.Addr().String())
+		if err != nil {
+			ln.Close()
+			require.Less(t, attempt, 10, "no free UDP port: %v", err)
+		}
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(s.answer(t, buf[:n], true), addr)
+		}
+	}()
+	s.serveStream(t, ln)
+	return pc.LocalAddr().String()
+}
+
+func (s *stubServer) serveStream(t *testing.T, ln net.Listener) {
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				resp := s.answer(t, query, false)
+				binary.BigEndian.PutUint16(length[:], uint16(len(resp)))
+				conn.Write(append(length[:], resp...))
+			}()
+		}
+	}()
+}
+
+type queryRecord struct {
+	upstream, result string
+}
+
+type testMetrics struct {
+	mu      sync.Mutex
+	queries []queryRecord
+}
+
+func (m *testMetrics) AddDNSQuery(upstream, result string, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queries = append(m.queries, queryRecord{upstream, result})
+}
+
+func (m *testMetrics) results() []queryRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]queryRecord(nil), m.queries...)
+}
+
+func newTestResolver(t *testing.T, config Config, metrics Metrics) *Resolver {
+	if config.Timeout == 0 {
+		config.Timeout = 2 * time.Second
+	}
+	r, err := NewResolver(config, metrics)
+	require.NoError(t, err)
+	return r
+}
+
+func TestResolverUDP(t *testing.T) {
+	stub := newStubServer()
+	addr := stub.serveUDP(t)
+	metrics := &testMetrics{}
+	r := newTestResolver(t, Config{Upstreams: []string{addr}, CacheSize: 10}, metrics)
+
+	ips, err := r.LookupIP(context.Background(), "Example.com")
+	require.NoError(t, err)
+	require.Equal(t, "[192.0.2.1 2001:db8::1]", fmt.Sprint(ips))
+	require.Equal(t, 2, stub.queryCount())
+
+	// The answers are cached.
+	ips, err = r.LookupIP(context.Background(), "example.com.")
+	require.NoError(t, err)
+	require.Equal(t, "[192.0.2.1 2001:db8::1]", fmt.Sprint(ips))
+	require.Equal(t, 2, stub.queryCount())
+	require.ElementsMatch(t, []queryRecord{
+		{"udp://" + addr, "OK"}, {"udp://" + addr, "OK"}, {"cache", "OK"}, {"cache", "OK"},
+	}, metrics.results())
+
+	_, err = r.LookupIP(context.Background(), "missing.test")
+	var dnsErr *net.DNSError
+	require.ErrorAs(t, err, &dnsErr)
+	require.True(t, dnsErr.IsNotFound)
+	require.Equal(t, "missing.test", dnsErr.Name)
+
+	ips, err = r.LookupIP(context.Background(), "192.0.2.9")
+	require.NoError(t, err)
+	require.Equal(t, "[192.0.2.9]", fmt.Sprint(ips))
+}
+
+func TestResolverTruncated(t *testing.T) {
+	stub := newStubServer()
+	stub.truncate = true
+	addr := stub.serveUDP(t)
+	r := newTestResolver(t, Config{Upstreams: []string{"udp://" + addr}, Prefer: OnlyIPv4}, nil)
+
+	ips, err := r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	require.Equal(t, "[192.0.2.1]", fmt.Sprint(ips))
+	// The truncated answer was retried over TCP.
+	require.Equal(t, 2, stub.queryCount())
+}
+
+func TestResolverPreference(t *testing.T) {
+	stub := newStubServer()
+	addr := stub.serveUDP(t)
+	for prefer, want := range map[string]string{
+		PreferIPv4: "[192.0.2.1 2001:db8::1]",
+		PreferIPv6: "[2001:db8::1 192.0.2.1]",
+		OnlyIPv4:   "[192.0.2.1]",
+		OnlyIPv6:   "[2001:db8::1]",
+	} {
+		r := newTestResolver(t, Config{Upstreams: []string{addr}, Prefer: prefer}, nil)
+		ips, err := r.LookupIP(context.Background(), "example.com")
+		require.NoError(t, err, prefer)
+		require.Equal(t, want, fmt.Sprint(ips), prefer)
+	}
+
+	r := newTestResolver(t, Config{Upstreams: []string{addr}, Prefer: OnlyIPv6}, nil)
+	_, err := r.LookupIP(context.Background(), "v4.test")
+	var dnsErr *net.DNSError
+	require.ErrorAs(t, err, &dnsErr)
+	require.True(t, dnsErr.IsNotFound)
+}
+
+func TestResolverCacheTTL(t *testing.T) {
+	stub := newStubServer()
+	addr := stub.serveUDP(t)
+	r := newTestResolver(t, Config{Upstreams: []string{addr}, Prefer: OnlyIPv4, CacheSize: 1}, nil)
+	now := time.Now()
+	r.cache.now = func() time.Time { return now }
+
+	_, err := r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	now = now.Add(59 * time.Second)
+	_, err = r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	require.Equal(t, 1, stub.queryCount())
+
+	now = now.Add(time.Second)
+	_, err = r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	require.Equal(t, 2, stub.queryCount())
+
+	// The cache holds a single answer.
+	_, err = r.LookupIP(context.Background(), "v4.test")
+	require.NoError(t, err)
+	_, err = r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	require.Equal(t, 4, stub.queryCount())
+
+	// Negative answers are cached for the SOA minimum.
+	_, err = r.LookupIP(context.Background(), "missing.test")
+	require.Error(t, err)
+	now = now.Add(4 * time.Second)
+	_, err = r.LookupIP(context.Background(), "missing.test")
+	require.Error(t, err)
+	require.Equal(t, 5, stub.queryCount())
+	now = now.Add(time.Second)
+	_, err = r.LookupIP(context.Background(), "missing.test")
+	require.Error(t, err)
+	require.Equal(t, 6, stub.queryCount())
+}
+
+func TestResolverFailover(t *testing.T) {
+	// Nothing answers on the first upstream.
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer dead.Close()
+	stub := newStubServer()
+	addr := stub.serveUDP(t)
+	metrics := &testMetrics{}
+	r := newTestResolver(t, Config{Upstreams: []string{dead.LocalAddr().String(), addr}, Prefer: OnlyIPv4, Timeout: time.Second}, metrics)
+	r.upstreams[0] = &timeoutUpstream{r.upstreams[0], 100 * time.Millisecond}
+
+	ips, err := r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	require.Equal(t, "[192.0.2.1]", fmt.Sprint(ips))
+	require.Equal(t, []queryRecord{
+		{"udp://" + dead.LocalAddr().String(), "ERR_TIMEOUT"}, {"udp://" + addr, "OK"},
+	}, metrics.results())
+
+	// Without a working upstream the lookup times out.
+	r = newTestResolver(t, Config{Upstreams: []string{dead.LocalAddr().String()}, Timeout: 100 * time.Millisecond}, nil)
+	_, err = r.LookupIP(context.Background(), "example.com")
+	var dnsErr *net.DNSError
+	require.ErrorAs(t, err, &dnsErr)
+	require.True(t, dnsErr.IsTimeout)
+}
+
+// timeoutUpstream gives up on its upstream after a timeout.
+type timeoutUpstream struct {
+	Upstream
+	timeout time.Duration
+}
+
+func (u *timeoutUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+	return u.Upstream.Exchange(ctx, msg)
+}
+
+func TestResolverTLS(t *testing.T) {
+	// Borrow the certificate of an HTTPS test server.
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	stub := newStubServer()
+	stub.serveStream(t, tls.NewListener(ln, server.TLS))
+
+	r := newTestResolver(t, Config{Upstreams: []string{"tls://" + ln.Addr().String()}, Prefer: OnlyIPv4}, nil)
+	upstream := r.upstreams[0].(*tlsUpstream)
+	require.Equal(t, "127.0.0.1", upstream.config.ServerName)
+	upstream.config.RootCAs = server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	ips, err := r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	require.Equal(t, "[192.0.2.1]", fmt.Sprint(ips))
+}
+
+func TestResolverHTTPS(t *testing.T) {
+	stub := newStubServer()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(req.Body)
+		if query[0] != 0 || query[1] != 0 {
+			http.Error(w, "nonzero ID", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(stub.answer(t, query, false))
+	}))
+	defer server.Close()
+
+	r := newTestResolver(t, Config{Upstreams: []string{server.URL + "/dns-query"}}, nil)
+	r.upstreams[0].(*httpsUpstream).client = server.Client()
+
+	ips, err := r.LookupIP(context.Background(), "example.com")
+	require.NoError(t, err)
+	require.Equal(t, "[192.0.2.1 2001:db8::1]", fmt.Sprint(ips))
+}
+
+func TestNewResolver(t *testing.T) {
+	for _, config := range []Config{
+		{Timeout: time.Second},
+		{Upstreams: []string{"1.1.1.1"}},
+		{Upstreams: []string{"quic://1.1.1.1"}, Timeout: time.Second},
+		{Upstreams: []string{"https:///dns-query"}, Timeout: time.Second},
+		{Upstreams: []string{"1.1.1.1"}, Timeout: time.Second, Prefer: "ipv5"},
+		{Upstreams: []string{"1.1.1.1"}, Timeout: time.Second, CacheSize: -1},
+	} {
+		_, err := NewResolver(config, nil)
+		require.Error(t, err, config)
+	}
+
+	r, err := NewResolver(Config{Upstreams: []string{"1.1.1.1", "udp://[2606:4700::1111]", "tls://dns.google", "https://dns.google/dns-query"}, Timeout: time.Second}, nil)
+	require.NoError(t, err)
+	var names []string
+	for _, upstream := range r.upstreams {
+		names = append(names, upstream.String())
+	}
+	require.Equal(t, []string{"udp://1.1.1.1:53", "udp://[2606:4700::1111]:53", "tls://dns.google:853", "https://dns.google/dns-query"}, names)
+}
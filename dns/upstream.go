@@ -0,0 +1,229 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxMessageSize is the largest DNS message, as limited by the TCP framing.
+const maxMessageSize = 65535
+
+// Upstream is a DNS server that resolves queries.
+type Upstream interface {
+	// Exchange sends the DNS query `msg` and returns the response.
+	Exchange(ctx context.Context, msg []byte) ([]byte, error)
+	// String names the upstream in logs and metrics.
+	String() string
+}
+
+// NewUpstream returns the upstream described by `spec`:
+//   - "udp://host[:port]", or just "host[:port]": plain DNS, retried over TCP
+//     if the response is truncated. The port defaults to 53.
+//   - "tls://host[:port]": DNS over TLS. The port defaults to 853.
+//   - "https://host[:port]/path": DNS over HTTPS, with POST requests.
+//
+// Host names in `spec` are resolved by the system resolver.
+func NewUpstream(spec string) (Upstream, error) {
+	if !strings.Contains(spec, "://") {
+		spec = "udp://" + spec
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("upstream %q has no host", spec)
+	}
+	switch u.Scheme {
+	case "udp":
+		return &udpUpstream{addr: withDefaultPort(u.Host, "53")}, nil
+	case "tls":
+		addr := withDefaultPort(u.Host, "853")
+		return &tlsUpstream{addr: addr, config: &tls.Config{
+			ServerName:         u.Hostname(),
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		}}, nil
+	case "https":
+		return &httpsUpstream{url: u.String(), client: &http.Client{
+			Transport: &http.Transport{ForceAttemptHTTP2: true},
+		}}, nil
+	default:
+		return nil, fmt.Errorf("upstream %q: unknown scheme %q, want udp, tls or https", spec, u.Scheme)
+	}
+}
+
+func withDefaultPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// checkResponse checks that `resp` answers the query `msg`, by ID and question.
+func checkResponse(msg, resp []byte) error {
+	if len(resp) < 12 {
+		return errors.New("response too short")
+	}
+	if resp[2]&0x80 == 0 {
+		return errors.New("not a response")
+	}
+	if !bytes.Equal(msg[:2], resp[:2]) {
+		return errors.New("response ID mismatch")
+	}
+	return nil
+}
+
+func isTruncated(resp []byte) bool {
+	return resp[2]&0x02 != 0
+}
+
+type udpUpstream struct {
+	addr string
+}
+
+func (u *udpUpstream) String() string {
+	return "udp://" + u.addr
+}
+
+func (u *udpUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Skip stray and spoofed packets.
+		if checkResponse(msg, buf[:n]) != nil {
+			continue
+		}
+		if isTruncated(buf[:n]) {
+			return exchangeStream(ctx, &dialer, "tcp", u.addr, msg)
+		}
+		return buf[:n], nil
+	}
+}
+
+type streamDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// exchangeStream sends `msg` over a new stream connection, with the length
+// prefixes of RFC 1035 section 4.2.2.
+func exchangeStream(ctx context.Context, dialer streamDialer, network, addr string, msg []byte) ([]byte, error) {
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	framed := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	copy(framed[2:], msg)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	if err := checkResponse(msg, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+type tlsUpstream struct {
+	addr   string
+	config *tls.Config
+}
+
+func (u *tlsUpstream) String() string {
+	return "tls://" + u.addr
+}
+
+func (u *tlsUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	return exchangeStream(ctx, &tls.Dialer{Config: u.config}, "tcp", u.addr, msg)
+}
+
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) String() string {
+	return u.url
+}
+
+// Exchange sends `msg` as in RFC 8484, with the ID set to 0 so that HTTP
+// caches can share responses.
+func (u *httpsUpstream) Exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	query := append([]byte{0, 0}, msg[2:]...)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %v", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxMessageSize {
+		return nil, errors.New("response too long")
+	}
+	if err := checkResponse(query, body); err != nil {
+		return nil, err
+	}
+	// Restore the ID of the query.
+	copy(body, msg[:2])
+	return body, nil
+}
@@ -32,6 +32,10 @@ type DuplexConn interface {
 	CloseWrite() error
 }
 
+// StreamTransport removes a transport layer, such as an obfuscation, from an
+// accepted connection, and returns the connection that carries the payload.
+type StreamTransport func(conn DuplexConn) (DuplexConn, error)
+
 // StreamEndpoint represents an endpoint that can be used to established stream connections (like TCP)
 type StreamEndpoint interface {
 	// Connect establishes a connection with the endpoint, returning the connection.
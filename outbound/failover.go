@@ -0,0 +1,186 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	onet "myoss/net"
+)
+
+type member struct {
+	Outbound
+	healthy atomic.Bool
+}
+
+// Failover relays through the first of its upstreams that is healthy, and
+// fails over to the next ones when it can't connect. Upstreams start
+// healthy, turn unhealthy when they fail, and healthy again when a health
+// check or a connection through them succeeds. If all of them are unhealthy,
+// they are all tried anyway.
+type Failover struct {
+	name    string
+	members []*member
+}
+
+// NewFailover creates the outbound `name` with `upstreams`, in order of
+// preference.
+func NewFailover(name string, upstreams []Outbound) (*Failover, error) {
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("outbound %v has no upstreams", name)
+	}
+	f := &Failover{name: name}
+	for _, upstream := range upstreams {
+		m := &member{Outbound: upstream}
+		m.healthy.Store(true)
+		f.members = append(f.members, m)
+	}
+	return f, nil
+}
+
+func (f *Failover) String() string {
+	return f.name
+}
+
+// ordered returns the healthy members, then the unhealthy ones.
+func (f *Failover) ordered() []*member {
+	ordered := make([]*member, 0, len(f.members))
+	for _, m := range f.members {
+		if m.healthy.Load() {
+			ordered = append(ordered, m)
+		}
+	}
+	for _, m := range f.members {
+		if !m.healthy.Load() {
+			ordered = append(ordered, m)
+		}
+	}
+	return ordered
+}
+
+// setHealthy records the health of `m`, and logs changes.
+func (f *Failover) setHealthy(m *member, healthy bool, err error) {
+	if m.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		logger.Infof("Outbound %v: upstream %v is healthy again", f.name, m)
+	} else {
+		logger.Warningf("Outbound %v: upstream %v failed: %v", f.name, m, err)
+	}
+}
+
+// failed reports whether `err` is a failure of the upstream, rather than of
+// the target or of the context.
+func failed(ctx context.Context, err error) bool {
+	var targetErr *TargetError
+	return ctx.Err() == nil && !errors.As(err, &targetErr)
+}
+
+// memberTimeout is how long an upstream may take to connect, when `left`
+// upstreams remain to be tried: at most handshakeTimeout, and a fair share of
+// the time left before the deadline of `ctx`, so that a blackholed upstream
+// can't use up the time of the others.
+func memberTimeout(ctx context.Context, left int) time.Duration {
+	timeout := handshakeTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if share := time.Until(deadline) / time.Duration(left); share < timeout {
+			timeout = share
+		}
+	}
+	return timeout
+}
+
+func (f *Failover) Dial(ctx context.Context, raddr string) (onet.DuplexConn, error) {
+	var errs []string
+	ordered := f.ordered()
+	for i, m := range ordered {
+		memberCtx, cancel := context.WithTimeout(ctx, memberTimeout(ctx, len(ordered)-i))
+		conn, err := m.Dial(memberCtx, raddr)
+		cancel()
+		if err == nil {
+			f.setHealthy(m, true, nil)
+			return conn, nil
+		}
+		if !failed(ctx, err) {
+			return nil, err
+		}
+		f.setHealthy(m, false, err)
+		errs = append(errs, fmt.Sprintf("%v: %v", m, err))
+	}
+	return nil, fmt.Errorf("all upstreams failed: %v", strings.Join(errs, "; "))
+}
+
+func (f *Failover) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	var errs []string
+	ordered := f.ordered()
+	for i, m := range ordered {
+		memberCtx, cancel := context.WithTimeout(ctx, memberTimeout(ctx, len(ordered)-i))
+		pc, err := m.ListenPacket(memberCtx)
+		cancel()
+		if err == nil {
+			return pc, nil
+		}
+		if errors.Is(err, ErrUDPUnsupported) {
+			continue
+		}
+		if !failed(ctx, err) {
+			return nil, err
+		}
+		f.setHealthy(m, false, err)
+		errs = append(errs, fmt.Sprintf("%v: %v", m, err))
+	}
+	if len(errs) == 0 {
+		return nil, ErrUDPUnsupported
+	}
+	return nil, fmt.Errorf("all upstreams failed: %v", strings.Join(errs, "; "))
+}
+
+// CheckHealth connects to `target` through every upstream each `interval`,
+// and records which ones succeed, until `ctx` is done. Checks time out
+// after `interval`, or 10 seconds if that's shorter.
+func (f *Failover) CheckHealth(ctx context.Context, target string, interval time.Duration) {
+	timeout := interval
+	if timeout > handshakeTimeout {
+		timeout = handshakeTimeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, m := range f.members {
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			conn, err := m.Dial(checkCtx, target)
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+			if err == nil {
+				conn.Close()
+			}
+			f.setHealthy(m, err == nil, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
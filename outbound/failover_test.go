@@ -0,0 +1,155 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package outbound
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	onet "myoss/net"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeOutbound fails with its err, if it's set. If it hangs, it fails when
+// the context is done, like a blackholed upstream.
+type fakeOutbound struct {
+	name string
+	mu   sync.Mutex
+	err  error
+	udp  bool
+	hang bool
+}
+
+func (o *fakeOutbound) String() string {
+	return o.name
+}
+
+func (o *fakeOutbound) setErr(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.err = err
+}
+
+func (o *fakeOutbound) Dial(ctx context.Context, raddr string) (onet.DuplexConn, error) {
+	if o.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.err != nil {
+		return nil, o.err
+	}
+	left, right := net.Pipe()
+	right.Close()
+	return &pipeConn{Conn: left, name: o.name}, nil
+}
+
+func (o *fakeOutbound) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if !o.udp {
+		return nil, ErrUDPUnsupported
+	}
+	return net.ListenPacket("udp", "127.0.0.1:0")
+}
+
+// pipeConn names the outbound it came from.
+type pipeConn struct {
+	net.Conn
+	name string
+}
+
+func (c *pipeConn) CloseRead() error  { return nil }
+func (c *pipeConn) CloseWrite() error { return nil }
+
+func dialedThrough(t *testing.T, f *Failover) string {
+	conn, err := f.Dial(context.Background(), "192.0.2.1:80")
+	require.NoError(t, err)
+	conn.Close()
+	return conn.(*pipeConn).name
+}
+
+func TestFailover(t *testing.T) {
+	first, second := &fakeOutbound{name: "first"}, &fakeOutbound{name: "second", udp: true}
+	f, err := NewFailover("exit", []Outbound{first, second})
+	require.NoError(t, err)
+	require.Equal(t, "exit", f.String())
+	require.Equal(t, "first", dialedThrough(t, f))
+
+	first.setErr(errors.New("connection refused"))
+	require.Equal(t, "second", dialedThrough(t, f))
+	require.False(t, f.members[0].healthy.Load())
+	// A failure to reach the target isn't the fault of the upstream.
+	second.setErr(&TargetError{errors.New("host unreachable")})
+	_, err = f.Dial(context.Background(), "192.0.2.1:80")
+	var targetErr *TargetError
+	require.ErrorAs(t, err, &targetErr)
+	require.True(t, f.members[1].healthy.Load())
+
+	second.setErr(errors.New("connection refused"))
+	_, err = f.Dial(context.Background(), "192.0.2.1:80")
+	require.ErrorContains(t, err, "all upstreams failed")
+
+	// Unhealthy upstreams are still tried, last.
+	second.setErr(nil)
+	require.Equal(t, "second", dialedThrough(t, f))
+	first.setErr(nil)
+	require.Equal(t, "second", dialedThrough(t, f))
+
+	// Upstreams that can't relay packets are skipped.
+	pc, err := f.ListenPacket(context.Background())
+	require.NoError(t, err)
+	pc.Close()
+	_, err = NewFailover("empty", nil)
+	require.Error(t, err)
+}
+
+func TestFailoverBlackholed(t *testing.T) {
+	first, second := &fakeOutbound{name: "first", hang: true}, &fakeOutbound{name: "second"}
+	f, err := NewFailover("exit", []Outbound{first, second})
+	require.NoError(t, err)
+	// The blackholed upstream only gets its share of the time.
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+	conn, err := f.Dial(ctx, "192.0.2.1:80")
+	require.NoError(t, err)
+	conn.Close()
+	require.Equal(t, "second", conn.(*pipeConn).name)
+	require.False(t, f.members[0].healthy.Load())
+}
+
+func TestFailoverCheckHealth(t *testing.T) {
+	first, second := &fakeOutbound{name: "first", err: errors.New("connection refused")}, &fakeOutbound{name: "second"}
+	f, err := NewFailover("exit", []Outbound{first, second})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		f.CheckHealth(ctx, "192.0.2.1:80", 10*time.Millisecond)
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return !f.members[0].healthy.Load() }, time.Second, time.Millisecond)
+	require.Equal(t, "second", dialedThrough(t, f))
+
+	first.setErr(nil)
+	require.Eventually(t, func() bool { return f.members[0].healthy.Load() }, time.Second, time.Millisecond)
+	require.Equal(t, "first", dialedThrough(t, f))
+	cancel()
+	<-done
+}
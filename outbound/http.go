@@ -0,0 +1,92 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package outbound
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	onet "myoss/net"
+)
+
+type httpOutbound struct {
+	server, username, password string
+}
+
+// NewHTTPConnect returns an outbound through the HTTP proxy at `server`, a
+// host:port, with CONNECT requests. If `username` is set, it authenticates
+// with Basic authentication. It can't relay packets.
+func NewHTTPConnect(server, username, password string) (Outbound, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return nil, err
+	}
+	return &httpOutbound{server: server, username: username, password: password}, nil
+}
+
+func (o *httpOutbound) String() string {
+	return "http://" + o.server
+}
+
+func (o *httpOutbound) Dial(ctx context.Context, raddr string) (onet.DuplexConn, error) {
+	conn, err := dialUpstream(ctx, o.server)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		Host:   raddr,
+		URL:    &url.URL{Host: raddr},
+		Header: make(http.Header),
+	}
+	if o.username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(o.username + ":" + o.password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		err := fmt.Errorf("CONNECT %v: %v", raddr, resp.Status)
+		if resp.StatusCode == http.StatusProxyAuthRequired {
+			return nil, err
+		}
+		return nil, &TargetError{err}
+	}
+	conn.SetDeadline(time.Time{})
+	if reader.Buffered() > 0 {
+		// The target spoke first, and its data is in the reader.
+		return onet.WrapConn(conn, reader, conn), nil
+	}
+	return conn, nil
+}
+
+func (o *httpOutbound) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	return nil, ErrUDPUnsupported
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package outbound
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startHTTPProxy runs an HTTP proxy that only serves CONNECT requests with
+// the Proxy-Authorization `auth`.
+func startHTTPProxy(t *testing.T, auth string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != auth {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				targetConn, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer targetConn.Close()
+				// The greeting of the target is sent with the response.
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\nHi")
+				go io.Copy(targetConn, conn)
+				io.Copy(conn, targetConn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestHTTPConnect(t *testing.T) {
+	echo := startTCPEchoServer(t)
+	// "user:pass" in base64.
+	server := startHTTPProxy(t, "Basic dXNlcjpwYXNz")
+
+	o, err := NewHTTPConnect(server, "user", "pass")
+	require.NoError(t, err)
+	require.Equal(t, "http://"+server, o.String())
+	conn, err := o.Dial(context.Background(), echo.Addr().String())
+	require.NoError(t, err)
+	greeting := make([]byte, 2)
+	_, err = io.ReadFull(conn, greeting)
+	require.NoError(t, err)
+	require.Equal(t, "Hi", string(greeting))
+	requireEcho(t, conn)
+	conn.Close()
+
+	_, err = o.Dial(context.Background(), closedAddr(t))
+	var targetErr *TargetError
+	require.ErrorAs(t, err, &targetErr)
+
+	o, err = NewHTTPConnect(server, "user", "wrong")
+	require.NoError(t, err)
+	_, err = o.Dial(context.Background(), echo.Addr().String())
+	require.Error(t, err)
+	require.False(t, errors.As(err, &targetErr))
+
+	_, err = o.ListenPacket(context.Background())
+	require.ErrorIs(t, err, ErrUDPUnsupported)
+}
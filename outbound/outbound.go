@@ -0,0 +1,130 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package outbound relays the connections and packets of proxy targets
+// through upstream proxies, instead of connecting to the targets directly.
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	onet "myoss/net"
+	ss "myoss/shadowsocks"
+	"myoss/shadowsocks/client"
+
+	logging "github.com/op/go-logging"
+)
+
+var logger = logging.MustGetLogger("outbound")
+
+// handshakeTimeout bounds the handshake with an upstream if the context of
+// the connection has no deadline.
+const handshakeTimeout = 10 * time.Second
+
+// ErrUDPUnsupported is returned by the ListenPacket of outbounds that can't
+// relay packets.
+var ErrUDPUnsupported = errors.New("outbound can't relay UDP")
+
+// Outbound relays connections and packets to targets through an upstream.
+type Outbound interface {
+	onet.StreamDialer
+	onet.PacketListener
+	// String names the outbound in logs.
+	String() string
+}
+
+// TargetError is a failure of the upstream to reach the target, as opposed
+// to a failure of the upstream itself.
+type TargetError struct {
+	Err error
+}
+
+func (e *TargetError) Error() string {
+	return fmt.Sprintf("upstream failed to reach the target: %v", e.Err)
+}
+
+func (e *TargetError) Unwrap() error {
+	return e.Err
+}
+
+// dialUpstream connects to the upstream `server` and sets the deadline of the
+// handshake. The caller clears it when the handshake is done.
+func dialUpstream(ctx context.Context, server string) (*net.TCPConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
+	conn.SetDeadline(deadline)
+	return conn.(*net.TCPConn), nil
+}
+
+type streamEndpoint struct {
+	server string
+}
+
+func (e streamEndpoint) Connect(ctx context.Context) (onet.DuplexConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", e.server)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+type packetEndpoint struct {
+	server string
+}
+
+func (e packetEndpoint) Connect(ctx context.Context) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "udp", e.server)
+}
+
+type shadowsocksOutbound struct {
+	onet.StreamDialer
+	onet.PacketListener
+	server string
+}
+
+// NewShadowsocks returns an outbound through the Shadowsocks server at
+// `server`, a host:port, with `cipher`. Note that the target of a connection
+// is only reached when the first data is sent, so connection failures show
+// up as closed connections.
+func NewShadowsocks(server string, cipher *ss.Cipher) (Outbound, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return nil, err
+	}
+	dialer, err := client.NewShadowsocksStreamDialer(streamEndpoint{server}, cipher)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := client.NewShadowsocksPacketListener(packetEndpoint{server}, cipher)
+	if err != nil {
+		return nil, err
+	}
+	return &shadowsocksOutbound{StreamDialer: dialer, PacketListener: listener, server: server}, nil
+}
+
+func (o *shadowsocksOutbound) String() string {
+	return "shadowsocks://" + o.server
+}
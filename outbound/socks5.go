@@ -0,0 +1,223 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	onet "myoss/net"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// SOCKS5 commands and authentication methods, from RFC 1928 and RFC 1929.
+const (
+	socks5Version       = 5
+	socks5Connect       = 1
+	socks5UDPAssociate  = 3
+	socks5NoAuth        = 0
+	socks5UserPass      = 2
+	socks5NoAcceptable  = 0xff
+	socks5UserPassVer   = 1
+	socks5MaxHeaderSize = 3 + socks.MaxAddrLen
+)
+
+type socks5Outbound struct {
+	server, username, password string
+}
+
+// NewSOCKS5 returns an outbound through the SOCKS5 proxy at `server`, a
+// host:port. If `username` is set, it authenticates with it. Packets are
+// relayed with UDP ASSOCIATE.
+func NewSOCKS5(server, username, password string) (Outbound, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return nil, err
+	}
+	if len(username) > 255 || len(password) > 255 {
+		return nil, errors.New("SOCKS5 username and password must be at most 255 bytes")
+	}
+	return &socks5Outbound{server: server, username: username, password: password}, nil
+}
+
+func (o *socks5Outbound) String() string {
+	return "socks5://" + o.server
+}
+
+// request connects to the server, authenticates and sends the command `cmd`
+// for `addr`. It returns the connection and the address bound by the server.
+func (o *socks5Outbound) request(ctx context.Context, cmd byte, addr socks.Addr) (*net.TCPConn, socks.Addr, error) {
+	conn, err := dialUpstream(ctx, o.server)
+	if err != nil {
+		return nil, nil, err
+	}
+	bound, err := o.handshake(conn, cmd, addr)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, bound, nil
+}
+
+func (o *socks5Outbound) handshake(conn io.ReadWriter, cmd byte, addr socks.Addr) (socks.Addr, error) {
+	method := byte(socks5NoAuth)
+	if o.username != "" {
+		method = socks5UserPass
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return nil, err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return nil, err
+	}
+	if reply[0] != socks5Version {
+		return nil, fmt.Errorf("not a SOCKS5 server: version %d", reply[0])
+	}
+	if reply[1] != method {
+		return nil, errors.New("SOCKS5 server refused the authentication method")
+	}
+	if method == socks5UserPass {
+		auth := append([]byte{socks5UserPassVer, byte(len(o.username))}, o.username...)
+		auth = append(append(auth, byte(len(o.password))), o.password...)
+		if _, err := conn.Write(auth); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return nil, err
+		}
+		if reply[1] != 0 {
+			return nil, errors.New("SOCKS5 authentication failed")
+		}
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, cmd, 0}, addr...)); err != nil {
+		return nil, err
+	}
+	var header [3]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, err
+	}
+	if header[1] != 0 {
+		err := fmt.Errorf("SOCKS5 request failed: %v", socks.Error(header[1]))
+		if header[1] == byte(socks.ErrGeneralFailure) || header[1] == byte(socks.ErrCommandNotSupported) {
+			return nil, err
+		}
+		return nil, &TargetError{err}
+	}
+	return socks.ReadAddr(conn)
+}
+
+func (o *socks5Outbound) Dial(ctx context.Context, raddr string) (onet.DuplexConn, error) {
+	addr := socks.ParseAddr(raddr)
+	if addr == nil {
+		return nil, fmt.Errorf("bad target address %q", raddr)
+	}
+	conn, _, err := o.request(ctx, socks5Connect, addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (o *socks5Outbound) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	control, bound, err := o.request(ctx, socks5UDPAssociate, socks.ParseAddr("0.0.0.0:0"))
+	if err != nil {
+		return nil, err
+	}
+	relay, err := net.ResolveUDPAddr("udp", bound.String())
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	if relay.IP.IsUnspecified() {
+		// The relay is on the server.
+		relay.IP = control.RemoteAddr().(*net.TCPAddr).IP
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	return &socks5PacketConn{PacketConn: pc, control: control, relay: relay}, nil
+}
+
+// socks5PacketConn relays packets through the UDP relay of a SOCKS5 server.
+// The association lasts as long as the control connection.
+type socks5PacketConn struct {
+	net.PacketConn
+	control   *net.TCPConn
+	relay     *net.UDPAddr
+	closeOnce sync.Once
+}
+
+func (c *socks5PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	target := socks.ParseAddr(addr.String())
+	if target == nil {
+		return 0, fmt.Errorf("bad target address %v", addr)
+	}
+	packet := make([]byte, 0, 3+len(target)+len(b))
+	packet = append(append(append(packet, 0, 0, 0), target...), b...)
+	if _, err := c.PacketConn.WriteTo(packet, c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socks5PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, socks5MaxHeaderSize+len(b))
+	for {
+		n, from, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if udpFrom, ok := from.(*net.UDPAddr); !ok || !udpFrom.IP.Equal(c.relay.IP) || udpFrom.Port != c.relay.Port {
+			// Not from the relay.
+			continue
+		}
+		// Fragments, with a nonzero FRAG, are dropped.
+		if n < 3 || buf[2] != 0 {
+			continue
+		}
+		source := socks.SplitAddr(buf[3:n])
+		if source == nil {
+			continue
+		}
+		srcAddr, err := net.ResolveUDPAddr("udp", source.String())
+		if err != nil {
+			continue
+		}
+		payload := buf[3+len(source) : n]
+		copied := copy(b, payload)
+		if copied < len(payload) {
+			return copied, srcAddr, io.ErrShortBuffer
+		}
+		return copied, srcAddr, nil
+	}
+}
+
+func (c *socks5PacketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.control.Close()
+		err = c.PacketConn.Close()
+	})
+	return err
+}
@@ -0,0 +1,243 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package outbound
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/require"
+)
+
+func startTCPEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func startUDPEchoServer(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc
+}
+
+// closedAddr returns an address where nothing listens.
+func closedAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+// startSOCKS5Server runs a SOCKS5 server with CONNECT and UDP ASSOCIATE,
+// that requires `username` and `password` if `username` is set.
+func startSOCKS5Server(t *testing.T, username, password string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, username, password)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveSOCKS5(conn net.Conn, username, password string) {
+	defer conn.Close()
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(socks5NoAuth)
+	if username != "" {
+		method = socks5UserPass
+	}
+	if !bytes.Contains(methods, []byte{method}) {
+		conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return
+	}
+	conn.Write([]byte{socks5Version, method})
+	if method == socks5UserPass {
+		readString := func() string {
+			var length [1]byte
+			io.ReadFull(conn, length[:])
+			value := make([]byte, length[0])
+			io.ReadFull(conn, value)
+			return string(value)
+		}
+		var version [1]byte
+		io.ReadFull(conn, version[:])
+		if readString() != username || readString() != password {
+			conn.Write([]byte{socks5UserPassVer, 1})
+			return
+		}
+		conn.Write([]byte{socks5UserPassVer, 0})
+	}
+	var request [3]byte
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		return
+	}
+	target, err := socks.ReadAddr(conn)
+	if err != nil {
+		return
+	}
+	switch request[1] {
+	case socks5Connect:
+		targetConn, err := net.Dial("tcp", target.String())
+		if err != nil {
+			conn.Write(append([]byte{socks5Version, byte(socks.ErrConnectionRefused), 0}, socks.ParseAddr("0.0.0.0:0")...))
+			return
+		}
+		defer targetConn.Close()
+		conn.Write(append([]byte{socks5Version, 0, 0}, socks.ParseAddr(targetConn.LocalAddr().String())...))
+		go io.Copy(targetConn, conn)
+		io.Copy(conn, targetConn)
+	case socks5UDPAssociate:
+		relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		_, port, _ := net.SplitHostPort(relay.LocalAddr().String())
+		conn.Write(append([]byte{socks5Version, 0, 0}, socks.ParseAddr(net.JoinHostPort("0.0.0.0", port))...))
+		go func() {
+			var client net.Addr
+			buf := make([]byte, 1500)
+			for {
+				n, from, err := relay.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				if client == nil || from.String() == client.String() {
+					client = from
+					target := socks.SplitAddr(buf[3:n])
+					targetAddr, _ := net.ResolveUDPAddr("udp", target.String())
+					relay.WriteTo(buf[3+len(target):n], targetAddr)
+				} else {
+					packet := append(append([]byte{0, 0, 0}, socks.ParseAddr(from.String())...), buf[:n]...)
+					relay.WriteTo(packet, client)
+				}
+			}
+		}()
+		// The association ends with the control connection.
+		io.Copy(io.Discard, conn)
+	default:
+		conn.Write(append([]byte{socks5Version, byte(socks.ErrCommandNotSupported), 0}, socks.ParseAddr("0.0.0.0:0")...))
+	}
+}
+
+func requireEcho(t *testing.T, conn net.Conn) {
+	_, err := conn.Write([]byte("Hello"))
+	require.NoError(t, err)
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, "Hello", string(reply))
+}
+
+func TestSOCKS5Dial(t *testing.T) {
+	echo := startTCPEchoServer(t)
+	server := startSOCKS5Server(t, "user", "pass")
+
+	o, err := NewSOCKS5(server, "user", "pass")
+	require.NoError(t, err)
+	require.Equal(t, "socks5://"+server, o.String())
+	conn, err := o.Dial(context.Background(), echo.Addr().String())
+	require.NoError(t, err)
+	requireEcho(t, conn)
+	conn.Close()
+
+	// The server can't reach the target.
+	_, err = o.Dial(context.Background(), closedAddr(t))
+	var targetErr *TargetError
+	require.ErrorAs(t, err, &targetErr)
+
+	o, err = NewSOCKS5(server, "user", "wrong")
+	require.NoError(t, err)
+	_, err = o.Dial(context.Background(), echo.Addr().String())
+	require.Error(t, err)
+	require.False(t, errors.As(err, &targetErr))
+
+	o, err = NewSOCKS5(server, "", "")
+	require.NoError(t, err)
+	_, err = o.Dial(context.Background(), echo.Addr().String())
+	require.Error(t, err)
+	require.False(t, errors.As(err, &targetErr))
+}
+
+func TestSOCKS5ListenPacket(t *testing.T) {
+	echo := startUDPEchoServer(t)
+	o, err := NewSOCKS5(startSOCKS5Server(t, "", ""), "", "")
+	require.NoError(t, err)
+
+	pc, err := o.ListenPacket(context.Background())
+	require.NoError(t, err)
+	defer pc.Close()
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = pc.WriteTo([]byte("Hello"), echo.LocalAddr())
+	require.NoError(t, err)
+	buf := make([]byte, 100)
+	n, from, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "Hello", string(buf[:n]))
+	require.Equal(t, echo.LocalAddr().String(), from.String())
+
+	// Packets longer than the buffer are cut.
+	_, err = pc.WriteTo([]byte("Hello"), echo.LocalAddr())
+	require.NoError(t, err)
+	n, _, err = pc.ReadFrom(buf[:2])
+	require.ErrorIs(t, err, io.ErrShortBuffer)
+	require.Equal(t, "He", string(buf[:n]))
+}
@@ -0,0 +1,287 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	onet "myoss/net"
+)
+
+// ACLRule is a destination access rule. A destination matches the rule if it
+// matches one entry of each list that is set: Domains are domain suffixes
+// of the requested name, CIDRs contain the IP it resolves to, and Ports are
+// ports or ranges like "6881-6889". If Keys or Plans are set, the rule only
+// applies to those access keys or the keys of those plans.
+type ACLRule struct {
+	ID string `toml:"id"`
+	// Action is "allow" or "deny".
+	Action string `toml:"action"`
+	// Rules with a higher Priority are evaluated first. Rules with the same
+	// priority are evaluated in order.
+	Priority int      `toml:"priority"`
+	Domains  []string `toml:"domains"`
+	CIDRs    []string `toml:"cidrs"`
+	Ports    []string `toml:"ports"`
+	Keys     []string `toml:"keys"`
+	Plans    []string `toml:"plans"`
+}
+
+type portRange struct {
+	from, to int
+}
+
+// ruleMatch is the destinations and clients a rule applies to.
+type ruleMatch struct {
+	domains []string
+	nets    []*net.IPNet
+	ports   []portRange
+	keys    map[string]bool
+	plans   map[string]bool
+}
+
+type aclRule struct {
+	ruleMatch
+	id       string
+	allow    bool
+	priority int
+}
+
+// ACL decides which destinations clients may reach. The first rule, in
+// priority order, that matches a destination decides; destinations that
+// match no rule are allowed. Domain rules are matched on the requested name,
+// before it's resolved, and CIDR rules on the resolved IP. The rules can be
+// replaced while the ACL is in use. A nil ACL allows everything.
+type ACL struct {
+	mu    sync.RWMutex
+	rules []aclRule
+}
+
+// NewACL creates an ACL with `rules`.
+func NewACL(rules []ACLRule) (*ACL, error) {
+	acl := &ACL{}
+	if err := acl.Update(rules); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Update replaces the rules of the ACL. It leaves them unchanged if any of
+// `rules` is invalid.
+func (a *ACL) Update(rules []ACLRule) error {
+	compiled := make([]aclRule, len(rules))
+	ids := make(map[string]bool, len(rules))
+	for i, rule := range rules {
+		if rule.ID == "" {
+			return fmt.Errorf("rule %d has no id", i+1)
+		}
+		if ids[rule.ID] {
+			return fmt.Errorf("duplicate rule id %q", rule.ID)
+		}
+		ids[rule.ID] = true
+		var err error
+		if compiled[i], err = compileACLRule(rule); err != nil {
+			return fmt.Errorf("rule %q: %v", rule.ID, err)
+		}
+	}
+	sort.SliceStable(compiled, func(i, j int) bool {
+		return compiled[i].priority > compiled[j].priority
+	})
+	a.mu.Lock()
+	a.rules = compiled
+	a.mu.Unlock()
+	return nil
+}
+
+func compileACLRule(rule ACLRule) (aclRule, error) {
+	compiled := aclRule{id: rule.ID, priority: rule.Priority}
+	switch rule.Action {
+	case "allow":
+		compiled.allow = true
+	case "deny":
+	default:
+		return compiled, fmt.Errorf("action must be allow or deny, not %q", rule.Action)
+	}
+	if len(rule.Domains) == 0 && len(rule.CIDRs) == 0 && len(rule.Ports) == 0 {
+		return compiled, fmt.Errorf("needs domains, cidrs or ports")
+	}
+	var err error
+	compiled.ruleMatch, err = compileRuleMatch(rule.Domains, rule.CIDRs, rule.Ports, rule.Keys, rule.Plans)
+	return compiled, err
+}
+
+func compileRuleMatch(domains, cidrs, ports, keys, plans []string) (ruleMatch, error) {
+	var compiled ruleMatch
+	for _, domain := range domains {
+		domain = normalizeDomain(domain)
+		if domain == "" {
+			return compiled, fmt.Errorf("empty domain")
+		}
+		compiled.domains = append(compiled.domains, domain)
+	}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			// A single IP.
+			if ip := net.ParseIP(cidr); ip != nil {
+				bits := 8 * len(ip)
+				if ip4 := ip.To4(); ip4 != nil {
+					ip, bits = ip4, 32
+				}
+				compiled.nets = append(compiled.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return compiled, err
+		}
+		compiled.nets = append(compiled.nets, ipNet)
+	}
+	for _, portText := range ports {
+		r, err := parsePortRange(portText)
+		if err != nil {
+			return compiled, err
+		}
+		compiled.ports = append(compiled.ports, r)
+	}
+	compiled.keys = stringSet(keys)
+	compiled.plans = stringSet(plans)
+	return compiled, nil
+}
+
+func parsePortRange(text string) (portRange, error) {
+	fromText, toText, isRange := strings.Cut(text, "-")
+	if !isRange {
+		toText = fromText
+	}
+	from, err := strconv.Atoi(strings.TrimSpace(fromText))
+	if err != nil || from < 1 || from > 65535 {
+		return portRange{}, fmt.Errorf("bad port %q", text)
+	}
+	to, err := strconv.Atoi(strings.TrimSpace(toText))
+	if err != nil || to < from || to > 65535 {
+		return portRange{}, fmt.Errorf("bad port range %q", text)
+	}
+	return portRange{from, to}, nil
+}
+
+func stringSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(domain), "."), ".")
+}
+
+// appliesTo reports whether the rule applies to the clients of `entry`.
+func (r *ruleMatch) appliesTo(entry *CipherEntry) bool {
+	if r.keys == nil && r.plans == nil {
+		return true
+	}
+	if entry == nil {
+		return false
+	}
+	return r.keys[entry.ID] || r.plans[entry.Plan()]
+}
+
+// match reports whether the destination matches the rule. If `ip` is nil,
+// because the destination isn't resolved yet, rules with CIDRs are undecided.
+func (r *ruleMatch) match(domain string, ip net.IP, port int) (matched, decided bool) {
+	if len(r.ports) > 0 {
+		inRange := false
+		for _, p := range r.ports {
+			if p.from <= port && port <= p.to {
+				inRange = true
+				break
+			}
+		}
+		if !inRange {
+			return false, true
+		}
+	}
+	if len(r.domains) > 0 {
+		suffixMatch := false
+		for _, suffix := range r.domains {
+			if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+				suffixMatch = true
+				break
+			}
+		}
+		if !suffixMatch {
+			return false, true
+		}
+	}
+	if len(r.nets) > 0 {
+		if ip == nil {
+			return false, false
+		}
+		for _, ipNet := range r.nets {
+			if ipNet.Contains(ip) {
+				return true, true
+			}
+		}
+		return false, true
+	}
+	return true, true
+}
+
+// Check returns an ERR_ADDRESS_BLOCKED error, naming the rule, if the client
+// of `entry` may not reach `host`:`port`. `host` is the requested name or IP,
+// and `ip` what it resolved to. Before resolution `ip` is nil, and only
+// destinations that no CIDR rule could allow are blocked.
+func (a *ACL) Check(entry *CipherEntry, host string, ip net.IP, port int) *onet.ConnectionError {
+	if a == nil {
+		return nil
+	}
+	domain := ""
+	if hostIP := net.ParseIP(host); hostIP == nil {
+		domain = normalizeDomain(host)
+	} else if ip == nil {
+		ip = hostIP
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for i := range a.rules {
+		rule := &a.rules[i]
+		if !rule.appliesTo(entry) {
+			continue
+		}
+		matched, decided := rule.match(domain, ip, port)
+		if !decided {
+			// This rule may match once the destination is resolved.
+			return nil
+		}
+		if !matched {
+			continue
+		}
+		if rule.allow {
+			return nil
+		}
+		return onet.NewConnectionError("ERR_ADDRESS_BLOCKED", fmt.Sprintf("Address blocked by rule %v", rule.id), nil)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	onet "myoss/net"
+	ss "myoss/shadowsocks"
+	"myoss/shadowsocks/client"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/require"
+)
+
+func requireBlockedBy(t *testing.T, ruleID string, err *onet.ConnectionError) {
+	t.Helper()
+	require.NotNil(t, err)
+	require.Equal(t, "ERR_ADDRESS_BLOCKED", err.Status)
+	require.Contains(t, err.Message, ruleID)
+}
+
+func TestACL(t *testing.T) {
+	acl, err := NewACL([]ACLRule{
+		{ID: "smtp", Action: "deny", Ports: []string{"25", "465-587"}},
+		{ID: "trackers", Action: "deny", Domains: []string{"Tracker.example.com."}},
+		{ID: "lan", Action: "deny", CIDRs: []string{"192.0.2.0/24", "2001:db8::1"}},
+		{ID: "partner-mail", Action: "allow", Priority: 10, Domains: []string{"mail.example.com"}, Ports: []string{"25"}},
+		{ID: "free-video", Action: "deny", Domains: []string{"video.example.com"}, Plans: []string{"free"}},
+	})
+	require.NoError(t, err)
+	free := &CipherEntry{ID: "free-user"}
+	free.SetPlan("free")
+	paid := &CipherEntry{ID: "paid-user"}
+	paid.SetPlan("paid")
+
+	requireBlockedBy(t, "smtp", acl.Check(paid, "198.51.100.1", nil, 25))
+	requireBlockedBy(t, "smtp", acl.Check(paid, "198.51.100.1", nil, 500))
+	require.Nil(t, acl.Check(paid, "198.51.100.1", nil, 588))
+	// The allow rule has priority over the port rule.
+	require.Nil(t, acl.Check(paid, "mail.example.com", nil, 25))
+	requireBlockedBy(t, "smtp", acl.Check(paid, "other.example.com", nil, 25))
+
+	// Domains match as suffixes, before resolution.
+	requireBlockedBy(t, "trackers", acl.Check(paid, "tracker.example.com", nil, 80))
+	requireBlockedBy(t, "trackers", acl.Check(paid, "udp.TRACKER.example.com", nil, 80))
+	require.Nil(t, acl.Check(paid, "nottracker.example.com", nil, 80))
+
+	// CIDRs match resolved IPs, and IP literals.
+	require.Nil(t, acl.Check(paid, "lan.example.com", nil, 80))
+	requireBlockedBy(t, "lan", acl.Check(paid, "lan.example.com", net.ParseIP("192.0.2.7"), 80))
+	requireBlockedBy(t, "lan", acl.Check(paid, "2001:db8::1", nil, 80))
+	require.Nil(t, acl.Check(paid, "2001:db8::2", nil, 80))
+
+	// Plan rules only apply to the keys of the plan.
+	videoIP := net.ParseIP("198.51.100.1")
+	requireBlockedBy(t, "free-video", acl.Check(free, "video.example.com", videoIP, 443))
+	require.Nil(t, acl.Check(paid, "video.example.com", videoIP, 443))
+
+	// A bad update leaves the rules as they were.
+	require.Error(t, acl.Update([]ACLRule{{ID: "bad", Action: "drop", Ports: []string{"25"}}}))
+	requireBlockedBy(t, "smtp", acl.Check(paid, "198.51.100.1", nil, 25))
+	require.NoError(t, acl.Update(nil))
+	require.Nil(t, acl.Check(paid, "198.51.100.1", nil, 25))
+
+	var none *ACL
+	require.Nil(t, none.Check(paid, "198.51.100.1", nil, 25))
+}
+
+func TestACLInvalidRules(t *testing.T) {
+	for _, rule := range []ACLRule{
+		{Action: "deny", Ports: []string{"25"}},
+		{ID: "r", Action: "deny"},
+		{ID: "r", Action: "deny", Ports: []string{"0"}},
+		{ID: "r", Action: "deny", Ports: []string{"30-20"}},
+		{ID: "r", Action: "deny", CIDRs: []string{"192.0.2.0/33"}},
+		{ID: "r", Action: "deny", Domains: []string{"."}},
+	} {
+		_, err := NewACL([]ACLRule{rule})
+		require.Error(t, err, "%+v", rule)
+	}
+	_, err := NewACL([]ACLRule{{ID: "r", Action: "deny", Ports: []string{"25"}}, {ID: "r", Action: "allow", Ports: []string{"80"}}})
+	require.Error(t, err)
+}
+
+func TestTCPACL(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, nil, testMetrics, time.Second)
+	s.SetTargetIPValidator(allowAll)
+	_, echoPort, _ := net.SplitHostPort(echo.Addr().String())
+	acl, err := NewACL([]ACLRule{{ID: "echo", Action: "deny", Ports: []string{echoPort}}})
+	require.NoError(t, err)
+	s.SetACL(acl)
+	listener := makeLocalhostListener(t)
+	go s.Serve(listener)
+	dialer, err := client.NewShadowsocksStreamDialer(onet.TCPEndpoint{RemoteAddr: *listener.Addr().(*net.TCPAddr)}, firstCipher(cipherList))
+	require.NoError(t, err)
+
+	conn, err := dialer.Dial(context.Background(), echo.Addr().String())
+	require.NoError(t, err)
+	conn.Write([]byte("Hello"))
+	reply, _ := io.ReadAll(conn)
+	require.Empty(t, reply)
+	conn.Close()
+
+	// The rules are replaced live.
+	require.NoError(t, acl.Update(nil))
+	conn, err = dialer.Dial(context.Background(), echo.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("Hello"))
+	require.NoError(t, err)
+	reply = make([]byte, 5)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	conn.Close()
+
+	s.GracefulStop()
+	require.Equal(t, []string{"ERR_ADDRESS_BLOCKED", "OK"}, testMetrics.closeStatus)
+}
+
+func TestUDPACL(t *testing.T) {
+	ciphers, err := MakeTestCiphers([]string{"asdf"})
+	require.NoError(t, err)
+	entry := ciphers.SnapshotForClientIP(nil)[0].Value.(*CipherEntry)
+	clientConn := makePacketConn()
+	metrics := &natTestMetrics{}
+	service := NewUDPService(timeout, ciphers, metrics)
+	service.SetTargetIPValidator(allowAll)
+	acl, err := NewACL([]ACLRule{{ID: "dns", Action: "deny", CIDRs: []string{"127.0.0.1"}, Ports: []string{"53"}}})
+	require.NoError(t, err)
+	service.SetACL(acl)
+	go service.Serve(clientConn)
+
+	plaintext := append(socks.ParseAddr("127.0.0.1:53"), make([]byte, 10)...)
+	ciphertext := make([]byte, entry.Cipher.SaltSize()+len(plaintext)+entry.Cipher.TagSize())
+	ss.Pack(ciphertext, plaintext, entry.Cipher)
+	clientConn.recv <- packet{addr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 54321}, payload: ciphertext}
+	service.GracefulStop()
+
+	require.Len(t, metrics.upstreamPackets, 1)
+	require.Equal(t, "ERR_ADDRESS_BLOCKED", metrics.upstreamPackets[0].status)
+}
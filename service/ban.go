@@ -0,0 +1,185 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"container/list"
+	"myoss/mylog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BanList bans client IPs that fail authentication too often, to protect
+// against probing and trial-decryption DoS. An IP is banned for `duration`
+// once it fails `maxFailures` times within `window`. At most `maxIPs` IPs are
+// tracked; when full, the least recently failed one is forgotten.
+// A nil BanList bans nothing.
+type BanList struct {
+	maxFailures int
+	window      time.Duration
+	duration    time.Duration
+	maxIPs      int
+
+	mu sync.Mutex
+	// ips indexes lru, whose front is the IP that failed most recently.
+	ips map[string]*list.Element
+	lru list.List
+}
+
+type banRecord struct {
+	ip          string
+	failures    int
+	windowStart time.Time
+	lastFailure time.Time
+	bannedUntil time.Time
+}
+
+// Ban describes a banned IP.
+type Ban struct {
+	IP       string    `json:"ip"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+// NewBanList creates a BanList. It returns nil, which bans nothing, if
+// `maxFailures` is 0.
+func NewBanList(maxFailures int, window, duration time.Duration, maxIPs int) *BanList {
+	if maxFailures <= 0 {
+		return nil
+	}
+	return &BanList{
+		maxFailures: maxFailures,
+		window:      window,
+		duration:    duration,
+		maxIPs:      maxIPs,
+		ips:         make(map[string]*list.Element),
+	}
+}
+
+// Banned reports whether `ip` is banned.
+func (b *BanList) Banned(ip net.IP, now time.Time) bool {
+	if b == nil || ip == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	elt, ok := b.ips[ip.String()]
+	if !ok {
+		return false
+	}
+	return now.Before(elt.Value.(*banRecord).bannedUntil)
+}
+
+// AddFailure records a failed authentication from `ip`, and reports whether
+// it got the IP banned.
+func (b *BanList) AddFailure(ip net.IP, now time.Time) bool {
+	if b == nil || ip == nil {
+		return false
+	}
+	key := ip.String()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var record *banRecord
+	if elt, ok := b.ips[key]; ok {
+		record = elt.Value.(*banRecord)
+		b.lru.MoveToFront(elt)
+	} else {
+		if b.maxIPs > 0 && len(b.ips) >= b.maxIPs {
+			oldest := b.lru.Back()
+			b.lru.Remove(oldest)
+			delete(b.ips, oldest.Value.(*banRecord).ip)
+		}
+		record = &banRecord{ip: key}
+		b.ips[key] = b.lru.PushFront(record)
+	}
+	if now.Before(record.bannedUntil) {
+		// Already banned. Failures from a banned IP don't extend the ban.
+		return false
+	}
+	if now.Sub(record.windowStart) > b.window {
+		record.windowStart = now
+		record.failures = 0
+	}
+	record.failures++
+	record.lastFailure = now
+	if record.failures < b.maxFailures {
+		return false
+	}
+	record.bannedUntil = now.Add(b.duration)
+	return true
+}
+
+// pruneLocked forgets the IPs that are neither banned nor failed within the
+// window. b.mu must be held.
+func (b *BanList) pruneLocked(now time.Time) {
+	for elt := b.lru.Back(); elt != nil; {
+		prev := elt.Prev()
+		record := elt.Value.(*banRecord)
+		if now.Before(record.bannedUntil) || now.Sub(record.lastFailure) <= b.window {
+			// Banned IPs may sit behind others, so keep scanning.
+			elt = prev
+			continue
+		}
+		b.lru.Remove(elt)
+		delete(b.ips, record.ip)
+		elt = prev
+	}
+}
+
+// List returns the banned IPs, sorted by IP.
+func (b *BanList) List(now time.Time) []Ban {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pruneLocked(now)
+	var bans []Ban
+	for _, elt := range b.ips {
+		record := elt.Value.(*banRecord)
+		if now.Before(record.bannedUntil) {
+			bans = append(bans, Ban{IP: record.ip, Failures: record.failures, Until: record.bannedUntil})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+	return bans
+}
+
+// Unban lifts the ban on `ip` and forgets its failures. It reports whether
+// the IP was banned.
+func (b *BanList) Unban(ip net.IP, now time.Time) bool {
+	if b == nil || ip == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	elt, ok := b.ips[ip.String()]
+	if !ok {
+		return false
+	}
+	b.lru.Remove(elt)
+	delete(b.ips, ip.String())
+	return now.Before(elt.Value.(*banRecord).bannedUntil)
+}
+
+// recordAuthFailure counts a failed authentication against `ip`, and logs
+// when it gets the IP banned.
+func recordAuthFailure(bans *BanList, ip net.IP) {
+	if bans.AddFailure(ip, time.Now()) {
+		mylog.Logf("banned %v for %v after %d authentication failures", ip, bans.duration, bans.maxFailures)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	ss "myoss/shadowsocks"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBanList(t *testing.T) {
+	bans := NewBanList(3, time.Minute, time.Hour, 10)
+	ip := net.ParseIP("192.0.2.1")
+	now := time.Now()
+
+	require.False(t, bans.AddFailure(ip, now))
+	require.False(t, bans.AddFailure(ip, now))
+	require.False(t, bans.Banned(ip, now))
+	require.True(t, bans.AddFailure(ip, now))
+	require.True(t, bans.Banned(ip, now))
+	require.False(t, bans.AddFailure(ip, now), "already banned")
+	require.Equal(t, []Ban{{IP: "192.0.2.1", Failures: 3, Until: now.Add(time.Hour)}}, bans.List(now))
+
+	// The ban expires.
+	later := now.Add(2 * time.Hour)
+	require.False(t, bans.Banned(ip, later))
+	require.Empty(t, bans.List(later))
+
+	// Failures outside the window don't add up.
+	other := net.ParseIP("2001:db8::1")
+	bans.AddFailure(other, now)
+	bans.AddFailure(other, now)
+	require.False(t, bans.AddFailure(other, now.Add(2*time.Minute)))
+	require.False(t, bans.Banned(other, now.Add(2*time.Minute)))
+}
+
+func TestBanListUnban(t *testing.T) {
+	bans := NewBanList(1, time.Minute, time.Hour, 10)
+	ip := net.ParseIP("192.0.2.1")
+	now := time.Now()
+	require.True(t, bans.AddFailure(ip, now))
+	require.True(t, bans.Unban(ip, now))
+	require.False(t, bans.Banned(ip, now))
+	require.False(t, bans.Unban(ip, now))
+}
+
+func TestBanListBounded(t *testing.T) {
+	bans := NewBanList(2, time.Minute, time.Hour, 2)
+	now := time.Now()
+	first, second, third := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")
+	bans.AddFailure(first, now)
+	bans.AddFailure(second, now)
+	// Tracking a third IP forgets the least recent one.
+	bans.AddFailure(third, now)
+	require.False(t, bans.AddFailure(first, now))
+	require.Len(t, bans.ips, 2)
+	require.True(t, bans.AddFailure(third, now))
+}
+
+func TestNilBanList(t *testing.T) {
+	var bans *BanList
+	require.Nil(t, NewBanList(0, time.Minute, time.Hour, 10))
+	ip := net.ParseIP("192.0.2.1")
+	require.False(t, bans.AddFailure(ip, time.Now()))
+	require.False(t, bans.Banned(ip, time.Now()))
+	require.Empty(t, bans.List(time.Now()))
+}
+
+func TestTCPBan(t *testing.T) {
+	const testTimeout = 200 * time.Millisecond
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, nil, testMetrics, testTimeout)
+	s.SetBanList(NewBanList(2, time.Minute, time.Hour, 10))
+	go s.Serve(listener)
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+		require.NoError(t, err)
+		_, err = conn.Write(ss.MakeTestPayload(60))
+		require.NoError(t, err)
+		// Banned clients are drained until the timeout and never reset.
+		n, err := conn.Read(make([]byte, 1))
+		require.Equal(t, 0, n)
+		require.Equal(t, io.EOF, err)
+		conn.Close()
+	}
+	s.GracefulStop()
+
+	require.Equal(t, []string{"ERR_CIPHER", "ERR_CIPHER", "ERR_BANNED"}, testMetrics.closeStatus)
+	require.Equal(t, []string{"ERR_CIPHER", "ERR_CIPHER", "ERR_BANNED"}, testMetrics.probeStatus)
+}
+
+func TestUDPBan(t *testing.T) {
+	ciphers, err := MakeTestCiphers([]string{"asdf"})
+	require.NoError(t, err)
+	entry := ciphers.SnapshotForClientIP(nil)[0].Value.(*CipherEntry)
+	clientConn := makePacketConn()
+	metrics := &natTestMetrics{}
+	service := NewUDPService(timeout, ciphers, metrics)
+	service.SetTargetIPValidator(allowAll)
+	service.SetBanList(NewBanList(2, time.Minute, time.Hour, 10))
+	go service.Serve(clientConn)
+
+	clientAddr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 54321}
+	for i := 0; i < 2; i++ {
+		clientConn.recv <- packet{addr: clientAddr, payload: ss.MakeTestPayload(60)}
+	}
+	// Once banned, even valid packets are dropped.
+	plaintext := append(socks.ParseAddr("127.0.0.1:9"), make([]byte, 10)...)
+	ciphertext := make([]byte, entry.Cipher.SaltSize()+len(plaintext)+entry.Cipher.TagSize())
+	ss.Pack(ciphertext, plaintext, entry.Cipher)
+	clientConn.recv <- packet{addr: clientAddr, payload: ciphertext}
+	service.GracefulStop()
+
+	require.Len(t, metrics.upstreamPackets, 3)
+	require.Equal(t, "ERR_CIPHER", metrics.upstreamPackets[0].status)
+	require.Equal(t, "ERR_CIPHER", metrics.upstreamPackets[1].status)
+	require.Equal(t, "ERR_BANNED", metrics.upstreamPackets[2].status)
+}
@@ -18,6 +18,7 @@ import (
 	"container/list"
 	"net"
 	"sync"
+	"sync/atomic"
 
 	ss "myoss/shadowsocks"
 )
@@ -27,11 +28,73 @@ const minSaltEntropy = 16
 
 // CipherEntry holds a Cipher with an identifier.
 // The public fields are constant, but lastClientIP is mutable under cipherList.mu.
+// The connection counters and the quota are updated atomically, and the rate
+// limiters are shared by all connections of the key.
 type CipherEntry struct {
 	ID            string
 	Cipher        *ss.Cipher
 	SaltGenerator ServerSaltGenerator
 	lastClientIP  net.IP
+	tcpConns      int64
+	udpSessions   int64
+	quota         quota
+	upload        RateLimiter
+	download      RateLimiter
+	connLimits    connLimits
+	devices       deviceSet
+	// plan is the string plan of the key, for the ACL rules of plans.
+	plan atomic.Value
+	// outbound names the outbound the targets of the key go through, unless
+	// a route rule picks another one.
+	outbound atomic.Value
+	// sourceIP is the net.IP that the key connects to targets from, if it
+	// has its own.
+	sourceIP atomic.Value
+}
+
+// ActiveTCPConnections returns the number of open TCP connections using this key.
+func (e *CipherEntry) ActiveTCPConnections() int64 {
+	return atomic.LoadInt64(&e.tcpConns)
+}
+
+// ActiveUDPSessions returns the number of UDP NAT entries using this key.
+func (e *CipherEntry) ActiveUDPSessions() int64 {
+	return atomic.LoadInt64(&e.udpSessions)
+}
+
+// SetPlan sets the plan of the key, which selects the ACL rules of the plan.
+func (e *CipherEntry) SetPlan(plan string) {
+	e.plan.Store(plan)
+}
+
+// Plan returns the plan of the key, or "" if it has none.
+func (e *CipherEntry) Plan() string {
+	plan, _ := e.plan.Load().(string)
+	return plan
+}
+
+// SetOutbound sets the outbound that the targets of the key go through, or
+// "" for the default of the node.
+func (e *CipherEntry) SetOutbound(outbound string) {
+	e.outbound.Store(outbound)
+}
+
+// Outbound returns the outbound of the key, or "" if it has none.
+func (e *CipherEntry) Outbound() string {
+	outbound, _ := e.outbound.Load().(string)
+	return outbound
+}
+
+// SetSourceIP sets the local IP that the key connects to targets of its
+// family from, or nil to use the pool of the node.
+func (e *CipherEntry) SetSourceIP(ip net.IP) {
+	e.sourceIP.Store(ip)
+}
+
+// SourceIP returns the source IP of the key, or nil if it has none.
+func (e *CipherEntry) SourceIP() net.IP {
+	ip, _ := e.sourceIP.Load().(net.IP)
+	return ip
 }
 
 // MakeCipherEntry constructs a CipherEntry.
@@ -62,12 +125,17 @@ type CipherList interface {
 	// which is a List of *CipherEntry.  Update takes ownership of `contents`,
 	// which must not be read or written after this call.
 	Update(contents *list.List)
+	// ElementForUser returns the element of the Shadowsocks 2022 cipher that
+	// identity headers name `user`, or nil.
+	ElementForUser(user ss.UserHash) *list.Element
 }
 
 type cipherList struct {
 	CipherList
 	list *list.List
-	mu   sync.RWMutex
+	// users indexes the ciphers that support identity headers.
+	users map[ss.UserHash]*list.Element
+	mu    sync.RWMutex
 }
 
 // NewCipherList creates an empty CipherList
@@ -112,7 +180,20 @@ func (cl *cipherList) MarkUsedByClientIP(e *list.Element, clientIP net.IP) {
 }
 
 func (cl *cipherList) Update(src *list.List) {
+	users := make(map[ss.UserHash]*list.Element)
+	for e := src.Front(); e != nil; e = e.Next() {
+		if user, ok := e.Value.(*CipherEntry).Cipher.UserHash(); ok {
+			users[user] = e
+		}
+	}
 	cl.mu.Lock()
 	cl.list = src
+	cl.users = users
 	cl.mu.Unlock()
 }
+
+func (cl *cipherList) ElementForUser(user ss.UserHash) *list.Element {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.users[user]
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"syscall"
+)
+
+// EgressConfig describes the local side of the connections of the node to
+// targets.
+type EgressConfig struct {
+	// SourceIPs are the local IPs that targets are connected from. Each key
+	// connects from one of the IPs of the family of the target, picked by
+	// hashing its ID so that it sticks to it, unless it has its own source
+	// IP. Empty means any.
+	SourceIPs []net.IP
+	// Mark is the SO_MARK of the sockets, for policy routing, or 0 for none.
+	Mark int
+	// Interface is the network interface the sockets are bound to, or "" for
+	// any.
+	Interface string
+}
+
+// Egress picks the local addresses that the node connects to targets from,
+// and sets the options of the sockets. A nil Egress only uses the source IPs
+// of keys.
+type Egress struct {
+	ipv4, ipv6 []net.IP
+	mark       int
+	iface      string
+}
+
+// NewEgress creates an Egress with `config`. The socket options are only
+// supported on Linux.
+func NewEgress(config EgressConfig) (*Egress, error) {
+	e := &Egress{mark: config.Mark, iface: config.Interface}
+	for _, ip := range config.SourceIPs {
+		if ip4 := ip.To4(); ip4 != nil {
+			e.ipv4 = append(e.ipv4, ip4)
+		} else if ip != nil {
+			e.ipv6 = append(e.ipv6, ip)
+		}
+	}
+	if (e.mark != 0 || e.iface != "") && !socketOptionsSupported {
+		return nil, errors.New("SO_MARK and interface binding are only supported on Linux")
+	}
+	if e.mark < 0 {
+		return nil, fmt.Errorf("bad mark %v", e.mark)
+	}
+	return e, nil
+}
+
+// binds reports whether the source IP of the connections of the client of
+// `entry` through `route` depends on the family of the target.
+func (e *Egress) binds(entry *CipherEntry, route Route) bool {
+	if route.SourceIP != nil || (entry != nil && entry.SourceIP() != nil) {
+		return true
+	}
+	return e != nil && (len(e.ipv4) > 0 || len(e.ipv6) > 0)
+}
+
+// sourceIP returns the local IP that the client of `entry` connects to
+// `target` from through `route`, or nil for any. The source IP of the route
+// comes first, then that of the key, if they're of the family of the target,
+// and then the IP of the pool that the key hashes to.
+func (e *Egress) sourceIP(entry *CipherEntry, route Route, target net.IP) net.IP {
+	if target == nil {
+		return nil
+	}
+	isIPv4 := target.To4() != nil
+	if ip := route.SourceIP; ip != nil && (ip.To4() != nil) == isIPv4 {
+		return ip
+	}
+	if entry != nil {
+		if ip := entry.SourceIP(); ip != nil && (ip.To4() != nil) == isIPv4 {
+			return ip
+		}
+	}
+	if e == nil {
+		return nil
+	}
+	pool := e.ipv6
+	if isIPv4 {
+		pool = e.ipv4
+	}
+	if len(pool) == 0 {
+		return nil
+	}
+	if entry == nil {
+		return pool[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(entry.ID))
+	return pool[h.Sum32()%uint32(len(pool))]
+}
+
+// control sets the options of the egress on the socket `c`.
+func (e *Egress) control(c syscall.RawConn) error {
+	if e == nil || (e.mark == 0 && e.iface == "") {
+		return nil
+	}
+	return setSocketOptions(c, e.mark, e.iface)
+}
+
+// addrIPText returns the IP of `addr`, or "" if it's unknown or unspecified,
+// like that of a socket that isn't bound to an IP.
+func addrIPText(addr net.Addr) string {
+	ip := addrIP(addr)
+	if ip == nil || ip.IsUnspecified() {
+		return ""
+	}
+	return ip.String()
+}
+
+// BindInterface returns a Control function for net.ListenConfig that binds
+// the sockets to the network interface `iface`. It's only supported on Linux.
+func BindInterface(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	if !socketOptionsSupported {
+		return nil, errors.New("interface binding is only supported on Linux")
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return setSocketOptions(c, 0, iface)
+	}, nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const socketOptionsSupported = true
+
+func setSocketOptions(c syscall.RawConn, mark int, iface string) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if mark != 0 {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark); err != nil {
+				sockErr = fmt.Errorf("failed to set SO_MARK: %w", err)
+				return
+			}
+		}
+		if iface != "" {
+			if err := syscall.BindToDevice(int(fd), iface); err != nil {
+				sockErr = fmt.Errorf("failed to bind to interface %v: %w", iface, err)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
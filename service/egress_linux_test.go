@@ -0,0 +1,44 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEgressMark(t *testing.T) {
+	egress, err := NewEgress(EgressConfig{Mark: 100})
+	require.NoError(t, err)
+	pc, err := listenRoute(Route{Outbound: DirectOutbound}, egress, nil, nil)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("Setting SO_MARK needs CAP_NET_ADMIN")
+	}
+	require.NoError(t, err)
+	defer pc.Close()
+	rawConn, err := pc.(*net.UDPConn).SyscallConn()
+	require.NoError(t, err)
+	var mark int
+	var markErr error
+	require.NoError(t, rawConn.Control(func(fd uintptr) {
+		mark, markErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+	}))
+	require.NoError(t, markErr)
+	require.Equal(t, 100, mark)
+}
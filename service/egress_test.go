@@ -0,0 +1,177 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	onet "myoss/net"
+	ss "myoss/shadowsocks"
+	"myoss/shadowsocks/client"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/require"
+)
+
+// destinationRecorder records the source IPs of the destinations.
+type destinationRecorder struct {
+	noopRecorder
+	mu        sync.Mutex
+	sourceIPs []string
+}
+
+func (r *destinationRecorder) AddDestination(keyID, host, clientAddr, outbound, sourceIP string, isUDP bool) {
+	r.mu.Lock()
+	r.sourceIPs = append(r.sourceIPs, sourceIP)
+	r.mu.Unlock()
+}
+
+func TestEgressSourceIP(t *testing.T) {
+	egress, err := NewEgress(EgressConfig{SourceIPs: []net.IP{
+		net.ParseIP("203.0.113.1"), net.ParseIP("203.0.113.2"), net.ParseIP("203.0.113.3"), net.ParseIP("2001:db8::1"),
+	}})
+	require.NoError(t, err)
+	ipv4, ipv6 := net.ParseIP("198.51.100.1"), net.ParseIP("2001:db8:1::1")
+
+	// Keys stick to an IP of the pool, and are spread across it.
+	used := make(map[string]bool)
+	for i := 0; i < 30; i++ {
+		entry := &CipherEntry{ID: string(rune('a' + i))}
+		ip := egress.sourceIP(entry, Route{}, ipv4)
+		require.NotNil(t, ip.To4())
+		require.Equal(t, ip, egress.sourceIP(entry, Route{}, ipv4))
+		used[ip.String()] = true
+		require.Equal(t, "2001:db8::1", egress.sourceIP(entry, Route{}, ipv6).String())
+	}
+	require.Len(t, used, 3)
+
+	// Keys with their own IP only use the pool for the other family.
+	pinned := &CipherEntry{ID: "pinned"}
+	pinned.SetSourceIP(net.ParseIP("203.0.113.9"))
+	require.Equal(t, "203.0.113.9", egress.sourceIP(pinned, Route{}, ipv4).String())
+	require.Equal(t, "2001:db8::1", egress.sourceIP(pinned, Route{}, ipv6).String())
+	var noEgress *Egress
+	require.Equal(t, "203.0.113.9", noEgress.sourceIP(pinned, Route{}, ipv4).String())
+	require.Nil(t, noEgress.sourceIP(pinned, Route{}, ipv6))
+	require.True(t, noEgress.binds(pinned, Route{}))
+	require.False(t, noEgress.binds(&CipherEntry{ID: "any"}, Route{}))
+
+	// The source IP of the route comes first.
+	route := Route{Outbound: "second-ip", SourceIP: net.ParseIP("203.0.113.7")}
+	require.Equal(t, "203.0.113.7", egress.sourceIP(pinned, route, ipv4).String())
+	require.True(t, noEgress.binds(&CipherEntry{ID: "any"}, route))
+	// Targets of the other family fall back to the key and the pool.
+	require.Equal(t, "2001:db8::1", egress.sourceIP(pinned, route, ipv6).String())
+	require.Nil(t, noEgress.sourceIP(&CipherEntry{ID: "any"}, route, ipv6))
+	require.Nil(t, egress.sourceIP(pinned, Route{}, nil))
+}
+
+// startSourceIPServer starts a TCP server that answers each connection
+// with the IP it came from.
+func startSourceIPServer(t *testing.T) *net.TCPListener {
+	listener := makeLocalhostListener(t)
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(addrIP(conn.RemoteAddr()).String()))
+			conn.Close()
+		}
+	}()
+	return listener
+}
+
+func TestTCPEgress(t *testing.T) {
+	server := startSourceIPServer(t)
+	defer server.Close()
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(2))
+	require.NoError(t, err)
+	elements := cipherList.SnapshotForClientIP(nil)
+	elements[1].Value.(*CipherEntry).SetSourceIP(net.ParseIP("127.0.0.3"))
+	egress, err := NewEgress(EgressConfig{SourceIPs: []net.IP{net.ParseIP("127.0.0.2")}})
+	require.NoError(t, err)
+	s := NewTCPService(cipherList, nil, &probeTestMetrics{}, time.Second)
+	s.SetTargetIPValidator(allowAll)
+	s.SetEgress(egress)
+	traffic := &destinationRecorder{}
+	s.SetTrafficRecorder(traffic)
+	listener := makeLocalhostListener(t)
+	go s.Serve(listener)
+
+	for i, want := range []string{"127.0.0.2", "127.0.0.3"} {
+		cipher := elements[i].Value.(*CipherEntry).Cipher
+		dialer, err := client.NewShadowsocksStreamDialer(onet.TCPEndpoint{RemoteAddr: *listener.Addr().(*net.TCPAddr)}, cipher)
+		require.NoError(t, err)
+		conn, err := dialer.Dial(context.Background(), server.Addr().String())
+		require.NoError(t, err)
+		conn.Write(nil)
+		reply, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		require.Equal(t, want, string(reply))
+		conn.Close()
+	}
+	s.GracefulStop()
+	require.ElementsMatch(t, []string{"127.0.0.2", "127.0.0.3"}, traffic.sourceIPs)
+}
+
+func TestUDPEgress(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			_, addr, err := target.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			target.WriteTo([]byte(addrIP(addr).String()), addr)
+		}
+	}()
+	ciphers, err := MakeTestCiphers([]string{"asdf"})
+	require.NoError(t, err)
+	entry := ciphers.SnapshotForClientIP(nil)[0].Value.(*CipherEntry)
+	egress, err := NewEgress(EgressConfig{SourceIPs: []net.IP{net.ParseIP("127.0.0.2")}})
+	require.NoError(t, err)
+	clientConn := makePacketConn()
+	service := NewUDPService(timeout, ciphers, &natTestMetrics{})
+	service.SetTargetIPValidator(allowAll)
+	service.SetEgress(egress)
+	traffic := &destinationRecorder{}
+	service.SetTrafficRecorder(traffic)
+	go service.Serve(clientConn)
+
+	clientAddr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 54321}
+	plaintext := append(socks.ParseAddr(target.LocalAddr().String()), []byte("Hello")...)
+	ciphertext := make([]byte, entry.Cipher.SaltSize()+len(plaintext)+entry.Cipher.TagSize())
+	ss.Pack(ciphertext, plaintext, entry.Cipher)
+	clientConn.recv <- packet{addr: clientAddr, payload: ciphertext}
+
+	reply := <-clientConn.send
+	buf := make([]byte, len(reply.payload))
+	replyText, err := ss.Unpack(buf, reply.payload, entry.Cipher)
+	require.NoError(t, err)
+	tgtAddr := socks.SplitAddr(replyText)
+	require.Equal(t, "127.0.0.2", string(replyText[len(tgtAddr):]))
+	service.GracefulStop()
+	require.Equal(t, []string{"127.0.0.2"}, traffic.sourceIPs)
+}
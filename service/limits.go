@@ -0,0 +1,349 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	onet "myoss/net"
+)
+
+// RateLimiter is a token bucket limiting a flow of bytes, shared by all the
+// connections it applies to. The bucket holds up to one second of traffic.
+// A nil or zero-rate RateLimiter doesn't limit anything.
+type RateLimiter struct {
+	rate   int64 // Bytes per second, accessed atomically. 0 means no limit.
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a RateLimiter for `bytesPerSecond`.
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetRate(bytesPerSecond)
+	return l
+}
+
+// SetRate changes the rate, or removes the limit if `bytesPerSecond` is 0.
+func (l *RateLimiter) SetRate(bytesPerSecond int64) {
+	atomic.StoreInt64(&l.rate, bytesPerSecond)
+}
+
+// Rate returns the rate in bytes per second, or 0 if there is no limit.
+func (l *RateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.rate)
+}
+
+// refillLocked adds the tokens earned since the last call. l.mu must be held.
+func (l *RateLimiter) refillLocked(rate int64, now time.Time) {
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	} else {
+		l.tokens = float64(rate)
+	}
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	l.last = now
+}
+
+// reserve takes `n` tokens, going into debt if needed, and returns how long
+// the caller must wait before the debt is paid.
+func (l *RateLimiter) reserve(n int, now time.Time) time.Duration {
+	rate := l.Rate()
+	if rate <= 0 || n <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refillLocked(rate, now)
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+}
+
+// wait blocks until `n` bytes may pass.
+func (l *RateLimiter) wait(n int) {
+	if d := l.reserve(n, time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// allow takes `n` tokens if they are available, without waiting.
+func (l *RateLimiter) allow(n int, now time.Time) bool {
+	rate := l.Rate()
+	if rate <= 0 || n <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refillLocked(rate, now)
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// NodeLimits are rate limits shared by every key on the node. It may be nil,
+// and so may either field.
+type NodeLimits struct {
+	Upload   *RateLimiter
+	Download *RateLimiter
+}
+
+func (n *NodeLimits) upload() *RateLimiter {
+	if n == nil {
+		return nil
+	}
+	return n.Upload
+}
+
+func (n *NodeLimits) download() *RateLimiter {
+	if n == nil {
+		return nil
+	}
+	return n.Download
+}
+
+// SetRateLimit limits the upload and download of the key, in bytes per
+// second, across all its connections. 0 means no limit.
+func (e *CipherEntry) SetRateLimit(upload, download int64) {
+	e.upload.SetRate(upload)
+	e.download.SetRate(download)
+}
+
+// RateLimit returns the upload and download limits of the key.
+func (e *CipherEntry) RateLimit() (upload, download int64) {
+	return e.upload.Rate(), e.download.Rate()
+}
+
+// waitUpload blocks until `n` bytes may be sent to the target.
+func (e *CipherEntry) waitUpload(node *NodeLimits, n int) {
+	e.upload.wait(n)
+	node.upload().wait(n)
+}
+
+// waitDownload blocks until `n` bytes may be sent to the client.
+func (e *CipherEntry) waitDownload(node *NodeLimits, n int) {
+	e.download.wait(n)
+	node.download().wait(n)
+}
+
+// allowUpload reports whether a packet of `n` bytes may be sent to the target
+// now. Packets that don't fit are dropped, instead of blocking the UDP loop.
+func (e *CipherEntry) allowUpload(node *NodeLimits, n int) bool {
+	now := time.Now()
+	return e.upload.allow(n, now) && node.upload().allow(n, now)
+}
+
+// limitedConn applies the quota and rate limits of `entry` to the traffic
+// to and from the target.
+type limitedConn struct {
+	onet.DuplexConn
+	entry *CipherEntry
+	node  *NodeLimits
+	// exceeded is set atomically when the quota stopped the connection.
+	exceeded int32
+}
+
+func (c *limitedConn) check() error {
+	if !c.entry.quotaExceeded() {
+		return nil
+	}
+	atomic.StoreInt32(&c.exceeded, 1)
+	// Unblock the other direction too.
+	c.DuplexConn.SetDeadline(time.Now())
+	return errQuotaExceeded
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	if err := c.check(); err != nil {
+		return 0, err
+	}
+	n, err := c.DuplexConn.Read(b)
+	c.entry.addUsage(n)
+	c.entry.waitDownload(c.node, n)
+	return n, err
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	if err := c.check(); err != nil {
+		return 0, err
+	}
+	c.entry.waitUpload(c.node, len(b))
+	n, err := c.DuplexConn.Write(b)
+	c.entry.addUsage(n)
+	return n, err
+}
+
+// quotaExceeded reports whether the quota stopped the connection.
+func (c *limitedConn) quotaExceeded() bool {
+	return atomic.LoadInt32(&c.exceeded) == 1
+}
+
+// defaultDeviceWindow is used when SetConnectionLimits is given no window.
+const defaultDeviceWindow = 10 * time.Minute
+
+// connLimits caps the concurrent use of a key. The fields are accessed
+// atomically, and 0 means no limit.
+type connLimits struct {
+	maxTCP     int64
+	maxUDP     int64
+	maxDevices int64
+	window     int64 // A time.Duration.
+}
+
+// deviceSet tracks the client IPs of a key. An IP counts as a device while
+// it has open connections, and for the device window after the last one.
+type deviceSet struct {
+	mu      sync.Mutex
+	devices map[string]*device
+}
+
+type device struct {
+	active   int
+	lastSeen time.Time
+}
+
+// SetConnectionLimits caps the simultaneous TCP connections, UDP NAT
+// sessions and distinct client IPs seen within `window` of the key.
+// 0 means no limit.
+func (e *CipherEntry) SetConnectionLimits(maxTCP, maxUDP, maxDevices int, window time.Duration) {
+	if window <= 0 {
+		window = defaultDeviceWindow
+	}
+	atomic.StoreInt64(&e.connLimits.maxTCP, int64(maxTCP))
+	atomic.StoreInt64(&e.connLimits.maxUDP, int64(maxUDP))
+	atomic.StoreInt64(&e.connLimits.maxDevices, int64(maxDevices))
+	atomic.StoreInt64(&e.connLimits.window, int64(window))
+}
+
+// ConnectionLimits returns the limits set by SetConnectionLimits.
+func (e *CipherEntry) ConnectionLimits() (maxTCP, maxUDP, maxDevices int) {
+	return int(atomic.LoadInt64(&e.connLimits.maxTCP)), int(atomic.LoadInt64(&e.connLimits.maxUDP)),
+		int(atomic.LoadInt64(&e.connLimits.maxDevices))
+}
+
+func (e *CipherEntry) deviceWindow() time.Duration {
+	if window := time.Duration(atomic.LoadInt64(&e.connLimits.window)); window > 0 {
+		return window
+	}
+	return defaultDeviceWindow
+}
+
+// acquireTCP counts a new TCP connection, unless the key is at its limit.
+func (e *CipherEntry) acquireTCP() bool {
+	for {
+		max := atomic.LoadInt64(&e.connLimits.maxTCP)
+		current := atomic.LoadInt64(&e.tcpConns)
+		if max > 0 && current >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&e.tcpConns, current, current+1) {
+			return true
+		}
+	}
+}
+
+func (e *CipherEntry) releaseTCP() {
+	atomic.AddInt64(&e.tcpConns, -1)
+}
+
+// acquireUDP counts a new UDP NAT session, unless the key is at its limit.
+func (e *CipherEntry) acquireUDP() bool {
+	for {
+		max := atomic.LoadInt64(&e.connLimits.maxUDP)
+		current := atomic.LoadInt64(&e.udpSessions)
+		if max > 0 && current >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&e.udpSessions, current, current+1) {
+			return true
+		}
+	}
+}
+
+func (e *CipherEntry) releaseUDP() {
+	atomic.AddInt64(&e.udpSessions, -1)
+}
+
+// pruneDevicesLocked forgets idle devices not seen within the window. e.devices.mu must be held.
+func (e *CipherEntry) pruneDevicesLocked(now time.Time) {
+	window := e.deviceWindow()
+	for ip, d := range e.devices.devices {
+		if d.active == 0 && now.Sub(d.lastSeen) > window {
+			delete(e.devices.devices, ip)
+		}
+	}
+}
+
+// acquireDevice counts a connection from `ip`, unless it is a new device and
+// the key is at its device limit. Every successful call must be followed by
+// releaseDevice.
+func (e *CipherEntry) acquireDevice(ip net.IP, now time.Time) bool {
+	if ip == nil {
+		return true
+	}
+	key := ip.String()
+	e.devices.mu.Lock()
+	defer e.devices.mu.Unlock()
+	if e.devices.devices == nil {
+		e.devices.devices = make(map[string]*device)
+	}
+	e.pruneDevicesLocked(now)
+	d, ok := e.devices.devices[key]
+	if !ok {
+		if max := atomic.LoadInt64(&e.connLimits.maxDevices); max > 0 && int64(len(e.devices.devices)) >= max {
+			return false
+		}
+		d = &device{}
+		e.devices.devices[key] = d
+	}
+	d.active++
+	d.lastSeen = now
+	return true
+}
+
+// releaseDevice ends a connection from `ip`.
+func (e *CipherEntry) releaseDevice(ip net.IP, now time.Time) {
+	if ip == nil {
+		return
+	}
+	e.devices.mu.Lock()
+	defer e.devices.mu.Unlock()
+	if d, ok := e.devices.devices[ip.String()]; ok && d.active > 0 {
+		d.active--
+		d.lastSeen = now
+	}
+}
+
+// Devices returns the number of distinct client IPs that are connected or
+// were seen within the device window.
+func (e *CipherEntry) Devices() int {
+	e.devices.mu.Lock()
+	defer e.devices.mu.Unlock()
+	e.pruneDevicesLocked(time.Now())
+	return len(e.devices.devices)
+}
@@ -0,0 +1,186 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ss "myoss/shadowsocks"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	l := NewRateLimiter(1000)
+	now := time.Now()
+	// The bucket starts full, with one second of traffic.
+	require.Equal(t, time.Duration(0), l.reserve(1000, now))
+	require.Equal(t, 500*time.Millisecond, l.reserve(500, now))
+	// Concurrent users queue up behind each other.
+	require.Equal(t, time.Second, l.reserve(500, now))
+	// After two seconds, the debt is paid and one more second is available.
+	now = now.Add(2 * time.Second)
+	require.Equal(t, time.Duration(0), l.reserve(1000, now))
+
+	// The rate can change while in use.
+	l.SetRate(0)
+	require.Equal(t, time.Duration(0), l.reserve(1<<30, now))
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := NewRateLimiter(100)
+	now := time.Now()
+	require.True(t, l.allow(60, now))
+	require.False(t, l.allow(60, now))
+	require.True(t, l.allow(40, now))
+	require.True(t, l.allow(50, now.Add(500*time.Millisecond)))
+
+	var unlimited *RateLimiter
+	require.True(t, unlimited.allow(1<<30, now))
+	require.Equal(t, time.Duration(0), unlimited.reserve(1<<30, now))
+}
+
+func TestSetRateLimit(t *testing.T) {
+	entry := &CipherEntry{}
+	entry.SetRateLimit(100, 200)
+	upload, download := entry.RateLimit()
+	require.Equal(t, int64(100), upload)
+	require.Equal(t, int64(200), download)
+	node := &NodeLimits{Upload: NewRateLimiter(50)}
+	require.True(t, entry.allowUpload(node, 50))
+	// The key has tokens left, but the node doesn't.
+	require.False(t, entry.allowUpload(node, 10))
+	require.True(t, entry.allowUpload(nil, 10))
+}
+
+func TestUDPRateLimit(t *testing.T) {
+	ciphers, err := MakeTestCiphers([]string{"asdf"})
+	require.NoError(t, err)
+	entry := ciphers.SnapshotForClientIP(nil)[0].Value.(*CipherEntry)
+	entry.SetRateLimit(25, 0)
+	clientConn := makePacketConn()
+	metrics := &natTestMetrics{}
+	service := NewUDPService(timeout, ciphers, metrics)
+	service.SetTargetIPValidator(allowAll)
+	go service.Serve(clientConn)
+
+	targetAddr := socks.ParseAddr("127.0.0.1:9")
+	for i := 0; i < 3; i++ {
+		plaintext := append(targetAddr, make([]byte, 10)...)
+		ciphertext := make([]byte, entry.Cipher.SaltSize()+len(plaintext)+entry.Cipher.TagSize())
+		ss.Pack(ciphertext, plaintext, entry.Cipher)
+		clientConn.recv <- packet{
+			addr:    &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 54321},
+			payload: ciphertext,
+		}
+	}
+	service.GracefulStop()
+
+	require.Len(t, metrics.upstreamPackets, 3)
+	require.Equal(t, "OK", metrics.upstreamPackets[0].status)
+	require.Equal(t, "OK", metrics.upstreamPackets[1].status)
+	require.Equal(t, "ERR_RATE_LIMIT", metrics.upstreamPackets[2].status)
+}
+
+func TestAcquireTCP(t *testing.T) {
+	var entry CipherEntry
+	entry.SetConnectionLimits(2, 0, 0, 0)
+	require.True(t, entry.acquireTCP())
+	require.True(t, entry.acquireTCP())
+	require.False(t, entry.acquireTCP())
+	require.Equal(t, int64(2), entry.ActiveTCPConnections())
+	entry.releaseTCP()
+	require.True(t, entry.acquireTCP())
+
+	entry.SetConnectionLimits(0, 0, 0, 0)
+	require.True(t, entry.acquireTCP())
+}
+
+func TestAcquireUDP(t *testing.T) {
+	var entry CipherEntry
+	entry.SetConnectionLimits(0, 2, 0, 0)
+	var wg sync.WaitGroup
+	var acquired int64
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if entry.acquireUDP() {
+				atomic.AddInt64(&acquired, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int64(2), acquired)
+	require.Equal(t, int64(2), entry.ActiveUDPSessions())
+	entry.releaseUDP()
+	require.True(t, entry.acquireUDP())
+	require.False(t, entry.acquireUDP())
+
+	entry.SetConnectionLimits(0, 0, 0, 0)
+	require.True(t, entry.acquireUDP())
+}
+
+func TestAcquireDevice(t *testing.T) {
+	var entry CipherEntry
+	entry.SetConnectionLimits(0, 0, 1, time.Minute)
+	ip1, ip2 := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	now := time.Now()
+
+	require.True(t, entry.acquireDevice(ip1, now))
+	require.True(t, entry.acquireDevice(ip1, now), "connections from a known device are allowed")
+	require.False(t, entry.acquireDevice(ip2, now))
+	entry.releaseDevice(ip1, now)
+	entry.releaseDevice(ip1, now)
+	// The device still counts within the window.
+	require.False(t, entry.acquireDevice(ip2, now.Add(30*time.Second)))
+	require.Equal(t, 1, entry.Devices())
+	// And is forgotten after it.
+	require.True(t, entry.acquireDevice(ip2, now.Add(2*time.Minute)))
+	require.True(t, entry.acquireDevice(nil, now))
+}
+
+func TestUDPSessionLimit(t *testing.T) {
+	ciphers, err := MakeTestCiphers([]string{"asdf"})
+	require.NoError(t, err)
+	entry := ciphers.SnapshotForClientIP(nil)[0].Value.(*CipherEntry)
+	entry.SetConnectionLimits(0, 1, 0, 0)
+	clientConn := makePacketConn()
+	metrics := &natTestMetrics{}
+	service := NewUDPService(timeout, ciphers, metrics)
+	service.SetTargetIPValidator(allowAll)
+	go service.Serve(clientConn)
+
+	targetAddr := socks.ParseAddr("127.0.0.1:9")
+	for _, port := range []int{54321, 54322} {
+		plaintext := append(targetAddr, make([]byte, 10)...)
+		ciphertext := make([]byte, entry.Cipher.SaltSize()+len(plaintext)+entry.Cipher.TagSize())
+		ss.Pack(ciphertext, plaintext, entry.Cipher)
+		clientConn.recv <- packet{
+			addr:    &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: port},
+			payload: ciphertext,
+		}
+	}
+	service.GracefulStop()
+
+	require.Len(t, metrics.upstreamPackets, 2)
+	require.Equal(t, "OK", metrics.upstreamPackets[0].status)
+	require.Equal(t, "ERR_CONN_LIMIT", metrics.upstreamPackets[1].status)
+}
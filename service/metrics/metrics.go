@@ -34,17 +34,44 @@ type ShadowsocksMetrics interface {
 	GetLocation(net.Addr) (string, error)
 
 	SetNumAccessKeys(numKeys int, numPorts int)
+	// SetKeyDevices replaces the number of devices of every access key.
+	SetKeyDevices(devices map[string]int)
+	// SetBannedIPs sets the number of client IPs banned for failing authentication.
+	SetBannedIPs(count int)
+	// SetStreamCipherKeys sets the number of access keys that use an insecure
+	// legacy stream cipher.
+	SetStreamCipherKeys(count int)
+	// AddReload records the outcome of a key reload caused by `trigger`.
+	AddReload(trigger, status string, addedKeys, removedKeys, addedPorts, removedPorts int)
+
+	// Traffic report spool metrics
+	SetReportSpool(segments int, bytes int64)
+	AddReportBatch(status string, entries int)
+	AddReportSpoolDropped(entries int)
 
 	// TCP metrics
 	AddOpenTCPConnection(clientLocation string)
 	AddClosedTCPConnection(clientLocation, accessKey, status string, data ProxyMetrics, timeToCipher, duration time.Duration)
 	AddTCPProbe(status, drainResult string, port int, data ProxyMetrics)
+	// AddTCPFallback records a client that failed authentication with `status`
+	// and was relayed to the fallback, with `result`.
+	AddTCPFallback(status, result string, port int)
 
 	// UDP metrics
 	AddUDPPacketFromClient(clientLocation, accessKey, status string, clientProxyBytes, proxyTargetBytes int, timeToCipher time.Duration)
 	AddUDPPacketFromTarget(clientLocation, accessKey, status string, targetProxyBytes, proxyClientBytes int)
 	AddUDPNatEntry()
 	RemoveUDPNatEntry()
+
+	// DNS metrics
+	// AddDNSQuery records a target name query answered with `result` after
+	// `duration`, by `upstream` or by the cache if it's "cache".
+	AddDNSQuery(upstream, result string, duration time.Duration)
+
+	// Routing metrics
+	// AddOutboundConnection records a TCP connection or UDP session, per
+	// `proto`, that was routed through `outbound` and ended with `status`.
+	AddOutboundConnection(proto, outbound, status string)
 }
 
 type shadowsocksMetrics struct {
@@ -53,12 +80,24 @@ type shadowsocksMetrics struct {
 	buildInfo            *prometheus.GaugeVec
 	accessKeys           prometheus.Gauge
 	ports                prometheus.Gauge
+	keyDevices           *prometheus.GaugeVec
+	bannedIPs            prometheus.Gauge
+	streamCipherKeys     prometheus.Gauge
+	reloads              *prometheus.CounterVec
+	reloadChanges        *prometheus.CounterVec
+	lastReload           prometheus.Gauge
+	reportSpoolSegments  prometheus.Gauge
+	reportSpoolBytes     prometheus.Gauge
+	reportBatches        *prometheus.CounterVec
+	reportEntries        *prometheus.CounterVec
+	reportDropped        prometheus.Counter
 	dataBytes            *prometheus.CounterVec
 	dataBytesPerLocation *prometheus.CounterVec
 	timeToCipherMs       *prometheus.HistogramVec
 	// TODO: Add time to first byte.
 
 	tcpProbes               *prometheus.HistogramVec
+	tcpFallbacks            *prometheus.CounterVec
 	tcpOpenConnections      *prometheus.CounterVec
 	tcpClosedConnections    *prometheus.CounterVec
 	tcpConnectionDurationMs *prometheus.HistogramVec
@@ -66,6 +105,10 @@ type shadowsocksMetrics struct {
 	udpPacketsFromClientPerLocation *prometheus.CounterVec
 	udpAddedNatEntries              prometheus.Counter
 	udpRemovedNatEntries            prometheus.Counter
+
+	dnsQueryDurationMs *prometheus.HistogramVec
+
+	outboundConnections *prometheus.CounterVec
 }
 
 func newShadowsocksMetrics(ipCountryDB *geoip2.Reader) *shadowsocksMetrics {
@@ -87,12 +130,78 @@ func newShadowsocksMetrics(ipCountryDB *geoip2.Reader) *shadowsocksMetrics {
 			Name:      "ports",
 			Help:      "Count of open Shadowsocks ports",
 		}),
+		keyDevices: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "shadowsocks",
+			Name:      "key_devices",
+			Help:      "Count of distinct client IPs recently connected, per access key",
+		}, []string{"access_key"}),
+		bannedIPs: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "shadowsocks",
+			Name:      "banned_ips",
+			Help:      "Count of client IPs banned for failing authentication",
+		}),
+		streamCipherKeys: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "shadowsocks",
+			Name:      "stream_cipher_keys",
+			Help:      "Count of access keys using insecure legacy stream ciphers",
+		}),
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "shadowsocks",
+			Name:      "reloads",
+			Help:      "Count of key reloads, per trigger and status",
+		}, []string{"trigger", "status"}),
+		reloadChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "shadowsocks",
+			Name:      "reload_changes",
+			Help:      "Keys and ports added or removed by reloads",
+		}, []string{"kind", "change"}),
+		lastReload: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "shadowsocks",
+			Name:      "last_successful_reload_timestamp_seconds",
+			Help:      "Time of the last successful key reload",
+		}),
+		reportSpoolSegments: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "shadowsocks",
+			Subsystem: "report",
+			Name:      "spool_segments",
+			Help:      "Count of traffic report segments waiting to be sent",
+		}),
+		reportSpoolBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "shadowsocks",
+			Subsystem: "report",
+			Name:      "spool_bytes",
+			Help:      "Size of the traffic report spool",
+		}),
+		reportBatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "shadowsocks",
+			Subsystem: "report",
+			Name:      "batches",
+			Help:      "Count of traffic report batches sent, per status",
+		}, []string{"status"}),
+		reportEntries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "shadowsocks",
+			Subsystem: "report",
+			Name:      "entries",
+			Help:      "Count of traffic report entries sent, per status",
+		}, []string{"status"}),
+		reportDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "shadowsocks",
+			Subsystem: "report",
+			Name:      "dropped_entries",
+			Help:      "Traffic report entries dropped because the spool was full",
+		}),
 		tcpProbes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Namespace: "shadowsocks",
 			Name:      "tcp_probes",
 			Buckets:   []float64{0, 49, 50, 51, 73, 91},
 			Help:      "Histogram of number of bytes from client to proxy, for detecting possible probes",
 		}, []string{"port", "status", "error"}),
+		tcpFallbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "shadowsocks",
+			Subsystem: "tcp",
+			Name:      "fallbacks",
+			Help:      "Count of TCP connections that failed authentication and were relayed to the fallback",
+		}, []string{"port", "status", "result"}),
 		tcpOpenConnections: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: "shadowsocks",
 			Subsystem: "tcp",
@@ -132,6 +241,20 @@ func newShadowsocksMetrics(ipCountryDB *geoip2.Reader) *shadowsocksMetrics {
 				Name:      "data_bytes_per_location",
 				Help:      "Bytes transferred by the proxy, per location",
 			}, []string{"dir", "proto", "location"}),
+		dnsQueryDurationMs: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "dns",
+				Name:      "query_duration_ms",
+				Help:      "Time needed to resolve target names, per upstream and result",
+				Buckets:   []float64{1, 10, 50, 100, 500, 1000, 5000},
+			}, []string{"upstream", "result"}),
+		outboundConnections: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "shadowsocks",
+				Name:      "outbound_connections",
+				Help:      "TCP connections and UDP sessions, per outbound they were routed through and status",
+			}, []string{"proto", "outbound", "status"}),
 		timeToCipherMs: prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
 				Namespace: "shadowsocks",
@@ -170,8 +293,10 @@ func newShadowsocksMetrics(ipCountryDB *geoip2.Reader) *shadowsocksMetrics {
 func NewPrometheusShadowsocksMetrics(ipCountryDB *geoip2.Reader, registerer prometheus.Registerer) ShadowsocksMetrics {
 	m := newShadowsocksMetrics(ipCountryDB)
 	// TODO: Is it possible to pass where to register the collectors?
-	registerer.MustRegister(m.buildInfo, m.accessKeys, m.ports, m.tcpProbes, m.tcpOpenConnections, m.tcpClosedConnections, m.tcpConnectionDurationMs,
-		m.dataBytes, m.dataBytesPerLocation, m.timeToCipherMs, m.udpPacketsFromClientPerLocation, m.udpAddedNatEntries, m.udpRemovedNatEntries)
+	registerer.MustRegister(m.buildInfo, m.accessKeys, m.ports, m.keyDevices, m.bannedIPs, m.streamCipherKeys, m.reloads, m.reloadChanges, m.lastReload,
+		m.reportSpoolSegments, m.reportSpoolBytes, m.reportBatches, m.reportEntries, m.reportDropped, m.tcpProbes, m.tcpFallbacks, m.tcpOpenConnections, m.tcpClosedConnections, m.tcpConnectionDurationMs,
+		m.dataBytes, m.dataBytesPerLocation, m.timeToCipherMs, m.udpPacketsFromClientPerLocation, m.udpAddedNatEntries, m.udpRemovedNatEntries,
+		m.dnsQueryDurationMs, m.outboundConnections)
 	return m
 }
 
@@ -222,6 +347,46 @@ func (m *shadowsocksMetrics) SetNumAccessKeys(numKeys int, ports int) {
 	m.ports.Set(float64(ports))
 }
 
+func (m *shadowsocksMetrics) SetKeyDevices(devices map[string]int) {
+	m.keyDevices.Reset()
+	for accessKey, count := range devices {
+		m.keyDevices.WithLabelValues(accessKey).Set(float64(count))
+	}
+}
+
+func (m *shadowsocksMetrics) SetBannedIPs(count int) {
+	m.bannedIPs.Set(float64(count))
+}
+
+func (m *shadowsocksMetrics) SetStreamCipherKeys(count int) {
+	m.streamCipherKeys.Set(float64(count))
+}
+
+func (m *shadowsocksMetrics) AddReload(trigger, status string, addedKeys, removedKeys, addedPorts, removedPorts int) {
+	m.reloads.WithLabelValues(trigger, status).Inc()
+	if status == "OK" {
+		m.lastReload.SetToCurrentTime()
+	}
+	addIfNonZero(int64(addedKeys), m.reloadChanges, "key", "added")
+	addIfNonZero(int64(removedKeys), m.reloadChanges, "key", "removed")
+	addIfNonZero(int64(addedPorts), m.reloadChanges, "port", "added")
+	addIfNonZero(int64(removedPorts), m.reloadChanges, "port", "removed")
+}
+
+func (m *shadowsocksMetrics) SetReportSpool(segments int, bytes int64) {
+	m.reportSpoolSegments.Set(float64(segments))
+	m.reportSpoolBytes.Set(float64(bytes))
+}
+
+func (m *shadowsocksMetrics) AddReportBatch(status string, entries int) {
+	m.reportBatches.WithLabelValues(status).Inc()
+	m.reportEntries.WithLabelValues(status).Add(float64(entries))
+}
+
+func (m *shadowsocksMetrics) AddReportSpoolDropped(entries int) {
+	m.reportDropped.Add(float64(entries))
+}
+
 func (m *shadowsocksMetrics) AddOpenTCPConnection(clientLocation string) {
 	m.tcpOpenConnections.WithLabelValues(clientLocation).Inc()
 }
@@ -256,6 +421,10 @@ func (m *shadowsocksMetrics) AddTCPProbe(status, drainResult string, port int, d
 	m.tcpProbes.WithLabelValues(strconv.Itoa(port), status, drainResult).Observe(float64(data.ClientProxy))
 }
 
+func (m *shadowsocksMetrics) AddTCPFallback(status, result string, port int) {
+	m.tcpFallbacks.WithLabelValues(strconv.Itoa(port), status, result).Inc()
+}
+
 func (m *shadowsocksMetrics) AddUDPPacketFromClient(clientLocation, accessKey, status string, clientProxyBytes, proxyTargetBytes int, timeToCipher time.Duration) {
 	m.timeToCipherMs.WithLabelValues("udp", isFound(accessKey)).Observe(timeToCipher.Seconds() * 1000)
 	m.udpPacketsFromClientPerLocation.WithLabelValues(clientLocation, status).Inc()
@@ -280,6 +449,14 @@ func (m *shadowsocksMetrics) RemoveUDPNatEntry() {
 	m.udpRemovedNatEntries.Inc()
 }
 
+func (m *shadowsocksMetrics) AddDNSQuery(upstream, result string, duration time.Duration) {
+	m.dnsQueryDurationMs.WithLabelValues(upstream, result).Observe(duration.Seconds() * 1000)
+}
+
+func (m *shadowsocksMetrics) AddOutboundConnection(proto, outbound, status string) {
+	m.outboundConnections.WithLabelValues(proto, outbound, status).Inc()
+}
+
 type ProxyMetrics struct {
 	ClientProxy int64
 	ProxyTarget int64
@@ -337,12 +514,21 @@ type NoOpMetrics struct{}
 func (m *NoOpMetrics) SetBuildInfo(version string) {}
 func (m *NoOpMetrics) AddTCPProbe(status, drainResult string, port int, data ProxyMetrics) {
 }
+func (m *NoOpMetrics) AddTCPFallback(status, result string, port int) {}
 func (m *NoOpMetrics) AddClosedTCPConnection(clientLocation, accessKey, status string, data ProxyMetrics, timeToCipher, duration time.Duration) {
 }
 func (m *NoOpMetrics) GetLocation(net.Addr) (string, error) {
 	return "", nil
 }
 func (m *NoOpMetrics) SetNumAccessKeys(numKeys int, numPorts int) {}
+func (m *NoOpMetrics) SetKeyDevices(devices map[string]int)       {}
+func (m *NoOpMetrics) SetBannedIPs(count int)                     {}
+func (m *NoOpMetrics) SetStreamCipherKeys(count int)              {}
+func (m *NoOpMetrics) AddReload(trigger, status string, addedKeys, removedKeys, addedPorts, removedPorts int) {
+}
+func (m *NoOpMetrics) SetReportSpool(segments int, bytes int64)   {}
+func (m *NoOpMetrics) AddReportBatch(status string, entries int)  {}
+func (m *NoOpMetrics) AddReportSpoolDropped(entries int)          {}
 func (m *NoOpMetrics) AddOpenTCPConnection(clientLocation string) {}
 func (m *NoOpMetrics) AddUDPPacketFromClient(clientLocation, accessKey, status string, clientProxyBytes, proxyTargetBytes int, timeToCipher time.Duration) {
 }
@@ -350,3 +536,6 @@ func (m *NoOpMetrics) AddUDPPacketFromTarget(clientLocation, accessKey, status s
 }
 func (m *NoOpMetrics) AddUDPNatEntry()    {}
 func (m *NoOpMetrics) RemoveUDPNatEntry() {}
+func (m *NoOpMetrics) AddDNSQuery(upstream, result string, duration time.Duration) {
+}
+func (m *NoOpMetrics) AddOutboundConnection(proto, outbound, status string) {}
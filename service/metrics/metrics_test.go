@@ -18,13 +18,25 @@ func TestMethodsDontPanic(t *testing.T) {
 		ProxyClient: 4,
 	}
 	ssMetrics.SetNumAccessKeys(20, 2)
+	ssMetrics.SetKeyDevices(map[string]int{"1": 2, "2": 1})
+	ssMetrics.SetBannedIPs(3)
+	ssMetrics.SetStreamCipherKeys(1)
+	ssMetrics.AddReload("sighup", "OK", 2, 1, 1, 0)
+	ssMetrics.AddReload("poll", "ERR", 0, 0, 0, 0)
+	ssMetrics.SetReportSpool(2, 1024)
+	ssMetrics.AddReportBatch("OK", 10)
+	ssMetrics.AddReportSpoolDropped(3)
 	ssMetrics.AddOpenTCPConnection("US")
 	ssMetrics.AddClosedTCPConnection("US", "1", "OK", proxyMetrics, 10*time.Millisecond, 100*time.Millisecond)
 	ssMetrics.AddTCPProbe("ERR_CIPHER", "eof", 443, proxyMetrics)
+	ssMetrics.AddTCPFallback("ERR_CIPHER", "OK", 443)
 	ssMetrics.AddUDPPacketFromClient("US", "2", "OK", 10, 20, 10*time.Millisecond)
 	ssMetrics.AddUDPPacketFromTarget("US", "3", "OK", 10, 20)
 	ssMetrics.AddUDPNatEntry()
 	ssMetrics.RemoveUDPNatEntry()
+	ssMetrics.AddDNSQuery("udp://1.1.1.1:53", "OK", 10*time.Millisecond)
+	ssMetrics.AddDNSQuery("cache", "NOT_FOUND", 0)
+	ssMetrics.AddOutboundConnection("tcp", "direct", "OK")
 }
 
 func BenchmarkGetLocation(b *testing.B) {
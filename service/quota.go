@@ -0,0 +1,138 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// QuotaPeriod is how often the usage of a quota is reset. Periods start at
+// midnight UTC.
+type QuotaPeriod int32
+
+const (
+	// QuotaNever means the usage is never reset.
+	QuotaNever QuotaPeriod = iota
+	QuotaDaily
+	QuotaWeekly
+	QuotaMonthly
+)
+
+// ParseQuotaPeriod parses "", "daily", "weekly" or "monthly".
+func ParseQuotaPeriod(period string) (QuotaPeriod, error) {
+	switch period {
+	case "":
+		return QuotaNever, nil
+	case "daily":
+		return QuotaDaily, nil
+	case "weekly":
+		return QuotaWeekly, nil
+	case "monthly":
+		return QuotaMonthly, nil
+	}
+	return QuotaNever, fmt.Errorf("unknown quota period %q, want daily, weekly or monthly", period)
+}
+
+// start returns the start of the period that contains `now`, as a Unix time.
+func (p QuotaPeriod) start(now time.Time) int64 {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	switch p {
+	case QuotaDaily:
+		return day.Unix()
+	case QuotaWeekly:
+		// Weeks start on Monday.
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7).Unix()
+	case QuotaMonthly:
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).Unix()
+	}
+	return 0
+}
+
+var errQuotaExceeded = errors.New("data quota exceeded")
+
+// quota is the data allowance of a CipherEntry. All fields are accessed atomically.
+type quota struct {
+	limit       int64 // Bytes per period, or 0 for no limit.
+	period      int32 // A QuotaPeriod.
+	used        int64
+	periodStart int64
+
+	// The last usage reported by the user source, and the period it was
+	// counted in. Only SetQuota accesses them, from one goroutine.
+	reported       int64
+	reportedPeriod QuotaPeriod
+	reportedStart  int64
+}
+
+// SetQuota limits the key to `limit` bytes per `period`, or removes the limit
+// if `limit` is 0. `used` is the usage in the current period according to the
+// user source. It only raises the usage counted by the server, so that a
+// source that lags behind doesn't give back traffic that was already used.
+// After a new period starts, the source is taken to still report the last one
+// until its usage drops below what it reported then, so that the reset isn't
+// undone by stale usage.
+func (e *CipherEntry) SetQuota(limit int64, period QuotaPeriod, used int64) {
+	atomic.StoreInt32(&e.quota.period, int32(period))
+	atomic.StoreInt64(&e.quota.limit, limit)
+	e.resetExpiredQuota(time.Now())
+	start := atomic.LoadInt64(&e.quota.periodStart)
+	q := &e.quota
+	if q.reportedStart != start && q.reportedPeriod == period && q.reported > 0 && used >= q.reported {
+		return
+	}
+	q.reported, q.reportedPeriod, q.reportedStart = used, period, start
+	for {
+		current := atomic.LoadInt64(&e.quota.used)
+		if used <= current || atomic.CompareAndSwapInt64(&e.quota.used, current, used) {
+			return
+		}
+	}
+}
+
+// QuotaUsage returns the limit and the usage in the current period.
+func (e *CipherEntry) QuotaUsage() (limit, used int64) {
+	e.resetExpiredQuota(time.Now())
+	return atomic.LoadInt64(&e.quota.limit), atomic.LoadInt64(&e.quota.used)
+}
+
+// resetExpiredQuota resets the usage if a new period started.
+func (e *CipherEntry) resetExpiredQuota(now time.Time) {
+	start := QuotaPeriod(atomic.LoadInt32(&e.quota.period)).start(now)
+	previous := atomic.LoadInt64(&e.quota.periodStart)
+	if previous != start && atomic.CompareAndSwapInt64(&e.quota.periodStart, previous, start) {
+		atomic.StoreInt64(&e.quota.used, 0)
+	}
+}
+
+// quotaExceeded reports whether the key has used up its quota.
+func (e *CipherEntry) quotaExceeded() bool {
+	limit := atomic.LoadInt64(&e.quota.limit)
+	if limit == 0 {
+		return false
+	}
+	e.resetExpiredQuota(time.Now())
+	return atomic.LoadInt64(&e.quota.used) >= limit
+}
+
+// addUsage counts `n` bytes against the quota.
+func (e *CipherEntry) addUsage(n int) {
+	if n > 0 {
+		atomic.AddInt64(&e.quota.used, int64(n))
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	ss "myoss/shadowsocks"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQuotaPeriod(t *testing.T) {
+	for name, want := range map[string]QuotaPeriod{"": QuotaNever, "daily": QuotaDaily, "weekly": QuotaWeekly, "monthly": QuotaMonthly} {
+		period, err := ParseQuotaPeriod(name)
+		require.NoError(t, err)
+		require.Equal(t, want, period)
+	}
+	_, err := ParseQuotaPeriod("yearly")
+	require.Error(t, err)
+}
+
+func TestQuotaPeriodStart(t *testing.T) {
+	// A Wednesday.
+	now := time.Date(2024, 5, 15, 13, 30, 0, 0, time.UTC)
+	require.Equal(t, int64(0), QuotaNever.start(now))
+	require.Equal(t, time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC).Unix(), QuotaDaily.start(now))
+	require.Equal(t, time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC).Unix(), QuotaWeekly.start(now))
+	require.Equal(t, time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC).Unix(), QuotaWeekly.start(time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)))
+	require.Equal(t, time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC).Unix(), QuotaWeekly.start(time.Date(2024, 5, 19, 23, 0, 0, 0, time.UTC)))
+	require.Equal(t, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC).Unix(), QuotaMonthly.start(now))
+}
+
+func TestSetQuota(t *testing.T) {
+	entry := &CipherEntry{}
+	require.False(t, entry.quotaExceeded())
+	entry.addUsage(100)
+	// No limit.
+	require.False(t, entry.quotaExceeded())
+
+	entry.SetQuota(150, QuotaNever, 0)
+	require.False(t, entry.quotaExceeded())
+	entry.addUsage(50)
+	require.True(t, entry.quotaExceeded())
+	limit, used := entry.QuotaUsage()
+	require.Equal(t, int64(150), limit)
+	require.Equal(t, int64(150), used)
+
+	// A lagging source doesn't lower the usage.
+	entry.SetQuota(1000, QuotaNever, 10)
+	_, used = entry.QuotaUsage()
+	require.Equal(t, int64(150), used)
+	entry.SetQuota(1000, QuotaNever, 500)
+	_, used = entry.QuotaUsage()
+	require.Equal(t, int64(500), used)
+}
+
+func TestQuotaReset(t *testing.T) {
+	entry := &CipherEntry{}
+	entry.SetQuota(100, QuotaDaily, 100)
+	require.True(t, entry.quotaExceeded())
+	// Pretend the current period started yesterday.
+	entry.quota.periodStart -= 24 * 60 * 60
+	require.False(t, entry.quotaExceeded())
+	_, used := entry.QuotaUsage()
+	require.Equal(t, int64(0), used)
+}
+
+func TestQuotaResetStaleSource(t *testing.T) {
+	entry := &CipherEntry{}
+	entry.SetQuota(100, QuotaDaily, 100)
+	require.True(t, entry.quotaExceeded())
+	// Pretend the current period started yesterday.
+	entry.quota.periodStart -= 24 * 60 * 60
+	entry.quota.reportedStart -= 24 * 60 * 60
+
+	// The source still reports the usage of yesterday.
+	entry.SetQuota(100, QuotaDaily, 100)
+	require.False(t, entry.quotaExceeded())
+	entry.addUsage(10)
+	entry.SetQuota(100, QuotaDaily, 120)
+	_, used := entry.QuotaUsage()
+	require.Equal(t, int64(10), used)
+
+	// Once the source resets too, its usage counts again.
+	entry.SetQuota(100, QuotaDaily, 30)
+	_, used = entry.QuotaUsage()
+	require.Equal(t, int64(30), used)
+	entry.SetQuota(100, QuotaDaily, 100)
+	require.True(t, entry.quotaExceeded())
+}
+
+func TestTCPQuota(t *testing.T) {
+	target, running := startDiscardServer(t)
+	defer running.Wait()
+	defer target.Close()
+
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	entry := cipherList.SnapshotForClientIP(nil)[0].Value.(*CipherEntry)
+	entry.SetQuota(10, QuotaNever, 0)
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, nil, testMetrics, 200*time.Millisecond)
+	s.SetTargetIPValidator(allowAll)
+	go s.Serve(listener)
+
+	run := func() {
+		conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+		require.NoError(t, err)
+		// Sends 12 and then 9 bytes, in separate chunks.
+		_, err = conn.Write(makeClientBytesCoalesced(t, entry.Cipher, target.Addr().String()))
+		require.NoError(t, err)
+		// Wait for the proxy to close the connection.
+		io.Copy(io.Discard, conn)
+		conn.Close()
+	}
+	// The first connection uses up the quota while relaying.
+	run()
+	_, used := entry.QuotaUsage()
+	require.Equal(t, int64(12), used)
+	// The second one is rejected right away.
+	run()
+	s.GracefulStop()
+
+	require.Equal(t, []string{"ERR_QUOTA", "ERR_QUOTA"}, testMetrics.closeStatus)
+}
+
+func TestUDPQuota(t *testing.T) {
+	ciphers, err := MakeTestCiphers([]string{"asdf"})
+	require.NoError(t, err)
+	entry := ciphers.SnapshotForClientIP(nil)[0].Value.(*CipherEntry)
+	entry.SetQuota(15, QuotaNever, 0)
+	clientConn := makePacketConn()
+	metrics := &natTestMetrics{}
+	service := NewUDPService(timeout, ciphers, metrics)
+	service.SetTargetIPValidator(allowAll)
+	go service.Serve(clientConn)
+
+	targetAddr := socks.ParseAddr("127.0.0.1:9")
+	for i := 0; i < 3; i++ {
+		plaintext := append(targetAddr, make([]byte, 10)...)
+		ciphertext := make([]byte, entry.Cipher.SaltSize()+len(plaintext)+entry.Cipher.TagSize())
+		ss.Pack(ciphertext, plaintext, entry.Cipher)
+		clientConn.recv <- packet{
+			addr:    &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 54321},
+			payload: ciphertext,
+		}
+	}
+	service.GracefulStop()
+
+	require.Len(t, metrics.upstreamPackets, 3)
+	require.Equal(t, "OK", metrics.upstreamPackets[0].status)
+	require.Equal(t, "OK", metrics.upstreamPackets[1].status)
+	require.Equal(t, "ERR_QUOTA", metrics.upstreamPackets[2].status)
+	require.Equal(t, 0, metrics.upstreamPackets[2].proxyTargetBytes)
+}
@@ -17,6 +17,9 @@ package service
 import (
 	"encoding/binary"
 	"sync"
+	"time"
+
+	ss "myoss/shadowsocks"
 )
 
 // MaxCapacity is the largest allowed size of ReplayCache.
@@ -38,6 +41,15 @@ type ReplayCache struct {
 	capacity int
 	active   map[uint32]empty
 	archive  map[uint32]empty
+	// Salts of Shadowsocks 2022 handshakes, which are remembered by time
+	// instead of by count. They're made lazily.
+	timedActive  map[string]empty
+	timedArchive map[string]empty
+	// Replay filters of Shadowsocks 2022 UDP sessions, by key ID and session
+	// ID, which are remembered like the timed salts.
+	packetActive  map[string]*ss.ReplayFilter
+	packetArchive map[string]*ss.ReplayFilter
+	timedStart    time.Time
 }
 
 // NewReplayCache returns a fresh ReplayCache that promises to remember at least
@@ -100,3 +112,69 @@ func (c *ReplayCache) Add(id string, salt []byte) bool {
 	c.active[hash] = empty{}
 	return !inArchive
 }
+
+// AddTimed adds a Shadowsocks 2022 handshake with this key ID and salt to the
+// cache, which remembers it for as long as its timestamp is valid, regardless
+// of the capacity. Returns false if it is already present.
+func (c *ReplayCache) AddTimed(id string, salt []byte, now time.Time) bool {
+	if c == nil {
+		return true
+	}
+	key := id + string(salt)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rotateTimedLocked(now)
+	if _, ok := c.timedActive[key]; ok {
+		return false
+	}
+	if _, ok := c.timedArchive[key]; ok {
+		return false
+	}
+	c.timedActive[key] = empty{}
+	return true
+}
+
+// PacketFilter returns the replay filter of the Shadowsocks 2022 UDP session
+// `sessionID` of key `id`. It's the same for every client address that the
+// session's packets come from, for as long as their timestamps are valid,
+// so a packet can't be replayed from another address either.
+func (c *ReplayCache) PacketFilter(id string, sessionID uint64, now time.Time) *ss.ReplayFilter {
+	if c == nil {
+		return &ss.ReplayFilter{}
+	}
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], sessionID)
+	session := id + string(key[:])
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rotateTimedLocked(now)
+	filter, ok := c.packetActive[session]
+	if !ok {
+		// Sessions that are still in use move to the active generation.
+		if filter, ok = c.packetArchive[session]; !ok {
+			filter = &ss.ReplayFilter{}
+		}
+		c.packetActive[session] = filter
+	}
+	return filter
+}
+
+// rotateTimedLocked starts a new generation of the timed salts and sessions
+// if the current one is over. c.mutex must be held.
+func (c *ReplayCache) rotateTimedLocked(now time.Time) {
+	// Each generation lasts the whole timestamp window, so together they
+	// cover at least twice as long.
+	window := 2 * ss.MaxTimestampDiff
+	if now.Sub(c.timedStart) < window {
+		return
+	}
+	if now.Sub(c.timedStart) >= 2*window {
+		c.timedActive = nil
+		c.packetActive = nil
+	}
+	c.timedArchive = c.timedActive
+	c.timedActive = make(map[string]empty)
+	c.packetArchive = c.packetActive
+	c.packetActive = make(map[string]*ss.ReplayFilter)
+	c.timedStart = now
+}
@@ -17,6 +17,9 @@ package service
 import (
 	"encoding/binary"
 	"testing"
+	"time"
+
+	ss "myoss/shadowsocks"
 )
 
 const keyID = "the key"
@@ -91,6 +94,31 @@ func TestReplayCache_Archive(t *testing.T) {
 	}
 }
 
+func TestReplayCache_PacketFilter(t *testing.T) {
+	cache := NewReplayCache(10)
+	start := time.Now()
+	filter := cache.PacketFilter(keyID, 1, start)
+	if !filter.Validate(0) {
+		t.Error("First packet of a session should be new")
+	}
+	if cache.PacketFilter(keyID, 1, start) != filter {
+		t.Error("A session should keep its filter")
+	}
+	if cache.PacketFilter(keyID, 2, start) == filter || cache.PacketFilter("other key", 1, start) == filter {
+		t.Error("Sessions should have their own filters")
+	}
+	window := 2 * ss.MaxTimestampDiff
+	if cache.PacketFilter(keyID, 1, start.Add(window)) != filter {
+		t.Error("A session should be remembered in the archive")
+	}
+	if cache.PacketFilter(keyID, 1, start.Add(2*window)) != filter {
+		t.Error("A session in use should move to the active generation")
+	}
+	if cache.PacketFilter(keyID, 1, start.Add(5*window)) == filter {
+		t.Error("A session should be forgotten once its packets expire")
+	}
+}
+
 // Benchmark to determine the memory usage of ReplayCache.
 // Note that NewReplayCache only allocates the active set,
 // so the eventual memory usage will be roughly double.
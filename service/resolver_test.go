@@ -0,0 +1,140 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"myoss/dns"
+	onet "myoss/net"
+	ss "myoss/shadowsocks"
+	"myoss/shadowsocks/client"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startStubResolver returns a resolver whose upstream answers the A queries
+// for "echo.test" with 127.0.0.1, and any other query with NXDOMAIN.
+func startStubResolver(t *testing.T) *dns.Resolver {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			header, err := p.Start(buf[:n])
+			require.NoError(t, err)
+			q, err := p.Question()
+			require.NoError(t, err)
+			header.Response = true
+			found := q.Name.String() == "echo.test."
+			if !found {
+				header.RCode = dnsmessage.RCodeNameError
+			}
+			b := dnsmessage.NewBuilder(nil, header)
+			require.NoError(t, b.StartQuestions())
+			require.NoError(t, b.Question(q))
+			require.NoError(t, b.StartAnswers())
+			if found && q.Type == dnsmessage.TypeA {
+				h := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+				require.NoError(t, b.AResource(h, dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}}))
+			}
+			resp, err := b.Finish()
+			require.NoError(t, err)
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	resolver, err := dns.NewResolver(dns.Config{Upstreams: []string{pc.LocalAddr().String()}, Timeout: time.Second}, nil)
+	require.NoError(t, err)
+	return resolver
+}
+
+func TestTCPResolver(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, nil, testMetrics, time.Second)
+	s.SetTargetIPValidator(allowAll)
+	s.SetResolver(startStubResolver(t))
+	listener := makeLocalhostListener(t)
+	go s.Serve(listener)
+	dialer, err := client.NewShadowsocksStreamDialer(onet.TCPEndpoint{RemoteAddr: *listener.Addr().(*net.TCPAddr)}, firstCipher(cipherList))
+	require.NoError(t, err)
+	_, echoPort, _ := net.SplitHostPort(echo.Addr().String())
+
+	conn, err := dialer.Dial(context.Background(), net.JoinHostPort("echo.test", echoPort))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("Hello"))
+	require.NoError(t, err)
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	conn.Close()
+
+	conn, err = dialer.Dial(context.Background(), net.JoinHostPort("missing.test", echoPort))
+	require.NoError(t, err)
+	conn.Write([]byte("Hello"))
+	reply, _ = io.ReadAll(conn)
+	require.Empty(t, reply)
+	conn.Close()
+
+	s.GracefulStop()
+	// The handlers of the two connections may record their status in any order.
+	require.ElementsMatch(t, []string{"OK", "ERR_RESOLVE_ADDRESS"}, testMetrics.closeStatus)
+}
+
+func TestUDPResolver(t *testing.T) {
+	target := startUDPEchoServer(t)
+	defer target.Close()
+	ciphers, err := MakeTestCiphers([]string{"asdf"})
+	require.NoError(t, err)
+	entry := ciphers.SnapshotForClientIP(nil)[0].Value.(*CipherEntry)
+	clientConn := makePacketConn()
+	metrics := &natTestMetrics{}
+	service := NewUDPService(timeout, ciphers, metrics)
+	service.SetTargetIPValidator(allowAll)
+	service.SetResolver(startStubResolver(t))
+	go service.Serve(clientConn)
+
+	_, targetPort, _ := net.SplitHostPort(target.LocalAddr().String())
+	clientAddr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 54321}
+	for _, host := range []string{"echo.test", "missing.test"} {
+		plaintext := append(socks.ParseAddr(net.JoinHostPort(host, targetPort)), []byte("Hello")...)
+		ciphertext := make([]byte, entry.Cipher.SaltSize()+len(plaintext)+entry.Cipher.TagSize())
+		ss.Pack(ciphertext, plaintext, entry.Cipher)
+		clientConn.recv <- packet{addr: clientAddr, payload: ciphertext}
+	}
+	// The echo comes back from the resolved address.
+	reply := <-clientConn.send
+	require.Equal(t, clientAddr, reply.addr)
+	service.GracefulStop()
+
+	require.Len(t, metrics.upstreamPackets, 2)
+	require.Equal(t, "OK", metrics.upstreamPackets[0].status)
+	require.Equal(t, "ERR_RESOLVE_ADDRESS", metrics.upstreamPackets[1].status)
+}
@@ -0,0 +1,297 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"myoss/dns"
+	"myoss/outbound"
+)
+
+// DirectOutbound names the outbound that connects to targets directly.
+const DirectOutbound = "direct"
+
+// BlockedOutbound names the outbound that refuses all targets.
+const BlockedOutbound = "blocked"
+
+// upstreamTimeout bounds connecting through an outbound, including failing
+// over between its upstreams.
+const upstreamTimeout = 30 * time.Second
+
+// RouteRule sends the targets it matches through an outbound. A target
+// matches the rule if it matches one entry of each list that is set: Domains
+// are domain suffixes of the requested name, DomainKeywords are substrings
+// of it, CIDRs contain an IP of the target, Countries are ISO codes of the
+// country of an IP of the target, and Ports are ports or ranges. If Keys or
+// Plans are set, the rule only applies to those access keys or the keys of
+// those plans. Names are only resolved for the rules with CIDRs or Countries.
+type RouteRule struct {
+	Domains        []string `toml:"domains"`
+	DomainKeywords []string `toml:"domain_keywords"`
+	CIDRs          []string `toml:"cidrs"`
+	Countries      []string `toml:"countries"`
+	Ports          []string `toml:"ports"`
+	Keys           []string `toml:"keys"`
+	Plans          []string `toml:"plans"`
+	Outbound       string   `toml:"outbound"`
+}
+
+type routeRule struct {
+	ruleMatch
+	keywords  []string
+	countries map[string]bool
+	outbound  string
+}
+
+// RouterConfig describes the outbounds of a Router and how it picks them.
+type RouterConfig struct {
+	// Outbounds are the upstream proxies, by name.
+	Outbounds map[string]outbound.Outbound
+	// SourceIPs are the outbounds that connect to targets directly, from a
+	// local IP, by name.
+	SourceIPs map[string]net.IP
+	// Default is the outbound of the targets that no rule or key picks one
+	// for. Empty means DirectOutbound.
+	Default string
+	Rules   []RouteRule
+	// Resolver resolves target names for the rules with CIDRs or Countries,
+	// or is nil to use the system resolver.
+	Resolver *dns.Resolver
+	// Locate returns the country of an address, like the GetLocation of
+	// metrics.ShadowsocksMetrics. Rules with Countries need it.
+	Locate func(net.Addr) (string, error)
+}
+
+// Route is where a Router sends a target.
+type Route struct {
+	// Outbound is the name of the outbound.
+	Outbound string
+	// Upstream relays the connections to the target, or is nil if the node
+	// connects to it itself or it's blocked.
+	Upstream outbound.Outbound
+	// SourceIP is the local IP that the node connects from, or nil for any.
+	SourceIP net.IP
+}
+
+// Blocked reports whether the target is refused.
+func (r Route) Blocked() bool {
+	return r.Outbound == BlockedOutbound
+}
+
+// Router picks the outbound of each target: that of the first rule that
+// matches the target, or else that of its access key, or else the default.
+// A nil Router connects to every target directly.
+type Router struct {
+	outbounds       map[string]outbound.Outbound
+	sourceIPs       map[string]net.IP
+	defaultOutbound string
+	rules           []routeRule
+	resolver        *dns.Resolver
+	locate          func(net.Addr) (string, error)
+}
+
+// NewRouter creates a Router that picks among the outbounds of `config`,
+// DirectOutbound and BlockedOutbound.
+func NewRouter(config RouterConfig) (*Router, error) {
+	r := &Router{
+		outbounds:       config.Outbounds,
+		sourceIPs:       config.SourceIPs,
+		defaultOutbound: config.Default,
+		resolver:        config.Resolver,
+		locate:          config.Locate,
+	}
+	for name := range config.Outbounds {
+		if name == DirectOutbound || name == BlockedOutbound {
+			return nil, fmt.Errorf("the outbound name %q is reserved", name)
+		}
+	}
+	for name, ip := range config.SourceIPs {
+		if name == DirectOutbound || name == BlockedOutbound || config.Outbounds[name] != nil {
+			return nil, fmt.Errorf("the outbound name %q is reserved or taken", name)
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("outbound %v has no source IP", name)
+		}
+	}
+	if r.defaultOutbound == "" {
+		r.defaultOutbound = DirectOutbound
+	}
+	if !r.known(r.defaultOutbound) {
+		return nil, fmt.Errorf("unknown default outbound %q", r.defaultOutbound)
+	}
+	for i, rule := range config.Rules {
+		if !r.known(rule.Outbound) {
+			return nil, fmt.Errorf("rule %d: unknown outbound %q", i+1, rule.Outbound)
+		}
+		if len(rule.Domains) == 0 && len(rule.DomainKeywords) == 0 && len(rule.CIDRs) == 0 && len(rule.Countries) == 0 &&
+			len(rule.Ports) == 0 && len(rule.Keys) == 0 && len(rule.Plans) == 0 {
+			return nil, fmt.Errorf("rule %d: needs domains, domain_keywords, cidrs, countries, ports, keys or plans", i+1)
+		}
+		if len(rule.Countries) > 0 && r.locate == nil {
+			return nil, fmt.Errorf("rule %d: countries need an IP-to-country database", i+1)
+		}
+		match, err := compileRuleMatch(rule.Domains, rule.CIDRs, rule.Ports, rule.Keys, rule.Plans)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		compiled := routeRule{ruleMatch: match, outbound: rule.Outbound}
+		for _, keyword := range rule.DomainKeywords {
+			if keyword = strings.ToLower(keyword); keyword == "" {
+				return nil, fmt.Errorf("rule %d: empty domain keyword", i+1)
+			}
+			compiled.keywords = append(compiled.keywords, keyword)
+		}
+		for _, country := range rule.Countries {
+			if len(country) != 2 {
+				return nil, fmt.Errorf("rule %d: bad country code %q", i+1, country)
+			}
+			if compiled.countries == nil {
+				compiled.countries = make(map[string]bool)
+			}
+			compiled.countries[strings.ToUpper(country)] = true
+		}
+		r.rules = append(r.rules, compiled)
+	}
+	return r, nil
+}
+
+func (r *Router) known(name string) bool {
+	return name == DirectOutbound || name == BlockedOutbound || r.outbounds[name] != nil || r.sourceIPs[name] != nil
+}
+
+func (r *Router) route(name string) Route {
+	return Route{Outbound: name, Upstream: r.outbounds[name], SourceIP: r.sourceIPs[name]}
+}
+
+// lookupIP resolves `host` for the rules that match IPs. Names that don't
+// resolve have no IPs, so those rules don't match them.
+func (r *Router) lookupIP(host string) []net.IP {
+	var ips []net.IP
+	var err error
+	if r.resolver != nil {
+		ips, err = r.resolver.LookupIP(context.Background(), host)
+	} else {
+		ips, err = net.DefaultResolver.LookupIP(context.Background(), "ip", host)
+	}
+	if err != nil {
+		logger.Debugf("Failed to resolve %v for routing: %v", host, err)
+	}
+	return ips
+}
+
+// country returns the ISO code of the country of `ip`, or "" if unknown.
+func (r *Router) country(ip net.IP) string {
+	country, err := r.locate(&net.TCPAddr{IP: ip})
+	if err != nil {
+		return ""
+	}
+	return country
+}
+
+// Route returns the route of `host`:`port` for the client of `entry`. Keys
+// with an unknown outbound use the default. `host` may be empty to route by
+// key and node only.
+func (r *Router) Route(entry *CipherEntry, host string, port int) Route {
+	if r == nil {
+		return Route{Outbound: DirectOutbound}
+	}
+	name := r.defaultOutbound
+	if entry != nil {
+		if keyOutbound := entry.Outbound(); keyOutbound != "" && r.known(keyOutbound) {
+			name = keyOutbound
+		}
+	}
+	domain, ip := "", net.ParseIP(host)
+	var ips []net.IP
+	resolved := ip != nil || host == ""
+	if ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		domain = normalizeDomain(host)
+	}
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if !rule.appliesTo(entry) {
+			continue
+		}
+		if !resolved && (len(rule.nets) > 0 || rule.countries != nil) {
+			ips, resolved = r.lookupIP(host), true
+		}
+		if r.match(rule, domain, ips, port) {
+			return r.route(rule.outbound)
+		}
+	}
+	return r.route(name)
+}
+
+// match reports whether the target with `domain`, which resolves to `ips`,
+// and `port` matches `rule`.
+func (r *Router) match(rule *routeRule, domain string, ips []net.IP, port int) bool {
+	if len(rule.keywords) > 0 {
+		found := false
+		for _, keyword := range rule.keywords {
+			if domain != "" && strings.Contains(domain, keyword) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.nets) == 0 && rule.countries == nil {
+		matched, _ := rule.ruleMatch.match(domain, nil, port)
+		return matched
+	}
+	for _, ip := range ips {
+		if matched, _ := rule.ruleMatch.match(domain, ip, port); !matched {
+			continue
+		}
+		if rule.countries == nil || rule.countries[r.country(ip)] {
+			return true
+		}
+	}
+	return false
+}
+
+// listenRoute creates the socket of a NAT session of the client of `entry`
+// whose packets go through `route`. Direct sockets are bound by `egress` to
+// the source IP of the family of `target`, the IP of the first packet, if
+// it's known.
+func listenRoute(route Route, egress *Egress, entry *CipherEntry, target net.IP) (net.PacketConn, error) {
+	if route.Upstream != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+		defer cancel()
+		pc, err := route.Upstream.ListenPacket(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("outbound %v: %w", route.Outbound, err)
+		}
+		return pc, nil
+	}
+	address := ""
+	if sourceIP := egress.sourceIP(entry, route, target); sourceIP != nil {
+		address = net.JoinHostPort(sourceIP.String(), "0")
+	}
+	config := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return egress.control(c)
+	}}
+	return config.ListenPacket(context.Background(), "udp", address)
+}
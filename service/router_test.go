@@ -0,0 +1,231 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	onet "myoss/net"
+	"myoss/outbound"
+	ss "myoss/shadowsocks"
+	"myoss/shadowsocks/client"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouter(t *testing.T) {
+	residential, err := outbound.NewSOCKS5("127.0.0.1:1080", "", "")
+	require.NoError(t, err)
+	relay, err := outbound.NewHTTPConnect("127.0.0.1:8080", "", "")
+	require.NoError(t, err)
+	config := RouterConfig{
+		Outbounds: map[string]outbound.Outbound{"residential": residential, "relay": relay},
+		SourceIPs: map[string]net.IP{"second-ip": net.ParseIP("203.0.113.7")},
+		Default:   "relay",
+		Rules: []RouteRule{
+			{Domains: []string{"netflix.com"}, Outbound: "residential"},
+			{DomainKeywords: []string{"Torrent"}, Outbound: BlockedOutbound},
+			{CIDRs: []string{"10.0.0.0/8"}, Ports: []string{"53"}, Outbound: DirectOutbound},
+			{Countries: []string{"jp"}, Outbound: "second-ip"},
+			{CIDRs: []string{"127.0.0.0/8"}, Outbound: DirectOutbound},
+			{Plans: []string{"free"}, Outbound: DirectOutbound},
+		},
+		Resolver: startStubResolver(t),
+		Locate: func(addr net.Addr) (string, error) {
+			if addr.(*net.TCPAddr).IP.Equal(net.ParseIP("198.51.100.1")) {
+				return "JP", nil
+			}
+			return "US", nil
+		},
+	}
+	router, err := NewRouter(config)
+	require.NoError(t, err)
+
+	free := &CipherEntry{ID: "free"}
+	free.SetPlan("free")
+	keyed := &CipherEntry{ID: "keyed"}
+	keyed.SetOutbound("residential")
+	unknown := &CipherEntry{ID: "unknown"}
+	unknown.SetOutbound("missing")
+	for _, test := range []struct {
+		entry    *CipherEntry
+		host     string
+		port     int
+		outbound string
+	}{
+		{nil, "www.netflix.com", 443, "residential"},
+		{nil, "tracker.opentorrent.example", 443, BlockedOutbound},
+		{nil, "10.1.2.3", 53, DirectOutbound},
+		{nil, "10.1.2.3", 443, "relay"},
+		{nil, "198.51.100.1", 443, "second-ip"},
+		{nil, "example.com", 443, "relay"},
+		// Names are resolved for the rules that match IPs.
+		{nil, "echo.test", 443, DirectOutbound},
+		{free, "www.netflix.com", 443, "residential"},
+		{free, "example.com", 443, DirectOutbound},
+		{keyed, "example.com", 443, "residential"},
+		{unknown, "example.com", 443, "relay"},
+		// Targets without a host are routed by key and node.
+		{keyed, "", 0, "residential"},
+	} {
+		route := router.Route(test.entry, test.host, test.port)
+		require.Equal(t, test.outbound, route.Outbound, "%v:%v", test.host, test.port)
+		require.Equal(t, config.Outbounds[test.outbound], route.Upstream)
+		require.Equal(t, config.SourceIPs[test.outbound], route.SourceIP)
+		require.Equal(t, test.outbound == BlockedOutbound, route.Blocked())
+	}
+
+	var nilRouter *Router
+	require.Equal(t, Route{Outbound: DirectOutbound}, nilRouter.Route(free, "example.com", 443))
+
+	for _, bad := range []RouterConfig{
+		{Outbounds: config.Outbounds, Default: "missing"},
+		{Outbounds: config.Outbounds, Rules: []RouteRule{{Ports: []string{"25"}, Outbound: "missing"}}},
+		{Outbounds: config.Outbounds, Rules: []RouteRule{{Outbound: "relay"}}},
+		{Outbounds: config.Outbounds, Rules: []RouteRule{{Countries: []string{"JP"}, Outbound: "relay"}}},
+		{Outbounds: map[string]outbound.Outbound{DirectOutbound: relay}},
+		{Outbounds: config.Outbounds, SourceIPs: map[string]net.IP{"relay": net.ParseIP("203.0.113.7")}},
+	} {
+		_, err = NewRouter(bad)
+		require.Error(t, err)
+	}
+}
+
+// startRelay starts a TCP and a UDP service on a random port of localhost,
+// and returns a Shadowsocks outbound through them.
+func startRelay(t *testing.T) outbound.Outbound {
+	cipherList, err := MakeTestCiphers([]string{"relay"})
+	require.NoError(t, err)
+	listener := makeLocalhostListener(t)
+	tcp := NewTCPService(cipherList, nil, &probeTestMetrics{}, time.Second)
+	tcp.SetTargetIPValidator(allowAll)
+	go tcp.Serve(listener)
+	pc, err := net.ListenPacket("udp", listener.Addr().String())
+	require.NoError(t, err)
+	udp := NewUDPService(timeout, cipherList, &natTestMetrics{})
+	udp.SetTargetIPValidator(allowAll)
+	go udp.Serve(pc)
+	t.Cleanup(func() {
+		tcp.GracefulStop()
+		udp.GracefulStop()
+	})
+	relay, err := outbound.NewShadowsocks(listener.Addr().String(), firstCipher(cipherList))
+	require.NoError(t, err)
+	return relay
+}
+
+func TestTCPRouter(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	router, err := NewRouter(RouterConfig{
+		Outbounds: map[string]outbound.Outbound{"relay": startRelay(t)},
+		Default:   "relay",
+		Rules: []RouteRule{
+			{Ports: []string{"1"}, Outbound: DirectOutbound},
+			{Ports: []string{"25"}, Outbound: BlockedOutbound},
+		},
+	})
+	require.NoError(t, err)
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, nil, testMetrics, time.Second)
+	s.SetRouter(router)
+	listener := makeLocalhostListener(t)
+	go s.Serve(listener)
+	dialer, err := client.NewShadowsocksStreamDialer(onet.TCPEndpoint{RemoteAddr: *listener.Addr().(*net.TCPAddr)}, firstCipher(cipherList))
+	require.NoError(t, err)
+
+	// The node itself rejects loopback targets, but it doesn't resolve the
+	// names that it routes through the relay, which connects to them.
+	_, echoPort, _ := net.SplitHostPort(echo.Addr().String())
+	conn, err := dialer.Dial(context.Background(), net.JoinHostPort("localhost", echoPort))
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("Hello"))
+	require.NoError(t, err)
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, "Hello", string(reply))
+	conn.Close()
+
+	// Port 1 is routed directly, so the node's validator applies.
+	conn, err = dialer.Dial(context.Background(), "localhost:1")
+	require.NoError(t, err)
+	conn.Write([]byte("Hello"))
+	reply, _ = io.ReadAll(conn)
+	require.Empty(t, reply)
+	conn.Close()
+
+	conn, err = dialer.Dial(context.Background(), "localhost:25")
+	require.NoError(t, err)
+	conn.Write([]byte("Hello"))
+	reply, _ = io.ReadAll(conn)
+	require.Empty(t, reply)
+	conn.Close()
+
+	s.GracefulStop()
+	require.ElementsMatch(t, []string{"OK", "ERR_ADDRESS_INVALID", "ERR_ADDRESS_BLOCKED"}, testMetrics.closeStatus)
+	require.ElementsMatch(t, []string{"relay OK", "direct ERR_ADDRESS_INVALID", "blocked ERR_ADDRESS_BLOCKED"}, testMetrics.outbounds)
+}
+
+func TestUDPRouter(t *testing.T) {
+	target := startUDPEchoServer(t)
+	defer target.Close()
+	router, err := NewRouter(RouterConfig{
+		Outbounds: map[string]outbound.Outbound{"relay": startRelay(t)},
+		Default:   "relay",
+		Rules:     []RouteRule{{Ports: []string{"25"}, Outbound: BlockedOutbound}},
+	})
+	require.NoError(t, err)
+	ciphers, err := MakeTestCiphers([]string{"asdf"})
+	require.NoError(t, err)
+	entry := ciphers.SnapshotForClientIP(nil)[0].Value.(*CipherEntry)
+	clientConn := makePacketConn()
+	metrics := &natTestMetrics{}
+	service := NewUDPService(timeout, ciphers, metrics)
+	service.SetTargetIPValidator(allowAll)
+	service.SetRouter(router)
+	go service.Serve(clientConn)
+
+	clientAddr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 54321}
+	plaintext := append(socks.ParseAddr(target.LocalAddr().String()), []byte("Hello")...)
+	ciphertext := make([]byte, entry.Cipher.SaltSize()+len(plaintext)+entry.Cipher.TagSize())
+	ss.Pack(ciphertext, plaintext, entry.Cipher)
+	clientConn.recv <- packet{addr: clientAddr, payload: ciphertext}
+	// Blocked targets are dropped, even within a session.
+	blocked := append(socks.ParseAddr("127.0.0.1:25"), []byte("Hello")...)
+	blockedText := make([]byte, entry.Cipher.SaltSize()+len(blocked)+entry.Cipher.TagSize())
+	ss.Pack(blockedText, blocked, entry.Cipher)
+	clientConn.recv <- packet{addr: clientAddr, payload: blockedText}
+
+	reply := <-clientConn.send
+	require.Equal(t, clientAddr, reply.addr)
+	buf := make([]byte, len(reply.payload))
+	replyText, err := ss.Unpack(buf, reply.payload, entry.Cipher)
+	require.NoError(t, err)
+	require.Equal(t, []byte(plaintext), replyText)
+	service.GracefulStop()
+	require.Len(t, metrics.upstreamPackets, 2)
+	require.Equal(t, "OK", metrics.upstreamPackets[0].status)
+	require.Equal(t, "ERR_ADDRESS_BLOCKED", metrics.upstreamPackets[1].status)
+	// The session counts once, with the status of its first packet.
+	require.Equal(t, []string{"relay OK"}, metrics.outbounds)
+}
@@ -0,0 +1,330 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	onet "myoss/net"
+	ss "myoss/shadowsocks"
+	"myoss/shadowsocks/client"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/require"
+)
+
+// make2022Ciphers makes a list with a legacy cipher and a cipher called
+// `name`, which is returned.
+func make2022Ciphers(t *testing.T, name string) (CipherList, *ss.Cipher) {
+	l := list.New()
+	legacy, err := ss.NewCipher(ss.TestCipher, "legacy secret")
+	require.NoError(t, err)
+	legacyEntry := MakeCipherEntry("legacy", legacy, "legacy secret")
+	l.PushBack(&legacyEntry)
+	secret := ss.MakeTestSecret(name, "2022 secret")
+	cipher, err := ss.NewCipher(name, secret)
+	require.NoError(t, err)
+	entry := MakeCipherEntry("2022", cipher, secret)
+	l.PushBack(&entry)
+	cipherList := NewCipherList()
+	cipherList.Update(l)
+	return cipherList, cipher
+}
+
+func startEchoServer(t *testing.T) *net.TCPListener {
+	listener := makeLocalhostListener(t)
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestTCP2022(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	for _, name := range []string{"2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm", "2022-blake3-chacha20-poly1305"} {
+		cipherList, cipher := make2022Ciphers(t, name)
+		listener := makeLocalhostListener(t)
+		s := NewTCPService(cipherList, nil, &probeTestMetrics{}, 5*time.Second)
+		s.SetTargetIPValidator(allowAll)
+		go s.Serve(listener)
+
+		d, err := client.NewShadowsocksStreamDialer(onet.TCPEndpoint{RemoteAddr: *listener.Addr().(*net.TCPAddr)}, cipher)
+		require.NoError(t, err)
+		conn, err := d.Dial(context.Background(), echo.Addr().String())
+		require.NoError(t, err, name)
+		_, err = conn.Write([]byte("Hello"))
+		require.NoError(t, err)
+		reply := make([]byte, 5)
+		_, err = io.ReadFull(conn, reply)
+		require.NoError(t, err, name)
+		require.Equal(t, "Hello", string(reply), name)
+		conn.Close()
+		s.GracefulStop()
+	}
+}
+
+func TestTCP2022ReplayDefense(t *testing.T) {
+	listener, running := startDiscardServer(t)
+	defer func() {
+		listener.Close()
+		running.Wait()
+	}()
+	cipherList, cipher := make2022Ciphers(t, "2022-blake3-aes-256-gcm")
+	// Shadowsocks 2022 salts are remembered even without capacity.
+	replayCache := NewReplayCache(0)
+	testMetrics := &probeTestMetrics{}
+	const testTimeout = 200 * time.Millisecond
+	s := NewTCPService(cipherList, &replayCache, testMetrics, testTimeout)
+	s.SetTargetIPValidator(allowAll)
+	serverListener := makeLocalhostListener(t)
+	go s.Serve(serverListener)
+
+	var request bytes.Buffer
+	ssw := ss.NewRequestWriter(&request, cipher)
+	_, err := ssw.Write(append(socks.ParseAddr(listener.Addr().String()), "Hello"...))
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		conn, err := net.DialTCP("tcp", nil, serverListener.Addr().(*net.TCPAddr))
+		require.NoError(t, err)
+		_, err = conn.Write(request.Bytes())
+		require.NoError(t, err)
+		conn.CloseWrite()
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	s.GracefulStop()
+	require.Equal(t, []string{"OK", "ERR_REPLAY_CLIENT"}, testMetrics.closeStatus)
+}
+
+func TestUDP2022(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := target.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			target.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	for _, name := range []string{"2022-blake3-aes-128-gcm", "2022-blake3-chacha20-poly1305"} {
+		cipherList, cipher := make2022Ciphers(t, name)
+		serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		require.NoError(t, err)
+		s := NewUDPService(time.Minute, cipherList, &natTestMetrics{})
+		s.SetTargetIPValidator(allowAll)
+		go s.Serve(serverConn)
+
+		l, err := client.NewShadowsocksPacketListener(onet.UDPEndpoint{RemoteAddr: *serverConn.LocalAddr().(*net.UDPAddr)}, cipher)
+		require.NoError(t, err)
+		conn, err := l.ListenPacket(context.Background())
+		require.NoError(t, err)
+		for _, payload := range []string{"Hello", "again"} {
+			_, err = conn.WriteTo([]byte(payload), target.LocalAddr())
+			require.NoError(t, err)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 1024)
+			n, addr, err := conn.ReadFrom(buf)
+			require.NoError(t, err, name)
+			require.Equal(t, payload, string(buf[:n]), name)
+			require.Equal(t, target.LocalAddr().String(), addr.String())
+		}
+		conn.Close()
+		s.GracefulStop()
+	}
+}
+
+// A captured packet of a session can't be replayed from another client
+// address, even though it makes a new NAT entry.
+func TestUDP2022ReplayFromOtherAddress(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := target.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			target.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	cipherList, cipher := make2022Ciphers(t, "2022-blake3-aes-128-gcm")
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	testMetrics := &natTestMetrics{}
+	s := NewUDPService(time.Minute, cipherList, testMetrics)
+	s.SetTargetIPValidator(allowAll)
+	go s.Serve(serverConn)
+
+	// Capture the packets of a client session.
+	sniffer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer sniffer.Close()
+	l, err := client.NewShadowsocksPacketListener(onet.UDPEndpoint{RemoteAddr: *sniffer.LocalAddr().(*net.UDPAddr)}, cipher)
+	require.NoError(t, err)
+	conn, err := l.ListenPacket(context.Background())
+	require.NoError(t, err)
+	defer conn.Close()
+	var packets [][]byte
+	for _, payload := range []string{"Hello", "again"} {
+		_, err = conn.WriteTo([]byte(payload), target.LocalAddr())
+		require.NoError(t, err)
+		buf := make([]byte, 1024)
+		sniffer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := sniffer.ReadFrom(buf)
+		require.NoError(t, err)
+		packets = append(packets, buf[:n])
+	}
+
+	// send sends `packet` from `sender`, and reports whether it's answered.
+	send := func(sender net.PacketConn, packet []byte, timeout time.Duration) bool {
+		_, err := sender.WriteTo(packet, serverConn.LocalAddr())
+		require.NoError(t, err)
+		sender.SetReadDeadline(time.Now().Add(timeout))
+		_, _, err = sender.ReadFrom(make([]byte, 1024))
+		return err == nil
+	}
+	var senders []net.PacketConn
+	for i := 0; i < 3; i++ {
+		sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		require.NoError(t, err)
+		defer sender.Close()
+		senders = append(senders, sender)
+	}
+	require.True(t, send(senders[0], packets[0], 5*time.Second))
+	require.False(t, send(senders[1], packets[0], 100*time.Millisecond), "Replay from another address was answered")
+	// The other packet of the session is still new, and not a replay from
+	// the third address either once it's been seen.
+	require.True(t, send(senders[1], packets[1], 5*time.Second))
+	require.False(t, send(senders[2], packets[1], 100*time.Millisecond), "Replay from another address was answered")
+
+	s.GracefulStop()
+	var statuses []string
+	for _, report := range testMetrics.upstreamPackets {
+		statuses = append(statuses, report.status)
+	}
+	require.Equal(t, []string{"OK", "ERR_REPLAY_CLIENT", "OK", "ERR_REPLAY_CLIENT"}, statuses)
+}
+
+// makeIdentityCiphers makes a list with 100 legacy keys and a Shadowsocks 2022
+// user, and returns the identity key and the cipher of a client of the user
+// that sends identity headers.
+func makeIdentityCiphers(t testing.TB) (CipherList, *ss.IdentityKey, *ss.Cipher) {
+	const name = "2022-blake3-aes-256-gcm"
+	l := list.New()
+	for i, secret := range ss.MakeTestSecrets(100) {
+		cipher, err := ss.NewCipher(ss.TestCipher, secret)
+		require.NoError(t, err)
+		entry := MakeCipherEntry(fmt.Sprintf("id-%v", i), cipher, secret)
+		l.PushBack(&entry)
+	}
+	identitySecret := ss.MakeTestSecret(name, "identity")
+	userSecret := ss.MakeTestSecret(name, "user")
+	cipher, err := ss.NewCipher(name, userSecret)
+	require.NoError(t, err)
+	entry := MakeCipherEntry("2022", cipher, userSecret)
+	l.PushBack(&entry)
+	cipherList := NewCipherList()
+	cipherList.Update(l)
+
+	identity, err := ss.NewIdentityKey(identitySecret)
+	require.NoError(t, err)
+	clientCipher, err := ss.NewCipher(name, identitySecret+":"+userSecret)
+	require.NoError(t, err)
+	return cipherList, identity, clientCipher
+}
+
+func TestFindAccessKeyIdentity(t *testing.T) {
+	cipherList, identity, clientCipher := makeIdentityCiphers(t)
+	var request bytes.Buffer
+	_, err := ss.NewRequestWriter(&request, clientCipher).Write(append(socks.ParseAddr("192.0.2.1:80"), "Hello"...))
+	require.NoError(t, err)
+	stream := request.Bytes()
+
+	entry, reader, salt, _, err := findAccessKey(bytes.NewReader(stream), nil, cipherList, identity)
+	require.NoError(t, err)
+	require.Equal(t, "2022", entry.ID)
+	require.Equal(t, stream[:len(salt)], salt)
+	got, err := io.ReadAll(ss.NewRequestReader(reader, entry.Cipher))
+	require.NoError(t, err)
+	require.Equal(t, "Hello", string(got[len(socks.ParseAddr("192.0.2.1:80")):]))
+
+	// Legacy keys are still found by trial decryption.
+	legacy := cipherList.SnapshotForClientIP(nil)[50].Value.(*CipherEntry)
+	var legacyRequest bytes.Buffer
+	_, err = ss.NewRequestWriter(&legacyRequest, legacy.Cipher).Write(append(socks.ParseAddr("192.0.2.1:80"), "Hello"...))
+	require.NoError(t, err)
+	entry, _, _, _, err = findAccessKey(&legacyRequest, nil, cipherList, identity)
+	require.NoError(t, err)
+	require.Equal(t, legacy.ID, entry.ID)
+}
+
+func TestUDPIdentity(t *testing.T) {
+	cipherList, identity, clientCipher := makeIdentityCiphers(t)
+	session, err := ss.NewPacketSession(clientCipher, false)
+	require.NoError(t, err)
+	plaintext := append(socks.ParseAddr("192.0.2.1:53"), "Hello"...)
+	pkt, err := session.Pack(make([]byte, 1500), plaintext)
+	require.NoError(t, err)
+	original := append([]byte{}, pkt...)
+
+	// Without the identity key, trial decryption fails.
+	_, _, _, _, _, err = findAccessKeyUDP(nil, make([]byte, 1500), pkt, cipherList, nil)
+	require.Error(t, err)
+	require.Equal(t, original, pkt)
+
+	buf, id, _, _, identified, err := findAccessKeyUDP(nil, make([]byte, 1500), pkt, cipherList, identity)
+	require.NoError(t, err)
+	require.True(t, identified)
+	require.Equal(t, "2022", id)
+	require.Equal(t, []byte(plaintext), buf)
+}
+
+func BenchmarkTCPFindCipherIdentity(b *testing.B) {
+	cipherList, identity, clientCipher := makeIdentityCiphers(b)
+	var request bytes.Buffer
+	ss.NewRequestWriter(&request, clientCipher).Write(socks.ParseAddr("192.0.2.1:80"))
+	stream := request.Bytes()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, _, _, _, err := findAccessKey(bytes.NewReader(append([]byte{}, stream...)), nil, cipherList, identity); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
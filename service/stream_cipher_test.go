@@ -0,0 +1,110 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	onet "myoss/net"
+	ss "myoss/shadowsocks"
+	"myoss/shadowsocks/client"
+
+	"github.com/stretchr/testify/require"
+)
+
+// makeStreamCiphers makes a list with a single key that uses the stream
+// cipher `name`.
+func makeStreamCiphers(t *testing.T, name string) (CipherList, *ss.Cipher) {
+	cipher, err := ss.NewStreamCipher(name, "stream secret")
+	require.NoError(t, err)
+	entry := MakeCipherEntry("stream", cipher, "stream secret")
+	l := list.New()
+	l.PushBack(&entry)
+	cipherList := NewCipherList()
+	cipherList.Update(l)
+	return cipherList, cipher
+}
+
+func TestTCPStreamCipher(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	for _, name := range ss.StreamCipherNames() {
+		cipherList, cipher := makeStreamCiphers(t, name)
+		listener := makeLocalhostListener(t)
+		testMetrics := &probeTestMetrics{}
+		s := NewTCPService(cipherList, nil, testMetrics, 5*time.Second)
+		s.SetTargetIPValidator(allowAll)
+		go s.Serve(listener)
+
+		d, err := client.NewShadowsocksStreamDialer(onet.TCPEndpoint{RemoteAddr: *listener.Addr().(*net.TCPAddr)}, cipher)
+		require.NoError(t, err)
+		conn, err := d.Dial(context.Background(), echo.Addr().String())
+		require.NoError(t, err, name)
+		_, err = conn.Write([]byte("Hello"))
+		require.NoError(t, err)
+		reply := make([]byte, 5)
+		_, err = io.ReadFull(conn, reply)
+		require.NoError(t, err, name)
+		require.Equal(t, "Hello", string(reply), name)
+		conn.Close()
+		s.GracefulStop()
+		require.Equal(t, []string{"OK"}, testMetrics.closeStatus, name)
+	}
+}
+
+func TestUDPStreamCipher(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := target.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			target.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	cipherList, cipher := makeStreamCiphers(t, "chacha20-ietf")
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	s := NewUDPService(time.Minute, cipherList, &natTestMetrics{})
+	s.SetTargetIPValidator(allowAll)
+	go s.Serve(serverConn)
+	defer s.GracefulStop()
+
+	l, err := client.NewShadowsocksPacketListener(onet.UDPEndpoint{RemoteAddr: *serverConn.LocalAddr().(*net.UDPAddr)}, cipher)
+	require.NoError(t, err)
+	conn, err := l.ListenPacket(context.Background())
+	require.NoError(t, err)
+	defer conn.Close()
+	for _, payload := range []string{"Hello", "again"} {
+		_, err = conn.WriteTo([]byte(payload), target.LocalAddr())
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1024)
+		n, addr, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, payload, string(buf[:n]))
+		require.Equal(t, target.LocalAddr().String(), addr.String())
+	}
+}
@@ -17,17 +17,19 @@ package service
 import (
 	"bytes"
 	"container/list"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"myoss/api"
 	"myoss/mylog"
 	"net"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
+	"myoss/dns"
 	onet "myoss/net"
 	"myoss/service/metrics"
 	ss "myoss/shadowsocks"
@@ -37,12 +39,20 @@ import (
 )
 
 func remoteIP(conn net.Conn) net.IP {
-	addr := conn.RemoteAddr()
+	return addrIP(conn.RemoteAddr())
+}
+
+// addrIP returns the IP of a client address, which may not be a TCP or UDP
+// address if the client came through another transport.
+func addrIP(addr net.Addr) net.IP {
 	if addr == nil {
 		return nil
 	}
-	if tcpaddr, ok := addr.(*net.TCPAddr); ok {
-		return tcpaddr.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
 	}
 	ipstr, _, err := net.SplitHostPort(addr.String())
 	if err == nil {
@@ -61,59 +71,162 @@ func debugTCP(cipherID, template string, val interface{}) {
 }
 
 // bytesForKeyFinding is the number of bytes to read for finding the AccessKey.
-// Is must satisfy provided >= bytesForKeyFinding >= required for every cipher in the list.
+// Is must satisfy provided >= bytesForKeyFinding >= required for every cipher in the list,
+// except the Shadowsocks 2022 ciphers that require more, for which we read more.
 // provided = saltSize + 2 + 2 * cipher.TagSize, the minimum number of bytes we will see in a valid connection
 // required = saltSize + 2 + cipher.TagSize, the number of bytes needed to authenticate the connection.
 const bytesForKeyFinding = 50
 
-func findAccessKey(clientReader io.Reader, clientIP net.IP, cipherList CipherList) (*CipherEntry, io.Reader, []byte, time.Duration, error, string) {
+// fallbackStallTimeout is how long a client may pause while its key is looked
+// up, if there's a fallback. Clients send their first bytes at once, so a
+// client that stalls short of them is a probe waiting for a reply, which
+// goes to the fallback right away instead of after the read timeout.
+const fallbackStallTimeout = 500 * time.Millisecond
+
+// requiredBytes is the number of bytes needed to authenticate a connection with `cipher`.
+func requiredBytes(cipher *ss.Cipher) int {
+	return cipher.SaltSize() + cipher.FirstMessageSize() + cipher.TagSize()
+}
+
+func findAccessKey(clientReader io.Reader, clientIP net.IP, cipherList CipherList, identity *ss.IdentityKey) (*CipherEntry, io.Reader, []byte, time.Duration, error) {
 	// We snapshot the list because it may be modified while we use it.
 	ciphers := cipherList.SnapshotForClientIP(clientIP)
+	if len(ciphers) == 1 && ciphers[0].Value.(*CipherEntry).Cipher.IsStream() {
+		// Stream ciphers can't be authenticated, so they get a port of their own.
+		entry := ciphers[0].Value.(*CipherEntry)
+		iv := make([]byte, entry.Cipher.SaltSize())
+		if n, err := io.ReadFull(clientReader, iv); err != nil {
+			return nil, clientReader, nil, 0, fmt.Errorf("Reading IV failed after %d bytes: %v", n, err)
+		}
+		return entry, io.MultiReader(bytes.NewReader(iv), clientReader), iv, 0, nil
+	}
+
 	firstBytes := make([]byte, bytesForKeyFinding)
 	if n, err := io.ReadFull(clientReader, firstBytes); err != nil {
-		return nil, clientReader, nil, 0, fmt.Errorf("Reading header failed after %d bytes: %v", n, err), ""
+		return nil, clientReader, nil, 0, fmt.Errorf("Reading header failed after %d bytes: %v", n, err)
+	}
+
+	var timeToCipher time.Duration
+	if identity != nil {
+		entry, elt, timeToIdentity, err := findIdentityEntry(clientReader, &firstBytes, cipherList, identity)
+		timeToCipher = timeToIdentity
+		if err != nil {
+			return nil, clientReader, nil, timeToCipher, err
+		}
+		if entry != nil {
+			cipherList.MarkUsedByClientIP(elt, clientIP)
+			salt := firstBytes[:entry.Cipher.SaltSize()]
+			return entry, io.MultiReader(bytes.NewReader(firstBytes), clientReader), salt, timeToCipher, nil
+		}
 	}
 
 	findStartTime := time.Now()
-	entry, elt, id := findEntry(firstBytes, ciphers)
-	timeToCipher := time.Now().Sub(findStartTime)
+	entry, elt := findEntry(firstBytes, ciphers, 0)
+	timeToCipher += time.Now().Sub(findStartTime)
+	if entry == nil {
+		// Some Shadowsocks 2022 ciphers need more bytes. Their connections
+		// provide them, so it's safe to wait for them.
+		maxRequired := 0
+		for _, elt := range ciphers {
+			if required := requiredBytes(elt.Value.(*CipherEntry).Cipher); required > maxRequired {
+				maxRequired = required
+			}
+		}
+		if tried := len(firstBytes); maxRequired > tried {
+			firstBytes = append(firstBytes, make([]byte, maxRequired-tried)...)
+			if n, err := io.ReadFull(clientReader, firstBytes[tried:]); err != nil {
+				return nil, clientReader, nil, timeToCipher, fmt.Errorf("Reading header failed after %d bytes: %v", tried+n, err)
+			}
+			findStartTime = time.Now()
+			entry, elt = findEntry(firstBytes, ciphers, tried)
+			timeToCipher += time.Now().Sub(findStartTime)
+		}
+	}
 	if entry == nil {
-		// TODO: Ban and log client IPs with too many failures too quick to protect against DoS.
-		return nil, clientReader, nil, timeToCipher, fmt.Errorf("Could not find valid TCP cipher"), id
+		return nil, clientReader, nil, timeToCipher, fmt.Errorf("Could not find valid TCP cipher")
 	}
 
 	// Move the active cipher to the front, so that the search is quicker next time.
 	cipherList.MarkUsedByClientIP(elt, clientIP)
 	salt := firstBytes[:entry.Cipher.SaltSize()]
-	return entry, io.MultiReader(bytes.NewReader(firstBytes), clientReader), salt, timeToCipher, nil, id
+	return entry, io.MultiReader(bytes.NewReader(firstBytes), clientReader), salt, timeToCipher, nil
+}
+
+// findIdentityEntry looks up the user named by the Shadowsocks 2022 identity
+// header of the stream that starts with `*firstBytes`, and authenticates the
+// stream, reading more of it into `*firstBytes` if needed. On success, it
+// strips the identity header from `*firstBytes`. It returns a nil entry if
+// the stream has no valid identity header.
+func findIdentityEntry(clientReader io.Reader, firstBytes *[]byte, cipherList CipherList, identity *ss.IdentityKey) (*CipherEntry, *list.Element, time.Duration, error) {
+	findStartTime := time.Now()
+	user, err := identity.StreamUser(*firstBytes)
+	if err != nil {
+		return nil, nil, time.Now().Sub(findStartTime), err
+	}
+	elt := cipherList.ElementForUser(user)
+	timeToCipher := time.Now().Sub(findStartTime)
+	if elt == nil {
+		return nil, nil, timeToCipher, nil
+	}
+	entry := elt.Value.(*CipherEntry)
+	cipher := entry.Cipher
+	if !identity.Identifies(cipher) {
+		return nil, nil, timeToCipher, nil
+	}
+	saltSize := cipher.SaltSize()
+	headerStart := saltSize + ss.IdentityHeaderSize
+	required := headerStart + cipher.FirstMessageSize() + cipher.TagSize()
+	if tried := len(*firstBytes); required > tried {
+		*firstBytes = append(*firstBytes, make([]byte, required-tried)...)
+		if n, err := io.ReadFull(clientReader, (*firstBytes)[tried:]); err != nil {
+			return nil, nil, timeToCipher, fmt.Errorf("Reading header failed after %d bytes: %v", tried+n, err)
+		}
+	}
+
+	findStartTime = time.Now()
+	var plaintextBuf [16]byte
+	_, err = ss.DecryptOnce(cipher, (*firstBytes)[:saltSize], plaintextBuf[:0], (*firstBytes)[headerStart:required])
+	timeToCipher += time.Now().Sub(findStartTime)
+	if err != nil {
+		debugTCP(entry.ID, "Failed to decrypt identified header: %v", err)
+		return nil, nil, timeToCipher, nil
+	}
+	debugTCP(entry.ID, "Found cipher by identity header in %v", timeToCipher)
+	*firstBytes = identity.StripStreamIdentity(*firstBytes)
+	return entry, elt, timeToCipher, nil
 }
 
 // Implements a trial decryption search.  This assumes that all ciphers are AEAD.
-func findEntry(firstBytes []byte, ciphers []*list.Element) (*CipherEntry, *list.Element, string) {
-	// To hold the decrypted chunk length.
-	chunkLenBuf := [2]byte{}
+// It only tries the ciphers that require more than `tried` bytes, and no more
+// than len(firstBytes).
+func findEntry(firstBytes []byte, ciphers []*list.Element, tried int) (*CipherEntry, *list.Element) {
+	// To hold the decrypted length or Shadowsocks 2022 header.
+	var plaintextBuf [16]byte
 	for ci, elt := range ciphers {
 		entry := elt.Value.(*CipherEntry)
 		id, cipher := entry.ID, entry.Cipher
+		if required := requiredBytes(cipher); required <= tried || required > len(firstBytes) {
+			continue
+		}
 		saltsize := cipher.SaltSize()
 		salt := firstBytes[:saltsize]
-		cipherTextLength := 2 + cipher.TagSize()
+		cipherTextLength := cipher.FirstMessageSize() + cipher.TagSize()
 		cipherText := firstBytes[saltsize : saltsize+cipherTextLength]
-		_, err := ss.DecryptOnce(cipher, salt, chunkLenBuf[:0], cipherText)
+		_, err := ss.DecryptOnce(cipher, salt, plaintextBuf[:0], cipherText)
 		if err != nil {
 			debugTCP(id, "Failed to decrypt length: %v", err)
 			continue
 		}
 		debugTCP(id, "Found cipher at index %d", ci)
 		// Move the active cipher to the front, so that the search is quicker next time.
-		return entry, elt, id
+		return entry, elt
 	}
-	return nil, nil, ""
+	return nil, nil
 }
 
 type tcpService struct {
 	mu          sync.RWMutex // Protects .listeners and .stopped
-	listener    *net.TCPListener
+	listener    net.Listener
 	stopped     bool
 	ciphers     CipherList
 	m           metrics.ShadowsocksMetrics
@@ -122,19 +235,31 @@ type tcpService struct {
 	// `replayCache` is a pointer to .replayCache, to share the cache among all ports.
 	replayCache       *ReplayCache
 	targetIPValidator onet.TargetIPValidator
-	api               *api.APIClient
+	traffic           TrafficRecorder
+	nodeLimits        *NodeLimits
+	bans              *BanList
+	identity          *ss.IdentityKey
+	transport         onet.StreamTransport
+	fallback          string
+	// natTimeout is the idle timeout of UDP-over-TCP streams, or 0 if
+	// UDP-over-TCP is disabled.
+	natTimeout time.Duration
+	acl        *ACL
+	resolver   *dns.Resolver
+	router     *Router
+	egress     *Egress
 }
 
 // NewTCPService creates a TCPService
 // `replayCache` is a pointer to SSServer.replayCache, to share the cache among all ports.
-func NewTCPService(ciphers CipherList, replayCache *ReplayCache, m metrics.ShadowsocksMetrics, timeout time.Duration, api2 *api.APIClient) TCPService {
+func NewTCPService(ciphers CipherList, replayCache *ReplayCache, m metrics.ShadowsocksMetrics, timeout time.Duration) TCPService {
 	return &tcpService{
 		ciphers:           ciphers,
 		m:                 m,
 		readTimeout:       timeout,
 		replayCache:       replayCache,
 		targetIPValidator: onet.RequirePublicIP,
-		api:               api2,
+		traffic:           noopRecorder{},
 	}
 }
 
@@ -142,8 +267,38 @@ func NewTCPService(ciphers CipherList, replayCache *ReplayCache, m metrics.Shado
 type TCPService interface {
 	// SetTargetIPValidator sets the function to be used to validate the target IP addresses.
 	SetTargetIPValidator(targetIPValidator onet.TargetIPValidator)
+	// SetTrafficRecorder sets where the traffic of each access key is recorded.
+	SetTrafficRecorder(traffic TrafficRecorder)
+	// SetNodeLimits sets the rate limits shared by all keys, on top of the per-key limits.
+	SetNodeLimits(limits *NodeLimits)
+	// SetBanList sets the list of client IPs banned for failing authentication.
+	SetBanList(bans *BanList)
+	// SetIdentityKey sets the identity PSK that Shadowsocks 2022 clients use
+	// to name their key, so it's found without trial decryption.
+	SetIdentityKey(identity *ss.IdentityKey)
+	// SetTransport sets the transport that is removed from each client
+	// connection before the Shadowsocks stream is read, or nil for none.
+	SetTransport(transport onet.StreamTransport)
+	// SetFallback sets the host:port that clients failing authentication are
+	// relayed to, with what they sent, instead of being drained. Empty means none.
+	SetFallback(fallback string)
+	// SetUDPOverTCP lets clients relay UDP packets in their streams, each
+	// stream ending after `natTimeout` without packets. 0 disables it.
+	SetUDPOverTCP(natTimeout time.Duration)
+	// SetACL sets the rules of the destinations that clients may reach, or
+	// nil to allow all of them.
+	SetACL(acl *ACL)
+	// SetResolver sets the resolver of target names, or nil for the system one.
+	SetResolver(resolver *dns.Resolver)
+	// SetRouter sets the router that picks the outbound of each target, or
+	// nil to connect to all of them directly.
+	SetRouter(router *Router)
+	// SetEgress sets the local addresses and socket options of the
+	// connections to targets, or nil for the defaults.
+	SetEgress(egress *Egress)
 	// Serve adopts the listener, which will be closed before Serve returns.  Serve returns an error unless Stop() was called.
-	Serve(listener *net.TCPListener) error
+	// The listener must accept onet.DuplexConns, like a *net.TCPListener.
+	Serve(listener net.Listener) error
 	// Stop closes the listener but does not interfere with existing connections.
 	Stop() error
 	// GracefulStop calls Stop(), and then blocks until all resources have been cleaned up.
@@ -154,17 +309,126 @@ func (s *tcpService) SetTargetIPValidator(targetIPValidator onet.TargetIPValidat
 	s.targetIPValidator = targetIPValidator
 }
 
-func dialTarget(tgtAddr socks.Addr, proxyMetrics *metrics.ProxyMetrics, targetIPValidator onet.TargetIPValidator) (onet.DuplexConn, *onet.ConnectionError) {
+func (s *tcpService) SetTrafficRecorder(traffic TrafficRecorder) {
+	s.traffic = traffic
+}
+
+func (s *tcpService) SetNodeLimits(limits *NodeLimits) {
+	s.nodeLimits = limits
+}
+
+func (s *tcpService) SetBanList(bans *BanList) {
+	s.bans = bans
+}
+
+func (s *tcpService) SetIdentityKey(identity *ss.IdentityKey) {
+	s.identity = identity
+}
+
+func (s *tcpService) SetTransport(transport onet.StreamTransport) {
+	s.transport = transport
+}
+
+func (s *tcpService) SetFallback(fallback string) {
+	s.fallback = fallback
+}
+
+func (s *tcpService) SetUDPOverTCP(natTimeout time.Duration) {
+	s.natTimeout = natTimeout
+}
+
+func (s *tcpService) SetACL(acl *ACL) {
+	s.acl = acl
+}
+
+func (s *tcpService) SetResolver(resolver *dns.Resolver) {
+	s.resolver = resolver
+}
+
+func (s *tcpService) SetRouter(router *Router) {
+	s.router = router
+}
+
+func (s *tcpService) SetEgress(egress *Egress) {
+	s.egress = egress
+}
+
+// lookupTarget resolves `host` with `resolver`, or the system resolver if
+// it's nil.
+func lookupTarget(resolver *dns.Resolver, host string) ([]net.IP, error) {
+	if resolver != nil {
+		return resolver.LookupIP(context.Background(), host)
+	}
+	return net.DefaultResolver.LookupIP(context.Background(), "ip", host)
+}
+
+func (s *tcpService) dialTarget(tgtAddr socks.Addr, route Route, proxyMetrics *metrics.ProxyMetrics, entry *CipherEntry) (onet.DuplexConn, *onet.ConnectionError) {
+	host, portText, _ := net.SplitHostPort(tgtAddr.String())
+	port, _ := strconv.Atoi(portText)
+	// Domain rules are checked before the name is resolved.
+	if aclErr := s.acl.Check(entry, host, nil, port); aclErr != nil {
+		return nil, aclErr
+	}
+	if route.Blocked() {
+		return nil, onet.NewConnectionError("ERR_ADDRESS_BLOCKED", "Target blocked by routing", nil)
+	}
+	if upstream := route.Upstream; upstream != nil {
+		// The outbound resolves names, so only IP targets can be checked here.
+		if ip := net.ParseIP(host); ip != nil {
+			if ipError := s.targetIPValidator(ip); ipError != nil {
+				return nil, ipError
+			}
+			if aclErr := s.acl.Check(entry, host, ip, port); aclErr != nil {
+				return nil, aclErr
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+		defer cancel()
+		tgtConn, err := upstream.Dial(ctx, tgtAddr.String())
+		if err != nil {
+			return nil, onet.NewConnectionError("ERR_CONNECT", fmt.Sprintf("Failed to connect to target through outbound %v", route.Outbound), err)
+		}
+		return metrics.MeasureConn(tgtConn, &proxyMetrics.ProxyTarget, &proxyMetrics.TargetProxy), nil
+	}
+	// Without a resolver, the dialer resolves the name, unless the source IP
+	// depends on the family of the target.
+	addresses := []string{tgtAddr.String()}
+	if s.resolver != nil || s.egress.binds(entry, route) {
+		ips, err := lookupTarget(s.resolver, host)
+		if err != nil {
+			return nil, onet.NewConnectionError("ERR_RESOLVE_ADDRESS", fmt.Sprintf("Failed to resolve target address %v", tgtAddr), err)
+		}
+		addresses = addresses[:0]
+		for _, ip := range ips {
+			addresses = append(addresses, net.JoinHostPort(ip.String(), portText))
+		}
+	}
 	var ipError *onet.ConnectionError
 	dialer := net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
-		ip, _, _ := net.SplitHostPort(address)
-		ipError = targetIPValidator(net.ParseIP(ip))
+		ipText, _, _ := net.SplitHostPort(address)
+		ip := net.ParseIP(ipText)
+		ipError = s.targetIPValidator(ip)
+		if ipError == nil {
+			ipError = s.acl.Check(entry, host, ip, port)
+		}
 		if ipError != nil {
 			return errors.New(ipError.Message)
 		}
-		return nil
+		return s.egress.control(c)
 	}}
-	tgtConn, err := dialer.Dial("tcp", tgtAddr.String())
+	var tgtConn net.Conn
+	var err error
+	for _, address := range addresses {
+		ipError = nil
+		dialer.LocalAddr = nil
+		ipText, _, _ := net.SplitHostPort(address)
+		if sourceIP := s.egress.sourceIP(entry, route, net.ParseIP(ipText)); sourceIP != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: sourceIP}
+		}
+		if tgtConn, err = dialer.Dial("tcp", address); err == nil {
+			break
+		}
+	}
 	if ipError != nil {
 		return nil, ipError
 	} else if err != nil {
@@ -175,7 +439,7 @@ func dialTarget(tgtAddr socks.Addr, proxyMetrics *metrics.ProxyMetrics, targetIP
 	return metrics.MeasureConn(tgtTCPConn, &proxyMetrics.ProxyTarget, &proxyMetrics.TargetProxy), nil
 }
 
-func (s *tcpService) Serve(listener *net.TCPListener) error {
+func (s *tcpService) Serve(listener net.Listener) error {
 	s.mu.Lock()
 	if s.listener != nil {
 		s.mu.Unlock()
@@ -191,8 +455,12 @@ func (s *tcpService) Serve(listener *net.TCPListener) error {
 	s.mu.Unlock()
 
 	defer s.running.Done()
+	listenerPort := 0
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		listenerPort = addr.Port
+	}
 	for {
-		clientTCPConn, err := listener.AcceptTCP()
+		conn, err := listener.Accept()
 		if err != nil {
 			s.mu.RLock()
 			stopped := s.stopped
@@ -203,6 +471,12 @@ func (s *tcpService) Serve(listener *net.TCPListener) error {
 			logger.Errorf("Accept failed: %v", err)
 			continue
 		}
+		clientConn, ok := conn.(onet.DuplexConn)
+		if !ok {
+			logger.Errorf("Accepted a %T, which can't be half-closed", conn)
+			conn.Close()
+			continue
+		}
 
 		s.running.Add(1)
 		go func() {
@@ -212,94 +486,175 @@ func (s *tcpService) Serve(listener *net.TCPListener) error {
 					logger.Errorf("Panic in TCP handler: %v", r)
 				}
 			}()
-			s.handleConnection(listener.Addr().(*net.TCPAddr).Port, clientTCPConn)
+			s.handleConnection(listenerPort, clientConn)
 		}()
 	}
 }
 
-func (s *tcpService) handleConnection(listenerPort int, clientTCPConn *net.TCPConn) {
-	//clientLocation, err := s.m.GetLocation(clientTCPConn.RemoteAddr())
+func (s *tcpService) handleConnection(listenerPort int, acceptedConn onet.DuplexConn) {
+	//clientLocation, err := s.m.GetLocation(acceptedConn.RemoteAddr())
 	//if err != nil {
 	//	logger.Warningf("Failed location lookup: %v", err)
 	//}
-	//mylog.Logf("Got location \"%v\" for IP %v", clientLocation, clientTCPConn.RemoteAddr().String())
+	//mylog.Logf("Got location \"%v\" for IP %v", clientLocation, acceptedConn.RemoteAddr().String())
 	//s.m.AddOpenTCPConnection(clientLocation)
 	status := "OK"
 
 	connStart := time.Now()
-	clientTCPConn.SetKeepAlive(true)
+	if tcpConn, ok := acceptedConn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(true)
+	}
 	// Set a deadline to receive the address to the target.
-	clientTCPConn.SetReadDeadline(connStart.Add(s.readTimeout))
+	acceptedConn.SetReadDeadline(connStart.Add(s.readTimeout))
+	clientDuplex := acceptedConn
+	var transportErr error
+	if s.transport != nil {
+		// The transport handshake runs under the same deadline.
+		if clientDuplex, transportErr = s.transport(acceptedConn); transportErr != nil {
+			clientDuplex = acceptedConn
+		}
+	}
 	var proxyMetrics metrics.ProxyMetrics
-	clientConn := metrics.MeasureConn(clientTCPConn, &proxyMetrics.ProxyClient, &proxyMetrics.ClientProxy)
-	cipherEntry, clientReader, clientSalt, timeToCipher, keyErr, uid := findAccessKey(clientConn, remoteIP(clientTCPConn), s.ciphers)
+	clientConn := metrics.MeasureConn(clientDuplex, &proxyMetrics.ProxyClient, &proxyMetrics.ClientProxy)
+	clientIP := remoteIP(clientDuplex)
+	// Banned IPs skip the trial decryption, but are otherwise treated like any
+	// other client that fails authentication.
+	banned := s.bans.Banned(clientIP, connStart)
+	var cipherEntry *CipherEntry
+	var clientReader io.Reader
+	var clientSalt []byte
+	var timeToCipher time.Duration
+	var keyErr error
+	// With a fallback, what the client sends while its key is looked up is
+	// recorded to be replayed to the fallback.
+	var recorder *recordingReader
+	if !banned && transportErr == nil {
+		var keyReader io.Reader = clientConn
+		if s.fallback != "" {
+			recorder = &recordingReader{Reader: clientConn, conn: clientConn, stallTimeout: fallbackStallTimeout, deadline: connStart.Add(s.readTimeout)}
+			keyReader = recorder
+		}
+		cipherEntry, clientReader, clientSalt, timeToCipher, keyErr = findAccessKey(keyReader, clientIP, s.ciphers, s.identity)
+		if recorder != nil && keyErr == nil {
+			recorder.stop()
+			clientConn.SetReadDeadline(connStart.Add(s.readTimeout))
+		}
+	}
 	var id string
+	// outboundName is the outbound the target was routed through, if any.
+	var outboundName string
 
 	connError := func() *onet.ConnectionError {
+		if banned {
+			const status = "ERR_BANNED"
+			s.absorbProbe(listenerPort, clientConn, "", status, &proxyMetrics)
+			return onet.NewConnectionError(status, "Client IP is banned", nil)
+		}
+		if transportErr != nil {
+			const status = "ERR_TRANSPORT"
+			recordAuthFailure(s.bans, clientIP)
+			s.absorbProbe(listenerPort, clientConn, "", status, &proxyMetrics)
+			return onet.NewConnectionError(status, "Failed to remove the transport", transportErr)
+		}
 		if keyErr != nil {
 			logger.Debugf("Failed to find a valid cipher after reading %v bytes: %v", proxyMetrics.ClientProxy, keyErr)
 			const status = "ERR_CIPHER"
-			s.absorbProbe(listenerPort, clientConn, "", status, &proxyMetrics)
+			recordAuthFailure(s.bans, clientIP)
+			if recorder != nil {
+				s.relayToFallback(listenerPort, clientConn, recorder.recorded(), status, &proxyMetrics)
+			} else {
+				s.absorbProbe(listenerPort, clientConn, "", status, &proxyMetrics)
+			}
 			return onet.NewConnectionError(status, "Failed to find a valid cipher", keyErr)
 		}
 
 		isServerSalt := cipherEntry.SaltGenerator.IsServerSalt(clientSalt)
 		// Only check the cache if findAccessKey succeeded and the salt is unrecognized.
-		if isServerSalt || !s.replayCache.Add(cipherEntry.ID, clientSalt) {
+		isNewSalt := s.replayCache.Add(cipherEntry.ID, clientSalt)
+		if cipherEntry.Cipher.Is2022() {
+			// Shadowsocks 2022 requires remembering every salt within the
+			// timestamp window, however busy the server is.
+			isNewSalt = s.replayCache.AddTimed(cipherEntry.ID, clientSalt, connStart) && isNewSalt
+		}
+		if isServerSalt || !isNewSalt {
 			var status string
 			if isServerSalt {
 				status = "ERR_REPLAY_SERVER"
 			} else {
 				status = "ERR_REPLAY_CLIENT"
 			}
+			recordAuthFailure(s.bans, clientIP)
 			s.absorbProbe(listenerPort, clientConn, "", status, &proxyMetrics)
-			logger.Debugf(status+": %v in %s sent %d bytes", clientTCPConn.RemoteAddr(), "", proxyMetrics.ClientProxy)
+			logger.Debugf(status+": %v in %s sent %d bytes", clientConn.RemoteAddr(), "", proxyMetrics.ClientProxy)
 			return onet.NewConnectionError(status, "Replay detected", nil)
 		}
 
-		ssr := ss.NewShadowsocksReader(clientReader, cipherEntry.Cipher)
+		if cipherEntry.quotaExceeded() {
+			mylog.Logf("quota exceeded user:%v,%v", cipherEntry.ID, clientConn.RemoteAddr().String())
+			return onet.NewConnectionError("ERR_QUOTA", "Data quota exceeded", nil)
+		}
+		if !cipherEntry.acquireDevice(clientIP, time.Now()) {
+			mylog.Logf("device limit user:%v,%v", cipherEntry.ID, clientConn.RemoteAddr().String())
+			return onet.NewConnectionError("ERR_DEVICE_LIMIT", "Too many devices", nil)
+		}
+		defer func() { cipherEntry.releaseDevice(clientIP, time.Now()) }()
+		if !cipherEntry.acquireTCP() {
+			mylog.Logf("connection limit user:%v,%v", cipherEntry.ID, clientConn.RemoteAddr().String())
+			return onet.NewConnectionError("ERR_CONN_LIMIT", "Too many connections", nil)
+		}
+		defer cipherEntry.releaseTCP()
+
+		ssr := ss.NewRequestReader(clientReader, cipherEntry.Cipher)
 		tgtAddr, err := socks.ReadAddr(ssr)
 		// Clear the deadline for the target address
-		clientTCPConn.SetReadDeadline(time.Time{})
+		clientConn.SetReadDeadline(time.Time{})
 		if err != nil {
 			// Drain to prevent a close on cipher error.
 			io.Copy(io.Discard, clientConn)
 			return onet.NewConnectionError("ERR_READ_ADDRESS", "Failed to get target address", err)
 		}
-		mylog.Logf("proxy333 host:%v,user:%v,%v", tgtAddr.String(), uid, clientTCPConn.RemoteAddr().String())
-		s.api.AddWwwRepo(api.WwwTraffic{
-			Host:   tgtAddr.String(),
-			UNID:   uid,
-			Date:   time.Now().Unix(),
-			Status: 1,
-			IsUdp:  0,
-			Uip:    clientTCPConn.RemoteAddr().String(),
-		})
-		tgtConn, dialErr := dialTarget(tgtAddr, &proxyMetrics, s.targetIPValidator)
+		if version := ss.UDPOverTCPVersion(tgtAddr.String()); version != 0 && s.natTimeout > 0 {
+			ssw := ss.NewResponseWriter(clientConn, cipherEntry.Cipher, clientSalt)
+			ssw.SetSaltGenerator(cipherEntry.SaltGenerator)
+			return s.relayPackets(clientConn, ssr, ssw, cipherEntry, version, &proxyMetrics)
+		}
+		tgtHost, tgtPort, _ := net.SplitHostPort(tgtAddr.String())
+		port, _ := strconv.Atoi(tgtPort)
+		route := s.router.Route(cipherEntry, tgtHost, port)
+		outboundName = route.Outbound
+		tgtConn, dialErr := s.dialTarget(tgtAddr, route, &proxyMetrics, cipherEntry)
+		sourceIP := ""
+		if dialErr == nil {
+			sourceIP = addrIPText(tgtConn.LocalAddr())
+		}
+		s.traffic.AddDestination(cipherEntry.ID, tgtAddr.String(), clientConn.RemoteAddr().String(), route.Outbound, sourceIP, false)
+		dialStatus := "OK"
+		if dialErr != nil {
+			dialStatus = dialErr.Status
+		}
+		mylog.Logf("proxy333 host:%v,user:%v,%v, outbound:%v, source:%v, status:%v", tgtAddr.String(), cipherEntry.ID, clientConn.RemoteAddr().String(), route.Outbound, sourceIP, dialStatus)
 		if dialErr != nil {
 			// We don't drain so dial errors and invalid addresses are communicated quickly.
 			return dialErr
 		}
 		defer tgtConn.Close()
+		limitedTgtConn := &limitedConn{DuplexConn: tgtConn, entry: cipherEntry, node: s.nodeLimits}
 
-		//logger.Debugf("proxy %s <-> %s", clientTCPConn.RemoteAddr().String(), tgtConn.RemoteAddr().String())
+		//logger.Debugf("proxy %s <-> %s", clientConn.RemoteAddr().String(), tgtConn.RemoteAddr().String())
 
-		ssw := ss.NewShadowsocksWriter(clientConn, cipherEntry.Cipher)
+		ssw := ss.NewResponseWriter(clientConn, cipherEntry.Cipher, clientSalt)
 		ssw.SetSaltGenerator(cipherEntry.SaltGenerator)
 
 		fromClientErrCh := make(chan error)
 		go func() {
-			i, fromClientErr := ssr.WriteTo(tgtConn)
+			i, fromClientErr := ssr.WriteTo(limitedTgtConn)
 
-			if fromClientErr != nil {
+			if fromClientErr != nil && !limitedTgtConn.quotaExceeded() {
 				// Drain to prevent a close in the case of a cipher error.
 				io.Copy(io.Discard, clientConn)
 			}
 			//mylog.Logf("proxy2222 %s ------%v", tgtAddr.String(), uid)
-			s.api.AddRepo(&api.UserTraffic{
-				UID: uid,
-				U:   i,
-			})
+			s.traffic.AddTraffic(cipherEntry.ID, i, 0)
 			clientConn.CloseRead()
 			// Send FIN to target.
 			// We must do this after the drain is completed, otherwise the target will close its
@@ -307,16 +662,17 @@ func (s *tcpService) handleConnection(listenerPort int, clientTCPConn *net.TCPCo
 			tgtConn.CloseWrite()
 			fromClientErrCh <- fromClientErr
 		}()
-		ri, fromTargetErr := ssw.ReadFrom(tgtConn)
-		s.api.AddRepo(&api.UserTraffic{
-			UID: uid,
-			D:   ri,
-		})
+		ri, fromTargetErr := ssw.ReadFrom(limitedTgtConn)
+		s.traffic.AddTraffic(cipherEntry.ID, 0, ri)
 		// Send FIN to client.
 		clientConn.CloseWrite()
 		tgtConn.CloseRead()
 
 		fromClientErr := <-fromClientErrCh
+		if limitedTgtConn.quotaExceeded() {
+			mylog.Logf("quota exceeded user:%v,%v", cipherEntry.ID, clientConn.RemoteAddr().String())
+			return onet.NewConnectionError("ERR_QUOTA", "Data quota exceeded", errQuotaExceeded)
+		}
 		if fromClientErr != nil {
 			return onet.NewConnectionError("ERR_RELAY_CLIENT", "Failed to relay traffic from client", fromClientErr)
 		}
@@ -336,6 +692,9 @@ func (s *tcpService) handleConnection(listenerPort int, clientTCPConn *net.TCPCo
 	}
 	//mylog.Logf("uid:%v,id:%v", uid, id)
 	s.m.AddClosedTCPConnection("", id, status, proxyMetrics, timeToCipher, connDuration)
+	if outboundName != "" {
+		s.m.AddOutboundConnection("tcp", outboundName, status)
+	}
 	clientConn.Close() // Closing after the metrics are added aids integration testing.
 	logger.Debugf("Done with status %v, duration %v", status, connDuration)
 }
@@ -349,6 +708,68 @@ func (s *tcpService) absorbProbe(listenerPort int, clientConn io.ReadCloser, cli
 	s.m.AddTCPProbe(status, drainResult, listenerPort, *proxyMetrics)
 }
 
+// relayToFallback relays a client that failed authentication to the fallback,
+// starting with `firstBytes`, what it already sent, so that probes see the
+// fallback's service instead of a port that never answers. If the fallback
+// can't be reached, the client is drained like any other probe.
+func (s *tcpService) relayToFallback(listenerPort int, clientConn onet.DuplexConn, firstBytes []byte, status string, proxyMetrics *metrics.ProxyMetrics) {
+	fallbackConn, err := net.DialTimeout("tcp", s.fallback, s.readTimeout)
+	if err != nil {
+		logger.Warningf("Failed to connect to the fallback: %v", err)
+		s.m.AddTCPFallback(status, "ERR_CONNECT", listenerPort)
+		s.absorbProbe(listenerPort, clientConn, "", status, proxyMetrics)
+		return
+	}
+	defer fallbackConn.Close()
+	clientConn.SetReadDeadline(time.Time{})
+	_, err = fallbackConn.Write(firstBytes)
+	if err == nil {
+		_, _, err = onet.Relay(clientConn, fallbackConn.(*net.TCPConn))
+	}
+	result := "OK"
+	if err != nil {
+		logger.Debugf("Fallback relay failed: %v", err)
+		result = "ERR_RELAY"
+	}
+	s.m.AddTCPFallback(status, result, listenerPort)
+}
+
+// recordingReader keeps a copy of what is read through it, until stopped.
+// Until then, each read also times out if `conn` stalls for stallTimeout,
+// or at the deadline.
+type recordingReader struct {
+	io.Reader
+	conn         net.Conn
+	stallTimeout time.Duration
+	deadline     time.Time
+	buf          bytes.Buffer
+	stopped      bool
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	if !r.stopped && r.conn != nil {
+		deadline := time.Now().Add(r.stallTimeout)
+		if deadline.After(r.deadline) {
+			deadline = r.deadline
+		}
+		r.conn.SetReadDeadline(deadline)
+	}
+	n, err := r.Reader.Read(p)
+	if !r.stopped {
+		r.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+func (r *recordingReader) stop() {
+	r.stopped = true
+	r.buf = bytes.Buffer{}
+}
+
+func (r *recordingReader) recorded() []byte {
+	return r.buf.Bytes()
+}
+
 func drainErrToString(drainErr error) string {
 	netErr, ok := drainErr.(net.Error)
 	switch {
@@ -103,23 +103,33 @@ func BenchmarkTCPFindCipherFail(b *testing.B) {
 		}
 		clientIP := clientConn.RemoteAddr().(*net.TCPAddr).IP
 		b.StartTimer()
-		findAccessKey(clientConn, clientIP, cipherList)
+		findAccessKey(clientConn, clientIP, cipherList, nil)
 		b.StopTimer()
 	}
 }
 
 func TestCompatibleCiphers(t *testing.T) {
 	for _, cipherName := range ss.SupportedCipherNames() {
-		cipher, _ := ss.NewCipher(cipherName, "dummy secret")
+		cipher, err := ss.NewCipher(cipherName, ss.MakeTestSecret(cipherName, "dummy secret"))
+		require.NoError(t, err, cipherName)
 		// We need at least this many bytes to assess whether a TCP stream corresponds
 		// to this cipher.
-		requires := cipher.SaltSize() + 2 + cipher.TagSize()
-		if requires > bytesForKeyFinding {
-			t.Errorf("Cipher %v required %v bytes > bytesForKeyFinding (%v)", cipherName, requires, bytesForKeyFinding)
-		}
+		requires := requiredBytes(cipher)
 		// Any TCP stream for this cipher will deliver at least this many bytes before
 		// requiring the proxy to act.
 		provides := requires + cipher.TagSize()
+		if cipher.Is2022() {
+			// The variable-length header has at least an IPv4 address and the
+			// padding length.
+			provides += len(socks.ParseAddr("192.0.2.1:80")) + 2
+		}
+		if requires > bytesForKeyFinding {
+			if !cipher.Is2022() {
+				t.Errorf("Cipher %v required %v bytes > bytesForKeyFinding (%v)", cipherName, requires, bytesForKeyFinding)
+			} else if provides < requires {
+				t.Errorf("Cipher %v provides %v bytes < required (%v)", cipherName, provides, requires)
+			}
+		}
 		if provides < bytesForKeyFinding {
 			t.Errorf("Cipher %v provides %v bytes < bytesForKeyFinding (%v)", cipherName, provides, bytesForKeyFinding)
 		}
@@ -206,7 +216,7 @@ func BenchmarkTCPFindCipherRepeat(b *testing.B) {
 		cipher := cipherEntries[cipherNumber].Cipher
 		go ss.NewShadowsocksWriter(writer, cipher).Write(ss.MakeTestPayload(50))
 		b.StartTimer()
-		_, _, _, _, err := findAccessKey(&c, clientIP, cipherList)
+		_, _, _, _, err := findAccessKey(&c, clientIP, cipherList, nil)
 		b.StopTimer()
 		if err != nil {
 			b.Error(err)
@@ -222,6 +232,8 @@ type probeTestMetrics struct {
 	probeData   []metrics.ProxyMetrics
 	probeStatus []string
 	closeStatus []string
+	fallbacks   []string
+	outbounds   []string
 }
 
 func (m *probeTestMetrics) AddTCPProbe(status, drainResult string, port int, data metrics.ProxyMetrics) {
@@ -230,12 +242,23 @@ func (m *probeTestMetrics) AddTCPProbe(status, drainResult string, port int, dat
 	m.probeStatus = append(m.probeStatus, status)
 	m.mu.Unlock()
 }
+func (m *probeTestMetrics) AddTCPFallback(status, result string, port int) {
+	m.mu.Lock()
+	m.fallbacks = append(m.fallbacks, status+" "+result)
+	m.mu.Unlock()
+}
 func (m *probeTestMetrics) AddClosedTCPConnection(clientLocation, accessKey, status string, data metrics.ProxyMetrics, timeToCipher, duration time.Duration) {
 	m.mu.Lock()
 	m.closeStatus = append(m.closeStatus, status)
 	m.mu.Unlock()
 }
 
+func (m *probeTestMetrics) AddOutboundConnection(proto, outbound, status string) {
+	m.mu.Lock()
+	m.outbounds = append(m.outbounds, outbound+" "+status)
+	m.mu.Unlock()
+}
+
 func (m *probeTestMetrics) GetLocation(net.Addr) (string, error) {
 	return "", nil
 }
@@ -718,3 +741,140 @@ func TestTCPEarlyStop(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// prefixTransport is a transport that removes a fixed prefix.
+func prefixTransport(prefix string) onet.StreamTransport {
+	return func(conn onet.DuplexConn) (onet.DuplexConn, error) {
+		got := make([]byte, len(prefix))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			return nil, err
+		}
+		if string(got) != prefix {
+			return nil, errors.New("bad prefix")
+		}
+		return conn, nil
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+	listener, running := startDiscardServer(t)
+	defer func() {
+		listener.Close()
+		running.Wait()
+	}()
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, nil, testMetrics, 200*time.Millisecond)
+	s.SetTargetIPValidator(allowAll)
+	s.SetTransport(prefixTransport("obfs"))
+	serverListener := makeLocalhostListener(t)
+	go s.Serve(serverListener)
+
+	request := makeClientBytesBasic(t, firstCipher(cipherList), listener.Addr().String())
+	for _, prefix := range []string{"obfs", "plain"} {
+		conn, err := net.DialTCP("tcp", nil, serverListener.Addr().(*net.TCPAddr))
+		require.NoError(t, err)
+		_, err = conn.Write(append([]byte(prefix), request...))
+		require.NoError(t, err)
+		conn.CloseWrite()
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	s.GracefulStop()
+	require.Equal(t, []string{"OK", "ERR_TRANSPORT"}, testMetrics.closeStatus)
+	require.Equal(t, []string{"ERR_TRANSPORT"}, testMetrics.probeStatus)
+}
+
+func TestTCPFallback(t *testing.T) {
+	// The fallback answers with everything it received.
+	fallback := makeLocalhostListener(t)
+	defer fallback.Close()
+	go func() {
+		for {
+			conn, err := fallback.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				received, _ := io.ReadAll(conn)
+				conn.Write(append([]byte("fallback:"), received...))
+			}()
+		}
+	}()
+
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, nil, testMetrics, 200*time.Millisecond)
+	s.SetFallback(fallback.Addr().String())
+	serverListener := makeLocalhostListener(t)
+	go s.Serve(serverListener)
+
+	// Both a probe long enough for key finding and a short one reach the
+	// fallback whole.
+	for _, size := range []int{221, 10} {
+		payload := ss.MakeTestPayload(size)
+		conn, err := net.DialTCP("tcp", nil, serverListener.Addr().(*net.TCPAddr))
+		require.NoError(t, err)
+		_, err = conn.Write(payload)
+		require.NoError(t, err)
+		conn.CloseWrite()
+		reply, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		require.Equal(t, append([]byte("fallback:"), payload...), reply)
+		conn.Close()
+	}
+
+	// Without a reachable fallback, probes are drained.
+	fallback.Close()
+	require.NoError(t, probe(serverListener.Addr().(*net.TCPAddr), ss.MakeTestPayload(60)))
+	s.GracefulStop()
+
+	require.Equal(t, []string{"ERR_CIPHER OK", "ERR_CIPHER OK", "ERR_CIPHER ERR_CONNECT"}, testMetrics.fallbacks)
+	require.Equal(t, []string{"ERR_CIPHER"}, testMetrics.probeStatus)
+}
+
+// A short probe that waits for a reply, like an HTTP request, gets the
+// fallback's reply as soon as it stalls, long before the read timeout.
+func TestTCPFallbackShortProbe(t *testing.T) {
+	// The fallback answers each request it receives.
+	fallback := makeLocalhostListener(t)
+	defer fallback.Close()
+	go func() {
+		for {
+			conn, err := fallback.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				n, _ := conn.Read(buf)
+				conn.Write(append([]byte("fallback:"), buf[:n]...))
+			}()
+		}
+	}()
+
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	s := NewTCPService(cipherList, nil, &probeTestMetrics{}, time.Minute)
+	s.SetFallback(fallback.Addr().String())
+	serverListener := makeLocalhostListener(t)
+	go s.Serve(serverListener)
+	defer s.GracefulStop()
+
+	request := []byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	conn, err := net.DialTCP("tcp", nil, serverListener.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	defer conn.Close()
+	start := time.Now()
+	_, err = conn.Write(request)
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, append([]byte("fallback:"), request...), reply)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
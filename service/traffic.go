@@ -0,0 +1,30 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+// TrafficRecorder accumulates the usage of each access key for billing.
+// Its methods are called concurrently from every connection.
+type TrafficRecorder interface {
+	// AddTraffic adds `up` bytes from and `down` bytes to the client to `keyID`.
+	AddTraffic(keyID string, up, down int64)
+	// AddDestination records that `keyID` at `clientAddr` connected to `host`
+	// through `outbound`, from the local `sourceIP`, or "" if unknown.
+	AddDestination(keyID, host, clientAddr, outbound, sourceIP string, isUDP bool)
+}
+
+type noopRecorder struct{}
+
+func (noopRecorder) AddTraffic(keyID string, up, down int64)                                       {}
+func (noopRecorder) AddDestination(keyID, host, clientAddr, outbound, sourceIP string, isUDP bool) {}
@@ -15,17 +15,19 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"myoss/api"
 	"myoss/mylog"
 	"net"
 	"runtime/debug"
+	"strconv"
 	"sync"
 	"time"
 
 	logging "github.com/op/go-logging"
 	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"myoss/dns"
 	onet "myoss/net"
 	"myoss/service/metrics"
 	ss "myoss/shadowsocks"
@@ -51,24 +53,59 @@ func debugUDPAddr(addr net.Addr, template string, val interface{}) {
 }
 
 // Decrypts src into dst. It tries each cipher until it finds one that authenticates
-// correctly. dst and src must not overlap.
-func findAccessKeyUDP(clientIP net.IP, dst, src []byte, cipherList CipherList) ([]byte, string, *ss.Cipher, error) {
+// correctly. dst and src must not overlap. It also returns the session header of
+// Shadowsocks 2022 packets, and whether the packet named its key with an
+// identity header, which it finds without trial decryption.
+func findAccessKeyUDP(clientIP net.IP, dst, src []byte, cipherList CipherList, identity *ss.IdentityKey) ([]byte, string, *CipherEntry, ss.PacketHeader, bool, error) {
+	if entry, buf, header, ok := findIdentityUDP(clientIP, dst, src, cipherList, identity); ok {
+		return buf, entry.ID, entry, header, true, nil
+	}
 	// Try each cipher until we find one that authenticates successfully. This assumes that all ciphers are AEAD.
 	// We snapshot the list because it may be modified while we use it.
 	snapshot := cipherList.SnapshotForClientIP(clientIP)
-	for ci, entry := range snapshot {
-		id, cipher := entry.Value.(*CipherEntry).ID, entry.Value.(*CipherEntry).Cipher
-		buf, err := ss.Unpack(dst, src, cipher)
+	for ci, elt := range snapshot {
+		entry := elt.Value.(*CipherEntry)
+		id, cipher := entry.ID, entry.Cipher
+		buf, header, err := ss.UnpackPacket(dst, src, cipher, false)
 		if err != nil {
 			debugUDP(id, "Failed to unpack: %v", err)
 			continue
 		}
 		debugUDP(id, "Found cipher at index %d", ci)
 		// Move the active cipher to the front, so that the search is quicker next time.
-		cipherList.MarkUsedByClientIP(entry, clientIP)
-		return buf, id, cipher, nil
+		cipherList.MarkUsedByClientIP(elt, clientIP)
+		return buf, id, entry, header, false, nil
+	}
+	return nil, "", nil, ss.PacketHeader{}, false, errors.New("could not find valid cipher")
+}
+
+// findIdentityUDP decrypts src into dst if its identity header names a key
+// that authenticates it. Otherwise, src is left as it was.
+func findIdentityUDP(clientIP net.IP, dst, src []byte, cipherList CipherList, identity *ss.IdentityKey) (*CipherEntry, []byte, ss.PacketHeader, bool) {
+	if identity == nil {
+		return nil, nil, ss.PacketHeader{}, false
+	}
+	user, ok := identity.PacketUser(src)
+	if !ok {
+		return nil, nil, ss.PacketHeader{}, false
+	}
+	elt := cipherList.ElementForUser(user)
+	if elt == nil || !identity.Identifies(elt.Value.(*CipherEntry).Cipher) {
+		return nil, nil, ss.PacketHeader{}, false
+	}
+	entry := elt.Value.(*CipherEntry)
+	// Stripping the identity header overwrites it, so keep it for trial decryption.
+	var identityHeader [ss.IdentityHeaderSize]byte
+	copy(identityHeader[:], src[ss.IdentityHeaderSize:])
+	buf, header, err := ss.UnpackPacket(dst, identity.StripPacketIdentity(src, entry.Cipher), entry.Cipher, false)
+	if err != nil {
+		debugUDP(entry.ID, "Failed to unpack identified packet: %v", err)
+		copy(src[ss.IdentityHeaderSize:], identityHeader[:])
+		return nil, nil, ss.PacketHeader{}, false
 	}
-	return nil, "", nil, errors.New("could not find valid cipher")
+	debugUDP(entry.ID, "Found cipher by identity header for %v", clientIP)
+	cipherList.MarkUsedByClientIP(elt, clientIP)
+	return entry, buf, header, true
 }
 
 type udpService struct {
@@ -80,18 +117,53 @@ type udpService struct {
 	m                 metrics.ShadowsocksMetrics
 	running           sync.WaitGroup
 	targetIPValidator onet.TargetIPValidator
-	api               *api.APIClient
+	traffic           TrafficRecorder
+	nodeLimits        *NodeLimits
+	bans              *BanList
+	identity          *ss.IdentityKey
+	acl               *ACL
+	resolver          *dns.Resolver
+	router            *Router
+	egress            *Egress
+	replayCache       *ReplayCache
 }
 
 // NewUDPService creates a UDPService
-func NewUDPService(natTimeout time.Duration, cipherList CipherList, m metrics.ShadowsocksMetrics, api2 *api.APIClient) UDPService {
-	return &udpService{natTimeout: natTimeout, ciphers: cipherList, m: m, targetIPValidator: onet.RequirePublicIP, api: api2}
+func NewUDPService(natTimeout time.Duration, cipherList CipherList, m metrics.ShadowsocksMetrics) UDPService {
+	return &udpService{natTimeout: natTimeout, ciphers: cipherList, m: m, targetIPValidator: onet.RequirePublicIP, traffic: noopRecorder{}, replayCache: &ReplayCache{}}
 }
 
 // UDPService is a running UDP shadowsocks proxy that can be stopped.
 type UDPService interface {
 	// SetTargetIPValidator sets the function to be used to validate the target IP addresses.
 	SetTargetIPValidator(targetIPValidator onet.TargetIPValidator)
+	// SetTrafficRecorder sets where the traffic of each access key is recorded.
+	SetTrafficRecorder(traffic TrafficRecorder)
+	// SetNodeLimits sets the rate limits shared by all keys, on top of the per-key limits.
+	SetNodeLimits(limits *NodeLimits)
+	// SetBanList sets the list of client IPs banned for failing authentication.
+	// UDP source addresses can be spoofed, so it shouldn't be the list of a
+	// TCP service, or forged packets could lock clients out of TCP.
+	SetBanList(bans *BanList)
+	// SetIdentityKey sets the identity PSK that Shadowsocks 2022 clients use
+	// to name their key, so it's found without trial decryption.
+	SetIdentityKey(identity *ss.IdentityKey)
+	// SetACL sets the rules of the destinations that clients may reach, or
+	// nil to allow all of them.
+	SetACL(acl *ACL)
+	// SetResolver sets the resolver of target names, or nil for the system one.
+	SetResolver(resolver *dns.Resolver)
+	// SetRouter sets the router that picks the outbound of each NAT session,
+	// by the target of its first packet, or nil to relay all of them directly.
+	SetRouter(router *Router)
+	// SetEgress sets the local addresses and socket options of the NAT
+	// sessions, or nil for the defaults. Sessions are bound to the source IP
+	// of the family of the target of their first packet.
+	SetEgress(egress *Egress)
+	// SetReplayCache sets the cache of the replay filters of Shadowsocks
+	// 2022 sessions, to share it with other ports. By default the service
+	// has its own.
+	SetReplayCache(replayCache *ReplayCache)
 	// Serve adopts the clientConn, and will not return until it is closed by Stop().
 	Serve(clientConn net.PacketConn) error
 	// Stop closes the clientConn and prevents further forwarding of packets.
@@ -104,6 +176,42 @@ func (s *udpService) SetTargetIPValidator(targetIPValidator onet.TargetIPValidat
 	s.targetIPValidator = targetIPValidator
 }
 
+func (s *udpService) SetTrafficRecorder(traffic TrafficRecorder) {
+	s.traffic = traffic
+}
+
+func (s *udpService) SetNodeLimits(limits *NodeLimits) {
+	s.nodeLimits = limits
+}
+
+func (s *udpService) SetBanList(bans *BanList) {
+	s.bans = bans
+}
+
+func (s *udpService) SetIdentityKey(identity *ss.IdentityKey) {
+	s.identity = identity
+}
+
+func (s *udpService) SetACL(acl *ACL) {
+	s.acl = acl
+}
+
+func (s *udpService) SetResolver(resolver *dns.Resolver) {
+	s.resolver = resolver
+}
+
+func (s *udpService) SetRouter(router *Router) {
+	s.router = router
+}
+
+func (s *udpService) SetEgress(egress *Egress) {
+	s.egress = egress
+}
+
+func (s *udpService) SetReplayCache(replayCache *ReplayCache) {
+	s.replayCache = replayCache
+}
+
 // Listen on addr for encrypted packets and basically do UDP NAT.
 // We take the ciphers as a pointer because it gets replaced on config updates.
 func (s *udpService) Serve(clientConn net.PacketConn) error {
@@ -123,6 +231,8 @@ func (s *udpService) Serve(clientConn net.PacketConn) error {
 	defer s.running.Done()
 
 	nm := newNATmap(s.natTimeout, s.m, &s.running)
+	nm.traffic = s.traffic
+	nm.nodeLimits = s.nodeLimits
 	defer nm.Close()
 	cipherBuf := make([]byte, serverUDPBufferSize)
 	textBuf := make([]byte, serverUDPBufferSize)
@@ -155,26 +265,31 @@ func (s *udpService) Serve(clientConn net.PacketConn) error {
 			var proxyTargetBytes int
 			var timeToCipher time.Duration
 			var tgtUDPAddr *net.UDPAddr
+			// outboundName is the outbound of the NAT session of the packet,
+			// and sessionOutbound is also set if the packet starts the session.
+			var outboundName, sessionOutbound string
+			// sourceIP is the local IP of the NAT session of the packet, if known.
+			var sourceIP string
 			defer func() {
 				status := "OK"
 				if connError != nil {
 					logger.Debugf("UDP Error: %v: %v", connError.Message, connError.Cause)
 					status = connError.Status
 				}
-				s.api.AddWwwRepo(api.WwwTraffic{
-					Host:   tgtUDPAddr.String(),
-					UNID:   keyID,
-					Date:   time.Now().Unix(),
-					Status: 1,
-					IsUdp:  1,
-					Uip:    clientAddr.String(),
-				})
-				mylog.Logf("UDP over user:%v,%v , up:%v,down:%v ,host:%v, status:%v", keyID, clientAddr.String(), clientProxyBytes, proxyTargetBytes, tgtUDPAddr.String(), status)
-				s.api.AddRepo(&api.UserTraffic{
-					UID: keyID,
-					U:   int64(clientProxyBytes),
-					D:   int64(proxyTargetBytes),
-				})
+				if tgtUDPAddr != nil {
+					s.traffic.AddDestination(keyID, tgtUDPAddr.String(), clientAddr.String(), outboundName, sourceIP, true)
+				}
+				mylog.Logf("UDP over user:%v,%v , up:%v,down:%v ,host:%v, outbound:%v, source:%v, status:%v", keyID, clientAddr.String(), clientProxyBytes, proxyTargetBytes, tgtUDPAddr.String(), outboundName, sourceIP, status)
+				if sessionOutbound != "" {
+					s.m.AddOutboundConnection("udp", sessionOutbound, status)
+				}
+				// The download is recorded by timedCopy, as packets come back from the target.
+				switch status {
+				case "ERR_QUOTA", "ERR_RATE_LIMIT", "ERR_CONN_LIMIT", "ERR_DEVICE_LIMIT":
+					// Refused packets are not billed.
+				default:
+					s.traffic.AddTraffic(keyID, int64(clientProxyBytes), 0)
+				}
 				s.m.AddUDPPacketFromClient(clientLocation, keyID, status, clientProxyBytes, proxyTargetBytes, timeToCipher)
 			}()
 
@@ -198,48 +313,116 @@ func (s *udpService) Serve(clientConn net.PacketConn) error {
 				}
 				debugUDPAddr(clientAddr, "Got location \"%s\"", clientLocation)
 
-				ip := clientAddr.(*net.UDPAddr).IP
+				ip := addrIP(clientAddr)
+				if s.bans.Banned(ip, time.Now()) {
+					// Dropped without trial decryption. UDP never answers failures anyway.
+					return onet.NewConnectionError("ERR_BANNED", "Client IP is banned", nil)
+				}
 				var textData []byte
-				var cipher *ss.Cipher
+				var entry *CipherEntry
+				var header ss.PacketHeader
+				var identified bool
 				unpackStart := time.Now()
-				textData, keyID, cipher, err = findAccessKeyUDP(ip, textBuf, cipherData, s.ciphers)
+				textData, keyID, entry, header, identified, err = findAccessKeyUDP(ip, textBuf, cipherData, s.ciphers, s.identity)
 				timeToCipher = time.Now().Sub(unpackStart)
 
 				if err != nil {
+					recordAuthFailure(s.bans, ip)
 					return onet.NewConnectionError("ERR_CIPHER", "Failed to unpack initial packet", err)
 				}
 
+				if entry.quotaExceeded() {
+					return onet.NewConnectionError("ERR_QUOTA", "Data quota exceeded", nil)
+				}
+
+				var route Route
 				var onetErr *onet.ConnectionError
-				if payload, tgtUDPAddr, onetErr = s.validatePacket(textData); onetErr != nil {
+				payload, tgtUDPAddr, route, onetErr = s.validatePacket(textData, entry)
+				outboundName, sessionOutbound = route.Outbound, route.Outbound
+				if onetErr != nil {
 					return onetErr
 				}
 
-				udpConn, err := net.ListenPacket("udp", "")
+				// The session is counted from here, so that the ports of the
+				// key can't open more than its limit between them. natmap.Add
+				// takes over the session and device it reserves.
+				if !entry.acquireUDP() {
+					return onet.NewConnectionError("ERR_CONN_LIMIT", "Too many UDP sessions", nil)
+				}
+				if !entry.acquireDevice(ip, time.Now()) {
+					entry.releaseUDP()
+					return onet.NewConnectionError("ERR_DEVICE_LIMIT", "Too many devices", nil)
+				}
+				session, err := ss.NewPacketSession(entry.Cipher, true)
+				if err != nil {
+					entry.releaseDevice(ip, time.Now())
+					entry.releaseUDP()
+					return onet.NewConnectionError("ERR_CREATE_SOCKET", "Failed to create UDP session", err)
+				}
+				// The packets of a client session share a replay filter,
+				// whichever address they come from.
+				replayCache, entryID := s.replayCache, entry.ID
+				session.SetReplayFilters(func(sessionID uint64) *ss.ReplayFilter {
+					return replayCache.PacketFilter(entryID, sessionID, time.Now())
+				})
+				if !session.Accept(header) {
+					entry.releaseDevice(ip, time.Now())
+					entry.releaseUDP()
+					return onet.NewConnectionError("ERR_REPLAY_CLIENT", "Replayed packet from client", ss.ErrReplayedPacket)
+				}
+				// Later packets go through the outbound of the first one.
+				udpConn, err := listenRoute(route, s.egress, entry, tgtUDPAddr.IP)
 				if err != nil {
+					entry.releaseDevice(ip, time.Now())
+					entry.releaseUDP()
 					return onet.NewConnectionError("ERR_CREATE_SOCKET", "Failed to create UDP socket", err)
 				}
-				targetConn = nm.Add(clientAddr, clientConn, cipher, udpConn, clientLocation, keyID)
+				targetConn = nm.Add(clientAddr, clientConn, entry, session, udpConn, clientLocation)
+				targetConn.outbound = route.Outbound
+				targetConn.sourceIP = addrIPText(udpConn.LocalAddr())
+				sourceIP = targetConn.sourceIP
+				if identified {
+					// Only this goroutine unpacks the packets of the client.
+					targetConn.identity = s.identity
+				}
 			} else {
 				clientLocation = targetConn.clientLocation
 
 				unpackStart := time.Now()
-				textData, err := ss.Unpack(nil, cipherData, targetConn.cipher)
+				if targetConn.identity != nil {
+					cipherData = targetConn.identity.StripPacketIdentity(cipherData, targetConn.cipher)
+				}
+				textData, err := targetConn.session.Unpack(nil, cipherData)
 				timeToCipher = time.Now().Sub(unpackStart)
+				if errors.Is(err, ss.ErrReplayedPacket) {
+					// Networks duplicate packets, so replays don't count as failures.
+					return onet.NewConnectionError("ERR_REPLAY_CLIENT", "Replayed packet from client", err)
+				}
 				if err != nil {
+					recordAuthFailure(s.bans, addrIP(clientAddr))
 					return onet.NewConnectionError("ERR_CIPHER", "Failed to unpack data from client", err)
 				}
 
 				// The key ID is known with confidence once decryption succeeds.
 				keyID = targetConn.keyID
+				outboundName = targetConn.outbound
+				sourceIP = targetConn.sourceIP
 
 				var onetErr *onet.ConnectionError
-				if payload, tgtUDPAddr, onetErr = s.validatePacket(textData); onetErr != nil {
+				if payload, tgtUDPAddr, _, onetErr = s.validatePacket(textData, targetConn.entry); onetErr != nil {
 					return onetErr
 				}
 			}
 			//mylog.Logf("Proxy exit %v,%v", targetConn.LocalAddr().String(), tgtUDPAddr)
 			//debugUDPAddr(clientAddr, "Proxy exit %v", targetConn.LocalAddr())
+			if targetConn.entry.quotaExceeded() {
+				return onet.NewConnectionError("ERR_QUOTA", "Data quota exceeded", nil)
+			}
+			if !targetConn.entry.allowUpload(s.nodeLimits, len(payload)) {
+				return onet.NewConnectionError("ERR_RATE_LIMIT", "Upload rate limit exceeded", nil)
+			}
 			proxyTargetBytes, err = targetConn.WriteTo(payload, tgtUDPAddr) // accept only UDPAddr despite the signature
+			targetConn.entry.addUsage(proxyTargetBytes)
 			if err != nil {
 				return onet.NewConnectionError("ERR_WRITE", "Failed to write to target", err)
 			}
@@ -250,24 +433,21 @@ func (s *udpService) Serve(clientConn net.PacketConn) error {
 }
 
 // Given the decrypted contents of a UDP packet, return
-// the payload and the destination address, or an error if
+// the payload, the destination address and its route, or an error if
 // this packet cannot or should not be forwarded.
-func (s *udpService) validatePacket(textData []byte) ([]byte, *net.UDPAddr, *onet.ConnectionError) {
+func (s *udpService) validatePacket(textData []byte, entry *CipherEntry) ([]byte, *net.UDPAddr, Route, *onet.ConnectionError) {
 	tgtAddr := socks.SplitAddr(textData)
 	if tgtAddr == nil {
-		return nil, nil, onet.NewConnectionError("ERR_READ_ADDRESS", "Failed to get target address", nil)
+		return nil, nil, Route{}, onet.NewConnectionError("ERR_READ_ADDRESS", "Failed to get target address", nil)
 	}
 
-	tgtUDPAddr, err := net.ResolveUDPAddr("udp", tgtAddr.String())
+	tgtUDPAddr, route, err := resolvePacketTarget(tgtAddr.String(), s.targetIPValidator, s.acl, s.resolver, s.router, entry)
 	if err != nil {
-		return nil, nil, onet.NewConnectionError("ERR_RESOLVE_ADDRESS", fmt.Sprintf("Failed to resolve target address %v", tgtAddr), err)
-	}
-	if err := s.targetIPValidator(tgtUDPAddr.IP); err != nil {
-		return nil, nil, err
+		return nil, nil, route, err
 	}
 
 	payload := textData[len(tgtAddr):]
-	return payload, tgtUDPAddr, nil
+	return payload, tgtUDPAddr, route, nil
 }
 
 func (s *udpService) Stop() error {
@@ -286,6 +466,49 @@ func (s *udpService) GracefulStop() error {
 	return err
 }
 
+// resolvePacketTarget resolves `address`, the target of a packet of the
+// client of `entry`, with `resolver`, or the system resolver if it's nil, and
+// checks that it may be reached. The first address of the name that may be
+// reached is used. It also returns the route that `router` picks for the
+// target, once it's known.
+func resolvePacketTarget(address string, targetIPValidator onet.TargetIPValidator, acl *ACL, resolver *dns.Resolver, router *Router, entry *CipherEntry) (*net.UDPAddr, Route, *onet.ConnectionError) {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, Route{}, onet.NewConnectionError("ERR_READ_ADDRESS", "Failed to get target address", err)
+	}
+	port, _ := strconv.Atoi(portText)
+	// Domain rules are checked before the name is resolved.
+	if aclErr := acl.Check(entry, host, nil, port); aclErr != nil {
+		return nil, Route{}, aclErr
+	}
+	route := router.Route(entry, host, port)
+	if route.Blocked() {
+		return nil, route, onet.NewConnectionError("ERR_ADDRESS_BLOCKED", "Target blocked by routing", nil)
+	}
+	var ips []net.IP
+	if resolver != nil {
+		ips, err = resolver.LookupIP(context.Background(), host)
+	} else {
+		var tgtUDPAddr *net.UDPAddr
+		if tgtUDPAddr, err = net.ResolveUDPAddr("udp", address); err == nil {
+			ips = []net.IP{tgtUDPAddr.IP}
+		}
+	}
+	if err != nil {
+		return nil, route, onet.NewConnectionError("ERR_RESOLVE_ADDRESS", fmt.Sprintf("Failed to resolve target address %v", address), err)
+	}
+	var connErr *onet.ConnectionError
+	for _, ip := range ips {
+		if connErr = targetIPValidator(ip); connErr == nil {
+			connErr = acl.Check(entry, host, ip, port)
+		}
+		if connErr == nil {
+			return &net.UDPAddr{IP: ip, Port: port}, route, nil
+		}
+	}
+	return nil, route, connErr
+}
+
 func isDNS(addr net.Addr) bool {
 	_, port, _ := net.SplitHostPort(addr.String())
 	return port == "53"
@@ -295,9 +518,18 @@ type natconn struct {
 	net.PacketConn
 	cipher *ss.Cipher
 	keyID  string
+	entry  *CipherEntry
+	// session packs and unpacks the packets of the client.
+	session *ss.PacketSession
+	// identity is set if the packets of the client have identity headers.
+	identity *ss.IdentityKey
 	// We store the client location in the NAT map to avoid recomputing it
 	// for every downstream packet in a UDP-based connection.
 	clientLocation string
+	// outbound is the outbound that the packets of the session go through.
+	outbound string
+	// sourceIP is the local IP of the session, or "" if it's not bound to one.
+	sourceIP string
 	// NAT timeout to apply for non-DNS packets.
 	defaultTimeout time.Duration
 	// Current read deadline of PacketConn.  Used to avoid decreasing the
@@ -356,14 +588,16 @@ func (c *natconn) ReadFrom(buf []byte) (int, net.Addr, error) {
 // Packet NAT table
 type natmap struct {
 	sync.RWMutex
-	keyConn map[string]*natconn
-	timeout time.Duration
-	metrics metrics.ShadowsocksMetrics
-	running *sync.WaitGroup
+	keyConn    map[string]*natconn
+	timeout    time.Duration
+	metrics    metrics.ShadowsocksMetrics
+	running    *sync.WaitGroup
+	traffic    TrafficRecorder
+	nodeLimits *NodeLimits
 }
 
 func newNATmap(timeout time.Duration, sm metrics.ShadowsocksMetrics, running *sync.WaitGroup) *natmap {
-	m := &natmap{metrics: sm, running: running}
+	m := &natmap{metrics: sm, running: running, traffic: noopRecorder{}}
 	m.keyConn = make(map[string]*natconn)
 	m.timeout = timeout
 	return m
@@ -375,11 +609,13 @@ func (m *natmap) Get(key string) *natconn {
 	return m.keyConn[key]
 }
 
-func (m *natmap) set(key string, pc net.PacketConn, cipher *ss.Cipher, keyID, clientLocation string) *natconn {
+func (m *natmap) set(key string, pc net.PacketConn, cipherEntry *CipherEntry, session *ss.PacketSession, clientLocation string) *natconn {
 	entry := &natconn{
 		PacketConn:     pc,
-		cipher:         cipher,
-		keyID:          keyID,
+		cipher:         cipherEntry.Cipher,
+		keyID:          cipherEntry.ID,
+		entry:          cipherEntry,
+		session:        session,
 		clientLocation: clientLocation,
 		defaultTimeout: m.timeout,
 	}
@@ -403,13 +639,19 @@ func (m *natmap) del(key string) net.PacketConn {
 	return nil
 }
 
-func (m *natmap) Add(clientAddr net.Addr, clientConn net.PacketConn, cipher *ss.Cipher, targetConn net.PacketConn, clientLocation, keyID string) *natconn {
-	entry := m.set(clientAddr.String(), targetConn, cipher, keyID, clientLocation)
+// Add adds a NAT entry for the session of `cipherEntry` that the caller
+// counted with acquireUDP, and releases the session when the entry expires.
+func (m *natmap) Add(clientAddr net.Addr, clientConn net.PacketConn, cipherEntry *CipherEntry, session *ss.PacketSession, targetConn net.PacketConn, clientLocation string) *natconn {
+	entry := m.set(clientAddr.String(), targetConn, cipherEntry, session, clientLocation)
 
 	m.metrics.AddUDPNatEntry()
 	m.running.Add(1)
 	go func() {
-		timedCopy(clientAddr, clientConn, entry, keyID, m.metrics)
+		timedCopy(clientAddr, clientConn, entry, cipherEntry.ID, m.metrics, m.traffic, m.nodeLimits)
+		cipherEntry.releaseUDP()
+		if ip := addrIP(clientAddr); ip != nil {
+			cipherEntry.releaseDevice(ip, time.Now())
+		}
 		m.metrics.RemoveUDPNatEntry()
 		if pc := m.del(clientAddr.String()); pc != nil {
 			pc.Close()
@@ -439,13 +681,14 @@ var maxAddrLen int = len(socks.ParseAddr("[2001:db8::1]:12345"))
 
 // copy from target to client until read timeout
 func timedCopy(clientAddr net.Addr, clientConn net.PacketConn, targetConn *natconn,
-	keyID string, sm metrics.ShadowsocksMetrics) {
+	keyID string, sm metrics.ShadowsocksMetrics, traffic TrafficRecorder, nodeLimits *NodeLimits) {
 	// pkt is used for in-place encryption of downstream UDP packets, with the layout
 	// [padding?][salt][address][body][tag][extra]
-	// Padding is only used if the address is IPv4.
+	// Padding is only used if the address is IPv4. With Shadowsocks 2022,
+	// the salt is the whole header of the packet.
 	pkt := make([]byte, serverUDPBufferSize)
 
-	saltSize := targetConn.cipher.SaltSize()
+	saltSize := targetConn.session.HeaderSize()
 	// Leave enough room at the beginning of the packet for a max-length header (i.e. IPv6).
 	bodyStart := saltSize + maxAddrLen
 
@@ -472,6 +715,10 @@ func timedCopy(clientAddr net.Addr, clientConn net.PacketConn, targetConn *natco
 				return onet.NewConnectionError("ERR_READ", "Failed to read from target", err)
 			}
 
+			if targetConn.entry.quotaExceeded() {
+				return onet.NewConnectionError("ERR_QUOTA", "Data quota exceeded", nil)
+			}
+
 			//debugUDPAddr(clientAddr, )
 			//mylog.Logf("Got response from %v", raddr)
 			srcAddr := socks.ParseAddr(raddr.String())
@@ -490,11 +737,14 @@ func timedCopy(clientAddr net.Addr, clientConn net.PacketConn, targetConn *natco
 			//           [            packBuf             ]
 			//           [          buf           ]
 			packBuf := pkt[saltStart:]
-			buf, err := ss.Pack(packBuf, plaintextBuf, targetConn.cipher) // Encrypt in-place
+			buf, err := targetConn.session.Pack(packBuf, plaintextBuf) // Encrypt in-place
 			if err != nil {
 				return onet.NewConnectionError("ERR_PACK", "Failed to pack data to client", err)
 			}
+			// Only this session waits, the packets of other sessions keep flowing.
+			targetConn.entry.waitDownload(nodeLimits, bodyLen)
 			proxyClientBytes, err = clientConn.WriteTo(buf, clientAddr)
+			targetConn.entry.addUsage(bodyLen)
 			if err != nil {
 				return onet.NewConnectionError("ERR_WRITE", "Failed to write to client", err)
 			}
@@ -509,5 +759,6 @@ func timedCopy(clientAddr net.Addr, clientConn net.PacketConn, targetConn *natco
 			break
 		}
 		sm.AddUDPPacketFromTarget(targetConn.clientLocation, keyID, status, bodyLen, proxyClientBytes)
+		traffic.AddTraffic(keyID, 0, int64(proxyClientBytes))
 	}
 }
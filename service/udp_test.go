@@ -101,6 +101,7 @@ type natTestMetrics struct {
 	metrics.ShadowsocksMetrics
 	natEntriesAdded int
 	upstreamPackets []udpReport
+	outbounds       []string
 }
 
 func (m *natTestMetrics) AddTCPProbe(status, drainResult string, port int, data metrics.ProxyMetrics) {
@@ -123,6 +124,9 @@ func (m *natTestMetrics) AddUDPNatEntry() {
 	m.natEntriesAdded++
 }
 func (m *natTestMetrics) RemoveUDPNatEntry() {}
+func (m *natTestMetrics) AddOutboundConnection(proto, outbound, status string) {
+	m.outbounds = append(m.outbounds, outbound+" "+status)
+}
 
 // Takes a validation policy, and returns the metrics it
 // generates when localhost access is attempted
@@ -213,7 +217,9 @@ func setupNAT() (*fakePacketConn, *fakePacketConn, *natconn) {
 	nat := newNATmap(timeout, &natTestMetrics{}, &sync.WaitGroup{})
 	clientConn := makePacketConn()
 	targetConn := makePacketConn()
-	nat.Add(&clientAddr, clientConn, natCipher, targetConn, "ZZ", "key id")
+	natEntry := MakeCipherEntry("key id", natCipher, "test password")
+	session, _ := ss.NewPacketSession(natCipher, true)
+	nat.Add(&clientAddr, clientConn, &natEntry, session, targetConn, "ZZ")
 	entry := nat.Get(clientAddr.String())
 	return clientConn, targetConn, entry
 }
@@ -405,7 +411,7 @@ func BenchmarkUDPUnpackFail(b *testing.B) {
 	testIP := net.ParseIP("192.0.2.1")
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		findAccessKeyUDP(testIP, textBuf, testPayload, cipherList)
+		findAccessKeyUDP(testIP, textBuf, testPayload, cipherList, nil)
 	}
 }
 
@@ -435,7 +441,7 @@ func BenchmarkUDPUnpackRepeat(b *testing.B) {
 		cipherNumber := n % numCiphers
 		ip := ips[cipherNumber]
 		packet := packets[cipherNumber]
-		_, _, _, err := findAccessKeyUDP(ip, testBuf, packet, cipherList)
+		_, _, _, _, _, err := findAccessKeyUDP(ip, testBuf, packet, cipherList, nil)
 		if err != nil {
 			b.Error(err)
 		}
@@ -464,7 +470,7 @@ func BenchmarkUDPUnpackSharedKey(b *testing.B) {
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
 		ip := ips[n%numIPs]
-		_, _, _, err := findAccessKeyUDP(ip, testBuf, packet, cipherList)
+		_, _, _, _, _, err := findAccessKeyUDP(ip, testBuf, packet, cipherList, nil)
 		if err != nil {
 			b.Error(err)
 		}
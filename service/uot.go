@@ -0,0 +1,194 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"myoss/mylog"
+	onet "myoss/net"
+	"myoss/service/metrics"
+	ss "myoss/shadowsocks"
+)
+
+// relayPackets serves a UDP-over-TCP stream: it relays the packets that the
+// client sends in `clientReader` like the UDP service relays the packets of
+// a NAT session, and sends the replies back in `clientWriter`. The stream
+// ends when the client closes it or after the NAT timeout without packets.
+func (s *tcpService) relayPackets(clientConn onet.DuplexConn, clientReader io.Reader, clientWriter io.Writer, entry *CipherEntry, version int, proxyMetrics *metrics.ProxyMetrics) (connErr *onet.ConnectionError) {
+	var request ss.UDPOverTCPRequest
+	if version == 2 {
+		var err error
+		if request, err = ss.ReadUDPOverTCPRequest(clientReader); err != nil {
+			return onet.NewConnectionError("ERR_READ_ADDRESS", "Failed to read UDP-over-TCP request", err)
+		}
+	}
+	var connectAddr *net.UDPAddr
+	var route Route
+	if request.Connect {
+		connectAddr, route, connErr = resolvePacketTarget(request.Destination, s.targetIPValidator, s.acl, s.resolver, s.router, entry)
+	} else {
+		// Streams without a connect destination are routed by key and node
+		// only, and their packets that are blocked are dropped.
+		route = s.router.Route(entry, "", 0)
+	}
+	// sourceIP is the local IP of the stream's UDP socket, once it's made.
+	var sourceIP string
+	defer func() {
+		status := "OK"
+		if connErr != nil {
+			status = connErr.Status
+		}
+		mylog.Logf("UDP over TCP user:%v,%v ,host:%v, outbound:%v, source:%v, status:%v", entry.ID, clientConn.RemoteAddr().String(), request.Destination, route.Outbound, sourceIP, status)
+		if route.Outbound != "" {
+			s.m.AddOutboundConnection("udp", route.Outbound, status)
+		}
+	}()
+	if connErr != nil {
+		return connErr
+	}
+	var connectIP net.IP
+	if connectAddr != nil {
+		connectIP = connectAddr.IP
+	}
+	udpConn, err := listenRoute(route, s.egress, entry, connectIP)
+	if err != nil {
+		return onet.NewConnectionError("ERR_CREATE_SOCKET", "Failed to create UDP socket", err)
+	}
+	sourceIP = addrIPText(udpConn.LocalAddr())
+	targetConn := &natconn{PacketConn: udpConn, cipher: entry.Cipher, keyID: entry.ID, entry: entry, outbound: route.Outbound, sourceIP: sourceIP, defaultTimeout: s.natTimeout}
+	defer targetConn.Close()
+	s.m.AddUDPNatEntry()
+	defer s.m.RemoveUDPNatEntry()
+
+	var mu sync.Mutex
+	expired := false
+	expire := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !expired {
+			expired = true
+			// Unblocks the other direction.
+			clientConn.SetReadDeadline(time.Now())
+			targetConn.SetReadDeadline(time.Now())
+		}
+	}
+	// The stream ends after the NAT timeout without packets, even if the
+	// client never sends one.
+	keepAlive := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !expired {
+			clientConn.SetReadDeadline(time.Now().Add(s.natTimeout))
+		}
+	}
+	keepAlive()
+	fromTargetErrCh := make(chan *onet.ConnectionError)
+	go func() {
+		fromTargetErr := s.copyPacketsToClient(clientWriter, targetConn, entry, connectAddr != nil, keepAlive, proxyMetrics)
+		expire()
+		fromTargetErrCh <- fromTargetErr
+	}()
+	fromClientErr := s.copyPacketsFromClient(clientReader, targetConn, entry, connectAddr, clientConn.RemoteAddr().String(), keepAlive, proxyMetrics)
+	expire()
+	fromTargetErr := <-fromTargetErrCh
+	clientConn.CloseWrite()
+	if fromClientErr != nil {
+		return fromClientErr
+	}
+	return fromTargetErr
+}
+
+// copyPacketsFromClient sends the packets read from the client to their
+// targets, or to `connectAddr` if it's set, until the stream ends. It calls
+// `keepAlive` for every packet.
+func (s *tcpService) copyPacketsFromClient(clientReader io.Reader, targetConn *natconn, entry *CipherEntry, connectAddr *net.UDPAddr, clientAddr string, keepAlive func(), proxyMetrics *metrics.ProxyMetrics) *onet.ConnectionError {
+	buf := make([]byte, serverUDPBufferSize)
+	for {
+		address, payload, err := ss.ReadUDPOverTCPPacket(clientReader, buf, connectAddr != nil)
+		if err != nil {
+			var netErr net.Error
+			if err == io.EOF || (errors.As(err, &netErr) && netErr.Timeout()) {
+				// The client is done, idle, or the target side expired.
+				return nil
+			}
+			return onet.NewConnectionError("ERR_RELAY_CLIENT", "Failed to read packet from client", err)
+		}
+		keepAlive()
+		tgtUDPAddr := connectAddr
+		if tgtUDPAddr == nil {
+			var connErr *onet.ConnectionError
+			if tgtUDPAddr, _, connErr = resolvePacketTarget(address, s.targetIPValidator, s.acl, s.resolver, s.router, entry); connErr != nil {
+				// Like in the UDP service, bad packets are dropped.
+				logger.Debugf("UDP-over-TCP: dropped packet: %v: %v", connErr.Message, connErr.Cause)
+				continue
+			}
+		}
+		s.traffic.AddDestination(entry.ID, tgtUDPAddr.String(), clientAddr, targetConn.outbound, targetConn.sourceIP, true)
+		if entry.quotaExceeded() {
+			return onet.NewConnectionError("ERR_QUOTA", "Data quota exceeded", nil)
+		}
+		if !entry.allowUpload(s.nodeLimits, len(payload)) {
+			continue
+		}
+		n, err := targetConn.WriteTo(payload, tgtUDPAddr)
+		entry.addUsage(n)
+		proxyMetrics.ProxyTarget += int64(n)
+		s.traffic.AddTraffic(entry.ID, int64(n), 0)
+		if err != nil {
+			logger.Debugf("UDP-over-TCP: failed to write to target: %v", err)
+		}
+	}
+}
+
+// copyPacketsToClient sends the packets from the targets to the client until
+// the NAT timeout expires. The addresses are left out for connected streams.
+// It calls `keepAlive` for every packet.
+func (s *tcpService) copyPacketsToClient(clientWriter io.Writer, targetConn *natconn, entry *CipherEntry, connected bool, keepAlive func(), proxyMetrics *metrics.ProxyMetrics) *onet.ConnectionError {
+	buf := make([]byte, serverUDPBufferSize)
+	var packet []byte
+	for {
+		n, raddr, err := targetConn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return nil
+			}
+			return onet.NewConnectionError("ERR_READ", "Failed to read from target", err)
+		}
+		keepAlive()
+		if entry.quotaExceeded() {
+			return onet.NewConnectionError("ERR_QUOTA", "Data quota exceeded", nil)
+		}
+		address := raddr.String()
+		if connected {
+			address = ""
+		}
+		if packet, err = ss.AppendUDPOverTCPPacket(packet[:0], address, buf[:n]); err != nil {
+			return onet.NewConnectionError("ERR_PACK", "Failed to pack data to client", err)
+		}
+		entry.waitDownload(s.nodeLimits, n)
+		_, err = clientWriter.Write(packet)
+		entry.addUsage(n)
+		proxyMetrics.TargetProxy += int64(n)
+		s.traffic.AddTraffic(entry.ID, 0, int64(n))
+		if err != nil {
+			return onet.NewConnectionError("ERR_RELAY_TARGET", "Failed to write packet to client", err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	onet "myoss/net"
+	"myoss/service/metrics"
+	ss "myoss/shadowsocks"
+	"myoss/shadowsocks/client"
+
+	"github.com/stretchr/testify/require"
+)
+
+func startUDPEchoServer(t *testing.T) *net.UDPConn {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := target.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			target.WriteTo(buf[:n], addr)
+		}
+	}()
+	return target
+}
+
+func TestUDPOverTCP(t *testing.T) {
+	target := startUDPEchoServer(t)
+	defer target.Close()
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{ShadowsocksMetrics: &metrics.NoOpMetrics{}}
+	s := NewTCPService(cipherList, nil, testMetrics, time.Second)
+	s.SetTargetIPValidator(allowAll)
+	s.SetUDPOverTCP(200 * time.Millisecond)
+	listener := makeLocalhostListener(t)
+	go s.Serve(listener)
+	dialer, err := client.NewShadowsocksStreamDialer(onet.TCPEndpoint{RemoteAddr: *listener.Addr().(*net.TCPAddr)}, firstCipher(cipherList))
+	require.NoError(t, err)
+
+	l, err := client.NewUDPOverTCPPacketListener(dialer)
+	require.NoError(t, err)
+	pc, err := l.ListenPacket(context.Background())
+	require.NoError(t, err)
+	defer pc.Close()
+	buf := make([]byte, 1024)
+	for _, payload := range []string{"Hello", "World"} {
+		_, err = pc.WriteTo([]byte(payload), target.LocalAddr())
+		require.NoError(t, err)
+		n, addr, err := pc.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, payload, string(buf[:n]))
+		require.Equal(t, target.LocalAddr().String(), addr.String())
+	}
+	// The stream ends after the NAT timeout without packets.
+	_, _, err = pc.ReadFrom(buf)
+	require.Equal(t, io.EOF, err)
+
+	// A connected stream sends its packets to the destination of its request.
+	conn, err := dialer.Dial(context.Background(), net.JoinHostPort(ss.UDPOverTCPV2Address, "0"))
+	require.NoError(t, err)
+	defer conn.Close()
+	stream, err := ss.AppendUDPOverTCPRequest(nil, ss.UDPOverTCPRequest{Connect: true, Destination: target.LocalAddr().String()})
+	require.NoError(t, err)
+	stream, err = ss.AppendUDPOverTCPPacket(stream, "", []byte("Hello"))
+	require.NoError(t, err)
+	_, err = conn.Write(stream)
+	require.NoError(t, err)
+	address, payload, err := ss.ReadUDPOverTCPPacket(conn, buf, true)
+	require.NoError(t, err)
+	require.Equal(t, "", address)
+	require.Equal(t, "Hello", string(payload))
+	conn.CloseWrite()
+	_, err = conn.Read(buf)
+	require.Equal(t, io.EOF, err)
+
+	// A stream that never sends a packet also ends after the NAT timeout.
+	idle, err := dialer.Dial(context.Background(), net.JoinHostPort(ss.UDPOverTCPV2Address, "0"))
+	require.NoError(t, err)
+	defer idle.Close()
+	stream, err = ss.AppendUDPOverTCPRequest(nil, ss.UDPOverTCPRequest{Connect: true, Destination: target.LocalAddr().String()})
+	require.NoError(t, err)
+	_, err = idle.Write(stream)
+	require.NoError(t, err)
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = idle.Read(buf)
+	require.Equal(t, io.EOF, err)
+
+	s.GracefulStop()
+	require.Equal(t, []string{"OK", "OK", "OK"}, testMetrics.closeStatus)
+}
+
+func TestUDPOverTCPDisabled(t *testing.T) {
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, nil, testMetrics, time.Second)
+	listener := makeLocalhostListener(t)
+	go s.Serve(listener)
+	dialer, err := client.NewShadowsocksStreamDialer(onet.TCPEndpoint{RemoteAddr: *listener.Addr().(*net.TCPAddr)}, firstCipher(cipherList))
+	require.NoError(t, err)
+	l, err := client.NewUDPOverTCPPacketListener(dialer)
+	require.NoError(t, err)
+	pc, err := l.ListenPacket(context.Background())
+	require.NoError(t, err)
+	defer pc.Close()
+	_, _, err = pc.ReadFrom(make([]byte, 1024))
+	require.Error(t, err)
+	s.GracefulStop()
+	require.Equal(t, []string{"ERR_CONNECT"}, testMetrics.closeStatus)
+}
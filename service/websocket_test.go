@@ -0,0 +1,92 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	ss "myoss/shadowsocks"
+	"myoss/shadowsocks/client"
+	"myoss/transport"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSocket(t *testing.T) {
+	echo := startEchoServer(t)
+	defer echo.Close()
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := target.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			target.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(3))
+	require.NoError(t, err)
+	cipher := cipherList.SnapshotForClientIP(nil)[2].Value.(*CipherEntry).Cipher
+	listener := makeLocalhostListener(t)
+	ws := transport.NewWebSocketServer(listener, transport.WebSocketOptions{StreamPath: "/tcp", PacketPath: "/udp"})
+	go ws.Serve()
+	testMetrics := &probeTestMetrics{}
+	tcp := NewTCPService(cipherList, nil, testMetrics, 5*time.Second)
+	tcp.SetTargetIPValidator(allowAll)
+	go tcp.Serve(ws.StreamListener())
+	udp := NewUDPService(time.Minute, cipherList, &natTestMetrics{})
+	udp.SetTargetIPValidator(allowAll)
+	go udp.Serve(ws.PacketConn())
+	url := "ws://" + listener.Addr().String()
+
+	d, err := client.NewShadowsocksStreamDialer(client.WebSocketStreamEndpoint{URL: url + "/tcp"}, cipher)
+	require.NoError(t, err)
+	conn, err := d.Dial(context.Background(), echo.Addr().String())
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("Hello"))
+	require.NoError(t, err)
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, "Hello", string(reply))
+	conn.Close()
+
+	l, err := client.NewShadowsocksPacketListener(client.WebSocketPacketEndpoint{URL: url + "/udp"}, cipher)
+	require.NoError(t, err)
+	pc, err := l.ListenPacket(context.Background())
+	require.NoError(t, err)
+	defer pc.Close()
+	_, err = pc.WriteTo([]byte("Hello"), target.LocalAddr())
+	require.NoError(t, err)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, addr, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "Hello", string(buf[:n]))
+	require.Equal(t, target.LocalAddr().String(), addr.String())
+
+	tcp.GracefulStop()
+	udp.GracefulStop()
+	require.Equal(t, []string{"OK"}, testMetrics.closeStatus)
+}
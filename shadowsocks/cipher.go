@@ -19,12 +19,14 @@ import (
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/sha1"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"strings"
 
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/hkdf"
+	"lukechampine.com/blake3"
 )
 
 // SupportedCipherNames lists the names of the AEAD ciphers that are supported.
@@ -42,22 +44,29 @@ type aeadSpec struct {
 	keySize     int
 	saltSize    int
 	tagSize     int
+	// is2022 marks the Shadowsocks 2022 ciphers, which use a base64 PSK,
+	// BLAKE3 key derivation and the SIP022 stream and packet formats.
+	is2022 bool
 }
 
 // List of supported AEAD ciphers, as specified at https://shadowsocks.org/en/spec/AEAD-Ciphers.html
+// and https://shadowsocks.org/doc/sip022.html
 var supportedAEADs = [...]aeadSpec{
-	newAEADSpec("chacha20-ietf-poly1305", chacha20poly1305.New, chacha20poly1305.KeySize, 32),
-	newAEADSpec("aes-256-gcm", newAesGCM, 32, 32),
-	newAEADSpec("aes-192-gcm", newAesGCM, 24, 24),
-	newAEADSpec("aes-128-gcm", newAesGCM, 16, 16),
+	newAEADSpec("chacha20-ietf-poly1305", chacha20poly1305.New, chacha20poly1305.KeySize, 32, false),
+	newAEADSpec("aes-256-gcm", newAesGCM, 32, 32, false),
+	newAEADSpec("aes-192-gcm", newAesGCM, 24, 24, false),
+	newAEADSpec("aes-128-gcm", newAesGCM, 16, 16, false),
+	newAEADSpec("2022-blake3-aes-128-gcm", newAesGCM, 16, 16, true),
+	newAEADSpec("2022-blake3-aes-256-gcm", newAesGCM, 32, 32, true),
+	newAEADSpec("2022-blake3-chacha20-poly1305", chacha20poly1305.New, chacha20poly1305.KeySize, 32, true),
 }
 
-func newAEADSpec(name string, newInstance func(key []byte) (cipher.AEAD, error), keySize, saltSize int) aeadSpec {
+func newAEADSpec(name string, newInstance func(key []byte) (cipher.AEAD, error), keySize, saltSize int, is2022 bool) aeadSpec {
 	dummyAead, err := newInstance(make([]byte, keySize))
 	if err != nil {
 		panic(fmt.Sprintf("Failed to initialize AEAD %v", name))
 	}
-	return aeadSpec{name, newInstance, keySize, saltSize, dummyAead.Overhead()}
+	return aeadSpec{name, newInstance, keySize, saltSize, dummyAead.Overhead(), is2022}
 }
 
 func getAEADSpec(name string) (*aeadSpec, error) {
@@ -92,6 +101,16 @@ func maxTagSize() int {
 type Cipher struct {
 	aead   aeadSpec
 	secret []byte
+	// For Shadowsocks 2022 UDP: the block cipher that encrypts the separate
+	// header of AES packets, or the XChaCha20-Poly1305 AEAD of ChaCha packets.
+	headerBlock cipher.Block
+	packetAEAD  cipher.AEAD
+	// For clients of multi-user Shadowsocks 2022 servers: the identity PSK
+	// of the server, and the block cipher of the identity headers of packets.
+	identityPSK   []byte
+	identityBlock cipher.Block
+	// stream is set for legacy stream ciphers, which have no AEAD.
+	stream *streamSpec
 }
 
 // SaltSize is the size of the salt for this Cipher
@@ -104,11 +123,34 @@ func (c *Cipher) TagSize() int {
 	return c.aead.tagSize
 }
 
+// Is2022 reports whether this is a Shadowsocks 2022 cipher.
+func (c *Cipher) Is2022() bool {
+	return c.aead.is2022
+}
+
+// FirstMessageSize is the plaintext size of the first AEAD message of a
+// request stream: the chunk length, or the fixed-length header for
+// Shadowsocks 2022. Decrypting it authenticates the stream.
+func (c *Cipher) FirstMessageSize() int {
+	if c.aead.is2022 {
+		return requestFixedHeaderSize
+	}
+	return 2
+}
+
 var subkeyInfo = []byte("ss-subkey")
 
 // NewAEAD creates the AEAD for this cipher
 func (c *Cipher) NewAEAD(salt []byte) (cipher.AEAD, error) {
+	if c.stream != nil {
+		return nil, ErrStreamCipher
+	}
 	sessionKey := make([]byte, c.aead.keySize)
+	if c.aead.is2022 {
+		material := make([]byte, 0, len(c.secret)+len(salt))
+		blake3.DeriveKey(sessionKey, subkeyContext2022, append(append(material, c.secret...), salt...))
+		return c.aead.newInstance(sessionKey)
+	}
 	r := hkdf.New(sha1.New, c.secret, salt, subkeyInfo)
 	if _, err := io.ReadFull(r, sessionKey); err != nil {
 		return nil, err
@@ -130,15 +172,65 @@ func simpleEVPBytesToKey(data []byte, keyLen int) []byte {
 	return derived[:keyLen]
 }
 
-// NewCipher creates a Cipher given a cipher name and a secret
+// NewCipher creates a Cipher given a cipher name and a secret. The secret of
+// a Shadowsocks 2022 cipher is its base64-encoded pre-shared key. Clients of
+// a multi-user server use "<identity key>:<user key>" to send identity headers.
 func NewCipher(cipherName string, secretText string) (*Cipher, error) {
 	aeadSpec, err := getAEADSpec(cipherName)
 	if err != nil {
 		return nil, err
 	}
+	if aeadSpec.is2022 {
+		return new2022Cipher(aeadSpec, secretText)
+	}
 	// Key derivation as per https://shadowsocks.org/en/spec/AEAD-Ciphers.html
 	secret := simpleEVPBytesToKey([]byte(secretText), aeadSpec.keySize)
-	return &Cipher{*aeadSpec, secret}, nil
+	return &Cipher{aead: *aeadSpec, secret: secret}, nil
+}
+
+func new2022Cipher(aeadSpec *aeadSpec, secretText string) (*Cipher, error) {
+	var identityPSK []byte
+	if i := strings.IndexByte(secretText, ':'); i >= 0 {
+		var err error
+		if identityPSK, err = decode2022Key(aeadSpec, secretText[:i]); err != nil {
+			return nil, fmt.Errorf("bad identity key: %v", err)
+		}
+		secretText = secretText[i+1:]
+	}
+	psk, err := decode2022Key(aeadSpec, secretText)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cipher{aead: *aeadSpec, secret: psk}
+	if aeadSpec.name == "2022-blake3-chacha20-poly1305" {
+		if identityPSK != nil {
+			return nil, fmt.Errorf("%v doesn't support identity keys", aeadSpec.name)
+		}
+		c.packetAEAD, err = chacha20poly1305.NewX(psk)
+	} else {
+		c.headerBlock, err = aes.NewCipher(psk)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if identityPSK != nil {
+		c.identityPSK = identityPSK
+		if c.identityBlock, err = aes.NewCipher(identityPSK); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func decode2022Key(aeadSpec *aeadSpec, keyText string) ([]byte, error) {
+	psk, err := base64.StdEncoding.DecodeString(keyText)
+	if err != nil {
+		return nil, fmt.Errorf("%v needs a base64 key: %v", aeadSpec.name, err)
+	}
+	if len(psk) != aeadSpec.keySize {
+		return nil, fmt.Errorf("%v needs a %d-byte key, got %d bytes", aeadSpec.name, aeadSpec.keySize, len(psk))
+	}
+	return psk, nil
 }
 
 // Assumes all ciphers have NonceSize() <= 12.
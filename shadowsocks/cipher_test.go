@@ -19,7 +19,7 @@ import (
 )
 
 func assertCipher(t *testing.T, name string, saltSize, tagSize int) {
-	cipher, err := NewCipher(name, "")
+	cipher, err := NewCipher(name, MakeTestSecret(name, ""))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -34,6 +34,22 @@ func TestSizes(t *testing.T) {
 	assertCipher(t, "aes-256-gcm", 32, 16)
 	assertCipher(t, "aes-192-gcm", 24, 16)
 	assertCipher(t, "aes-128-gcm", 16, 16)
+	// Values from https://shadowsocks.org/doc/sip022.html
+	assertCipher(t, "2022-blake3-aes-128-gcm", 16, 16)
+	assertCipher(t, "2022-blake3-aes-256-gcm", 32, 16)
+	assertCipher(t, "2022-blake3-chacha20-poly1305", 32, 16)
+}
+
+func Test2022Key(t *testing.T) {
+	if _, err := NewCipher("2022-blake3-aes-128-gcm", "AAAAAAAAAAAAAAAAAAAAAA=="); err != nil {
+		t.Errorf("Valid key rejected: %v", err)
+	}
+	if _, err := NewCipher("2022-blake3-aes-256-gcm", "AAAAAAAAAAAAAAAAAAAAAA=="); err == nil {
+		t.Errorf("Short key accepted")
+	}
+	if _, err := NewCipher("2022-blake3-aes-128-gcm", "not base64!"); err == nil {
+		t.Errorf("Invalid base64 accepted")
+	}
 }
 
 func TestUnsupportedCipher(t *testing.T) {
@@ -45,9 +61,9 @@ func TestUnsupportedCipher(t *testing.T) {
 
 func TestMaxNonceSize(t *testing.T) {
 	for _, aeadName := range SupportedCipherNames() {
-		cipher, err := NewCipher(aeadName, "")
+		cipher, err := NewCipher(aeadName, MakeTestSecret(aeadName, ""))
 		if err != nil {
-			t.Errorf("Failed to create Cipher %v: %v", aeadName, err)
+			t.Fatalf("Failed to create Cipher %v: %v", aeadName, err)
 		}
 		aead, err := cipher.NewAEAD(make([]byte, cipher.SaltSize()))
 		if err != nil {
@@ -15,6 +15,7 @@
 package shadowsocks
 
 import (
+	"encoding/base64"
 	"fmt"
 )
 
@@ -38,3 +39,13 @@ func MakeTestPayload(size int) []byte {
 	}
 	return payload
 }
+
+// MakeTestSecret returns a valid secret for `cipherName`: `secret` itself,
+// or a base64 key derived from it for Shadowsocks 2022 ciphers.
+func MakeTestSecret(cipherName, secret string) string {
+	spec, err := getAEADSpec(cipherName)
+	if err != nil || !spec.is2022 {
+		return secret
+	}
+	return base64.StdEncoding.EncodeToString(simpleEVPBytesToKey([]byte(secret), spec.keySize))
+}
@@ -53,13 +53,18 @@ func (c *packetListener) ListenPacket(ctx context.Context) (net.PacketConn, erro
 	if err != nil {
 		return nil, fmt.Errorf("Could not connect to endpoint: %x", err)
 	}
-	conn := packetConn{Conn: proxyConn, cipher: c.cipher}
+	session, err := shadowsocks.NewPacketSession(c.cipher, false)
+	if err != nil {
+		proxyConn.Close()
+		return nil, err
+	}
+	conn := packetConn{Conn: proxyConn, session: session}
 	return &conn, nil
 }
 
 type packetConn struct {
 	net.Conn
-	cipher *shadowsocks.Cipher
+	session *shadowsocks.PacketSession
 }
 
 // WriteTo encrypts `b` and writes to `addr` through the proxy.
@@ -71,12 +76,12 @@ func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
 	lazySlice := udpPool.LazySlice()
 	cipherBuf := lazySlice.Acquire()
 	defer lazySlice.Release()
-	saltSize := c.cipher.SaltSize()
+	saltSize := c.session.HeaderSize()
 	// Copy the SOCKS target address and payload, reserving space for the generated salt to avoid
 	// partially overlapping the plaintext and cipher slices since `Pack` skips the salt when calling
 	// `AEAD.Seal` (see https://golang.org/pkg/crypto/cipher/#AEAD).
 	plaintextBuf := append(append(cipherBuf[saltSize:saltSize], socksTargetAddr...), b...)
-	buf, err := shadowsocks.Pack(cipherBuf, plaintextBuf, c.cipher)
+	buf, err := c.session.Pack(cipherBuf, plaintextBuf)
 	if err != nil {
 		return 0, err
 	}
@@ -94,7 +99,7 @@ func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
 		return 0, nil, err
 	}
 	// Decrypt in-place.
-	buf, err := shadowsocks.Unpack(nil, cipherBuf[:n], c.cipher)
+	buf, err := c.session.Unpack(nil, cipherBuf[:n])
 	if err != nil {
 		return 0, nil, err
 	}
@@ -92,7 +92,7 @@ func (c *streamDialer) Dial(ctx context.Context, remoteAddr string) (onet.Duplex
 	if err != nil {
 		return nil, err
 	}
-	ssw := shadowsocks.NewShadowsocksWriter(proxyConn, c.cipher)
+	ssw := shadowsocks.NewRequestWriter(proxyConn, c.cipher)
 	if c.salter != nil {
 		ssw.SetSaltGenerator(c.salter)
 	}
@@ -104,6 +104,6 @@ func (c *streamDialer) Dial(ctx context.Context, remoteAddr string) (onet.Duplex
 	time.AfterFunc(helloWait, func() {
 		ssw.Flush()
 	})
-	ssr := shadowsocks.NewShadowsocksReader(proxyConn, c.cipher)
+	ssr := shadowsocks.NewResponseReader(proxyConn, c.cipher, ssw)
 	return onet.WrapConn(proxyConn, ssr, ssw), nil
 }
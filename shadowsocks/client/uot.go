@@ -0,0 +1,98 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	onet "myoss/net"
+	"myoss/shadowsocks"
+)
+
+type uotPacketListener struct {
+	dialer onet.StreamDialer
+}
+
+// NewUDPOverTCPPacketListener creates a PacketListener that relays packets in
+// UDP-over-TCP streams dialed with `dialer`, usually a Shadowsocks
+// StreamDialer, for networks that drop UDP. Each PacketConn has its own stream.
+func NewUDPOverTCPPacketListener(dialer onet.StreamDialer) (onet.PacketListener, error) {
+	if dialer == nil {
+		return nil, errors.New("Argument dialer must not be nil")
+	}
+	return &uotPacketListener{dialer: dialer}, nil
+}
+
+func (l *uotPacketListener) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	conn, err := l.dialer.Dial(ctx, net.JoinHostPort(shadowsocks.UDPOverTCPV2Address, "0"))
+	if err != nil {
+		return nil, err
+	}
+	// The packets of the stream may go anywhere.
+	request, err := shadowsocks.AppendUDPOverTCPRequest(nil, shadowsocks.UDPOverTCPRequest{Destination: "0.0.0.0:0"})
+	if err == nil {
+		_, err = conn.Write(request)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to write UDP-over-TCP request: %v", err)
+	}
+	// The buffer fits the largest packet of the framing.
+	return &uotPacketConn{DuplexConn: conn, readBuf: make([]byte, 0xffff)}, nil
+}
+
+type uotPacketConn struct {
+	onet.DuplexConn
+	readMu   sync.Mutex
+	readBuf  []byte
+	writeMu  sync.Mutex
+	writeBuf []byte
+}
+
+// WriteTo sends `b` to `addr` through the stream.
+func (c *uotPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	packet, err := shadowsocks.AppendUDPOverTCPPacket(c.writeBuf[:0], addr.String(), b)
+	if err != nil {
+		return 0, err
+	}
+	c.writeBuf = packet
+	if _, err := c.DuplexConn.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom reads the next packet of the stream into `b`.
+func (c *uotPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	address, payload, err := shadowsocks.ReadUDPOverTCPPacket(c.DuplexConn, c.readBuf, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	srcAddr := newAddr(address, "udp")
+	n := copy(b, payload)
+	if n < len(payload) {
+		return n, srcAddr, io.ErrShortBuffer
+	}
+	return n, srcAddr, nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	onet "myoss/net"
+	"myoss/transport"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketStreamEndpoint is a StreamEndpoint that carries the stream over a
+// WebSocket, for servers behind a CDN or HTTP reverse proxy.
+type WebSocketStreamEndpoint struct {
+	// URL is the ws:// or wss:// URL of the server's stream path.
+	URL string
+	// Dialer connects to the server. nil means websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+	// Header is added to the upgrade request, e.g. to set the Host.
+	Header http.Header
+}
+
+func (e WebSocketStreamEndpoint) Connect(ctx context.Context) (onet.DuplexConn, error) {
+	ws, err := dialWebSocket(ctx, e.Dialer, e.URL, e.Header)
+	if err != nil {
+		return nil, err
+	}
+	return transport.NewWebSocketStreamConn(ws, nil), nil
+}
+
+// WebSocketPacketEndpoint is a PacketEndpoint that sends each packet in a
+// WebSocket message.
+type WebSocketPacketEndpoint struct {
+	// URL is the ws:// or wss:// URL of the server's packet path.
+	URL string
+	// Dialer connects to the server. nil means websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+	// Header is added to the upgrade request.
+	Header http.Header
+}
+
+func (e WebSocketPacketEndpoint) Connect(ctx context.Context) (net.Conn, error) {
+	ws, err := dialWebSocket(ctx, e.Dialer, e.URL, e.Header)
+	if err != nil {
+		return nil, err
+	}
+	return transport.NewWebSocketPacketConn(ws), nil
+}
+
+func dialWebSocket(ctx context.Context, dialer *websocket.Dialer, url string, header http.Header) (*websocket.Conn, error) {
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	ws, resp, err := dialer.DialContext(ctx, url, header)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return ws, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"fmt"
+
+	"lukechampine.com/blake3"
+)
+
+// Extensible identity headers, as specified at https://shadowsocks.org/doc/sip022.html
+// A multi-user server has an identity PSK (iPSK). Clients put an identity
+// header, the hash of their user PSK (uPSK) encrypted with the iPSK, after the
+// salt of streams and the separate header of packets, so the server finds the
+// user with a lookup instead of trial decryption. Only the AES ciphers support
+// identity headers.
+
+const (
+	identityContext = "shadowsocks 2022 identity subkey"
+	// IdentityHeaderSize is the size of an identity header.
+	IdentityHeaderSize = aes.BlockSize
+)
+
+// UserHash identifies a user PSK in identity headers.
+type UserHash [IdentityHeaderSize]byte
+
+func hashPSK(psk []byte) UserHash {
+	var h UserHash
+	sum := blake3.Sum256(psk)
+	copy(h[:], sum[:])
+	return h
+}
+
+// UserHash returns the hash that identifies this cipher in identity headers,
+// and false if the cipher doesn't support identity headers.
+func (c *Cipher) UserHash() (UserHash, bool) {
+	if !c.supportsIdentity() {
+		return UserHash{}, false
+	}
+	return hashPSK(c.secret), true
+}
+
+func (c *Cipher) supportsIdentity() bool {
+	return c.aead.is2022 && c.headerBlock != nil
+}
+
+// identityBlock encrypts identity headers with `psk`, for the stream that
+// starts with `salt`, or for packets if `salt` is nil.
+func identityBlock(psk, salt []byte) (cipher.Block, error) {
+	if salt == nil {
+		return aes.NewCipher(psk)
+	}
+	key := make([]byte, len(psk))
+	material := make([]byte, 0, len(psk)+len(salt))
+	blake3.DeriveKey(key, identityContext, append(append(material, psk...), salt...))
+	return aes.NewCipher(key)
+}
+
+// putStreamIdentity writes the identity header of the stream that starts with
+// `salt` into `b`.
+func (c *Cipher) putStreamIdentity(b, salt []byte) error {
+	block, err := identityBlock(c.identityPSK, salt)
+	if err != nil {
+		return err
+	}
+	h := hashPSK(c.secret)
+	block.Encrypt(b, h[:])
+	return nil
+}
+
+// IdentityKey is the identity PSK of a multi-user Shadowsocks 2022 server.
+type IdentityKey struct {
+	psk   []byte
+	block cipher.Block
+}
+
+// NewIdentityKey creates an IdentityKey from a base64 PSK of 16 or 32 bytes,
+// for users of 2022-blake3-aes-128-gcm or 2022-blake3-aes-256-gcm respectively.
+func NewIdentityKey(pskText string) (*IdentityKey, error) {
+	psk, err := base64.StdEncoding.DecodeString(pskText)
+	if err != nil {
+		return nil, fmt.Errorf("identity key isn't base64: %v", err)
+	}
+	if len(psk) != 16 && len(psk) != 32 {
+		return nil, fmt.Errorf("identity key must have 16 or 32 bytes, got %d", len(psk))
+	}
+	block, err := aes.NewCipher(psk)
+	if err != nil {
+		return nil, err
+	}
+	return &IdentityKey{psk: psk, block: block}, nil
+}
+
+// SaltSize is the salt size of the ciphers that this key identifies.
+func (k *IdentityKey) SaltSize() int {
+	return len(k.psk)
+}
+
+// Identifies reports whether `c` can be identified with this key.
+func (k *IdentityKey) Identifies(c *Cipher) bool {
+	return c.supportsIdentity() && c.aead.keySize == len(k.psk)
+}
+
+// StreamUser returns the user in the identity header of a request stream that
+// starts with `firstBytes`, which must hold SaltSize()+IdentityHeaderSize bytes.
+func (k *IdentityKey) StreamUser(firstBytes []byte) (UserHash, error) {
+	var h UserHash
+	saltSize := k.SaltSize()
+	block, err := identityBlock(k.psk, firstBytes[:saltSize])
+	if err != nil {
+		return h, err
+	}
+	block.Decrypt(h[:], firstBytes[saltSize:saltSize+IdentityHeaderSize])
+	return h, nil
+}
+
+// StripStreamIdentity removes the identity header from the start of a request
+// stream, by moving the salt over it. It returns the shortened slice.
+func (k *IdentityKey) StripStreamIdentity(firstBytes []byte) []byte {
+	copy(firstBytes[IdentityHeaderSize:], firstBytes[:k.SaltSize()])
+	return firstBytes[IdentityHeaderSize:]
+}
+
+// PacketUser returns the user in the identity header of a packet from a
+// client, or false if the packet is too short.
+func (k *IdentityKey) PacketUser(pkt []byte) (UserHash, bool) {
+	var h UserHash
+	if len(pkt) < separateHeaderSize+IdentityHeaderSize {
+		return h, false
+	}
+	var separate [separateHeaderSize]byte
+	k.block.Decrypt(separate[:], pkt[:separateHeaderSize])
+	k.block.Decrypt(h[:], pkt[separateHeaderSize:separateHeaderSize+IdentityHeaderSize])
+	for i := range h {
+		h[i] ^= separate[i]
+	}
+	return h, true
+}
+
+// StripPacketIdentity turns a packet from a client of `c` into a packet
+// without identity header, in place, and returns it. The identity header is
+// overwritten. Packets that are too short are returned as they are.
+func (k *IdentityKey) StripPacketIdentity(pkt []byte, c *Cipher) []byte {
+	if len(pkt) < separateHeaderSize+IdentityHeaderSize {
+		return pkt
+	}
+	var separate [separateHeaderSize]byte
+	k.block.Decrypt(separate[:], pkt[:separateHeaderSize])
+	c.headerBlock.Encrypt(pkt[IdentityHeaderSize:], separate[:])
+	return pkt[IdentityHeaderSize:]
+}
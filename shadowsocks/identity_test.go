@@ -0,0 +1,123 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// newIdentityTestCiphers returns the identity key of a server, a client
+// cipher that sends identity headers, and the cipher of the same user on
+// the server.
+func newIdentityTestCiphers(t *testing.T, name string) (*IdentityKey, *Cipher, *Cipher) {
+	identitySecret := MakeTestSecret(name, "identity")
+	userSecret := MakeTestSecret(name, "user")
+	identity, err := NewIdentityKey(identitySecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewCipher(name, identitySecret+":"+userSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := NewCipher(name, userSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !identity.Identifies(user) {
+		t.Fatalf("%v: identity key doesn't identify the user", name)
+	}
+	return identity, client, user
+}
+
+func TestIdentityKey(t *testing.T) {
+	if _, err := NewIdentityKey("c2hvcnQ="); err == nil {
+		t.Error("Accepted a short identity key")
+	}
+	chacha := "2022-blake3-chacha20-poly1305"
+	secret := MakeTestSecret(chacha, "secret")
+	if _, err := NewCipher(chacha, secret+":"+secret); err == nil {
+		t.Error("Accepted an identity key for ChaCha")
+	}
+	c, err := NewCipher(chacha, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.UserHash(); ok {
+		t.Error("ChaCha ciphers can't be identified")
+	}
+}
+
+func TestStreamIdentity(t *testing.T) {
+	for _, name := range []string{"2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm"} {
+		identity, client, user := newIdentityTestCiphers(t, name)
+		var request bytes.Buffer
+		writer := NewRequestWriter(&request, client)
+		addr := socks.ParseAddr("example.com:443")
+		if _, err := writer.Write(append(addr, "Hello"...)); err != nil {
+			t.Fatal(err)
+		}
+
+		stream := request.Bytes()
+		got, err := identity.StreamUser(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, _ := user.UserHash(); got != want {
+			t.Errorf("%v: got user %x, want %x", name, got, want)
+		}
+		stream = identity.StripStreamIdentity(stream)
+		plaintext, err := ioutil.ReadAll(NewRequestReader(bytes.NewReader(stream), user))
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if want := append(addr, "Hello"...); !bytes.Equal(plaintext, want) {
+			t.Errorf("%v: got %q, want %q", name, plaintext, want)
+		}
+	}
+}
+
+func TestPacketIdentity(t *testing.T) {
+	for _, name := range []string{"2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm"} {
+		identity, client, user := newIdentityTestCiphers(t, name)
+		session, err := NewPacketSession(client, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkt, err := session.Pack(make([]byte, 1500), []byte("Hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, ok := identity.PacketUser(pkt)
+		if !ok {
+			t.Fatalf("%v: no user in packet", name)
+		}
+		if want, _ := user.UserHash(); got != want {
+			t.Errorf("%v: got user %x, want %x", name, got, want)
+		}
+		plaintext, _, err := UnpackPacket(nil, identity.StripPacketIdentity(pkt, user), user, false)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if string(plaintext) != "Hello" {
+			t.Errorf("%v: got %q", name, plaintext)
+		}
+	}
+}
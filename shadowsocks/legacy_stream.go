@@ -0,0 +1,213 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"myoss/internal/slicepool"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// Legacy stream ciphers, as specified at https://shadowsocks.org/en/spec/Stream-Ciphers.html
+// They have no integrity or replay protection, so a stream is just the IV
+// followed by the encrypted data, and a packet is the IV followed by the
+// encrypted payload. They're only created with NewStreamCipher, so NewCipher
+// and SupportedCipherNames stay AEAD-only.
+
+// ErrStreamCipher is returned when an AEAD is needed from a stream cipher.
+var ErrStreamCipher = errors.New("stream ciphers have no AEAD")
+
+type streamSpec struct {
+	name      string
+	keySize   int
+	ivSize    int
+	newStream func(key, iv []byte, decrypt bool) (cipher.Stream, error)
+}
+
+var supportedStreams = [...]streamSpec{
+	{"aes-128-ctr", 16, aes.BlockSize, newAESCTR},
+	{"aes-192-ctr", 24, aes.BlockSize, newAESCTR},
+	{"aes-256-ctr", 32, aes.BlockSize, newAESCTR},
+	{"aes-128-cfb", 16, aes.BlockSize, newAESCFB},
+	{"aes-192-cfb", 24, aes.BlockSize, newAESCFB},
+	{"aes-256-cfb", 32, aes.BlockSize, newAESCFB},
+	{"chacha20-ietf", chacha20.KeySize, chacha20.NonceSize, newChaCha20IETF},
+}
+
+func newAESCTR(key, iv []byte, decrypt bool) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, iv), nil
+}
+
+func newAESCFB(key, iv []byte, decrypt bool) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if decrypt {
+		return cipher.NewCFBDecrypter(block, iv), nil
+	}
+	return cipher.NewCFBEncrypter(block, iv), nil
+}
+
+func newChaCha20IETF(key, iv []byte, decrypt bool) (cipher.Stream, error) {
+	return chacha20.NewUnauthenticatedCipher(key, iv)
+}
+
+func getStreamSpec(name string) (*streamSpec, error) {
+	name = strings.ToLower(name)
+	for _, spec := range supportedStreams {
+		if spec.name == name {
+			return &spec, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown stream cipher %v", name)
+}
+
+// StreamCipherNames lists the names of the legacy stream ciphers that
+// NewStreamCipher supports.
+func StreamCipherNames() []string {
+	names := make([]string, len(supportedStreams))
+	for i, spec := range supportedStreams {
+		names[i] = spec.name
+	}
+	return names
+}
+
+// IsStreamCipher reports whether `cipherName` is a supported stream cipher.
+func IsStreamCipher(cipherName string) bool {
+	_, err := getStreamSpec(cipherName)
+	return err == nil
+}
+
+// NewStreamCipher creates a Cipher for a legacy stream cipher. These ciphers
+// are insecure: streams and packets can be modified and replayed undetected,
+// and servers can't tell keys apart, so a port can only serve one of them.
+func NewStreamCipher(cipherName string, secretText string) (*Cipher, error) {
+	spec, err := getStreamSpec(cipherName)
+	if err != nil {
+		return nil, err
+	}
+	secret := simpleEVPBytesToKey([]byte(secretText), spec.keySize)
+	return &Cipher{
+		aead:   aeadSpec{name: spec.name, keySize: spec.keySize, saltSize: spec.ivSize},
+		secret: secret,
+		stream: spec,
+	}, nil
+}
+
+// IsStream reports whether this is a legacy stream cipher, which can't
+// authenticate data.
+func (c *Cipher) IsStream() bool {
+	return c.stream != nil
+}
+
+func (c *Cipher) newStream(iv []byte, decrypt bool) (cipher.Stream, error) {
+	return c.stream.newStream(c.secret, iv, decrypt)
+}
+
+func packStream(dst, plaintext []byte, c *Cipher) ([]byte, error) {
+	ivSize := c.SaltSize()
+	if len(dst) < ivSize+len(plaintext) {
+		return nil, io.ErrShortBuffer
+	}
+	iv := dst[:ivSize]
+	if err := RandomSaltGenerator.GetSalt(iv); err != nil {
+		return nil, err
+	}
+	stream, err := c.newStream(iv, false)
+	if err != nil {
+		return nil, err
+	}
+	out := dst[ivSize : ivSize+len(plaintext)]
+	stream.XORKeyStream(out, plaintext)
+	return dst[:ivSize+len(plaintext)], nil
+}
+
+func unpackStream(dst, pkt []byte, c *Cipher) ([]byte, error) {
+	ivSize := c.SaltSize()
+	if len(pkt) < ivSize {
+		return nil, ErrShortPacket
+	}
+	msg := pkt[ivSize:]
+	if dst == nil {
+		dst = msg
+	}
+	if cap(dst) < len(msg) {
+		return nil, io.ErrShortBuffer
+	}
+	stream, err := c.newStream(pkt[:ivSize], true)
+	if err != nil {
+		return nil, err
+	}
+	buf := dst[:len(msg)]
+	stream.XORKeyStream(buf, msg)
+	return buf, nil
+}
+
+// streamChunkReader is the ChunkReader of stream ciphers, whose chunks are
+// whatever the inner Reader returns.
+type streamChunkReader struct {
+	reader   io.Reader
+	ssCipher *Cipher
+	// Made on the first read, from the IV.
+	stream  cipher.Stream
+	payload slicepool.LazySlice
+}
+
+func newStreamChunkReader(reader io.Reader, ssCipher *Cipher) *streamChunkReader {
+	return &streamChunkReader{reader: reader, ssCipher: ssCipher, payload: readBufPool.LazySlice()}
+}
+
+func (cr *streamChunkReader) ReadChunk() ([]byte, error) {
+	if cr.stream == nil {
+		iv := make([]byte, cr.ssCipher.SaltSize())
+		if _, err := io.ReadFull(cr.reader, iv); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				err = fmt.Errorf("failed to read IV: %w", err)
+			}
+			return nil, err
+		}
+		stream, err := cr.ssCipher.newStream(iv, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stream: %v", err)
+		}
+		cr.stream = stream
+	}
+	cr.payload.Release()
+	for {
+		buf := cr.payload.Acquire()
+		n, err := cr.reader.Read(buf)
+		if n > 0 {
+			// A Read error is returned by the next call.
+			cr.stream.XORKeyStream(buf[:n], buf[:n])
+			return buf[:n], nil
+		}
+		cr.payload.Release()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -27,6 +27,9 @@ var ErrShortPacket = errors.New("short packet")
 // If plaintext and dst overlap but are not aligned for in-place encryption, this
 // function will panic.
 func Pack(dst, plaintext []byte, cipher *Cipher) ([]byte, error) {
+	if cipher.IsStream() {
+		return packStream(dst, plaintext, cipher)
+	}
 	saltSize := cipher.SaltSize()
 	if len(dst) < saltSize {
 		return nil, io.ErrShortBuffer
@@ -53,6 +56,9 @@ func Pack(dst, plaintext []byte, cipher *Cipher) ([]byte, error) {
 // This function is needed because shadowaead.Unpack() embeds its own replay detection,
 // which we do not always want, especially on memory-constrained clients.
 func Unpack(dst, pkt []byte, cipher *Cipher) ([]byte, error) {
+	if cipher.IsStream() {
+		return unpackStream(dst, pkt, cipher)
+	}
 	saltSize := cipher.SaltSize()
 	if len(pkt) < saltSize {
 		return nil, ErrShortPacket
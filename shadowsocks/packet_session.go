@@ -0,0 +1,412 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// PacketHeader identifies a Shadowsocks 2022 packet. It's zero for other ciphers.
+type PacketHeader struct {
+	SessionID uint64
+	PacketID  uint64
+	// ClientSessionID is the client session that a packet from the server answers.
+	ClientSessionID uint64
+}
+
+// ErrReplayedPacket is returned by PacketSession.Unpack for packets that were
+// already received, or that answer another session.
+var ErrReplayedPacket = errors.New("replayed packet")
+
+const (
+	// The separate header of AES packets is one AES block with the session and packet IDs.
+	separateHeaderSize = 16
+	// ChaCha packets start with an XChaCha20-Poly1305 nonce.
+	packetNonceSize = 24
+)
+
+// packetHeaderSize is the size of a Shadowsocks 2022 packet before the
+// SOCKS address, without padding.
+func packetHeaderSize(c *Cipher, fromServer bool) int {
+	// Type, timestamp and padding length.
+	size := 1 + 8 + 2
+	if fromServer {
+		size += 8
+	} else if c.identityBlock != nil {
+		size += IdentityHeaderSize
+	}
+	if c.packetAEAD != nil {
+		return packetNonceSize + separateHeaderSize + size
+	}
+	return separateHeaderSize + size
+}
+
+// sessionAEAD caches the AEAD of an AES session, to avoid deriving the
+// session subkey for every packet.
+type sessionAEAD struct {
+	mu   sync.Mutex
+	id   uint64
+	aead cipher.AEAD
+}
+
+func (s *sessionAEAD) get(c *Cipher, sessionID []byte) (cipher.AEAD, error) {
+	id := binary.BigEndian.Uint64(sessionID)
+	if s != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.aead != nil && s.id == id {
+			return s.aead, nil
+		}
+	}
+	aead, err := c.NewAEAD(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if s != nil {
+		s.id, s.aead = id, aead
+	}
+	return aead, nil
+}
+
+// UnpackPacket decrypts a packet like Unpack, and also supports Shadowsocks
+// 2022, whose packets differ depending on whether `fromServer`. For those, it
+// checks the header type and timestamp, strips the padding, and returns the
+// session header, which the caller must check for replays. See PacketSession.
+func UnpackPacket(dst, pkt []byte, c *Cipher, fromServer bool) ([]byte, PacketHeader, error) {
+	return unpackPacket(dst, pkt, c, fromServer, nil)
+}
+
+func unpackPacket(dst, pkt []byte, c *Cipher, fromServer bool, cache *sessionAEAD) ([]byte, PacketHeader, error) {
+	var h PacketHeader
+	if !c.Is2022() {
+		buf, err := Unpack(dst, pkt, c)
+		return buf, h, err
+	}
+	if len(pkt) < packetHeaderSize(c, fromServer)+c.TagSize() {
+		return nil, h, ErrShortPacket
+	}
+
+	var buf []byte
+	if c.packetAEAD != nil {
+		nonce, msg := pkt[:packetNonceSize], pkt[packetNonceSize:]
+		if dst == nil {
+			dst = msg
+		}
+		if cap(dst) < len(msg)-c.TagSize() {
+			return nil, h, io.ErrShortBuffer
+		}
+		var err error
+		if buf, err = c.packetAEAD.Open(dst[:0], nonce, msg, nil); err != nil {
+			return nil, h, err
+		}
+		h.SessionID = binary.BigEndian.Uint64(buf[0:8])
+		h.PacketID = binary.BigEndian.Uint64(buf[8:16])
+		buf = buf[separateHeaderSize:]
+	} else {
+		var separate [separateHeaderSize]byte
+		c.headerBlock.Decrypt(separate[:], pkt[:separateHeaderSize])
+		msg := pkt[separateHeaderSize:]
+		if dst == nil {
+			dst = msg
+		}
+		if cap(dst) < len(msg)-c.TagSize() {
+			return nil, h, io.ErrShortBuffer
+		}
+		aead, err := cache.get(c, separate[:8])
+		if err != nil {
+			return nil, h, err
+		}
+		if buf, err = aead.Open(dst[:0], separate[4:16], msg, nil); err != nil {
+			return nil, h, err
+		}
+		h.SessionID = binary.BigEndian.Uint64(separate[0:8])
+		h.PacketID = binary.BigEndian.Uint64(separate[8:16])
+	}
+
+	headerType := byte(headerTypeClient)
+	if fromServer {
+		headerType = headerTypeServer
+	}
+	if err := checkHeaderPrefix(buf, headerType); err != nil {
+		return nil, h, err
+	}
+	buf = buf[9:]
+	if fromServer {
+		h.ClientSessionID = binary.BigEndian.Uint64(buf)
+		buf = buf[8:]
+	}
+	dataStart := 2 + int(binary.BigEndian.Uint16(buf))
+	if dataStart > len(buf) {
+		return nil, h, errors.New("packet padding is too long")
+	}
+	return buf[dataStart:], h, nil
+}
+
+// packPacket encrypts a Shadowsocks 2022 packet with `plaintext` into `dst`.
+// It's cheapest when `plaintext` is already at dst[packetHeaderSize(c, fromServer):].
+func packPacket(dst, plaintext []byte, c *Cipher, h PacketHeader, fromServer bool, cache *sessionAEAD) ([]byte, error) {
+	headerSize := packetHeaderSize(c, fromServer)
+	if len(dst) < headerSize+len(plaintext)+c.TagSize() {
+		return nil, io.ErrShortBuffer
+	}
+	copy(dst[headerSize:], plaintext)
+
+	var separate [separateHeaderSize]byte
+	binary.BigEndian.PutUint64(separate[0:8], h.SessionID)
+	binary.BigEndian.PutUint64(separate[8:16], h.PacketID)
+	mainStart := separateHeaderSize
+	if c.packetAEAD != nil {
+		mainStart += packetNonceSize
+	}
+	identity := !fromServer && c.identityBlock != nil
+	if identity {
+		mainStart += IdentityHeaderSize
+	}
+	main := dst[mainStart:headerSize]
+	headerType := byte(headerTypeClient)
+	if fromServer {
+		headerType = headerTypeServer
+	}
+	putHeaderPrefix(main, headerType)
+	if fromServer {
+		binary.BigEndian.PutUint64(main[9:], h.ClientSessionID)
+	}
+	// No padding.
+	binary.BigEndian.PutUint16(main[len(main)-2:], 0)
+
+	if c.packetAEAD != nil {
+		nonce := dst[:packetNonceSize]
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		copy(dst[packetNonceSize:], separate[:])
+		msg := dst[packetNonceSize : headerSize+len(plaintext)]
+		return dst[:packetNonceSize+len(c.packetAEAD.Seal(msg[:0], nonce, msg, nil))], nil
+	}
+	aead, err := cache.get(c, separate[:8])
+	if err != nil {
+		return nil, err
+	}
+	msgStart := separateHeaderSize
+	if identity {
+		msgStart += IdentityHeaderSize
+	}
+	msg := dst[msgStart : headerSize+len(plaintext)]
+	sealed := aead.Seal(msg[:0], separate[4:16], msg, nil)
+	if !identity {
+		c.headerBlock.Encrypt(dst[:separateHeaderSize], separate[:])
+		return dst[:separateHeaderSize+len(sealed)], nil
+	}
+	// The identity header is the user hash XOR the separate header, and
+	// both are encrypted with the identity PSK.
+	user := hashPSK(c.secret)
+	for i := range user {
+		user[i] ^= separate[i]
+	}
+	c.identityBlock.Encrypt(dst[separateHeaderSize:msgStart], user[:])
+	c.identityBlock.Encrypt(dst[:separateHeaderSize], separate[:])
+	return dst[:msgStart+len(sealed)], nil
+}
+
+// PacketSession is one side of a UDP association. With Shadowsocks 2022, it
+// numbers our packets within a random session, and rejects replayed packets
+// from the peer. With other ciphers, it just packs and unpacks.
+// It's safe for concurrent use.
+type PacketSession struct {
+	cipher   *Cipher
+	isServer bool
+	ownAEAD  sessionAEAD
+	peerAEAD sessionAEAD
+
+	mu           sync.Mutex
+	id           uint64
+	nextPacketID uint64
+	// peer and prevPeer are the current and previous sessions of the peer,
+	// whose packets may still arrive out of order.
+	peer, prevPeer *peerSession
+	// retired are the older sessions of the peer, whose packets are all
+	// rejected, so that their replay filters can't start over.
+	retired map[uint64]bool
+	// filters returns the shared replay filter of a new session of the
+	// peer, or is nil to give each session its own.
+	filters func(sessionID uint64) *ReplayFilter
+}
+
+// peerSession is a session of the peer, with the packet IDs seen in it.
+type peerSession struct {
+	id     uint64
+	filter *ReplayFilter
+}
+
+// maxRetiredSessions bounds the sessions that the peer may start within one
+// of ours. Later ones are rejected.
+const maxRetiredSessions = 1024
+
+// NewPacketSession starts a session for a client, or for a server if `isServer`.
+func NewPacketSession(c *Cipher, isServer bool) (*PacketSession, error) {
+	s := &PacketSession{cipher: c, isServer: isServer}
+	if c.Is2022() {
+		var id [8]byte
+		if _, err := rand.Read(id[:]); err != nil {
+			return nil, err
+		}
+		s.id = binary.BigEndian.Uint64(id[:])
+	}
+	return s, nil
+}
+
+// HeaderSize is the number of bytes that Pack puts before the plaintext.
+func (s *PacketSession) HeaderSize() int {
+	if !s.cipher.Is2022() {
+		return s.cipher.SaltSize()
+	}
+	return packetHeaderSize(s.cipher, s.isServer)
+}
+
+// Pack encrypts `plaintext` into a packet to the peer in `dst`. It's cheapest
+// when `plaintext` is already at dst[HeaderSize():].
+func (s *PacketSession) Pack(dst, plaintext []byte) ([]byte, error) {
+	if !s.cipher.Is2022() {
+		return Pack(dst, plaintext, s.cipher)
+	}
+	s.mu.Lock()
+	h := PacketHeader{SessionID: s.id, PacketID: s.nextPacketID}
+	if s.peer != nil {
+		h.ClientSessionID = s.peer.id
+	}
+	s.nextPacketID++
+	s.mu.Unlock()
+	return packPacket(dst, plaintext, s.cipher, h, s.isServer, &s.ownAEAD)
+}
+
+// Unpack decrypts a packet from the peer into `dst`, or in place if `dst` is nil.
+func (s *PacketSession) Unpack(dst, pkt []byte) ([]byte, error) {
+	buf, h, err := unpackPacket(dst, pkt, s.cipher, !s.isServer, &s.peerAEAD)
+	if err != nil {
+		return nil, err
+	}
+	if !s.Accept(h) {
+		return nil, ErrReplayedPacket
+	}
+	return buf, nil
+}
+
+// Accept checks the header of a packet from the peer that was unpacked with
+// UnpackPacket, and reports whether it's new. A new session of the peer
+// becomes the current one, and the packets of the one before it are still
+// accepted. Sessions older than that are rejected.
+func (s *PacketSession) Accept(h PacketHeader) bool {
+	if !s.cipher.Is2022() {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.isServer && h.ClientSessionID != s.id {
+		return false
+	}
+	switch {
+	case s.peer != nil && h.SessionID == s.peer.id:
+		return s.peer.filter.Validate(h.PacketID)
+	case s.prevPeer != nil && h.SessionID == s.prevPeer.id:
+		return s.prevPeer.filter.Validate(h.PacketID)
+	case s.retired[h.SessionID]:
+		return false
+	}
+	if s.prevPeer != nil {
+		if len(s.retired) >= maxRetiredSessions {
+			return false
+		}
+		if s.retired == nil {
+			s.retired = make(map[uint64]bool)
+		}
+		s.retired[s.prevPeer.id] = true
+	}
+	s.prevPeer = s.peer
+	s.peer = &peerSession{id: h.SessionID}
+	if s.filters != nil {
+		s.peer.filter = s.filters(h.SessionID)
+	} else {
+		s.peer.filter = &ReplayFilter{}
+	}
+	return s.peer.filter.Validate(h.PacketID)
+}
+
+// SetReplayFilters makes the sessions of the peer use the replay filters
+// that `filters` returns by session ID, such as those of a cache shared by
+// the whole server, so that packets can't be replayed to another
+// PacketSession either. It must be called before Accept.
+func (s *PacketSession) SetReplayFilters(filters func(sessionID uint64) *ReplayFilter) {
+	s.mu.Lock()
+	s.filters = filters
+	s.mu.Unlock()
+}
+
+// ReplayFilter rejects the packet IDs of a session that were seen before.
+// It's safe for concurrent use.
+type ReplayFilter struct {
+	mu     sync.Mutex
+	filter replayFilter
+}
+
+// Validate reports whether `id` is new, and records it.
+func (f *ReplayFilter) Validate(id uint64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.filter.validate(id)
+}
+
+// replayFilter is a sliding window of the packet IDs seen in a session, as
+// in WireGuard.
+type replayFilter struct {
+	last uint64
+	ring [replayRingBlocks]uint64
+}
+
+const (
+	replayBlockBits  = 64
+	replayRingBlocks = 32
+	// replayWindow is how far behind the newest packet a packet may arrive.
+	replayWindow = (replayRingBlocks - 1) * replayBlockBits
+)
+
+// validate reports whether `id` is new, and records it.
+func (f *replayFilter) validate(id uint64) bool {
+	block := id / replayBlockBits
+	if id > f.last {
+		current := f.last / replayBlockBits
+		diff := block - current
+		if diff > replayRingBlocks {
+			diff = replayRingBlocks
+		}
+		for i := current + 1; i <= current+diff; i++ {
+			f.ring[i%replayRingBlocks] = 0
+		}
+		f.last = id
+	} else if f.last-id > replayWindow {
+		return false
+	}
+	bit := uint64(1) << (id % replayBlockBits)
+	index := block % replayRingBlocks
+	if f.ring[index]&bit != 0 {
+		return false
+	}
+	f.ring[index] |= bit
+	return true
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"time"
+)
+
+// Constants of Shadowsocks 2022, as specified at https://shadowsocks.org/doc/sip022.html
+const (
+	subkeyContext2022 = "shadowsocks 2022 session subkey"
+	// Header types.
+	headerTypeClient = 0
+	headerTypeServer = 1
+	// MaxTimestampDiff is how far the timestamp of a Shadowsocks 2022 header
+	// may be from our clock. Peers must remember salts for twice as long.
+	MaxTimestampDiff = 30 * time.Second
+	// Type, timestamp and length of the variable-length header.
+	requestFixedHeaderSize = 1 + 8 + 2
+	// Type, timestamp, request salt (not counted here) and length of the first chunk.
+	responseFixedHeaderSize = 1 + 8 + 2
+	// maxPadding is the largest padding a client adds to a request without
+	// initial payload.
+	maxPadding = 900
+	// payloadSizeMask2022 is the maximum size of a Shadowsocks 2022 chunk.
+	payloadSizeMask2022 = 0xFFFF
+)
+
+// ErrBadTimestamp is returned for Shadowsocks 2022 headers whose timestamp is
+// more than MaxTimestampDiff away from our clock.
+var ErrBadTimestamp = errors.New("timestamp out of range")
+
+var errBadHeaderType = errors.New("unexpected header type")
+
+// timeNow is replaced in tests.
+var timeNow = time.Now
+
+func putHeaderPrefix(b []byte, headerType byte) {
+	b[0] = headerType
+	binary.BigEndian.PutUint64(b[1:9], uint64(timeNow().Unix()))
+}
+
+// checkHeaderPrefix checks the type and timestamp at the start of a header.
+func checkHeaderPrefix(b []byte, headerType byte) error {
+	if b[0] != headerType {
+		return fmt.Errorf("%w %d", errBadHeaderType, b[0])
+	}
+	diff := timeNow().Unix() - int64(binary.BigEndian.Uint64(b[1:9]))
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > int64(MaxTimestampDiff/time.Second) {
+		return ErrBadTimestamp
+	}
+	return nil
+}
+
+// randomPadding fills a random amount of padding, between 1 and maxPadding
+// bytes, at the start of `b`, and returns its length.
+func randomPadding(b []byte) (int, error) {
+	n := 1 + mrand.Intn(maxPadding)
+	if _, err := rand.Read(b[:n]); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,260 @@
+// Copyright 2020 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+var ciphers2022 = []string{"2022-blake3-aes-128-gcm", "2022-blake3-aes-256-gcm", "2022-blake3-chacha20-poly1305"}
+
+func new2022TestCipher(t testing.TB, name string) *Cipher {
+	cipher, err := NewCipher(name, MakeTestSecret(name, "test secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cipher
+}
+
+func TestStream2022(t *testing.T) {
+	addr := socks.ParseAddr("example.com:443")
+	for _, name := range ciphers2022 {
+		for _, payload := range [][]byte{nil, []byte("Request")} {
+			cipher := new2022TestCipher(t, name)
+			var request bytes.Buffer
+			writer := NewRequestWriter(&request, cipher)
+			if _, err := writer.LazyWrite(addr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := writer.Write(payload); err != nil {
+				t.Fatal(err)
+			}
+			if len(payload) == 0 {
+				if err := writer.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := writer.Write([]byte(" more")); err != nil {
+				t.Fatal(err)
+			}
+
+			reader := NewRequestReader(&request, cipher)
+			got, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("%v: failed to read request: %v", name, err)
+			}
+			want := append(append(append([]byte{}, addr...), payload...), " more"...)
+			if !bytes.Equal(got, want) {
+				t.Errorf("%v: got request %q, want %q", name, got, want)
+			}
+
+			var response bytes.Buffer
+			responseWriter := NewResponseWriter(&response, cipher, writer.salt())
+			if _, err := responseWriter.Write([]byte("Response")); err != nil {
+				t.Fatal(err)
+			}
+			got, err = ioutil.ReadAll(NewResponseReader(&response, cipher, writer))
+			if err != nil {
+				t.Fatalf("%v: failed to read response: %v", name, err)
+			}
+			if string(got) != "Response" {
+				t.Errorf("%v: got response %q", name, got)
+			}
+		}
+	}
+}
+
+func TestStream2022WrongRequestSalt(t *testing.T) {
+	cipher := new2022TestCipher(t, "2022-blake3-aes-128-gcm")
+	var request bytes.Buffer
+	writer := NewRequestWriter(&request, cipher)
+	if _, err := writer.Write(socks.ParseAddr("1.2.3.4:80")); err != nil {
+		t.Fatal(err)
+	}
+	var response bytes.Buffer
+	responseWriter := NewResponseWriter(&response, cipher, make([]byte, cipher.SaltSize()))
+	if _, err := responseWriter.Write([]byte("Response")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(NewResponseReader(&response, cipher, writer)); err == nil {
+		t.Error("Accepted a response to another request")
+	}
+}
+
+func TestStream2022BadTimestamp(t *testing.T) {
+	cipher := new2022TestCipher(t, "2022-blake3-chacha20-poly1305")
+	var request bytes.Buffer
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return time.Now().Add(-2 * MaxTimestampDiff) }
+	writer := NewRequestWriter(&request, cipher)
+	if _, err := writer.Write(socks.ParseAddr("1.2.3.4:80")); err != nil {
+		t.Fatal(err)
+	}
+	timeNow = time.Now
+	_, err := ioutil.ReadAll(NewRequestReader(&request, cipher))
+	if !errors.Is(err, ErrBadTimestamp) {
+		t.Errorf("Expected ErrBadTimestamp, got %v", err)
+	}
+}
+
+func TestStream2022Truncated(t *testing.T) {
+	cipher := new2022TestCipher(t, "2022-blake3-aes-256-gcm")
+	var request bytes.Buffer
+	writer := NewRequestWriter(&request, cipher)
+	if _, err := writer.Write(socks.ParseAddr("1.2.3.4:80")); err != nil {
+		t.Fatal(err)
+	}
+	truncated := request.Bytes()[:request.Len()-1]
+	_, err := ioutil.ReadAll(NewRequestReader(bytes.NewReader(truncated), cipher))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestPacketSession(t *testing.T) {
+	for _, name := range append([]string{"chacha20-ietf-poly1305"}, ciphers2022...) {
+		cipher := new2022TestCipher(t, name)
+		client, err := NewPacketSession(cipher, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := NewPacketSession(cipher, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 1500)
+		pkt, err := client.Pack(buf, []byte("Request"))
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		request := append([]byte{}, pkt...)
+		got, h, err := UnpackPacket(nil, append([]byte{}, request...), cipher, false)
+		if err != nil {
+			t.Fatalf("%v: failed to unpack request: %v", name, err)
+		}
+		if string(got) != "Request" {
+			t.Errorf("%v: got request %q", name, got)
+		}
+		if !server.Accept(h) {
+			t.Errorf("%v: rejected the first request", name)
+		}
+		if cipher.Is2022() && server.Accept(h) {
+			t.Errorf("%v: accepted a replayed request", name)
+		}
+
+		pkt, err = server.Pack(buf, []byte("Response"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := append([]byte{}, pkt...)
+		got, err = client.Unpack(nil, append([]byte{}, response...))
+		if err != nil {
+			t.Fatalf("%v: failed to unpack response: %v", name, err)
+		}
+		if string(got) != "Response" {
+			t.Errorf("%v: got response %q", name, got)
+		}
+		if !cipher.Is2022() {
+			continue
+		}
+		if _, err := client.Unpack(nil, response); err == nil {
+			t.Errorf("%v: accepted a replayed response", name)
+		}
+
+		// Responses to another client session are rejected.
+		other, err := NewPacketSession(cipher, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkt, err = server.Pack(buf, []byte("Response"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := other.Unpack(nil, pkt); err == nil {
+			t.Errorf("%v: accepted a response to another session", name)
+		}
+	}
+}
+
+func TestPacketSessionReplayAcrossSessions(t *testing.T) {
+	cipher := new2022TestCipher(t, "2022-blake3-aes-128-gcm")
+	server, err := NewPacketSession(cipher, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := PacketHeader{SessionID: 1, PacketID: 0}
+	second := PacketHeader{SessionID: 2, PacketID: 0}
+	third := PacketHeader{SessionID: 3, PacketID: 0}
+	for _, h := range []PacketHeader{first, second} {
+		if !server.Accept(h) {
+			t.Errorf("Rejected the first packet of session %d", h.SessionID)
+		}
+	}
+	// Alternating the packets of two sessions doesn't reset their filters.
+	for _, h := range []PacketHeader{first, second, first} {
+		if server.Accept(h) {
+			t.Errorf("Accepted a replayed packet of session %d", h.SessionID)
+		}
+	}
+	// Late packets of the previous session are still accepted.
+	if !server.Accept(PacketHeader{SessionID: 1, PacketID: 1}) {
+		t.Error("Rejected a new packet of the previous session")
+	}
+	if !server.Accept(third) {
+		t.Error("Rejected the first packet of a new session")
+	}
+	// Older sessions are retired.
+	if server.Accept(PacketHeader{SessionID: 1, PacketID: 2}) {
+		t.Error("Accepted a packet of a retired session")
+	}
+	if !server.Accept(PacketHeader{SessionID: 2, PacketID: 1}) {
+		t.Error("Rejected a new packet of the previous session")
+	}
+}
+
+func TestPacket2022Short(t *testing.T) {
+	cipher := new2022TestCipher(t, "2022-blake3-aes-128-gcm")
+	if _, _, err := UnpackPacket(nil, make([]byte, 20), cipher, false); err != ErrShortPacket {
+		t.Errorf("Expected ErrShortPacket, got %v", err)
+	}
+}
+
+func TestReplayFilter(t *testing.T) {
+	var f replayFilter
+	for _, id := range []uint64{0, 1, 5, 3, 2000, 100} {
+		if !f.validate(id) {
+			t.Errorf("Rejected new packet %d", id)
+		}
+	}
+	for _, id := range []uint64{0, 5, 2000, 100} {
+		if f.validate(id) {
+			t.Errorf("Accepted replayed packet %d", id)
+		}
+	}
+	if f.validate(2000 - replayWindow - 1) {
+		t.Error("Accepted a packet behind the window")
+	}
+	if !f.validate(2000 + 10*replayWindow) {
+		t.Error("Rejected a packet far ahead")
+	}
+}
@@ -18,10 +18,12 @@ import (
 	"bytes"
 	"crypto/cipher"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"sync"
 
+	"github.com/shadowsocks/go-shadowsocks2/socks"
 	"myoss/internal/slicepool"
 )
 
@@ -32,6 +34,29 @@ const payloadSizeMask = 0x3FFF // 16*1024 - 1
 // The largest buffer we could need is for decrypting a max-length payload.
 var readBufPool = slicepool.MakePool(payloadSizeMask + maxTagSize())
 
+// Buffer pool used for decrypting Shadowsocks 2022 streams, whose chunks and
+// headers are larger.
+var readBufPool2022 = slicepool.MakePool(payloadSizeMask2022 + maxTagSize())
+
+// streamHeader is the Shadowsocks 2022 header that starts a stream. Streams
+// of other ciphers have no header.
+type streamHeader int
+
+const (
+	noHeader streamHeader = iota
+	// The request header carries the target address and a timestamp.
+	requestHeader
+	// The response header binds the response to the salt of the request.
+	responseHeader
+)
+
+func headerFor(ssCipher *Cipher, header streamHeader) streamHeader {
+	if !ssCipher.Is2022() {
+		return noHeader
+	}
+	return header
+}
+
 // Writer is an io.Writer that also implements io.ReaderFrom to
 // allow for piping the data without extra allocations and copies.
 // The LazyWrite and Flush methods allow a header to be
@@ -56,14 +81,40 @@ type Writer struct {
 	aead cipher.AEAD
 	// Index of the next encrypted chunk to write.
 	counter []byte
+	// For stream ciphers, instead of aead and counter.
+	stream cipher.Stream
+	ivSent bool
+	header streamHeader
+	// The salt of the request, for a response header.
+	requestSalt []byte
 }
 
 // NewShadowsocksWriter creates a Writer that encrypts the given Writer using
 // the shadowsocks protocol with the given shadowsocks cipher.
+// It doesn't write the Shadowsocks 2022 headers; use NewRequestWriter and
+// NewResponseWriter for streams that may use a Shadowsocks 2022 cipher.
 func NewShadowsocksWriter(writer io.Writer, ssCipher *Cipher) *Writer {
 	return &Writer{writer: writer, ssCipher: ssCipher, saltGenerator: RandomSaltGenerator}
 }
 
+// NewRequestWriter creates a Writer for a stream from a client to a server.
+// The stream must start with the SOCKS address of the target, which goes into
+// the request header of Shadowsocks 2022.
+func NewRequestWriter(writer io.Writer, ssCipher *Cipher) *Writer {
+	sw := NewShadowsocksWriter(writer, ssCipher)
+	sw.header = headerFor(ssCipher, requestHeader)
+	return sw
+}
+
+// NewResponseWriter creates a Writer for the response to the request stream
+// that started with `requestSalt`.
+func NewResponseWriter(writer io.Writer, ssCipher *Cipher, requestSalt []byte) *Writer {
+	sw := NewShadowsocksWriter(writer, ssCipher)
+	sw.header = headerFor(ssCipher, responseHeader)
+	sw.requestSalt = requestSalt
+	return sw
+}
+
 // SetSaltGenerator sets the salt generator to be used. Must be called before the first write.
 func (sw *Writer) SetSaltGenerator(saltGenerator SaltGenerator) {
 	sw.saltGenerator = saltGenerator
@@ -72,11 +123,21 @@ func (sw *Writer) SetSaltGenerator(saltGenerator SaltGenerator) {
 // init generates a random salt, sets up the AEAD object and writes
 // the salt to the inner Writer.
 func (sw *Writer) init() (err error) {
-	if sw.aead == nil {
+	if sw.buf == nil {
 		salt := make([]byte, sw.ssCipher.SaltSize())
 		if err := sw.saltGenerator.GetSalt(salt); err != nil {
 			return fmt.Errorf("failed to generate salt: %v", err)
 		}
+		if sw.ssCipher.IsStream() {
+			// The salt is the IV of the stream.
+			if sw.stream, err = sw.ssCipher.newStream(salt, false); err != nil {
+				return fmt.Errorf("failed to create stream: %v", err)
+			}
+			sw.saltGenerator = nil
+			sw.buf = make([]byte, len(salt)+payloadSizeMask)
+			copy(sw.buf, salt)
+			return nil
+		}
 		sw.aead, err = sw.ssCipher.NewAEAD(salt)
 		if err != nil {
 			return fmt.Errorf("failed to create AEAD: %v", err)
@@ -94,6 +155,14 @@ func (sw *Writer) init() (err error) {
 	return nil
 }
 
+// salt returns the salt of the stream, or nil if nothing was written yet.
+func (sw *Writer) salt() []byte {
+	if sw.buf == nil {
+		return nil
+	}
+	return sw.buf[:sw.ssCipher.SaltSize()]
+}
+
 // encryptBlock encrypts `plaintext` in-place.  The slice must have enough capacity
 // for the tag. Returns the total ciphertext length.
 func (sw *Writer) encryptBlock(plaintext []byte) int {
@@ -157,9 +226,13 @@ func isZero(b []byte) bool {
 }
 
 // Returns the slices of sw.buf in which to place plaintext for encryption.
+// Stream ciphers have no sizeBuf.
 func (sw *Writer) buffers() (sizeBuf, payloadBuf []byte) {
 	// sw.buf starts with the salt.
 	saltSize := sw.ssCipher.SaltSize()
+	if sw.stream != nil {
+		return nil, sw.buf[saltSize : saltSize+payloadSizeMask]
+	}
 
 	// Each Shadowsocks-TCP message consists of a fixed-length size block,
 	// followed by a variable-length payload block.
@@ -184,12 +257,14 @@ func (sw *Writer) ReadFrom(r io.Reader) (int64, error) {
 		pending := sw.pending
 
 		sw.mu.Unlock()
-		saltsize := sw.ssCipher.SaltSize()
-		overhead := sw.aead.Overhead()
 		// The first pending+overhead bytes of payloadBuf are potentially
 		// in use, and may be modified on the flush thread.  Data after
 		// that is safe to use on this thread.
-		readBuf := sw.buf[saltsize+2+overhead+pending+overhead:]
+		readBuf := payloadBuf[pending:]
+		if sw.aead != nil {
+			overhead := sw.aead.Overhead()
+			readBuf = sw.buf[sw.ssCipher.SaltSize()+2+overhead+pending+overhead:]
+		}
 		var plaintextSize int
 		plaintextSize, err = r.Read(readBuf)
 		written = int64(plaintextSize)
@@ -232,6 +307,12 @@ func (sw *Writer) flush() error {
 	if sw.pending == 0 {
 		return nil
 	}
+	if sw.stream != nil {
+		return sw.flushStream()
+	}
+	if sw.header != noHeader && isZero(sw.counter) {
+		return sw.flushHeader()
+	}
 	// sw.buf starts with the salt.
 	saltSize := sw.ssCipher.SaltSize()
 	// Normally we ignore the salt at the beginning of sw.buf.
@@ -252,6 +333,88 @@ func (sw *Writer) flush() error {
 	return err
 }
 
+// flushStream encrypts the pending data with a stream cipher, and writes it
+// after the IV if that wasn't written yet.
+func (sw *Writer) flushStream() error {
+	saltSize := sw.ssCipher.SaltSize()
+	start := saltSize
+	if !sw.ivSent {
+		start = 0
+		sw.ivSent = true
+	}
+	_, payloadBuf := sw.buffers()
+	sw.stream.XORKeyStream(payloadBuf[:sw.pending], payloadBuf[:sw.pending])
+	_, err := sw.writer.Write(sw.buf[start : saltSize+sw.pending])
+	sw.pending = 0
+	return err
+}
+
+// flushHeader writes the salt and the Shadowsocks 2022 header that starts
+// the stream, with the pending data in it.
+func (sw *Writer) flushHeader() error {
+	saltSize := sw.ssCipher.SaltSize()
+	overhead := sw.aead.Overhead()
+	_, payloadBuf := sw.buffers()
+	pending := payloadBuf[:sw.pending]
+	sw.pending = 0
+
+	var fixedSize, identitySize int
+	if sw.header == requestHeader {
+		fixedSize = requestFixedHeaderSize
+		if sw.ssCipher.identityPSK != nil {
+			identitySize = IdentityHeaderSize
+		}
+	} else {
+		fixedSize = responseFixedHeaderSize + saltSize
+	}
+	// [salt][identity header?][fixed-length header][tag][variable-length header or payload][tag]
+	fixedStart := saltSize + identitySize
+	bodyStart := fixedStart + fixedSize + overhead
+	buf := make([]byte, bodyStart, bodyStart+2+maxPadding+len(pending)+overhead)
+	copy(buf, sw.buf[:saltSize])
+	if identitySize > 0 {
+		if err := sw.ssCipher.putStreamIdentity(buf[saltSize:fixedStart], buf[:saltSize]); err != nil {
+			return err
+		}
+	}
+	fixed := buf[fixedStart : fixedStart+fixedSize]
+
+	body := buf[bodyStart:]
+	if sw.header == requestHeader {
+		putHeaderPrefix(fixed, headerTypeClient)
+		// The variable-length header is the address, the padding and the
+		// initial payload. Requests without payload are padded.
+		addr := socks.SplitAddr(pending)
+		if addr == nil {
+			return errors.New("request doesn't start with a SOCKS address")
+		}
+		payload := pending[len(addr):]
+		body = append(body, addr...)
+		body = append(body, 0, 0)
+		if len(payload) == 0 {
+			padding, err := randomPadding(body[len(body) : len(body)+maxPadding])
+			if err != nil {
+				return err
+			}
+			binary.BigEndian.PutUint16(body[len(addr):], uint16(padding))
+			body = body[:len(body)+padding]
+		}
+		body = append(body, payload...)
+		binary.BigEndian.PutUint16(fixed[9:], uint16(len(body)))
+	} else {
+		putHeaderPrefix(fixed, headerTypeServer)
+		copy(fixed[9:], sw.requestSalt)
+		binary.BigEndian.PutUint16(fixed[9+saltSize:], uint16(len(pending)))
+		body = append(body, pending...)
+	}
+
+	// The sealed fixed-length header ends exactly at bodyStart.
+	sw.encryptBlock(fixed)
+	bodyEnd := bodyStart + sw.encryptBlock(body)
+	_, err := sw.writer.Write(buf[:bodyEnd])
+	return err
+}
+
 // ChunkReader is similar to io.Reader, except that it controls its own
 // buffer granularity.
 type ChunkReader interface {
@@ -272,6 +435,13 @@ type chunkReader struct {
 	payloadSizeBuf []byte
 	// Holds a buffer for the payload and its AEAD tag, when needed.
 	payload slicepool.LazySlice
+	header  streamHeader
+	// The request that a response header must match.
+	request *Writer
+	// The payload that came with the header, until it's read.
+	first []byte
+	// headerErr is the error from reading the header. It stops the stream.
+	headerErr error
 }
 
 // Reader is an io.Reader that also implements io.WriterTo to
@@ -283,13 +453,43 @@ type Reader interface {
 
 // NewShadowsocksReader creates a Reader that decrypts the given Reader using
 // the shadowsocks protocol with the given shadowsocks cipher.
+// It doesn't read the Shadowsocks 2022 headers; use NewRequestReader and
+// NewResponseReader for streams that may use a Shadowsocks 2022 cipher.
 func NewShadowsocksReader(reader io.Reader, ssCipher *Cipher) Reader {
-	return &readConverter{
-		cr: &chunkReader{
-			reader:   reader,
-			ssCipher: ssCipher,
-			payload:  readBufPool.LazySlice(),
-		},
+	return newReader(reader, ssCipher, noHeader, nil)
+}
+
+// NewRequestReader creates a Reader for a stream from a client to a server.
+// With a Shadowsocks 2022 cipher, it checks the request header, and the
+// stream starts with the SOCKS address of the target, as with other ciphers.
+func NewRequestReader(reader io.Reader, ssCipher *Cipher) Reader {
+	return newReader(reader, ssCipher, requestHeader, nil)
+}
+
+// NewResponseReader creates a Reader for the response to the stream written
+// by `request`.
+func NewResponseReader(reader io.Reader, ssCipher *Cipher, request *Writer) Reader {
+	return newReader(reader, ssCipher, responseHeader, request)
+}
+
+func newReader(reader io.Reader, ssCipher *Cipher, header streamHeader, request *Writer) Reader {
+	if ssCipher.IsStream() {
+		return &readConverter{cr: newStreamChunkReader(reader, ssCipher)}
+	}
+	return &readConverter{cr: newChunkReader(reader, ssCipher, header, request)}
+}
+
+func newChunkReader(reader io.Reader, ssCipher *Cipher, header streamHeader, request *Writer) *chunkReader {
+	pool := readBufPool
+	if ssCipher.Is2022() {
+		pool = readBufPool2022
+	}
+	return &chunkReader{
+		reader:   reader,
+		ssCipher: ssCipher,
+		payload:  pool.LazySlice(),
+		header:   headerFor(ssCipher, header),
+		request:  request,
 	}
 }
 
@@ -310,7 +510,67 @@ func (cr *chunkReader) init() (err error) {
 		}
 		cr.counter = make([]byte, cr.aead.NonceSize())
 		cr.payloadSizeBuf = make([]byte, 2+cr.aead.Overhead())
+		if cr.header != noHeader {
+			cr.headerErr = cr.readHeader()
+		}
 	}
+	return cr.headerErr
+}
+
+// readHeader reads and checks the Shadowsocks 2022 header, and keeps the
+// payload that came with it in cr.first.
+func (cr *chunkReader) readHeader() error {
+	saltSize := cr.ssCipher.SaltSize()
+	overhead := cr.aead.Overhead()
+	headerType := byte(headerTypeClient)
+	fixedSize := requestFixedHeaderSize
+	if cr.header == responseHeader {
+		headerType = headerTypeServer
+		fixedSize = responseFixedHeaderSize + saltSize
+	}
+	fixed := make([]byte, fixedSize+overhead)
+	if err := cr.readMessage(fixed); err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			err = fmt.Errorf("failed to read header: %w", err)
+		}
+		return err
+	}
+	if err := checkHeaderPrefix(fixed, headerType); err != nil {
+		return err
+	}
+	if cr.header == responseHeader && !bytes.Equal(fixed[9:9+saltSize], cr.request.salt()) {
+		return errors.New("response doesn't match the request salt")
+	}
+
+	size := int(binary.BigEndian.Uint16(fixed[fixedSize-2:]))
+	buf := cr.payload.Acquire()
+	if err := cr.readMessage(buf[:size+overhead]); err != nil {
+		cr.payload.Release()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	body := buf[:size]
+	if cr.header == responseHeader {
+		cr.first = body
+		return nil
+	}
+
+	// The variable-length header is the address, the padding and the initial
+	// payload. Move the address over the padding, so it's followed by the payload.
+	addr := socks.SplitAddr(body)
+	if addr == nil || len(body) < len(addr)+2 {
+		cr.payload.Release()
+		return errors.New("failed to read the address in the request header")
+	}
+	payloadStart := len(addr) + 2 + int(binary.BigEndian.Uint16(body[len(addr):]))
+	if payloadStart > len(body) {
+		cr.payload.Release()
+		return errors.New("request header padding is too long")
+	}
+	copy(body[payloadStart-len(addr):], addr)
+	cr.first = body[payloadStart-len(addr):]
 	return nil
 }
 
@@ -337,6 +597,11 @@ func (cr *chunkReader) ReadChunk() ([]byte, error) {
 	if err := cr.init(); err != nil {
 		return nil, err
 	}
+	if cr.first != nil {
+		first := cr.first
+		cr.first = nil
+		return first, nil
+	}
 
 	// Release the previous payload buffer.
 	cr.payload.Release()
@@ -351,7 +616,11 @@ func (cr *chunkReader) ReadChunk() ([]byte, error) {
 		}
 		return nil, err
 	}
-	size := int(binary.BigEndian.Uint16(cr.payloadSizeBuf) & payloadSizeMask)
+	sizeMask := uint16(payloadSizeMask)
+	if cr.ssCipher.Is2022() {
+		sizeMask = payloadSizeMask2022
+	}
+	size := int(binary.BigEndian.Uint16(cr.payloadSizeBuf) & sizeMask)
 	sizeWithTag := size + cr.aead.Overhead()
 	payloadBuf := cr.payload.Acquire()
 	if cap(payloadBuf) < sizeWithTag {
@@ -0,0 +1,207 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+// UDP-over-TCP carries UDP packets in a Shadowsocks stream, for networks
+// that drop UDP. The framing is the one of sing-box and its clients
+// (https://github.com/SagerNet/sing/tree/main/common/uot): a stream to one of
+// the magic addresses below carries packets, each its address, a 2-byte
+// length and the payload. Version 2 streams start with a request, which can
+// connect the stream to one destination, and then their packets have no
+// addresses. The addresses of packets are an address type (0 IPv4, 1 IPv6,
+// 2 domain name), the address and a 2-byte port. The destination of the
+// request is a SOCKS address instead, with the SOCKS address types.
+
+const (
+	// UDPOverTCPV1Address is the magic host of version 1 streams.
+	UDPOverTCPV1Address = "sp.udp-over-tcp.arpa"
+	// UDPOverTCPV2Address is the magic host of version 2 streams.
+	UDPOverTCPV2Address = "sp.v2.udp-over-tcp.arpa"
+)
+
+const (
+	uotAddrIPv4   = 0
+	uotAddrIPv6   = 1
+	uotAddrDomain = 2
+)
+
+// UDPOverTCPVersion returns the UDP-over-TCP version of a stream to
+// `address`, a host:port, or 0 if it's an ordinary stream.
+func UDPOverTCPVersion(address string) int {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return 0
+	}
+	switch host {
+	case UDPOverTCPV1Address:
+		return 1
+	case UDPOverTCPV2Address:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// UDPOverTCPRequest is the request that starts version 2 streams. If Connect
+// is set, all the packets of the stream go to and come from Destination.
+type UDPOverTCPRequest struct {
+	Connect     bool
+	Destination string
+}
+
+// ReadUDPOverTCPRequest reads the request of a version 2 stream.
+func ReadUDPOverTCPRequest(r io.Reader) (UDPOverTCPRequest, error) {
+	var connect [1]byte
+	if _, err := io.ReadFull(r, connect[:]); err != nil {
+		return UDPOverTCPRequest{}, err
+	}
+	destination, err := socks.ReadAddr(r)
+	if err != nil {
+		return UDPOverTCPRequest{}, unexpectedEOF(err)
+	}
+	return UDPOverTCPRequest{Connect: connect[0] != 0, Destination: destination.String()}, nil
+}
+
+// AppendUDPOverTCPRequest appends the encoded `request` to `b`.
+func AppendUDPOverTCPRequest(b []byte, request UDPOverTCPRequest) ([]byte, error) {
+	connect := byte(0)
+	if request.Connect {
+		connect = 1
+	}
+	destination := socks.ParseAddr(request.Destination)
+	if destination == nil {
+		return b, fmt.Errorf("bad destination %q", request.Destination)
+	}
+	return append(append(b, connect), destination...), nil
+}
+
+// ReadUDPOverTCPPacket reads a packet into `buf`, and returns its address,
+// unless the stream is connected, and its payload.
+func ReadUDPOverTCPPacket(r io.Reader, buf []byte, connected bool) (string, []byte, error) {
+	var address string
+	if !connected {
+		var err error
+		if address, err = readUDPOverTCPAddr(r); err != nil {
+			return "", nil, err
+		}
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		if connected {
+			// The length starts the packet.
+			return "", nil, err
+		}
+		return "", nil, unexpectedEOF(err)
+	}
+	size := int(binary.BigEndian.Uint16(length[:]))
+	if size > len(buf) {
+		return "", nil, io.ErrShortBuffer
+	}
+	if _, err := io.ReadFull(r, buf[:size]); err != nil {
+		return "", nil, unexpectedEOF(err)
+	}
+	return address, buf[:size], nil
+}
+
+// AppendUDPOverTCPPacket appends a packet with `payload` to `b`. `address`
+// is omitted if it's empty, as it must be in connected streams.
+func AppendUDPOverTCPPacket(b []byte, address string, payload []byte) ([]byte, error) {
+	if len(payload) > 0xffff {
+		return b, fmt.Errorf("packet of %d bytes is too large", len(payload))
+	}
+	if address != "" {
+		var err error
+		if b, err = appendUDPOverTCPAddr(b, address); err != nil {
+			return b, err
+		}
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	return append(b, payload...), nil
+}
+
+func readUDPOverTCPAddr(r io.Reader) (string, error) {
+	var addrType [1]byte
+	if _, err := io.ReadFull(r, addrType[:]); err != nil {
+		return "", err
+	}
+	var host []byte
+	switch addrType[0] {
+	case uotAddrIPv4:
+		host = make([]byte, net.IPv4len)
+	case uotAddrIPv6:
+		host = make([]byte, net.IPv6len)
+	case uotAddrDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return "", unexpectedEOF(err)
+		}
+		host = make([]byte, length[0])
+	default:
+		return "", fmt.Errorf("unknown address type %d", addrType[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	hostText := string(host)
+	if addrType[0] != uotAddrDomain {
+		hostText = net.IP(host).String()
+	}
+	return net.JoinHostPort(hostText, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+func appendUDPOverTCPAddr(b []byte, address string) ([]byte, error) {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return b, err
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return b, fmt.Errorf("bad port %q", portText)
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 0xff {
+			return b, errors.New("domain name is too long")
+		}
+		b = append(append(b, uotAddrDomain, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, uotAddrIPv4), ip4...)
+	} else {
+		b = append(append(b, uotAddrIPv6), ip...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// unexpectedEOF reports an EOF in the middle of a packet as such.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
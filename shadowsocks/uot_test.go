@@ -0,0 +1,133 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+)
+
+func TestUDPOverTCPVersion(t *testing.T) {
+	for address, want := range map[string]int{
+		"sp.udp-over-tcp.arpa:0":       1,
+		"sp.v2.udp-over-tcp.arpa:9999": 2,
+		"example.com:443":              0,
+		"sp.udp-over-tcp.arpa":         0,
+	} {
+		if got := UDPOverTCPVersion(address); got != want {
+			t.Errorf("UDPOverTCPVersion(%q) = %d, want %d", address, got, want)
+		}
+	}
+}
+
+func TestUDPOverTCPPackets(t *testing.T) {
+	var stream []byte
+	addresses := []string{"192.0.2.1:53", "[2001:db8::1]:443", "example.com:8080", ""}
+	var err error
+	for i, address := range addresses {
+		if stream, err = AppendUDPOverTCPPacket(stream, address, bytes.Repeat([]byte{byte(i)}, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stream[0] != uotAddrIPv4 || !bytes.Equal(stream[1:7], []byte{192, 0, 2, 1, 0, 53}) {
+		t.Errorf("Bad IPv4 packet: %v", stream[:9])
+	}
+
+	r := bytes.NewReader(stream)
+	buf := make([]byte, 16)
+	for i, address := range addresses {
+		gotAddress, payload, err := ReadUDPOverTCPPacket(r, buf, address == "")
+		if err != nil {
+			t.Fatalf("Packet %d: %v", i, err)
+		}
+		if gotAddress != address || !bytes.Equal(payload, bytes.Repeat([]byte{byte(i)}, i)) {
+			t.Errorf("Packet %d: got %q %v", i, gotAddress, payload)
+		}
+	}
+	if _, _, err := ReadUDPOverTCPPacket(r, buf, true); err != io.EOF {
+		t.Errorf("Expected EOF after the last packet, got %v", err)
+	}
+
+	truncated := bytes.NewReader(stream[:len(stream)-1])
+	for err == nil {
+		_, _, err = ReadUDPOverTCPPacket(truncated, buf, false)
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected ErrUnexpectedEOF for a truncated packet, got %v", err)
+	}
+
+	large, _ := AppendUDPOverTCPPacket(nil, "192.0.2.1:53", make([]byte, 17))
+	if _, _, err := ReadUDPOverTCPPacket(bytes.NewReader(large), buf, false); err != io.ErrShortBuffer {
+		t.Errorf("Expected ErrShortBuffer, got %v", err)
+	}
+	if _, err := AppendUDPOverTCPPacket(nil, "192.0.2.1:53", make([]byte, 0x10000)); err == nil {
+		t.Error("Expected an error for a packet over 64 KiB")
+	}
+	if _, _, err := ReadUDPOverTCPPacket(bytes.NewReader([]byte{7}), buf, false); err == nil {
+		t.Error("Expected an error for an unknown address type")
+	}
+}
+
+func TestUDPOverTCPRequest(t *testing.T) {
+	request := UDPOverTCPRequest{Connect: true, Destination: "example.com:53"}
+	encoded, err := AppendUDPOverTCPRequest(nil, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded, append([]byte{1, socks.AtypDomainName, 11}, append([]byte("example.com"), 0, 53)...)) {
+		t.Errorf("Bad encoding: %v", encoded)
+	}
+	decoded, err := ReadUDPOverTCPRequest(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded != request {
+		t.Errorf("Got %+v, want %+v", decoded, request)
+	}
+}
+
+// The requests of sing-box clients, as sing's uot.EncodeRequest writes them:
+// the destination is a SOCKS address, unlike the addresses of packets.
+func TestUDPOverTCPRequestFromSingBox(t *testing.T) {
+	for _, c := range []struct {
+		encoded []byte
+		request UDPOverTCPRequest
+	}{
+		{[]byte{1, 1, 192, 0, 2, 1, 0, 53}, UDPOverTCPRequest{Connect: true, Destination: "192.0.2.1:53"}},
+		{[]byte{1, 4, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0xbb}, UDPOverTCPRequest{Connect: true, Destination: "[2001:db8::1]:443"}},
+		{append([]byte{0, 3, 11}, append([]byte("example.com"), 0x1f, 0x90)...), UDPOverTCPRequest{Destination: "example.com:8080"}},
+	} {
+		decoded, err := ReadUDPOverTCPRequest(bytes.NewReader(c.encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded != c.request {
+			t.Errorf("Got %+v, want %+v", decoded, c.request)
+		}
+		encoded, err := AppendUDPOverTCPRequest(nil, c.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, c.encoded) {
+			t.Errorf("Bad encoding of %+v: %v", c.request, encoded)
+		}
+	}
+	if _, err := ReadUDPOverTCPRequest(bytes.NewReader([]byte{1, 1, 192, 0})); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected ErrUnexpectedEOF for a truncated request, got %v", err)
+	}
+}
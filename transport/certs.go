@@ -0,0 +1,190 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertStore holds the TLS certificates of the server, chosen by SNI. They
+// come from a certificate and key file, or from a directory of
+// <name>.crt and <name>.key pairs, and are reloaded when the files change.
+type CertStore struct {
+	certFile, keyFile, dir string
+
+	mu     sync.RWMutex // Protects .byName and .files
+	byName map[string]*tls.Certificate
+	// files fingerprints the files the certificates were loaded from.
+	files string
+}
+
+// NewCertStore loads the certificates of `certFile` and `keyFile`, or of
+// `dir` if it's not empty.
+func NewCertStore(certFile, keyFile, dir string) (*CertStore, error) {
+	s := &CertStore{certFile: certFile, keyFile: keyFile, dir: dir}
+	files, err := s.fingerprint()
+	if err != nil {
+		return nil, err
+	}
+	byName, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.byName, s.files = byName, files
+	return s, nil
+}
+
+// paths lists the certificate and key files of the store.
+func (s *CertStore) paths() ([][2]string, error) {
+	if s.dir == "" {
+		return [][2]string{{s.certFile, s.keyFile}}, nil
+	}
+	certs, err := filepath.Glob(filepath.Join(s.dir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(certs)
+	var paths [][2]string
+	for _, cert := range certs {
+		paths = append(paths, [2]string{cert, strings.TrimSuffix(cert, ".crt") + ".key"})
+	}
+	return paths, nil
+}
+
+// fingerprint summarizes the names, sizes and times of the files.
+func (s *CertStore) fingerprint() (string, error) {
+	paths, err := s.paths()
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, pair := range paths {
+		for _, path := range pair {
+			info, err := os.Stat(path)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&b, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return b.String(), nil
+}
+
+func (s *CertStore) load() (map[string]*tls.Certificate, error) {
+	paths, err := s.paths()
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*tls.Certificate)
+	for _, pair := range paths {
+		cert, err := tls.LoadX509KeyPair(pair[0], pair[1])
+		if err != nil {
+			return nil, err
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", pair[0], err)
+		}
+		cert.Leaf = leaf
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			byName[strings.ToLower(name)] = &cert
+		}
+	}
+	if len(byName) == 0 {
+		return nil, errors.New("no certificates with server names")
+	}
+	return byName, nil
+}
+
+// Reload loads the certificates again if the files have changed. It
+// reports whether they were reloaded. On error the old certificates stay.
+func (s *CertStore) Reload() (bool, error) {
+	files, err := s.fingerprint()
+	if err != nil {
+		return false, err
+	}
+	s.mu.RLock()
+	unchanged := files == s.files
+	s.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	byName, err := s.load()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Failures are only reported once per change of the files.
+	s.files = files
+	if err != nil {
+		return false, err
+	}
+	s.byName = byName
+	return true, nil
+}
+
+// Watch reloads the certificates every `interval` until `stop` is closed.
+func (s *CertStore) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if reloaded, err := s.Reload(); err != nil {
+			logger.Errorf("Failed to reload TLS certificates: %v", err)
+		} else if reloaded {
+			logger.Infof("Reloaded TLS certificates")
+		}
+	}
+}
+
+// lookup returns the certificate for `serverName`, or nil.
+func (s *CertStore) lookup(serverName string) *tls.Certificate {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if name == "" {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if cert, ok := s.byName[name]; ok {
+		return cert
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		return s.byName["*"+name[i:]]
+	}
+	return nil
+}
+
+// GetCertificate is the tls.Config callback that picks the certificate.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := s.lookup(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	onet "myoss/net"
+)
+
+// ObfsPluginName is the plugin name that selects the built-in simple-obfs
+// server instead of an external plugin.
+const ObfsPluginName = "obfs-server"
+
+// maxObfsHeaderSize bounds the HTTP request header of a client.
+const maxObfsHeaderSize = 8 << 10
+
+var errNotObfs = errors.New("not a simple-obfs handshake")
+
+// NewObfsServer returns the server side of simple-obfs for the SIP003 plugin
+// options `opts`: "obfs=http" or "obfs=tls", and optionally "obfs-host=<host>"
+// to only accept clients that use that host.
+func NewObfsServer(opts string) (onet.StreamTransport, error) {
+	options, err := ParsePluginOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	host := options["obfs-host"]
+	delete(options, "obfs-host")
+	mode := options["obfs"]
+	delete(options, "obfs")
+	for name := range options {
+		return nil, fmt.Errorf("unknown obfs option %q", name)
+	}
+	switch mode {
+	case "http":
+		return func(conn onet.DuplexConn) (onet.DuplexConn, error) {
+			return acceptObfsHTTP(conn, host)
+		}, nil
+	case "tls":
+		return func(conn onet.DuplexConn) (onet.DuplexConn, error) {
+			return acceptObfsTLS(conn, host)
+		}, nil
+	default:
+		return nil, fmt.Errorf("obfs must be http or tls, got %q", mode)
+	}
+}
+
+// obfsHTTPConn is a simple-obfs HTTP connection. After the upgrade request
+// and response, the stream is sent as is.
+type obfsHTTPConn struct {
+	onet.DuplexConn
+	r *bufio.Reader
+	// response is sent with the first write.
+	response []byte
+}
+
+func acceptObfsHTTP(conn onet.DuplexConn, host string) (onet.DuplexConn, error) {
+	r := bufio.NewReaderSize(conn, maxObfsHeaderSize)
+	header, err := readHTTPHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(header)))
+	if err != nil {
+		return nil, errNotObfs
+	}
+	if req.Method != http.MethodGet || !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return nil, errNotObfs
+	}
+	if host != "" && !strings.EqualFold(hostOnly(req.Host), host) {
+		return nil, fmt.Errorf("unexpected obfs host %q", req.Host)
+	}
+	return &obfsHTTPConn{DuplexConn: conn, r: r, response: httpUpgradeResponse(req.Header.Get("Sec-WebSocket-Key"))}, nil
+}
+
+// readHTTPHeader returns the request header up to and including the empty
+// line, leaving the body in `r`.
+func readHTTPHeader(r *bufio.Reader) ([]byte, error) {
+	var header []byte
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull || len(header)+len(line) > maxObfsHeaderSize {
+			return nil, errNotObfs
+		} else if err != nil {
+			return nil, err
+		}
+		header = append(header, line...)
+		if len(line) <= 2 && strings.TrimRight(string(line), "\r\n") == "" {
+			return header, nil
+		}
+	}
+}
+
+func hostOnly(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
+
+// httpUpgradeResponse mimics the response of simple-obfs, which pretends to
+// be an nginx WebSocket endpoint.
+func httpUpgradeResponse(key string) []byte {
+	if key == "" {
+		var b [16]byte
+		rand.Read(b[:])
+		key = base64.StdEncoding.EncodeToString(b[:])
+	}
+	h := sha1.New()
+	io.WriteString(h, key+"258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	return []byte(fmt.Sprintf("HTTP/1.1 101 Switching Protocols\r\n"+
+		"Server: nginx/1.18.0\r\n"+
+		"Date: %s\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n"+
+		"\r\n", time.Now().UTC().Format(http.TimeFormat), accept))
+}
+
+func (c *obfsHTTPConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *obfsHTTPConn) Write(b []byte) (int, error) {
+	if c.response == nil {
+		return c.DuplexConn.Write(b)
+	}
+	n, err := c.DuplexConn.Write(append(c.response, b...))
+	n -= len(c.response)
+	if n < 0 {
+		n = 0
+	}
+	if err == nil {
+		c.response = nil
+	}
+	return n, err
+}
+
+func (c *obfsHTTPConn) CloseWrite() error {
+	if c.response != nil {
+		// Complete the upgrade before closing, like simple-obfs does on EOF.
+		if _, err := c.Write(nil); err != nil {
+			return err
+		}
+	}
+	return c.DuplexConn.CloseWrite()
+}
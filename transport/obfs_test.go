@@ -0,0 +1,254 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	onet "myoss/net"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePluginOptions(t *testing.T) {
+	options, err := ParsePluginOptions(`obfs=http;obfs-host=www.example.com;fast-open;path=/a\;b\=c`)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"obfs":      "http",
+		"obfs-host": "www.example.com",
+		"fast-open": "",
+		"path":      "/a;b=c",
+	}, options)
+
+	options, err = ParsePluginOptions("")
+	require.NoError(t, err)
+	require.Empty(t, options)
+
+	for _, bad := range []string{"=http", "obfs=http;obfs=tls", `obfs\`} {
+		_, err = ParsePluginOptions(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestNewObfsServer(t *testing.T) {
+	for _, opts := range []string{"obfs=http", "obfs=tls;obfs-host=www.example.com"} {
+		_, err := NewObfsServer(opts)
+		require.NoError(t, err, opts)
+	}
+	for _, opts := range []string{"", "obfs=ws", "obfs=http;mux=4"} {
+		_, err := NewObfsServer(opts)
+		require.Error(t, err, opts)
+	}
+}
+
+// obfsPair returns a client connection, and the result of running the
+// server side of `transport` on the other end.
+func obfsPair(t *testing.T, transport onet.StreamTransport) (*net.TCPConn, chan onet.DuplexConn, chan error) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	conns, errs := make(chan onet.DuplexConn, 1), make(chan error, 1)
+	go func() {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			errs <- err
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		serverConn, err := transport(conn)
+		if err != nil {
+			errs <- err
+			return
+		}
+		conns <- serverConn
+	}()
+	client, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return client, conns, errs
+}
+
+func obfsHTTPRequest(host string, payload []byte) []byte {
+	return append([]byte(fmt.Sprintf("GET / HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"User-Agent: curl/7.64.0\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Content-Length: %d\r\n"+
+		"\r\n", host, len(payload))), payload...)
+}
+
+func TestObfsHTTP(t *testing.T) {
+	transport, err := NewObfsServer("obfs=http;obfs-host=www.example.com")
+	require.NoError(t, err)
+	client, conns, errs := obfsPair(t, transport)
+	_, err = client.Write(obfsHTTPRequest("www.example.com", []byte("Hello")))
+	require.NoError(t, err)
+	_, err = client.Write([]byte(" world"))
+	require.NoError(t, err)
+
+	var server onet.DuplexConn
+	select {
+	case server = <-conns:
+	case err := <-errs:
+		require.NoError(t, err)
+	}
+	got := make([]byte, len("Hello world"))
+	_, err = io.ReadFull(server, got)
+	require.NoError(t, err)
+	require.Equal(t, "Hello world", string(got))
+
+	_, err = server.Write([]byte("Reply"))
+	require.NoError(t, err)
+	server.CloseWrite()
+	r := bufio.NewReader(client)
+	resp, err := http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	require.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	reply, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "Reply", string(reply))
+}
+
+func TestObfsHTTPRejects(t *testing.T) {
+	transport, err := NewObfsServer("obfs=http;obfs-host=www.example.com")
+	require.NoError(t, err)
+	for _, request := range [][]byte{
+		obfsHTTPRequest("www.example.org", nil),
+		[]byte("POST / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"),
+		[]byte(strings.Repeat("\x16", 100) + "\n\n"),
+	} {
+		client, _, errs := obfsPair(t, transport)
+		_, err = client.Write(request)
+		require.NoError(t, err)
+		require.Error(t, <-errs)
+	}
+}
+
+// obfsTLSClientHello builds a ClientHello like the simple-obfs client, with
+// `payload` in the session ticket.
+func obfsTLSClientHello(serverName string, payload []byte) []byte {
+	var body []byte
+	body = append(body, 3, 3)
+	body = append(body, make([]byte, 32)...) // Random.
+	body = append(body, 32)
+	body = append(body, []byte(strings.Repeat("s", 32))...) // Session ID.
+	body = append(body, 0, 56)
+	body = append(body, make([]byte, 56)...) // Cipher suites.
+	body = append(body, 1, 0)
+	var ext []byte
+	ext = binary.BigEndian.AppendUint16(ext, extSessionTicket)
+	ext = binary.BigEndian.AppendUint16(ext, uint16(len(payload)))
+	ext = append(ext, payload...)
+	ext = binary.BigEndian.AppendUint16(ext, extServerName)
+	ext = binary.BigEndian.AppendUint16(ext, uint16(len(serverName)+5))
+	ext = binary.BigEndian.AppendUint16(ext, uint16(len(serverName)+3))
+	ext = append(ext, 0)
+	ext = binary.BigEndian.AppendUint16(ext, uint16(len(serverName)))
+	ext = append(ext, serverName...)
+	ext = append(ext, 0x00, 0x17, 0, 0) // extended_master_secret
+	body = binary.BigEndian.AppendUint16(body, uint16(len(ext)))
+	body = append(body, ext...)
+
+	hello := []byte{recordHandshake, 3, 1}
+	hello = binary.BigEndian.AppendUint16(hello, uint16(len(body)+4))
+	hello = append(hello, 1, 0)
+	hello = binary.BigEndian.AppendUint16(hello, uint16(len(body)))
+	return append(hello, body...)
+}
+
+func tlsRecord(recordType byte, payload []byte) []byte {
+	record := []byte{recordType, 3, 3}
+	record = binary.BigEndian.AppendUint16(record, uint16(len(payload)))
+	return append(record, payload...)
+}
+
+func TestObfsTLS(t *testing.T) {
+	transport, err := NewObfsServer("obfs=tls;obfs-host=www.example.com")
+	require.NoError(t, err)
+	client, conns, errs := obfsPair(t, transport)
+	_, err = client.Write(obfsTLSClientHello("www.example.com", []byte("Hello")))
+	require.NoError(t, err)
+	// The client's fake ChangeCipherSpec and Finished come before its data.
+	_, err = client.Write(append(append(tlsRecord(recordChangeCipherSpec, []byte{1}),
+		tlsRecord(recordHandshake, make([]byte, 32))...),
+		tlsRecord(recordApplicationData, []byte(" world"))...))
+	require.NoError(t, err)
+
+	var server onet.DuplexConn
+	select {
+	case server = <-conns:
+	case err := <-errs:
+		require.NoError(t, err)
+	}
+	got := make([]byte, len("Hello world"))
+	_, err = io.ReadFull(server, got)
+	require.NoError(t, err)
+	require.Equal(t, "Hello world", string(got))
+
+	reply := []byte(strings.Repeat("r", maxTLSRecordSize+100))
+	go func() {
+		server.Write(reply)
+		server.CloseWrite()
+	}()
+	r := bufio.NewReader(client)
+	hello := make([]byte, 96)
+	_, err = io.ReadFull(r, hello)
+	require.NoError(t, err)
+	require.Equal(t, []byte{recordHandshake, 3, 1, 0, 91, 2}, hello[:6])
+	require.Equal(t, strings.Repeat("s", 32), string(hello[44:76]), "session ID")
+	var received []byte
+	for {
+		var header [tlsRecordHeaderSize]byte
+		if _, err := io.ReadFull(r, header[:]); err == io.EOF {
+			break
+		} else {
+			require.NoError(t, err)
+		}
+		payload := make([]byte, binary.BigEndian.Uint16(header[3:]))
+		_, err = io.ReadFull(r, payload)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(payload), maxTLSRecordSize)
+		if header[0] == recordApplicationData {
+			received = append(received, payload...)
+		}
+	}
+	require.Equal(t, reply, received)
+}
+
+func TestObfsTLSRejects(t *testing.T) {
+	transport, err := NewObfsServer("obfs=tls;obfs-host=www.example.com")
+	require.NoError(t, err)
+	for _, request := range [][]byte{
+		obfsTLSClientHello("www.example.org", []byte("Hello")),
+		obfsTLSClientHello("www.example.com", nil),
+		obfsHTTPRequest("www.example.com", nil),
+	} {
+		client, _, errs := obfsPair(t, transport)
+		_, err = client.Write(request)
+		require.NoError(t, err)
+		client.CloseWrite()
+		require.Error(t, <-errs)
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	onet "myoss/net"
+)
+
+// TLS record types used by simple-obfs.
+const (
+	recordChangeCipherSpec = 0x14
+	recordAlert            = 0x15
+	recordHandshake        = 0x16
+	recordApplicationData  = 0x17
+)
+
+const (
+	tlsRecordHeaderSize = 5
+	// maxTLSRecordSize is the largest payload of a TLS record.
+	maxTLSRecordSize = 16 << 10
+	// clientHelloFixedSize is the size of the record and handshake headers,
+	// version, random and session ID of a ClientHello.
+	clientHelloFixedSize = tlsRecordHeaderSize + 4 + 2 + 32
+	extServerName        = 0x0000
+	extSessionTicket     = 0x0023
+)
+
+// obfsTLSConn is a simple-obfs TLS connection. The client sends its first
+// data in the session ticket of a fake ClientHello, and the rest in
+// application data records. The server answers with a fake ServerHello and
+// also sends application data records.
+type obfsTLSConn struct {
+	onet.DuplexConn
+	// pending is the data of the ClientHello that hasn't been read yet.
+	pending []byte
+	// left is the unread size of the current client record.
+	left int
+	// hello is the server's handshake, sent with the first write.
+	hello []byte
+}
+
+func acceptObfsTLS(conn onet.DuplexConn, host string) (onet.DuplexConn, error) {
+	var header [tlsRecordHeaderSize]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != recordHandshake || header[1] != 3 {
+		return nil, errNotObfs
+	}
+	record := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(conn, record); err != nil {
+		return nil, err
+	}
+	hello, err := parseClientHello(record)
+	if err != nil {
+		return nil, err
+	}
+	if len(hello.ticket) == 0 {
+		return nil, errNotObfs
+	}
+	if host != "" && !strings.EqualFold(hello.serverName, host) {
+		return nil, fmt.Errorf("unexpected obfs server name %q", hello.serverName)
+	}
+	return &obfsTLSConn{DuplexConn: conn, pending: hello.ticket, hello: serverHello(hello.sessionID)}, nil
+}
+
+// clientHello is what the server needs from a ClientHello.
+type clientHello struct {
+	sessionID  []byte
+	serverName string
+	ticket     []byte
+}
+
+// parseClientHello parses the ClientHello handshake message in `record`.
+func parseClientHello(record []byte) (*clientHello, error) {
+	var hello clientHello
+	p := tlsParser{b: record}
+	if p.u8() != 1 { // client_hello
+		return nil, errNotObfs
+	}
+	p.bytes(3 + 2 + 32) // Length, version and random.
+	hello.sessionID = p.bytes(int(p.u8()))
+	p.bytes(int(p.u16())) // Cipher suites.
+	p.bytes(int(p.u8()))  // Compression methods.
+	extensions := tlsParser{b: p.bytes(int(p.u16()))}
+	if p.err {
+		return nil, errNotObfs
+	}
+	for len(extensions.b) > 0 && !extensions.err {
+		extType := extensions.u16()
+		data := extensions.bytes(int(extensions.u16()))
+		switch extType {
+		case extSessionTicket:
+			hello.ticket = data
+		case extServerName:
+			names := tlsParser{b: data}
+			names.u16()
+			if names.u8() == 0 { // host_name
+				hello.serverName = string(names.bytes(int(names.u16())))
+			}
+		}
+	}
+	if extensions.err {
+		return nil, errNotObfs
+	}
+	return &hello, nil
+}
+
+// tlsParser reads big-endian fields, and sets err instead of reading past
+// the end.
+type tlsParser struct {
+	b   []byte
+	err bool
+}
+
+func (p *tlsParser) bytes(n int) []byte {
+	if n > len(p.b) {
+		p.err = true
+		p.b = nil
+		return nil
+	}
+	v := p.b[:n]
+	p.b = p.b[n:]
+	return v
+}
+
+func (p *tlsParser) u8() byte {
+	if b := p.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (p *tlsParser) u16() uint16 {
+	if b := p.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// serverHello builds the ServerHello, ChangeCipherSpec and encrypted Finished
+// records that simple-obfs answers with.
+func serverHello(sessionID []byte) []byte {
+	hello := []byte{
+		recordHandshake, 3, 1, 0, 91,
+		2, 0, 0, 87, // server_hello
+		3, 3,
+	}
+	var random [32]byte
+	rand.Read(random[:])
+	binary.BigEndian.PutUint32(random[:4], uint32(time.Now().Unix()))
+	hello = append(hello, random[:]...)
+	var id [32]byte
+	copy(id[:], sessionID)
+	hello = append(hello, 32)
+	hello = append(hello, id[:]...)
+	hello = append(hello,
+		0xcc, 0xa8, // TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256
+		0,     // No compression.
+		0, 15, // Extensions.
+		0xff, 0x01, 0, 1, 0, // renegotiation_info
+		0x00, 0x17, 0, 0, // extended_master_secret
+		0x00, 0x0b, 0, 2, 1, 0, // ec_point_formats
+	)
+	hello = append(hello, recordChangeCipherSpec, 3, 3, 0, 1, 1)
+	var finished [40]byte
+	rand.Read(finished[:])
+	hello = append(hello, recordHandshake, 3, 3, 0, byte(len(finished)))
+	return append(hello, finished[:]...)
+}
+
+func (c *obfsTLSConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	for c.left == 0 {
+		var header [tlsRecordHeaderSize]byte
+		if _, err := io.ReadFull(c.DuplexConn, header[:]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		size := int(binary.BigEndian.Uint16(header[3:]))
+		switch header[0] {
+		case recordApplicationData:
+			c.left = size
+		case recordChangeCipherSpec, recordHandshake:
+			// The client's fake ChangeCipherSpec and Finished.
+			if _, err := io.CopyN(io.Discard, c.DuplexConn, int64(size)); err != nil {
+				return 0, io.ErrUnexpectedEOF
+			}
+		default:
+			return 0, fmt.Errorf("unexpected TLS record type %d", header[0])
+		}
+	}
+	if len(b) > c.left {
+		b = b[:c.left]
+	}
+	n, err := c.DuplexConn.Read(b)
+	c.left -= n
+	if err == io.EOF && c.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (c *obfsTLSConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 || c.hello != nil {
+		chunk := b
+		if len(chunk) > maxTLSRecordSize {
+			chunk = chunk[:maxTLSRecordSize]
+		}
+		record := make([]byte, 0, len(c.hello)+tlsRecordHeaderSize+len(chunk))
+		record = append(record, c.hello...)
+		if len(chunk) > 0 {
+			record = append(record, recordApplicationData, 3, 3, byte(len(chunk)>>8), byte(len(chunk)))
+			record = append(record, chunk...)
+		}
+		if _, err := c.DuplexConn.Write(record); err != nil {
+			return written, err
+		}
+		c.hello = nil
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *obfsTLSConn) CloseWrite() error {
+	if c.hello != nil {
+		if _, err := c.Write(nil); err != nil {
+			return err
+		}
+	}
+	return c.DuplexConn.CloseWrite()
+}
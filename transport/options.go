@@ -0,0 +1,79 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package transport implements the layers that can wrap the Shadowsocks TCP
+// stream of a port: SIP003 plugins and the built-in obfuscations.
+package transport
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParsePluginOptions parses SIP003 plugin options, "key=value" pairs
+// separated by ';'. A backslash escapes the next character. A key without a
+// value maps to "".
+func ParsePluginOptions(opts string) (map[string]string, error) {
+	options := make(map[string]string)
+	var key, token strings.Builder
+	inValue := false
+	flush := func() error {
+		k := key.String()
+		if !inValue {
+			k = token.String()
+		}
+		if k == "" {
+			if inValue || token.Len() > 0 {
+				return fmt.Errorf("empty plugin option name")
+			}
+			return nil
+		}
+		if _, ok := options[k]; ok {
+			return fmt.Errorf("duplicate plugin option %q", k)
+		}
+		if inValue {
+			options[k] = token.String()
+		} else {
+			options[k] = ""
+		}
+		key.Reset()
+		token.Reset()
+		inValue = false
+		return nil
+	}
+	for i := 0; i < len(opts); i++ {
+		switch c := opts[i]; {
+		case c == '\\':
+			i++
+			if i == len(opts) {
+				return nil, fmt.Errorf("plugin options end with an escape")
+			}
+			token.WriteByte(opts[i])
+		case c == '=' && !inValue:
+			key.WriteString(token.String())
+			token.Reset()
+			inValue = true
+		case c == ';':
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		default:
+			token.WriteByte(c)
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
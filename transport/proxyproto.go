@@ -0,0 +1,368 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	onet "myoss/net"
+)
+
+// ProxyProtocolOptions configures the PROXY protocol of the listeners of a
+// port, which load balancers use to pass on the address of the client.
+type ProxyProtocolOptions struct {
+	// Trusted are the networks of the load balancers. Their connections must
+	// start with a v1 or v2 PROXY header, and their UDP packets may start with
+	// a v2 header. Other clients are served as they are.
+	Trusted []*net.IPNet
+	// HeaderTimeout bounds the time to receive the header of a connection.
+	HeaderTimeout time.Duration
+	// SessionTimeout is how long the packets to a UDP client still go
+	// through the balancer it came from after its last packet.
+	SessionTimeout time.Duration
+}
+
+// trusts reports whether `addr` is the address of a load balancer.
+func (o ProxyProtocolOptions) trusts(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return false
+	}
+	for _, network := range o.Trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyV2Signature starts every v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV2HeaderSize = 16
+	// proxyV1MaxLength is the longest v1 header, with its CRLF.
+	proxyV1MaxLength = 107
+	// proxyHeaderBufferSize bounds the v2 headers of connections, with
+	// their TLVs.
+	proxyHeaderBufferSize = 4096
+)
+
+var errNoProxyHeader = errors.New("no PROXY header")
+
+// parseProxyV2 parses the v2 header at the start of `b`. It returns the
+// address of the client, or a nil IP if the header doesn't carry one, as in
+// the health checks of balancers, and the length of the header.
+func parseProxyV2(b []byte) (net.IP, int, int, error) {
+	if len(b) < proxyV2HeaderSize || !bytes.HasPrefix(b, proxyV2Signature) {
+		return nil, 0, 0, errNoProxyHeader
+	}
+	if b[12]>>4 != 2 {
+		return nil, 0, 0, fmt.Errorf("unsupported PROXY version %d", b[12]>>4)
+	}
+	length := proxyV2HeaderSize + int(binary.BigEndian.Uint16(b[14:16]))
+	if len(b) < length {
+		return nil, 0, 0, io.ErrUnexpectedEOF
+	}
+	switch command := b[12] & 0xf; command {
+	case 0:
+		// LOCAL: the balancer's own connection.
+		return nil, 0, length, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, 0, 0, fmt.Errorf("unknown PROXY command %d", command)
+	}
+	addrs := b[proxyV2HeaderSize:length]
+	switch b[13] >> 4 {
+	case 1:
+		if len(addrs) < 12 {
+			return nil, 0, 0, errors.New("short IPv4 PROXY addresses")
+		}
+		return net.IP(append([]byte(nil), addrs[0:4]...)), int(binary.BigEndian.Uint16(addrs[8:10])), length, nil
+	case 2:
+		if len(addrs) < 36 {
+			return nil, 0, 0, errors.New("short IPv6 PROXY addresses")
+		}
+		return net.IP(append([]byte(nil), addrs[0:16]...)), int(binary.BigEndian.Uint16(addrs[32:34])), length, nil
+	default:
+		// Unspecified or Unix addresses.
+		return nil, 0, length, nil
+	}
+}
+
+// parseProxyV1 parses the v1 header `line`, with its CRLF, like the v2
+// headers of parseProxyV2.
+func parseProxyV1(line []byte) (net.IP, int, error) {
+	if len(line) > proxyV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, 0, errors.New("bad PROXY v1 header")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, 0, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, 0, fmt.Errorf("bad PROXY v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, 0, fmt.Errorf("bad PROXY v1 source %v:%v", fields[2], fields[4])
+	}
+	return ip, int(port), nil
+}
+
+// readProxyHeader reads the v1 or v2 header at the start of `r`, like
+// parseProxyV2.
+func readProxyHeader(r *bufio.Reader) (net.IP, int, error) {
+	// The shortest v1 header, "PROXY UNKNOWN\r\n", is longer than this.
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, 0, err
+	}
+	if bytes.Equal(start, proxyV2Signature) {
+		fixed, err := r.Peek(proxyV2HeaderSize)
+		if err != nil {
+			return nil, 0, err
+		}
+		header, err := r.Peek(proxyV2HeaderSize + int(binary.BigEndian.Uint16(fixed[14:16])))
+		if err != nil {
+			return nil, 0, err
+		}
+		ip, port, length, err := parseProxyV2(header)
+		if err != nil {
+			return nil, 0, err
+		}
+		r.Discard(length)
+		return ip, port, nil
+	}
+	if !bytes.HasPrefix(start, []byte("PROXY ")) {
+		return nil, 0, errNoProxyHeader
+	}
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseProxyV1(line)
+}
+
+// proxyListener recovers the client addresses of the connections that
+// balancers accept for another listener.
+type proxyListener struct {
+	inner net.Listener
+	opts  ProxyProtocolOptions
+	conns chan net.Conn
+	// closed is closed by Close.
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewProxyProtocolListener returns a listener that accepts the connections
+// of `inner`. The connections from trusted balancers start with a PROXY
+// header, which is removed, and have the address of their client as their
+// RemoteAddr. Connections that don't send a valid header are closed. The
+// connections are onet.DuplexConns.
+func NewProxyProtocolListener(inner net.Listener, opts ProxyProtocolOptions) net.Listener {
+	if opts.HeaderTimeout <= 0 {
+		opts.HeaderTimeout = 10 * time.Second
+	}
+	l := &proxyListener{
+		inner:  inner,
+		opts:   opts,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *proxyListener) acceptLoop() {
+	for {
+		conn, err := l.inner.Accept()
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				l.Close()
+				return
+			}
+			logger.Errorf("Accept failed: %v", err)
+			continue
+		}
+		clientConn, ok := conn.(onet.DuplexConn)
+		if !ok {
+			conn.Close()
+			continue
+		}
+		go l.readHeader(clientConn)
+	}
+}
+
+// readHeader reads the PROXY header of `conn`, if it comes from a balancer.
+func (l *proxyListener) readHeader(conn onet.DuplexConn) {
+	var clientConn net.Conn = conn
+	if l.opts.trusts(conn.RemoteAddr()) {
+		conn.SetReadDeadline(time.Now().Add(l.opts.HeaderTimeout))
+		r := bufio.NewReaderSize(conn, proxyHeaderBufferSize)
+		ip, port, err := readProxyHeader(r)
+		if err != nil {
+			logger.Debugf("PROXY header from %v: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		proxied := &proxyConn{DuplexConn: conn, remote: conn.RemoteAddr()}
+		if ip != nil {
+			proxied.remote = &net.TCPAddr{IP: ip, Port: port}
+		}
+		if buffered, _ := r.Peek(r.Buffered()); len(buffered) > 0 {
+			proxied.DuplexConn = onet.WrapConn(conn, io.MultiReader(bytes.NewReader(buffered), conn), conn)
+		}
+		clientConn = proxied
+	}
+	select {
+	case l.conns <- clientConn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyListener) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.inner.Close()
+	})
+	return err
+}
+
+func (l *proxyListener) Addr() net.Addr {
+	return l.inner.Addr()
+}
+
+// proxyConn is a connection from a balancer, with the address of its client.
+type proxyConn struct {
+	onet.DuplexConn
+	remote net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// proxyPacketConn recovers the client addresses of the packets that
+// balancers relay to another PacketConn, and sends the packets to those
+// clients through their balancers.
+type proxyPacketConn struct {
+	net.PacketConn
+	opts ProxyProtocolOptions
+	mu   sync.Mutex
+	// balancers maps the clients that came through a balancer to its
+	// address.
+	balancers map[string]proxyRoute
+	lastPrune time.Time
+}
+
+type proxyRoute struct {
+	balancer net.Addr
+	lastSeen time.Time
+}
+
+// NewProxyProtocolPacketConn returns a PacketConn that reads the packets of
+// `inner`. The packets from trusted balancers that start with a v2 PROXY
+// header have it removed, and come from the address of their client.
+// Packets with a bad header are dropped.
+func NewProxyProtocolPacketConn(inner net.PacketConn, opts ProxyProtocolOptions) net.PacketConn {
+	if opts.SessionTimeout <= 0 {
+		opts.SessionTimeout = 5 * time.Minute
+	}
+	return &proxyPacketConn{PacketConn: inner, opts: opts, balancers: make(map[string]proxyRoute), lastPrune: time.Now()}
+}
+
+func (c *proxyPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || !bytes.HasPrefix(p[:n], proxyV2Signature) || !c.opts.trusts(addr) {
+			return n, addr, err
+		}
+		ip, port, length, err := parseProxyV2(p[:n])
+		if err != nil {
+			logger.Debugf("PROXY header from %v: %v", addr, err)
+			continue
+		}
+		n = copy(p, p[length:n])
+		if ip == nil {
+			return n, addr, nil
+		}
+		client := &net.UDPAddr{IP: ip, Port: port}
+		c.remember(client, addr)
+		return n, client, nil
+	}
+}
+
+// remember records that `client` came through `balancer`, and forgets the
+// clients that haven't sent a packet for the session timeout.
+func (c *proxyPacketConn) remember(client, balancer net.Addr) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.balancers[client.String()] = proxyRoute{balancer: balancer, lastSeen: now}
+	if now.Sub(c.lastPrune) < c.opts.SessionTimeout {
+		return
+	}
+	for key, route := range c.balancers {
+		if now.Sub(route.lastSeen) > c.opts.SessionTimeout {
+			delete(c.balancers, key)
+		}
+	}
+	c.lastPrune = now
+}
+
+func (c *proxyPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	route, ok := c.balancers[addr.String()]
+	c.mu.Unlock()
+	if ok {
+		addr = route.balancer
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
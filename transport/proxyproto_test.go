@@ -0,0 +1,205 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// proxyV2Header returns a v2 header with command PROXY, from `src` to
+// 192.0.2.100:443, or with command LOCAL if `src` is nil.
+func proxyV2Header(src *net.UDPAddr, stream bool) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	if src == nil {
+		return append(header, 0x20, 0, 0, 0)
+	}
+	var addrs []byte
+	family := byte(0x10)
+	dst := net.ParseIP("192.0.2.100")
+	if ip4 := src.IP.To4(); ip4 != nil {
+		addrs = append(append(addrs, ip4...), dst.To4()...)
+	} else {
+		family = 0x20
+		addrs = append(append(addrs, src.IP...), dst.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, 443)
+	// A TLV, which is skipped.
+	addrs = append(addrs, 0x04, 0, 1, 0)
+	if stream {
+		family |= 1
+	} else {
+		family |= 2
+	}
+	header = append(header, 0x21, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		addr   string
+	}{
+		{"PROXY TCP4 192.0.2.1 192.0.2.100 5000 443\r\n", "192.0.2.1:5000"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::100 5000 443\r\n", "[2001:db8::1]:5000"},
+		{"PROXY UNKNOWN\r\n", ""},
+		{"PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n", ""},
+		{string(proxyV2Header(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}, true)), "192.0.2.1:5000"},
+		{string(proxyV2Header(&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}, true)), "[2001:db8::1]:5000"},
+		{string(proxyV2Header(nil, true)), ""},
+	} {
+		r := bufio.NewReader(bytes.NewReader([]byte(test.header + "Hello")))
+		ip, port, err := readProxyHeader(r)
+		require.NoError(t, err, test.header)
+		if test.addr == "" {
+			require.Nil(t, ip, test.header)
+		} else {
+			require.Equal(t, test.addr, (&net.TCPAddr{IP: ip, Port: port}).String())
+		}
+		rest, _ := io.ReadAll(r)
+		require.Equal(t, "Hello", string(rest), test.header)
+	}
+
+	badVersion := proxyV2Header(nil, true)
+	badVersion[12] = 0x10
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.100 5000\r\n",
+		"PROXY TCP4 2001:db8::1 192.0.2.100 5000 443\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.100 70000 443\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.100 5000 443\n",
+		string(badVersion),
+		string(proxyV2Header(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}, true)[:20]),
+	} {
+		_, _, err := readProxyHeader(bufio.NewReader(bytes.NewReader([]byte(header))))
+		require.Error(t, err, header)
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	l := NewProxyProtocolListener(inner, ProxyProtocolOptions{Trusted: []*net.IPNet{loopback}, HeaderTimeout: time.Second})
+	defer l.Close()
+
+	send := func(data string) net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		_, err = conn.Write([]byte(data))
+		require.NoError(t, err)
+		return conn
+	}
+
+	// A connection without a header is closed, without reaching Accept.
+	conn := send("GET / HTTP/1.1\r\n\r\n")
+	_, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	conn.Close()
+
+	conn = send("PROXY TCP4 192.0.2.1 192.0.2.100 5000 443\r\nHello")
+	defer conn.Close()
+	accepted, err := l.Accept()
+	require.NoError(t, err)
+	defer accepted.Close()
+	require.Equal(t, "192.0.2.1:5000", accepted.RemoteAddr().String())
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(accepted, buf)
+	require.NoError(t, err)
+	require.Equal(t, "Hello", string(buf))
+
+	// Health checks keep the address of the balancer.
+	conn = send(string(proxyV2Header(nil, true)))
+	defer conn.Close()
+	accepted, err = l.Accept()
+	require.NoError(t, err)
+	defer accepted.Close()
+	require.Equal(t, conn.LocalAddr().String(), accepted.RemoteAddr().String())
+
+	require.NoError(t, l.Close())
+	_, err = l.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestProxyProtocolListenerUntrusted(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, balancers, _ := net.ParseCIDR("10.0.0.0/8")
+	l := NewProxyProtocolListener(inner, ProxyProtocolOptions{Trusted: []*net.IPNet{balancers}})
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	header := "PROXY TCP4 192.0.2.1 192.0.2.100 5000 443\r\n"
+	conn.Write([]byte(header))
+
+	// Other clients can't pick their address.
+	accepted, err := l.Accept()
+	require.NoError(t, err)
+	defer accepted.Close()
+	require.Equal(t, conn.LocalAddr().String(), accepted.RemoteAddr().String())
+	buf := make([]byte, len(header))
+	_, err = io.ReadFull(accepted, buf)
+	require.NoError(t, err)
+	require.Equal(t, header, string(buf))
+}
+
+func TestProxyProtocolPacketConn(t *testing.T) {
+	inner, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	pc := NewProxyProtocolPacketConn(inner, ProxyProtocolOptions{Trusted: []*net.IPNet{loopback}})
+	defer pc.Close()
+	balancer, err := net.Dial("udp", pc.LocalAddr().String())
+	require.NoError(t, err)
+	defer balancer.Close()
+
+	client := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}
+	_, err = balancer.Write(append(proxyV2Header(client, false), "Hello"...))
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+	n, addr, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "Hello", string(buf[:n]))
+	require.Equal(t, client.String(), addr.String())
+
+	// Replies to the client go through its balancer.
+	_, err = pc.WriteTo([]byte("World"), addr)
+	require.NoError(t, err)
+	balancer.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = balancer.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "World", string(buf[:n]))
+
+	// Packets without a header come from the balancer, and bad headers are
+	// dropped.
+	bad := proxyV2Header(client, false)
+	bad[12] = 0x2f
+	balancer.Write(append(bad, "Dropped"...))
+	balancer.Write([]byte("Direct"))
+	n, addr, err = pc.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "Direct", string(buf[:n]))
+	require.Equal(t, balancer.LocalAddr().String(), addr.String())
+}
@@ -0,0 +1,160 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	logging "github.com/op/go-logging"
+)
+
+var logger = logging.MustGetLogger("transport")
+
+// Restart delays of a plugin that exits. The delay doubles after each quick
+// exit, and resets once the plugin stays up for maxRestartDelay.
+var (
+	minRestartDelay = time.Second
+	maxRestartDelay = time.Minute
+)
+
+// stopTimeout is how long a plugin has to exit after SIGTERM before it's killed.
+const stopTimeout = 5 * time.Second
+
+// Plugin is a SIP003 plugin subprocess. The plugin listens on the remote
+// address and forwards to the Shadowsocks server on the local address. It's
+// restarted whenever it exits, until Stop is called.
+type Plugin struct {
+	path string
+	env  []string
+
+	mu      sync.Mutex // Protects .cmd and .stopped
+	cmd     *exec.Cmd
+	stopped bool
+	// stop is closed by Stop, and done once the plugin is no longer running.
+	stop chan struct{}
+	done chan struct{}
+}
+
+var errPluginStopped = errors.New("plugin stopped")
+
+// StartPlugin starts the plugin executable `path` with the SIP003 options
+// `opts`. `remote` is the public address and `local` the address of the
+// Shadowsocks server.
+func StartPlugin(path, opts string, remote, local *net.TCPAddr) (*Plugin, error) {
+	remoteHost := "0.0.0.0"
+	if remote.IP != nil {
+		remoteHost = remote.IP.String()
+	}
+	p := &Plugin{
+		path: path,
+		env: append(os.Environ(),
+			"SS_REMOTE_HOST="+remoteHost,
+			"SS_REMOTE_PORT="+strconv.Itoa(remote.Port),
+			"SS_LOCAL_HOST="+local.IP.String(),
+			"SS_LOCAL_PORT="+strconv.Itoa(local.Port),
+			"SS_PLUGIN_OPTIONS="+opts,
+		),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	cmd, err := p.start()
+	if err != nil {
+		return nil, err
+	}
+	go p.supervise(cmd)
+	return p, nil
+}
+
+// start runs the plugin, unless it has been stopped.
+func (p *Plugin) start() (*exec.Cmd, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return nil, errPluginStopped
+	}
+	cmd := exec.Command(p.path)
+	cmd.Env = p.env
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p.cmd = cmd
+	return cmd, nil
+}
+
+// supervise waits for the plugin to exit and restarts it.
+func (p *Plugin) supervise(cmd *exec.Cmd) {
+	defer close(p.done)
+	delay := minRestartDelay
+	for {
+		started := time.Now()
+		err := cmd.Wait()
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+		if time.Since(started) >= maxRestartDelay {
+			delay = minRestartDelay
+		}
+		logger.Errorf("Plugin %v exited (%v), restarting in %v", p.path, err, delay)
+		for {
+			select {
+			case <-time.After(delay):
+			case <-p.stop:
+				return
+			}
+			if delay *= 2; delay > maxRestartDelay {
+				delay = maxRestartDelay
+			}
+			if cmd, err = p.start(); err == nil {
+				break
+			} else if err == errPluginStopped {
+				return
+			}
+			logger.Errorf("Failed to restart plugin %v: %v", p.path, err)
+		}
+	}
+}
+
+// Stop terminates the plugin and waits for it to exit.
+func (p *Plugin) Stop() error {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return errors.New("plugin already stopped")
+	}
+	p.stopped = true
+	process := p.cmd.Process
+	p.mu.Unlock()
+	close(p.stop)
+
+	process.Signal(syscall.SIGTERM)
+	select {
+	case <-p.done:
+	case <-time.After(stopTimeout):
+		process.Kill()
+		<-p.done
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestMain makes the test binary act as a SIP003 plugin that forwards
+// connections as they are, if it's run by a Plugin.
+func TestMain(m *testing.M) {
+	if os.Getenv("SS_PLUGIN_OPTIONS") == "test-plugin" {
+		runTestPlugin()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func runTestPlugin() {
+	remote := net.JoinHostPort(os.Getenv("SS_REMOTE_HOST"), os.Getenv("SS_REMOTE_PORT"))
+	local := net.JoinHostPort(os.Getenv("SS_LOCAL_HOST"), os.Getenv("SS_LOCAL_PORT"))
+	listener, err := net.Listen("tcp", remote)
+	if err != nil {
+		os.Exit(1)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			os.Exit(1)
+		}
+		go func() {
+			defer conn.Close()
+			target, err := net.Dial("tcp", local)
+			if err != nil {
+				return
+			}
+			defer target.Close()
+			go io.Copy(target, conn)
+			io.Copy(conn, target)
+		}()
+	}
+}
+
+func freeTCPAddr(t *testing.T) *net.TCPAddr {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr)
+}
+
+// dialEcho retries until a connection through the plugin gets an echo.
+func dialEcho(t *testing.T, addr *net.TCPAddr) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.DialTCP("tcp", nil, addr)
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(time.Second))
+			conn.Write([]byte("Hello"))
+			reply := make([]byte, 5)
+			_, err = io.ReadFull(conn, reply)
+			conn.Close()
+			if err == nil {
+				require.Equal(t, "Hello", string(reply))
+				return
+			}
+		}
+		require.True(t, time.Now().Before(deadline), "plugin not forwarding: %v", err)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	defer func(d time.Duration) { minRestartDelay = d }(minRestartDelay)
+	minRestartDelay = 10 * time.Millisecond
+
+	local, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer local.Close()
+	go func() {
+		for {
+			conn, err := local.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	remote := freeTCPAddr(t)
+	p, err := StartPlugin(os.Args[0], "test-plugin", remote, local.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	dialEcho(t, remote)
+
+	// A plugin that crashes is restarted.
+	p.mu.Lock()
+	first := p.cmd.Process
+	p.mu.Unlock()
+	require.NoError(t, first.Kill())
+	require.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.cmd.Process != first
+	}, 5*time.Second, 10*time.Millisecond)
+	dialEcho(t, remote)
+
+	require.NoError(t, p.Stop())
+	_, err = net.DialTCP("tcp", nil, remote)
+	require.Error(t, err)
+	require.Error(t, p.Stop())
+}
+
+func TestStartPluginMissing(t *testing.T) {
+	_, err := StartPlugin("/nonexistent/plugin", "", freeTCPAddr(t), freeTCPAddr(t))
+	require.Error(t, err)
+}
@@ -0,0 +1,236 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	onet "myoss/net"
+)
+
+// TLSOptions configures a TLS listener.
+type TLSOptions struct {
+	// Certs has the certificates. Clients whose SNI has no certificate
+	// aren't Shadowsocks clients.
+	Certs *CertStore
+	// ALPN lists the application protocols offered, if any.
+	ALPN []string
+	// Decoy is the host:port of a web server that serves the clients that
+	// aren't ours, so probes see a real site: clients with an unknown or no
+	// SNI, clients that don't speak TLS, and clients whose handshake fails
+	// before the server answers, such as with no version or cipher suite in
+	// common. Empty closes them.
+	Decoy string
+	// HandshakeTimeout bounds the time to receive the ClientHello and
+	// complete the handshake.
+	HandshakeTimeout time.Duration
+}
+
+// tlsListener terminates TLS for the connections of another listener, and
+// passes the rest to the decoy.
+type tlsListener struct {
+	inner  net.Listener
+	opts   TLSOptions
+	config *tls.Config
+	conns  chan onet.DuplexConn
+	// closed is closed by Close.
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewTLSListener returns a listener that accepts the connections of
+// `inner`, and completes the TLS handshake of the Shadowsocks clients among
+// them. Its connections are onet.DuplexConns.
+func NewTLSListener(inner net.Listener, opts TLSOptions) net.Listener {
+	if opts.HandshakeTimeout <= 0 {
+		opts.HandshakeTimeout = 10 * time.Second
+	}
+	l := &tlsListener{
+		inner: inner,
+		opts:  opts,
+		config: &tls.Config{
+			GetCertificate: opts.Certs.GetCertificate,
+			NextProtos:     opts.ALPN,
+			MinVersion:     tls.VersionTLS12,
+		},
+		conns:  make(chan onet.DuplexConn),
+		closed: make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *tlsListener) acceptLoop() {
+	for {
+		conn, err := l.inner.Accept()
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				l.Close()
+				return
+			}
+			logger.Errorf("Accept failed: %v", err)
+			continue
+		}
+		clientConn, ok := conn.(onet.DuplexConn)
+		if !ok {
+			conn.Close()
+			continue
+		}
+		go l.handshake(clientConn)
+	}
+}
+
+// handshake reads the ClientHello, and either completes the handshake or
+// hands the connection to the decoy.
+func (l *tlsListener) handshake(conn onet.DuplexConn) {
+	conn.SetDeadline(time.Now().Add(l.opts.HandshakeTimeout))
+	hello, serverName := readClientHello(conn)
+	replayed := onet.WrapConn(conn, io.MultiReader(bytes.NewReader(hello), conn), conn)
+	if serverName == "" || l.opts.Certs.lookup(serverName) == nil {
+		logger.Debugf("TLS client %v asked for %q, sending it to the decoy", conn.RemoteAddr(), serverName)
+		l.serveDecoy(replayed)
+		return
+	}
+	// What the handshake reads after the first record is recorded, and its
+	// first alert held back, so that a client that fails on its ClientHello
+	// alone can still be sent to the decoy with all it sent.
+	var read bytes.Buffer
+	writer := &earlyAlertWriter{Writer: conn}
+	tlsConn := tls.Server(onet.WrapConn(conn, io.MultiReader(bytes.NewReader(hello), io.TeeReader(conn, &read)), writer), l.config)
+	if err := tlsConn.Handshake(); err != nil {
+		if writer.held {
+			logger.Debugf("TLS handshake with %v failed before the server answered, sending it to the decoy: %v", conn.RemoteAddr(), err)
+			l.serveDecoy(onet.WrapConn(conn, io.MultiReader(bytes.NewReader(hello), &read, conn), conn))
+			return
+		}
+		logger.Debugf("TLS handshake with %v failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	select {
+	case l.conns <- &tlsDuplexConn{Conn: tlsConn, raw: conn}:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+// earlyAlertWriter drops an alert record that is the first thing written,
+// which is how the server fails a handshake on the ClientHello, and records
+// that it did.
+type earlyAlertWriter struct {
+	io.Writer
+	wrote bool
+	held  bool
+}
+
+func (w *earlyAlertWriter) Write(p []byte) (int, error) {
+	if !w.wrote && len(p) > 0 && p[0] == recordAlert {
+		w.held = true
+		return len(p), nil
+	}
+	w.wrote = true
+	return w.Writer.Write(p)
+}
+
+// readClientHello reads the first record, which should hold a ClientHello,
+// and returns the bytes read and the SNI. The server name is empty if the
+// client didn't send a ClientHello.
+func readClientHello(conn io.Reader) ([]byte, string) {
+	var header [tlsRecordHeaderSize]byte
+	n, err := io.ReadFull(conn, header[:])
+	if err != nil || header[0] != recordHandshake || header[1] != 3 {
+		return header[:n], ""
+	}
+	record := make([]byte, tlsRecordHeaderSize+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header[:])
+	n, err = io.ReadFull(conn, record[tlsRecordHeaderSize:])
+	record = record[:tlsRecordHeaderSize+n]
+	if err != nil {
+		return record, ""
+	}
+	hello, err := parseClientHello(record[tlsRecordHeaderSize:])
+	if err != nil {
+		return record, ""
+	}
+	return record, hello.serverName
+}
+
+// serveDecoy relays `conn` to the decoy, which sees what the client sent.
+func (l *tlsListener) serveDecoy(conn onet.DuplexConn) {
+	defer conn.Close()
+	if l.opts.Decoy == "" {
+		return
+	}
+	decoy, err := net.DialTimeout("tcp", l.opts.Decoy, l.opts.HandshakeTimeout)
+	if err != nil {
+		logger.Warningf("Failed to connect to the decoy: %v", err)
+		return
+	}
+	defer decoy.Close()
+	conn.SetDeadline(time.Time{})
+	onet.Relay(conn, decoy.(*net.TCPConn))
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *tlsListener) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.inner.Close()
+	})
+	return err
+}
+
+func (l *tlsListener) Addr() net.Addr {
+	return l.inner.Addr()
+}
+
+// tlsDuplexConn is a TLS connection that can be half-closed.
+type tlsDuplexConn struct {
+	*tls.Conn
+	raw onet.DuplexConn
+}
+
+func (c *tlsDuplexConn) CloseRead() error {
+	return c.raw.CloseRead()
+}
+
+func (c *tlsDuplexConn) CloseWrite() error {
+	if err := c.Conn.CloseWrite(); err != nil {
+		return err
+	}
+	return c.raw.CloseWrite()
+}
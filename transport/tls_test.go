@@ -0,0 +1,190 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	onet "myoss/net"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCert writes a self-signed certificate for `names` to
+// <dir>/<base>.crt and <dir>/<base>.key, and returns it.
+func writeTestCert(t *testing.T, dir, base string, names ...string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, base+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, base+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestCertStore(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir, "a", "a.example.com")
+	writeTestCert(t, dir, "b", "*.b.example.com")
+	store, err := NewCertStore("", "", dir)
+	require.NoError(t, err)
+	require.NotNil(t, store.lookup("a.example.com"))
+	require.NotNil(t, store.lookup("A.Example.com."))
+	require.NotNil(t, store.lookup("x.b.example.com"))
+	require.Nil(t, store.lookup("b.example.com"))
+	require.Nil(t, store.lookup("x.y.b.example.com"))
+	require.Nil(t, store.lookup(""))
+
+	reloaded, err := store.Reload()
+	require.NoError(t, err)
+	require.False(t, reloaded)
+
+	// Replacing a certificate reloads it.
+	writeTestCert(t, dir, "a", "c.example.com")
+	reloaded, err = store.Reload()
+	require.NoError(t, err)
+	require.True(t, reloaded)
+	require.Nil(t, store.lookup("a.example.com"))
+	require.NotNil(t, store.lookup("c.example.com"))
+
+	// A bad certificate is reported once, and the old ones stay.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.key"), []byte("bad"), 0600))
+	_, err = store.Reload()
+	require.Error(t, err)
+	reloaded, err = store.Reload()
+	require.NoError(t, err)
+	require.False(t, reloaded)
+	require.NotNil(t, store.lookup("x.b.example.com"))
+
+	_, err = NewCertStore(filepath.Join(dir, "b.crt"), filepath.Join(dir, "b.key"), "")
+	require.Error(t, err)
+	_, err = NewCertStore("", "", t.TempDir())
+	require.Error(t, err)
+}
+
+// startDecoy starts a server that replies "decoy" to anything, and sends
+// what it received within 100ms on the channel.
+func startDecoy(t *testing.T) (string, chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan []byte, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				data, _ := io.ReadAll(conn)
+				received <- data
+				conn.Write([]byte("decoy"))
+			}()
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestTLSListener(t *testing.T) {
+	dir := t.TempDir()
+	cert := writeTestCert(t, dir, "a", "a.example.com")
+	store, err := NewCertStore(filepath.Join(dir, "a.crt"), filepath.Join(dir, "a.key"), "")
+	require.NoError(t, err)
+	decoy, received := startDecoy(t)
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := NewTLSListener(inner, TLSOptions{Certs: store, ALPN: []string{"h2"}, Decoy: decoy})
+	defer l.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	// A client with a known SNI is accepted.
+	client, err := tls.Dial("tcp", inner.Addr().String(), &tls.Config{ServerName: "a.example.com", RootCAs: roots, NextProtos: []string{"h2"}})
+	require.NoError(t, err)
+	defer client.Close()
+	require.Equal(t, "h2", client.ConnectionState().NegotiatedProtocol)
+	_, err = client.Write([]byte("Hello"))
+	require.NoError(t, err)
+	require.NoError(t, client.CloseWrite())
+	accepted, err := l.Accept()
+	require.NoError(t, err)
+	server := accepted.(onet.DuplexConn)
+	request, err := io.ReadAll(server)
+	require.NoError(t, err)
+	require.Equal(t, "Hello", string(request))
+	_, err = server.Write([]byte("Reply"))
+	require.NoError(t, err)
+	require.NoError(t, server.CloseWrite())
+	reply, err := io.ReadAll(client)
+	require.NoError(t, err)
+	require.Equal(t, "Reply", string(reply))
+	server.Close()
+
+	// Other SNIs go to the decoy with their ClientHello.
+	_, err = tls.Dial("tcp", inner.Addr().String(), &tls.Config{ServerName: "other.example.com", RootCAs: roots})
+	require.Error(t, err)
+	hello := <-received
+	require.Equal(t, []byte{recordHandshake, 3}, hello[:2])
+
+	// And clients whose handshake fails on their ClientHello, like those
+	// without a version in common.
+	_, err = tls.Dial("tcp", inner.Addr().String(), &tls.Config{ServerName: "a.example.com", RootCAs: roots, MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11})
+	require.Error(t, err)
+	hello = <-received
+	require.Equal(t, []byte{recordHandshake, 3}, hello[:2])
+
+	// So do clients that don't speak TLS.
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+	reply, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "decoy", string(reply))
+	require.Equal(t, "GET / HTTP/1.1\r\n\r\n", string(<-received))
+
+	require.NoError(t, l.Close())
+	_, err = l.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+}
@@ -0,0 +1,482 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	onet "myoss/net"
+
+	"github.com/gorilla/websocket"
+)
+
+// closeTimeout bounds the time to send a WebSocket close message.
+const closeTimeout = 5 * time.Second
+
+// WebSocketOptions configures a WebSocketServer.
+type WebSocketOptions struct {
+	// StreamPath is the URL path of Shadowsocks streams.
+	StreamPath string
+	// PacketPath is the URL path of Shadowsocks packets, one per message.
+	// Empty disables packets.
+	PacketPath string
+	// RealIPHeader is the header, such as X-Forwarded-For, where a trusted
+	// reverse proxy or CDN puts the client IP. The last address in it is
+	// used. Empty means clients connect directly.
+	RealIPHeader string
+}
+
+// WebSocketServer accepts Shadowsocks streams and packets carried over
+// WebSocket. The streams are accepted from StreamListener, and the packets
+// read from PacketConn, so the usual services can serve them.
+type WebSocketServer struct {
+	opts     WebSocketOptions
+	listener net.Listener
+	server   *http.Server
+	upgrader websocket.Upgrader
+	streams  chan onet.DuplexConn
+	packets  *wsPacketConn
+	// closed is closed when the server stops accepting streams.
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewWebSocketServer makes a server that accepts HTTP connections from
+// `listener` once Serve is called.
+func NewWebSocketServer(listener net.Listener, opts WebSocketOptions) *WebSocketServer {
+	s := &WebSocketServer{
+		opts:     opts,
+		listener: listener,
+		upgrader: websocket.Upgrader{
+			// Browsers don't connect, so there's no origin to check.
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		streams: make(chan onet.DuplexConn),
+		packets: newWSPacketConn(listener.Addr()),
+		closed:  make(chan struct{}),
+	}
+	s.server = &http.Server{Handler: s, ReadHeaderTimeout: 30 * time.Second}
+	return s
+}
+
+// Serve serves HTTP until Close is called.
+func (s *WebSocketServer) Serve() error {
+	err := s.server.Serve(s.listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Close stops accepting connections. Established streams and packet
+// sessions are left alone, like those of a closed TCP listener.
+func (s *WebSocketServer) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return s.server.Close()
+}
+
+// StreamListener returns the listener of WebSocket streams. Closing it
+// closes the server.
+func (s *WebSocketServer) StreamListener() net.Listener {
+	return wsStreamListener{s}
+}
+
+// PacketConn returns the connection that reads and writes the packets of
+// all WebSocket packet sessions.
+func (s *WebSocketServer) PacketConn() net.PacketConn {
+	return s.packets
+}
+
+func (s *WebSocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == s.opts.StreamPath:
+		s.serveStream(w, r)
+	case s.opts.PacketPath != "" && r.URL.Path == s.opts.PacketPath:
+		s.servePackets(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// clientAddr is the address of the client of `r`, according to the real IP
+// header if there is one.
+func (s *WebSocketServer) clientAddr(r *http.Request) *net.TCPAddr {
+	addr, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if addr == nil {
+		addr = &net.TCPAddr{}
+	}
+	if s.opts.RealIPHeader == "" {
+		return addr
+	}
+	values := r.Header.Values(s.opts.RealIPHeader)
+	if len(values) == 0 {
+		return addr
+	}
+	hops := strings.Split(values[len(values)-1], ",")
+	if ip := net.ParseIP(strings.TrimSpace(hops[len(hops)-1])); ip != nil {
+		return &net.TCPAddr{IP: ip, Port: addr.Port}
+	}
+	return addr
+}
+
+func (s *WebSocketServer) serveStream(w http.ResponseWriter, r *http.Request) {
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has replied with an error.
+		return
+	}
+	conn := NewWebSocketStreamConn(ws, s.clientAddr(r))
+	select {
+	case s.streams <- conn:
+	case <-s.closed:
+		ws.Close()
+	}
+}
+
+func (s *WebSocketServer) servePackets(w http.ResponseWriter, r *http.Request) {
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	s.packets.serve(ws, s.clientAddr(r).IP)
+}
+
+type wsStreamListener struct {
+	s *WebSocketServer
+}
+
+func (l wsStreamListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.s.streams:
+		return conn, nil
+	case <-l.s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l wsStreamListener) Close() error {
+	return l.s.Close()
+}
+
+func (l wsStreamListener) Addr() net.Addr {
+	return l.s.listener.Addr()
+}
+
+// wsStreamConn carries a stream in binary WebSocket messages. A close
+// message ends each direction, like a FIN.
+type wsStreamConn struct {
+	ws     *websocket.Conn
+	remote net.Addr
+	// r is the message being read.
+	r       io.Reader
+	writeMu sync.Mutex
+}
+
+// NewWebSocketStreamConn makes a stream out of the binary messages of `ws`.
+// `remote` is the address of the peer, or nil for the WebSocket's.
+func NewWebSocketStreamConn(ws *websocket.Conn, remote net.Addr) onet.DuplexConn {
+	if remote == nil {
+		remote = ws.RemoteAddr()
+	}
+	// The default handler echoes the close message right away, which would
+	// end the stream in the other direction too.
+	ws.SetCloseHandler(func(code int, text string) error { return nil })
+	return &wsStreamConn{ws: ws, remote: remote}
+}
+
+func (c *wsStreamConn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			_, r, err := c.ws.NextReader()
+			if err != nil {
+				if _, ok := err.(*websocket.CloseError); ok {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsStreamConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsStreamConn) CloseRead() error {
+	return nil
+}
+
+func (c *wsStreamConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	err := c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(closeTimeout))
+	if err == websocket.ErrCloseSent {
+		return nil
+	}
+	return err
+}
+
+func (c *wsStreamConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *wsStreamConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *wsStreamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *wsStreamConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsStreamConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *wsStreamConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
+
+// wsPacketAddr is the address of a WebSocket packet session. Its port is
+// the session number, since many sessions may come through the same proxy
+// connection.
+type wsPacketAddr struct {
+	ip      net.IP
+	session uint64
+}
+
+func (a *wsPacketAddr) Network() string {
+	return "websocket"
+}
+
+func (a *wsPacketAddr) String() string {
+	return net.JoinHostPort(a.ip.String(), "ws"+strconv.FormatUint(a.session, 10))
+}
+
+type wsPacket struct {
+	data []byte
+	addr *wsPacketAddr
+}
+
+// wsPacketConn is a PacketConn for all the packet sessions of a server.
+// Each binary message of a session is a packet.
+type wsPacketConn struct {
+	local       net.Addr
+	packets     chan wsPacket
+	lastSession uint64
+	mu          sync.Mutex // Protects .sessions and .closed
+	sessions    map[string]*wsPacketSession
+	closed      bool
+	done        chan struct{}
+	deadline    atomic.Value // time.Time
+}
+
+type wsPacketSession struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+}
+
+var errPacketSessionClosed = errors.New("WebSocket packet session is closed")
+
+func newWSPacketConn(local net.Addr) *wsPacketConn {
+	c := &wsPacketConn{
+		local:    local,
+		packets:  make(chan wsPacket),
+		sessions: make(map[string]*wsPacketSession),
+		done:     make(chan struct{}),
+	}
+	c.deadline.Store(time.Time{})
+	return c
+}
+
+// serve reads the packets of a session until it ends.
+func (c *wsPacketConn) serve(ws *websocket.Conn, ip net.IP) {
+	addr := &wsPacketAddr{ip: ip, session: atomic.AddUint64(&c.lastSession, 1)}
+	key := addr.String()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		ws.Close()
+		return
+	}
+	c.sessions[key] = &wsPacketSession{ws: ws}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.sessions, key)
+		c.mu.Unlock()
+		ws.Close()
+	}()
+	for {
+		messageType, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		select {
+		case c.packets <- wsPacket{data, addr}:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *wsPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	var timeout <-chan time.Time
+	if deadline := c.deadline.Load().(time.Time); !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p := <-c.packets:
+		return copy(b, p.data), p.addr, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, errTimeout{}
+	}
+}
+
+func (c *wsPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	session := c.sessions[addr.String()]
+	c.mu.Unlock()
+	if session == nil {
+		return 0, errPacketSessionClosed
+	}
+	session.writeMu.Lock()
+	defer session.writeMu.Unlock()
+	if err := session.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close ends all the packet sessions.
+func (c *wsPacketConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	close(c.done)
+	for _, session := range c.sessions {
+		session.ws.Close()
+	}
+	return nil
+}
+
+func (c *wsPacketConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *wsPacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *wsPacketConn) SetReadDeadline(t time.Time) error {
+	c.deadline.Store(t)
+	return nil
+}
+
+// Writes go to sessions that are written with no deadline.
+func (c *wsPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// errTimeout is the net.Error of a read past the deadline.
+type errTimeout struct{}
+
+func (errTimeout) Error() string   { return "i/o timeout" }
+func (errTimeout) Timeout() bool   { return true }
+func (errTimeout) Temporary() bool { return true }
+
+// wsPacketClientConn is the client side of a packet session.
+type wsPacketClientConn struct {
+	*websocket.Conn
+	writeMu sync.Mutex
+}
+
+// NewWebSocketPacketConn makes a packet connection out of `ws`, which sends
+// and receives each packet in a binary message.
+func NewWebSocketPacketConn(ws *websocket.Conn) net.Conn {
+	return &wsPacketClientConn{Conn: ws}
+}
+
+func (c *wsPacketClientConn) Read(b []byte) (int, error) {
+	for {
+		messageType, r, err := c.NextReader()
+		if err != nil {
+			return 0, err
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		n, err := io.ReadFull(r, b)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsPacketClientConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsPacketClientConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
@@ -0,0 +1,138 @@
+// Copyright 2018 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transport
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	onet "myoss/net"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func startWebSocketServer(t *testing.T, opts WebSocketOptions) (*WebSocketServer, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := NewWebSocketServer(listener, opts)
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+	return s, "ws://" + listener.Addr().String()
+}
+
+func acceptStream(t *testing.T, l net.Listener) onet.DuplexConn {
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	return conn.(onet.DuplexConn)
+}
+
+func TestWebSocketStream(t *testing.T) {
+	s, url := startWebSocketServer(t, WebSocketOptions{StreamPath: "/tcp", RealIPHeader: "X-Forwarded-For"})
+	header := http.Header{"X-Forwarded-For": {"192.0.2.9, 198.51.100.7"}}
+	ws, _, err := websocket.DefaultDialer.Dial(url+"/tcp", header)
+	require.NoError(t, err)
+	client := NewWebSocketStreamConn(ws, nil)
+	defer client.Close()
+	server := acceptStream(t, s.StreamListener())
+	defer server.Close()
+	require.Equal(t, "198.51.100.7", server.RemoteAddr().(*net.TCPAddr).IP.String())
+
+	_, err = client.Write([]byte("Hello"))
+	require.NoError(t, err)
+	_, err = client.Write([]byte(" world"))
+	require.NoError(t, err)
+	require.NoError(t, client.CloseWrite())
+	request, err := io.ReadAll(server)
+	require.NoError(t, err)
+	require.Equal(t, "Hello world", string(request))
+
+	// The server can still reply after the client is done writing.
+	_, err = server.Write([]byte("Reply"))
+	require.NoError(t, err)
+	require.NoError(t, server.CloseWrite())
+	reply, err := io.ReadAll(client)
+	require.NoError(t, err)
+	require.Equal(t, "Reply", string(reply))
+}
+
+func TestWebSocketNotFound(t *testing.T) {
+	_, url := startWebSocketServer(t, WebSocketOptions{StreamPath: "/tcp"})
+	_, resp, err := websocket.DefaultDialer.Dial(url+"/udp", nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestWebSocketStreamListenerClose(t *testing.T) {
+	s, _ := startWebSocketServer(t, WebSocketOptions{StreamPath: "/tcp"})
+	l := s.StreamListener()
+	done := make(chan error)
+	go func() {
+		_, err := l.Accept()
+		done <- err
+	}()
+	require.NoError(t, l.Close())
+	require.ErrorIs(t, <-done, net.ErrClosed)
+}
+
+func TestWebSocketPackets(t *testing.T) {
+	s, url := startWebSocketServer(t, WebSocketOptions{StreamPath: "/tcp", PacketPath: "/udp"})
+	pc := s.PacketConn()
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		ws, _, err := websocket.DefaultDialer.Dial(url+"/udp", nil)
+		require.NoError(t, err)
+		client := NewWebSocketPacketConn(ws)
+		defer client.Close()
+		clients = append(clients, client)
+	}
+
+	// Each session has its own address, and replies go to the right one.
+	addrs := make(map[string]net.Addr)
+	for i, client := range clients {
+		payload := []byte{byte(i)}
+		_, err := client.Write(payload)
+		require.NoError(t, err)
+		buf := make([]byte, 10)
+		n, addr, err := pc.ReadFrom(buf)
+		require.NoError(t, err)
+		require.Equal(t, payload, buf[:n])
+		addrs[string(payload)] = addr
+	}
+	require.Len(t, addrs, 2)
+	for i, client := range clients {
+		_, err := pc.WriteTo([]byte{byte(i) + 10}, addrs[string([]byte{byte(i)})])
+		require.NoError(t, err)
+		buf := make([]byte, 10)
+		n, err := client.Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(i) + 10}, buf[:n])
+	}
+
+	pc.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err := pc.ReadFrom(make([]byte, 10))
+	require.True(t, err.(net.Error).Timeout())
+	pc.SetReadDeadline(time.Time{})
+
+	require.NoError(t, pc.Close())
+	_, _, err = pc.ReadFrom(make([]byte, 10))
+	require.ErrorIs(t, err, net.ErrClosed)
+	// Closing ends the sessions.
+	_, err = clients[0].Read(make([]byte, 10))
+	require.Error(t, err)
+}